@@ -1,2 +1,3 @@
 #!/bin/bash
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -v -i -o kube-chaos  kube-chaos.go
\ No newline at end of file
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -v -i -o kube-chaos .
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -v -i -o chaosctl ./cmd/chaosctl
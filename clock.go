@@ -0,0 +1,225 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/clock"
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The offset of a skewed pod and its processes patched with it
+type skewedClock struct {
+	seconds int64
+	pids    map[int]bool
+}
+
+// Pods whose clocks the daemon skews, kept across rounds so processes started since are skewed
+// too, and the clocks are restored when their pod leaves the node's selection, chaos is aborted
+// or the daemon stops. The patched processes stay skewed if the daemon dies, the pods' status
+// tells to restore them
+type skewedPods struct {
+	skewer    *clock.Skewer
+	processes *container.Processes
+	procRoot  string
+	mu        sync.Mutex
+	pods      map[types.UID]*skewedClock
+	// No pod is skewed once the daemon stops
+	stopped bool
+}
+
+func newSkewedPods(procRoot string) *skewedPods {
+	return &skewedPods{
+		skewer:    clock.NewSkewer(procRoot),
+		processes: container.NewProcesses(procRoot),
+		procRoot:  procRoot,
+		pods:      map[types.UID]*skewedClock{},
+	}
+}
+
+func (s *skewedPods) kind() *flow.PodFault {
+	return flow.ClockFault
+}
+
+// The processes are found again each round, there is no target to keep
+func (s *skewedPods) prepare(pod *v1.Pod, spec string) (string, time.Duration, error) {
+	settings, err := flow.ParsePodClock(spec)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := clockTarget(pod, settings); err != nil {
+		return "", 0, err
+	}
+	return "", settings.Duration, nil
+}
+
+// Skew the clocks of the pod's processes, or the named container's. Processes started since
+// they were last skewed are skewed too, those already skewed by the offset are skipped. The
+// pod stays skewed if some processes failed
+func (s *skewedPods) start(pod *v1.Pod, spec, target string) error {
+	settings, err := flow.ParsePodClock(spec)
+	if err != nil {
+		return err
+	}
+	id, err := clockTarget(pod, settings)
+	if err != nil {
+		return err
+	}
+	seconds, _ := clock.Seconds(settings.Offset)
+	return s.skew(pod.UID, id, seconds)
+}
+
+// Skew the clocks of the processes in the cgroup of id, the pod's UID or one of its container
+// ids, those already skewed by the seconds are skipped
+func (s *skewedPods) skew(uid types.UID, id string, seconds int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	pids, err := s.processes.InCgroup(id)
+	if err != nil {
+		return err
+	}
+	if len(pids) == 0 {
+		return fmt.Errorf("no process of %s found", id)
+	}
+	skewed, found := s.pods[uid]
+	if !found || skewed.seconds != seconds {
+		skewed = &skewedClock{seconds: seconds, pids: map[int]bool{}}
+	}
+	current := map[int]bool{}
+	var failed error
+	for _, pid := range pids {
+		current[pid] = true
+		if skewed.pids[pid] {
+			continue
+		}
+		if err := s.skewer.Skew(pid, seconds); err != nil {
+			if s.exited(pid) {
+				continue
+			}
+			failed = fmt.Errorf("failed to skew process %d: %v", pid, err)
+			continue
+		}
+		skewed.pids[pid] = true
+	}
+	// Pids of processes gone may be reused by others
+	for pid := range skewed.pids {
+		if !current[pid] {
+			delete(skewed.pids, pid)
+		}
+	}
+	if len(skewed.pids) > 0 {
+		s.pods[uid] = skewed
+	}
+	return failed
+}
+
+func (s *skewedPods) active(uid types.UID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.pods[uid]
+	return found
+}
+
+// Restore the clocks of all the pod's processes, also when it was skewed before the daemon started
+func (s *skewedPods) stop(pod *v1.Pod, target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.restorePod(pod.UID); err != nil {
+		return err
+	}
+	delete(s.pods, pod.UID)
+	return nil
+}
+
+func (s *skewedPods) stopExcept(keep map[types.UID]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for uid := range s.pods {
+		if keep[uid] {
+			continue
+		}
+		if err := s.restorePod(uid); err != nil {
+			glog.Warningf("Failed to restore the clock of pod %s: %v", uid, err)
+		}
+		glog.Infof("Restored the clock of pod %s no longer selected", uid)
+		delete(s.pods, uid)
+	}
+}
+
+func (s *skewedPods) stopAll(stop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = s.stopped || stop
+	for uid := range s.pods {
+		if err := s.restorePod(uid); err != nil {
+			glog.Errorf("Failed to restore the clock of pod %s: %v", uid, err)
+			continue
+		}
+		glog.Infof("Restored the clock of pod %s", uid)
+		delete(s.pods, uid)
+	}
+}
+
+// Restore the processes in the pod's cgroup, processes not skewed are left as they are
+func (s *skewedPods) restorePod(uid types.UID) error {
+	pids, err := s.processes.InCgroup(string(uid))
+	if err != nil {
+		return err
+	}
+	var failed error
+	for _, pid := range pids {
+		if err := s.skewer.Restore(pid); err != nil && !s.exited(pid) {
+			failed = fmt.Errorf("failed to restore process %d: %v", pid, err)
+		}
+	}
+	return failed
+}
+
+func (s *skewedPods) exited(pid int) bool {
+	_, err := os.Stat(filepath.Join(s.procRoot, strconv.Itoa(pid)))
+	return os.IsNotExist(err)
+}
+
+// The cgroup id of the processes skewed, the named container's or the pod's UID for all of them
+func clockTarget(pod *v1.Pod, settings *flow.PodClock) (string, error) {
+	if settings.Container == "" {
+		return string(pod.UID), nil
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != settings.Container {
+			continue
+		}
+		if status.State.Running == nil {
+			return "", fmt.Errorf("container %s is not running", settings.Container)
+		}
+		return container.ParseContainerID(status.ContainerID)
+	}
+	return "", fmt.Errorf("container %s not found", settings.Container)
+}
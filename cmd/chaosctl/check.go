@@ -0,0 +1,203 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// chaosctl check [-n namespace | -all-namespaces] [-l selector] [-ingress spec] [-egress spec] [pod...]
+func runCheck(args []string) error {
+	var (
+		cluster    clusterFlags
+		ingress    string
+		egress     string
+		controlMap string
+		profileMap string
+	)
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cluster.register(fs)
+	fs.StringVar(&ingress, "ingress", "", "ingress chaos settings to check instead of the pods' annotations")
+	fs.StringVar(&egress, "egress", "", "egress chaos settings to check instead of the pods' annotations")
+	fs.StringVar(&controlMap, "configmap", flow.DefaultControlConfigMap, "namespace/name of the control ConfigMap holding the guards")
+	fs.StringVar(&profileMap, "profiles", "kube-system/kube-chaos-profiles", "namespace/name of the ConfigMap adding network profiles")
+	fs.Parse(args)
+
+	clientset, err := cluster.clientset()
+	if err != nil {
+		return err
+	}
+	data, err := flow.GetConfigMapData(clientset, controlMap)
+	if err != nil {
+		return err
+	}
+	guards, err := flow.ParseGuards(data)
+	if err != nil {
+		return fmt.Errorf("ConfigMap %s: %v", controlMap, err)
+	}
+	data, err = flow.GetConfigMapData(clientset, profileMap)
+	if err != nil {
+		return err
+	}
+	profiles, err := flow.LoadProfiles(data)
+	if err != nil {
+		return fmt.Errorf("ConfigMap %s: %v", profileMap, err)
+	}
+
+	pods, err := clientset.CoreV1().Pods(cluster.podNamespace()).List(meta_v1.ListOptions{LabelSelector: cluster.labelSelector})
+	if err != nil {
+		return err
+	}
+	names := sets.NewString(fs.Args()...)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tDIRECTION\tCHAOS\tRESULT")
+	rejected := 0
+	// Pods of each namespace, for the owner limits
+	namespacePods := map[string][]v1.Pod{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if names.Len() > 0 && !names.Has(pod.Name) {
+			continue
+		}
+		if _, found := namespacePods[pod.Namespace]; !found {
+			siblings, err := clientset.CoreV1().Pods(pod.Namespace).List(meta_v1.ListOptions{})
+			if err != nil {
+				return err
+			}
+			namespacePods[pod.Namespace] = siblings.Items
+		}
+		if spec, found := pod.Annotations[flow.ChaosScheduleAnnotation]; found {
+			if _, err := flow.GetPodSchedule(pod.Annotations, time.Local); err != nil {
+				fmt.Fprintf(w, "%s\t%s\tschedule\t%s\trejected: %v\n", pod.Namespace, pod.Name, spec, err)
+				rejected++
+			}
+		}
+		if spec, found := pod.Annotations[flow.PodFailureAnnotation]; found {
+			result := "ok"
+			failure, err := flow.ParsePodFailure(spec)
+			if err == nil {
+				err = flow.CheckPodFailure(pod, failure, guards, namespacePods[pod.Namespace])
+			}
+			if err != nil {
+				result = fmt.Sprintf("rejected: %v", err)
+				rejected++
+			}
+			fmt.Fprintf(w, "%s\t%s\tfailure\t%s\t%s\n", pod.Namespace, pod.Name, spec, result)
+		}
+		for _, fault := range flow.PodFaults {
+			spec, found := pod.Annotations[fault.Annotation]
+			if !found {
+				continue
+			}
+			result := "ok"
+			err := fault.Parse(spec)
+			if err == nil {
+				err = fault.Check(pod, guards, namespacePods[pod.Namespace])
+			}
+			if err != nil {
+				result = fmt.Sprintf("rejected: %v", err)
+				rejected++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pod.Namespace, pod.Name, fault.Kind, spec, result)
+		}
+		if spec, found := pod.Annotations[flow.DNSChaosAnnotation]; found {
+			result := "ok"
+			if _, err := flow.CheckPodDNSChaos(pod, spec, guards, namespacePods[pod.Namespace]); err != nil {
+				result = fmt.Sprintf("rejected: %v", err)
+				rejected++
+			}
+			fmt.Fprintf(w, "%s\t%s\tdns\t%s\t%s\n", pod.Namespace, pod.Name, spec, result)
+		}
+		if spec, found := pod.Annotations[flow.HTTPChaosAnnotation]; found {
+			result := "ok"
+			if _, err := flow.CheckPodHTTPChaos(pod, spec, guards, namespacePods[pod.Namespace]); err != nil {
+				result = fmt.Sprintf("rejected: %v", err)
+				rejected++
+			}
+			fmt.Fprintf(w, "%s\t%s\thttp\t%s\t%s\n", pod.Namespace, pod.Name, spec, result)
+		}
+		for _, direction := range []string{"ingress", "egress"} {
+			info := ingress
+			if direction == "egress" {
+				info = egress
+			}
+			if info == "" {
+				info = pod.Annotations[fmt.Sprintf("kubernetes.io/%s-chaos", direction)]
+			}
+			if info == "" {
+				continue
+			}
+			result := "ok"
+			effective, err := flow.CheckPodChaos(pod, info, direction == "ingress", profiles, guards, namespacePods[pod.Namespace])
+			if err != nil {
+				result = fmt.Sprintf("rejected: %v", err)
+				rejected++
+			} else if effective != info {
+				result = fmt.Sprintf("ok (%s)", effective)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pod.Namespace, pod.Name, direction, info, result)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// The nodes' chaos, when no pod is named
+	if names.Len() == 0 {
+		nodes, err := clientset.CoreV1().Nodes().List(meta_v1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		header := false
+		for _, node := range nodes.Items {
+			spec, found := node.Annotations[flow.NodeChaosAnnotation]
+			if !found {
+				continue
+			}
+			if !header {
+				fmt.Fprintln(w, "\nNODE\tCHAOS\tRESULT")
+				header = true
+			}
+			result := "ok"
+			settings, err := flow.ParseNodeChaos(spec)
+			if err == nil {
+				_, _, err = flow.CheckNodeChaos(settings, profiles, guards)
+			}
+			if err != nil {
+				result = fmt.Sprintf("rejected: %v", err)
+				rejected++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", node.Name, spec, result)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d chaos settings rejected", rejected)
+	}
+	return nil
+}
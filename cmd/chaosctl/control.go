@@ -0,0 +1,68 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// chaosctl pause|abort|resume [-configmap namespace/name]
+func runControl(state string) func(args []string) error {
+	return func(args []string) error {
+		var kube kubeFlags
+		var controlMap string
+		fs := flag.NewFlagSet(state, flag.ExitOnError)
+		kube.register(fs)
+		fs.StringVar(&controlMap, "configmap", flow.DefaultControlConfigMap, "namespace/name of the control ConfigMap the daemons poll")
+		fs.Parse(args)
+
+		parts := strings.SplitN(controlMap, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid ConfigMap %q, expected namespace/name", controlMap)
+		}
+		clientset, err := kube.clientset()
+		if err != nil {
+			return err
+		}
+
+		configMaps := clientset.CoreV1().ConfigMaps(parts[0])
+		configMap, err := configMaps.Get(parts[1], meta_v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Namespace: parts[0], Name: parts[1]}}
+			configMap.Data = map[string]string{flow.ControlStateKey: state}
+			_, err = configMaps.Create(configMap)
+		} else if err == nil {
+			if configMap.Data == nil {
+				configMap.Data = map[string]string{}
+			}
+			configMap.Data[flow.ControlStateKey] = state
+			_, err = configMaps.Update(configMap)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("chaos %s, every node follows within its sync duration\n", state)
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// chaosctl inspects the chaos settings kube-chaos applies to pods.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"status", "show the chaos settings and statistics of pods", runStatus},
+	{"check", "check chaos settings of pods against the profiles and guards", runCheck},
+	{"pause", "keep the faults in place but apply no new chaos settings on any node", runControl(flow.ControlPaused)},
+	{"abort", "clear all faults on all nodes until resumed", runControl(flow.ControlAbort)},
+	{"resume", "apply the chaos settings again after a pause or abort", runControl(flow.ControlRunning)},
+	{"scenario", "plan or run a sequence of faults from a YAML file and print its timeline", runScenario},
+	{"report", "list the saved scenario reports or print one as Markdown, JSON or JUnit XML", runReport},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "chaosctl %s: %v\n", c.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: chaosctl <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+}
+
+// Flags of the commands talking to the cluster
+type kubeFlags struct {
+	kubeconfig string
+}
+
+func (k *kubeFlags) register(fs *flag.FlagSet) {
+	kubeconfig := os.Getenv("KUBECONFIG")
+	if kubeconfig == "" {
+		kubeconfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
+	}
+	fs.StringVar(&k.kubeconfig, "kubeconfig", kubeconfig, "absolute path to the kubeconfig file")
+}
+
+func (k *kubeFlags) clientset() (*kubernetes.Clientset, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", k.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Flags of the commands selecting pods
+type clusterFlags struct {
+	kubeFlags
+	namespace     string
+	allNamespaces bool
+	labelSelector string
+}
+
+func (c *clusterFlags) register(fs *flag.FlagSet) {
+	c.kubeFlags.register(fs)
+	fs.StringVar(&c.namespace, "n", "default", "namespace of the pods")
+	fs.BoolVar(&c.allNamespaces, "all-namespaces", false, "list the pods of all namespaces")
+	fs.StringVar(&c.labelSelector, "l", "chaos=on", "select the pods kube-chaos works on")
+}
+
+func (c *clusterFlags) podNamespace() string {
+	if c.allNamespaces {
+		return ""
+	}
+	return c.namespace
+}
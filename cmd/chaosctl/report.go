@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/scenario"
+)
+
+// chaosctl report [-n namespace] [-o markdown|json|junit] [-f file | name]
+func runReport(args []string) error {
+	var (
+		kube      kubeFlags
+		namespace string
+		output    string
+		file      string
+	)
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	kube.register(fs)
+	fs.StringVar(&namespace, "n", "kube-system", "namespace of the saved reports")
+	fs.StringVar(&output, "o", "markdown", "format, markdown, json or junit")
+	fs.StringVar(&file, "f", "", "read the report from a file written by chaosctl scenario run -o json instead")
+	fs.Parse(args)
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		timeline, err := scenario.ParseTimeline(data)
+		if err != nil {
+			return err
+		}
+		return writeReport(os.Stdout, timeline, output)
+	}
+
+	clientset, err := kube.clientset()
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		names, timelines, err := scenario.ListTimelines(clientset, namespace)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSCENARIO\tSTARTED\tDURATION\tRESULT")
+		for i, t := range timelines {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", names[i], t.Scenario, t.Started.UTC().Format(time.RFC3339),
+				t.Finished.Sub(t.Started).Truncate(time.Second), t.Result())
+		}
+		return w.Flush()
+	}
+	timeline, err := scenario.LoadTimeline(clientset, namespace, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return writeReport(os.Stdout, timeline, output)
+}
+
+func writeReport(out io.Writer, timeline *scenario.Timeline, format string) error {
+	switch format {
+	case "json":
+		return timeline.WriteJSON(out)
+	case "markdown":
+		return timeline.WriteMarkdown(out)
+	case "junit":
+		return timeline.WriteJUnit(out)
+	}
+	return fmt.Errorf("unknown format %q, expected markdown, json or junit", format)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/scenario"
+)
+
+// chaosctl scenario plan|run [flags] <file>
+func runScenario(args []string) error {
+	if len(args) == 0 || (args[0] != "plan" && args[0] != "run") {
+		return fmt.Errorf("expected plan or run, e.g. chaosctl scenario run scenario.yaml")
+	}
+	var (
+		kube       kubeFlags
+		namespace  string
+		label      string
+		controlMap string
+		interval   time.Duration
+		output     string
+		save       bool
+		reportNS   string
+	)
+	fs := flag.NewFlagSet("scenario "+args[0], flag.ExitOnError)
+	kube.register(fs)
+	fs.StringVar(&namespace, "n", "default", "namespace of the steps without one")
+	fs.StringVar(&label, "label", "chaos=on", "label the daemons select pods by, added to the targets")
+	fs.StringVar(&controlMap, "configmap", flow.DefaultControlConfigMap, "namespace/name of the control ConfigMap, aborting chaos there aborts the scenario")
+	fs.DurationVar(&interval, "interval", 2*time.Second, "how often the steps' pods are checked")
+	fs.StringVar(&output, "o", "table", "timeline format, table, json, markdown or junit")
+	fs.BoolVar(&save, "save", true, "save the report in a ConfigMap, for chaosctl report")
+	fs.StringVar(&reportNS, "report-namespace", "kube-system", "namespace of the saved reports")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected one scenario file")
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	s, err := scenario.Load(data)
+	if err != nil {
+		return err
+	}
+	if args[0] == "plan" {
+		return printPlan(os.Stdout, s)
+	}
+
+	clientset, err := kube.clientset()
+	if err != nil {
+		return err
+	}
+	// Interrupting chaosctl clears the faults of the steps in progress
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	timeline, runErr := scenario.NewRunner(clientset, s, namespace, label, controlMap, interval).Run(stop)
+	if output == "table" {
+		err = printTimeline(os.Stdout, timeline)
+	} else {
+		err = writeReport(os.Stdout, timeline, output)
+	}
+	if err != nil {
+		return err
+	}
+	if save {
+		name, err := scenario.SaveTimeline(clientset, reportNS, timeline)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save the report: %v\n", err)
+			// The report is not lost with the ConfigMap
+			file := scenario.ReportName(timeline) + ".json"
+			if err := saveReportFile(file, timeline); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write the report to %s: %v\n", file, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "report written to %s, see chaosctl report -f %s\n", file, file)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "report saved, see chaosctl report -n %s %s\n", reportNS, name)
+		}
+	}
+	return runErr
+}
+
+// Write the timeline as JSON to the file, for chaosctl report -f
+func saveReportFile(file string, timeline *scenario.Timeline) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := timeline.WriteJSON(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func printPlan(out io.Writer, s *scenario.Scenario) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTART\tEND\tDIRECTION\tCHAOS\tSELECTOR")
+	for _, planned := range s.Plan() {
+		for _, step := range s.Steps {
+			if step.Name == planned.Name {
+				direction, chaos := step.Fault()
+				fmt.Fprintf(w, "%s\t+%v\t+%v\t%s\t%s\t%s\n", step.Name, planned.Start, planned.End, direction, chaos, step.Selector)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// Events with their offset from the start of the run
+func printTimeline(out io.Writer, timeline *scenario.Timeline) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSTEP\tEVENT\tPOD\tMESSAGE")
+	for _, event := range timeline.Events {
+		fmt.Fprintf(w, "+%v\t%s\t%s\t%s\t%s\n", event.Time.Sub(timeline.Started).Truncate(time.Second),
+			orDash(event.Step), event.Type, orDash(event.Pod), event.Message)
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// chaosctl status [-n namespace | -all-namespaces] [-l selector] [pod...]
+func runStatus(args []string) error {
+	var cluster clusterFlags
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	cluster.register(fs)
+	fs.Parse(args)
+
+	clientset, err := cluster.clientset()
+	if err != nil {
+		return err
+	}
+	pods, err := clientset.CoreV1().Pods(cluster.podNamespace()).List(meta_v1.ListOptions{LabelSelector: cluster.labelSelector})
+	if err != nil {
+		return err
+	}
+
+	names := sets.NewString(fs.Args()...)
+	selected := []v1.Pod{}
+	for _, pod := range pods.Items {
+		if names.Len() == 0 || names.Has(pod.Name) {
+			selected = append(selected, pod)
+		}
+	}
+	if err := printStatus(os.Stdout, selected); err != nil {
+		return err
+	}
+	if names.Len() > 0 {
+		return nil
+	}
+	nodes, err := clientset.CoreV1().Nodes().List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	return printNodeStatus(os.Stdout, nodes.Items)
+}
+
+func printStatus(out io.Writer, pods []v1.Pod) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tDIRECTION\tCHAOS\tDONE\tSCHEDULE\tSENT\tDROPPED\tOVERLIMITS\tREQUEUES\tBACKLOG\tUPDATED")
+	for _, pod := range pods {
+		stats, err := flow.GetPodChaosStats(pod.Annotations)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid statistics of %s/%s: %v\n", pod.Namespace, pod.Name, err)
+		}
+		if stats == nil {
+			stats = &flow.PodChaosStats{}
+		}
+		schedule := scheduleSummary(pod.Annotations)
+		for _, direction := range []string{"ingress", "egress"} {
+			info, found := pod.Annotations[fmt.Sprintf("kubernetes.io/%s-chaos", direction)]
+			if !found {
+				continue
+			}
+			// Show what a profile expanded to
+			if effective := flow.GetEffectiveChaos(direction == "ingress", pod.Annotations); effective != "" && effective != info {
+				info = fmt.Sprintf("%s (%s)", info, effective)
+			}
+			done := pod.Annotations[fmt.Sprintf("kubernetes.io/done-%s-chaos", direction)]
+			if reason := flow.GetPodChaosRejected(direction == "ingress", pod.Annotations); reason != "" {
+				done = fmt.Sprintf("%s (%s)", done, reason)
+			} else if ramp, _ := flow.GetPodRampStatus(direction == "ingress", pod.Annotations); ramp != nil && done == "yes" {
+				done = fmt.Sprintf("%s (%s)", done, ramp)
+			}
+			s := stats.Ingress
+			if direction == "egress" {
+				s = stats.Egress
+			}
+			if s == nil {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t-\t-\t-\t-\t-\t-\n", pod.Namespace, pod.Name, direction, info, done, schedule)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d pkt (%d B)\t%d\t%d\t%d\t%d B\t%s\n",
+				pod.Namespace, pod.Name, direction, info, done, schedule,
+				s.SentPackets, s.SentBytes, s.Dropped, s.Overlimits, s.Requeues, s.Backlog, stats.UpdateTime)
+		}
+		// The DONE column of a pod failure shows its last chance of failing
+		if spec, found := pod.Annotations[flow.PodFailureAnnotation]; found {
+			last := "-"
+			if t := flow.GetPodFailureLast(pod.Annotations); !t.IsZero() {
+				last = t.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\tfailure\t%s\t%s\t%s\t-\t-\t-\t-\t-\t-\n", pod.Namespace, pod.Name, spec, last, schedule)
+		}
+		for _, fault := range flow.PodFaults {
+			spec, found := pod.Annotations[fault.Annotation]
+			if !found {
+				continue
+			}
+			done := "no"
+			if status, _ := fault.GetStatus(pod.Annotations); status != nil && status.Spec == spec {
+				done = fault.Describe(status)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t-\t-\t-\t-\t-\t-\n", pod.Namespace, pod.Name, fault.Kind, spec, done, schedule)
+		}
+		if spec, found := pod.Annotations[flow.DNSChaosAnnotation]; found {
+			done := pod.Annotations["kubernetes.io/done-dns-chaos"]
+			if reason := flow.GetPodDNSChaosRejected(pod.Annotations); reason != "" {
+				done = fmt.Sprintf("%s (%s)", done, reason)
+			}
+			fmt.Fprintf(w, "%s\t%s\tdns\t%s\t%s\t%s\t-\t-\t-\t-\t-\t-\n", pod.Namespace, pod.Name, spec, done, schedule)
+		}
+		if spec, found := pod.Annotations[flow.HTTPChaosAnnotation]; found {
+			done := pod.Annotations["kubernetes.io/done-http-chaos"]
+			if reason := flow.GetPodHTTPChaosRejected(pod.Annotations); reason != "" {
+				done = fmt.Sprintf("%s (%s)", done, reason)
+			}
+			fmt.Fprintf(w, "%s\t%s\thttp\t%s\t%s\t%s\t-\t-\t-\t-\t-\t-\n", pod.Namespace, pod.Name, spec, done, schedule)
+		}
+	}
+	return w.Flush()
+}
+
+// Whether the pod's schedule is active and when it changes, - if chaos is not scheduled
+func scheduleSummary(annotations map[string]string) string {
+	if _, found := annotations[flow.ChaosScheduleAnnotation]; !found {
+		return "-"
+	}
+	status, err := flow.GetPodScheduleStatus(annotations)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("invalid status: %v", err)
+	case status == nil:
+		return "pending"
+	case status.Active:
+		return "active until " + status.Until
+	case status.NextActivation != "":
+		return "next " + status.NextActivation
+	}
+	return "ended"
+}
+
+// The chaos of the nodes' interfaces, nothing if no node has any
+func printNodeStatus(out io.Writer, nodes []v1.Node) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	header := false
+	for _, node := range nodes {
+		spec, found := node.Annotations[flow.NodeChaosAnnotation]
+		if !found {
+			continue
+		}
+		if !header {
+			fmt.Fprintln(w, "\nNODE\tCHAOS\tDONE")
+			header = true
+		}
+		done := "no"
+		if status, _ := flow.GetNodeChaosStatus(node.Annotations); status != nil && status.Spec == spec {
+			done = status.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", node.Name, spec, done)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/dns"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Where the queries of a pod under DNS chaos are redirected from
+type dnsTarget struct {
+	iface  string
+	hostIP string
+	podIP  string
+}
+
+// Pods under DNS chaos on the node, kept across rounds so their queries are no longer
+// redirected when they leave the node's selection, chaos is aborted or the daemon stops
+type dnsPods struct {
+	// Resolver the queries not failed are forwarded to
+	upstream   string
+	port       int
+	redirector *dns.Redirector
+	mu         sync.Mutex
+	// Only listening while a pod is under DNS chaos, nil otherwise
+	server  *dns.Server
+	targets map[types.UID]dnsTarget
+	// No pod is redirected once the daemon stops
+	stopped bool
+}
+
+func newDNSPods(upstream string, port int, redirector *dns.Redirector) *dnsPods {
+	return &dnsPods{upstream: upstream, port: port, redirector: redirector, targets: map[types.UID]dnsTarget{}}
+}
+
+// Apply the rules to the pod's queries and redirect them to the server
+func (d *dnsPods) set(uid types.UID, target dnsTarget, rules []dns.Rule) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	// The pod's interface or IP changed with a new sandbox
+	if old, found := d.targets[uid]; found && old != target {
+		d.removeLocked(uid, old)
+	}
+	if d.server == nil {
+		if err := d.startLocked(target.hostIP); err != nil {
+			return err
+		}
+	}
+	d.server.SetRules(target.podIP, rules)
+	if err := d.redirector.Add(target.iface, target.hostIP); err != nil {
+		d.server.RemoveRules(target.podIP)
+		if len(d.targets) == 0 {
+			d.stopLocked()
+		}
+		return err
+	}
+	d.targets[uid] = target
+	return nil
+}
+
+// Listen on the node's IP and redirect to it, for the first pod under DNS chaos
+func (d *dnsPods) startLocked(hostIP string) error {
+	if err := d.redirector.Init(); err != nil {
+		return err
+	}
+	server := dns.NewServer(d.upstream)
+	if err := server.Listen(net.JoinHostPort(hostIP, strconv.Itoa(d.port))); err != nil {
+		d.redirector.Clear()
+		return fmt.Errorf("failed to start the dns server: %v", err)
+	}
+	glog.Infof("DNS server listening on %s:%d", hostIP, d.port)
+	d.server = server
+	return nil
+}
+
+// Stop listening and remove the redirection, once no pod is under DNS chaos
+func (d *dnsPods) stopLocked() error {
+	err := d.server.Close()
+	if clearErr := d.redirector.Clear(); err == nil {
+		err = clearErr
+	}
+	d.server = nil
+	glog.Infof("DNS server stopped, no pod is under dns chaos")
+	return err
+}
+
+// Whether the daemon redirects the pod's queries
+func (d *dnsPods) redirected(uid types.UID) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, found := d.targets[uid]
+	return found
+}
+
+// Stop redirecting the pod's queries, target is used if the daemon didn't redirect them itself
+func (d *dnsPods) remove(uid types.UID, target dnsTarget) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, found := d.targets[uid]; found {
+		target = old
+	}
+	return d.removeLocked(uid, target)
+}
+
+func (d *dnsPods) removeLocked(uid types.UID, target dnsTarget) error {
+	delete(d.targets, uid)
+	if d.server == nil {
+		return nil
+	}
+	d.server.RemoveRules(target.podIP)
+	err := d.redirector.Remove(target.iface, target.hostIP)
+	if len(d.targets) == 0 {
+		if stopErr := d.stopLocked(); err == nil {
+			err = stopErr
+		}
+	}
+	return err
+}
+
+// Stop redirecting the queries of the pods not in keep, those deleted or no longer selected
+func (d *dnsPods) removeExcept(keep map[types.UID]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for uid, target := range d.targets {
+		if keep[uid] {
+			continue
+		}
+		if err := d.removeLocked(uid, target); err != nil {
+			glog.Warningf("Failed to stop the dns chaos of pod %s: %v", uid, err)
+		}
+		glog.Infof("Stopped the dns chaos of pod %s no longer selected", uid)
+	}
+}
+
+// Stop redirecting the queries of all pods, and redirect none anymore if stop is set
+func (d *dnsPods) removeAll(stop bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = d.stopped || stop
+	for uid, target := range d.targets {
+		if err := d.removeLocked(uid, target); err != nil {
+			glog.Errorf("Failed to stop the dns chaos of pod %s: %v", uid, err)
+		}
+	}
+	if stop {
+		if err := d.redirector.Clear(); err != nil {
+			glog.Errorf("Failed to clear the dns redirection: %v", err)
+		}
+	}
+}
+
+// The first nameserver of the resolv.conf, as host:53
+func defaultNameserver(resolvConf string) (string, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", fmt.Errorf("no nameserver in %s", resolvConf)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// A kind of pod fault the daemon starts and stops. The pods under it are kept across rounds so
+// the fault is stopped when their pod leaves the node's selection, chaos is aborted or the
+// daemon stops
+type podFault interface {
+	kind() *flow.PodFault
+	// Parse the settings and find what they apply to in the pod, an error rejects them. The
+	// target is kept in the status, to stop the fault also after the daemon restarted
+	prepare(pod *v1.Pod, spec string) (target string, duration time.Duration, err error)
+	// Start the fault, it is started again each round while it is active, so it goes on after
+	// the daemon restarted
+	start(pod *v1.Pod, spec, target string) error
+	// Stop the fault, also when it was started before the daemon started
+	stop(pod *v1.Pod, target string) error
+	// Whether the daemon started the pod's fault since it started
+	active(uid types.UID) bool
+	// Stop the faults of the pods not in keep, those deleted or no longer selected
+	stopExcept(keep map[types.UID]bool)
+	// Stop the faults of all pods, and start none anymore if stop is set
+	stopAll(stop bool)
+}
+
+// Stop the faults of all pods, also of those in pods started before the daemon started, and
+// start none anymore if stop is set
+func stopFaults(faults []podFault, stop bool, pods []v1.Pod) {
+	for _, fault := range faults {
+		for i := range pods {
+			pod := &pods[i]
+			status, _ := fault.kind().GetStatus(pod.Annotations)
+			if status == nil || !status.Active || fault.active(pod.UID) {
+				continue
+			}
+			if err := fault.stop(pod, status.Target); err != nil {
+				glog.Errorf("Failed to stop the %s of %s/%s: %v", fault.kind().Kind, pod.Namespace, pod.Name, err)
+			}
+		}
+		fault.stopAll(stop)
+	}
+}
+
+// Start the pod's fault when its settings are set, only stopping it if hold is set, and stop it
+// when its duration is over or the settings are removed, return false if nothing was done
+func (s *podSyncer) syncFault(pod *v1.Pod, fault podFault, hold bool) bool {
+	kind := fault.kind()
+	spec, found := pod.Annotations[kind.Annotation]
+	status, err := kind.GetStatus(pod.Annotations)
+	if err != nil {
+		glog.Errorf("Invalid %s status of %s/%s: %v", kind.Kind, pod.Namespace, pod.Name, err)
+	}
+	changed := false
+
+	// Settings removed or changed end the fault in progress
+	if status != nil && (!found || status.Spec != spec) {
+		if status.Active {
+			if err := fault.stop(pod, status.Target); err != nil {
+				glog.Errorf("Failed to stop the %s of %s/%s: %v", kind.Kind, pod.Namespace, pod.Name, err)
+				return false
+			}
+			glog.Infof("Stopped the %s of %s/%s, its settings were removed", kind.Kind, pod.Namespace, pod.Name)
+		}
+		kind.SetStatus(nil, pod.Annotations)
+		status, changed = nil, true
+	}
+	if !found {
+		return changed
+	}
+
+	if status == nil {
+		if hold {
+			return changed
+		}
+		return s.startFault(pod, fault, spec) || changed
+	}
+	if !status.Active {
+		return changed
+	}
+
+	if !status.Over(time.Now()) {
+		if err := fault.start(pod, spec, status.Target); err != nil {
+			glog.Warningf("Failed to keep the %s of %s/%s: %v", kind.Kind, pod.Namespace, pod.Name, err)
+		}
+		return changed
+	}
+	if err := fault.stop(pod, status.Target); err != nil {
+		glog.Errorf("Failed to stop the %s of %s/%s: %v", kind.Kind, pod.Namespace, pod.Name, err)
+		return changed
+	}
+	glog.Infof("Stopped the %s of %s/%s", kind.Kind, pod.Namespace, pod.Name)
+	status.Active = false
+	kind.SetStatus(status, pod.Annotations)
+	return true
+}
+
+// Check a new fault against the guards and start it, return false if it failed and is retried
+// in the next round
+func (s *podSyncer) startFault(pod *v1.Pod, fault podFault, spec string) bool {
+	kind := fault.kind()
+	status := &flow.FaultStatus{Spec: spec}
+	var duration time.Duration
+	return s.checkOwner(pod, kind.Kind, func(pods []v1.Pod) bool {
+		err := kind.Check(pod, s.guards, pods)
+		if err == nil {
+			status.Target, duration, err = fault.prepare(pod, spec)
+		}
+		if err != nil {
+			glog.Warningf("Rejected %s of %s/%s: %v", kind.Kind, pod.Namespace, pod.Name, err)
+			s.recordEvent(pod, "ChaosRejected", fmt.Sprintf("Rejected %s: %v", kind.Kind, err))
+			status.Rejected = err.Error()
+			kind.SetStatus(status, pod.Annotations)
+			return true
+		}
+
+		if err := fault.start(pod, spec, status.Target); err != nil {
+			glog.Errorf("Failed to start the %s of %s/%s: %v", kind.Kind, pod.Namespace, pod.Name, err)
+			// A fault started in part is stopped when it ends
+			if !fault.active(pod.UID) {
+				return false
+			}
+		}
+		status.Active = true
+		if duration > 0 {
+			status.Until = time.Now().Add(duration).UTC().Format(time.RFC3339)
+		}
+		message := fmt.Sprintf("Started %s %s", kind.Kind, spec)
+		if status.Target != "" {
+			message += " on " + status.Target
+		}
+		glog.Infof("%s of %s/%s", message, pod.Namespace, pod.Name)
+		s.recordEvent(pod, kind.Event, message)
+		s.setNotReady(pod)
+		kind.SetStatus(status, pod.Annotations)
+		return true
+	})
+}
+
+// Check and apply a fault of the pod in apply, with the pods of its namespace when the guards
+// limit the pods of an owner, nil otherwise. Pods are checked and applied one at a time, so
+// workers can't overrun the limits, and claimed on their owner before, so the daemons of other
+// nodes can't either. Return false if the pods can't be listed or the owner can't be claimed,
+// what names the fault in the log
+func (s *podSyncer) checkOwner(pod *v1.Pod, what string, apply func(pods []v1.Pod) bool) bool {
+	if s.guards.MaxPodsPerOwner <= 0 && s.guards.MaxPercentPerOwner <= 0 {
+		return apply(nil)
+	}
+	s.ownerMu.Lock()
+	defer s.ownerMu.Unlock()
+	pods, err := s.listNamespacePods(pod.Namespace)
+	if err != nil {
+		glog.Errorf("Failed to check %s of %s/%s: %v", what, pod.Namespace, pod.Name, err)
+		return false
+	}
+	owner := meta_v1.GetControllerOf(pod)
+	if owner == nil {
+		return apply(pods)
+	}
+
+	claims, err := s.updateOwnerClaims(pod.Namespace, owner, func(claims flow.OwnerClaims) bool {
+		claims[pod.Name] = time.Now().Add(flow.OwnerClaimTTL)
+		return true
+	})
+	if err != nil {
+		glog.Errorf("Failed to check %s of %s/%s: %v", what, pod.Namespace, pod.Name, err)
+		return false
+	}
+	disrupted := s.isDisrupted(pod)
+	changed := apply(claims.Mark(pods))
+	if claims == nil || !disrupted && s.isDisrupted(pod) {
+		return changed
+	}
+	// Not left to expire, it would count against the siblings until then
+	_, err = s.updateOwnerClaims(pod.Namespace, owner, func(claims flow.OwnerClaims) bool {
+		_, found := claims[pod.Name]
+		delete(claims, pod.Name)
+		return found
+	})
+	if err != nil {
+		glog.Warningf("Failed to release the claim of %s/%s on %s %s: %v", pod.Namespace, pod.Name, owner.Kind, owner.Name, err)
+	}
+	return changed
+}
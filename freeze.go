@@ -0,0 +1,128 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Pods frozen by the daemon, kept across rounds so they are thawed when their pod
+// leaves the node's selection, chaos is aborted or the daemon stops
+type frozenPods struct {
+	freezer *container.Freezer
+	mu      sync.Mutex
+	cgroups map[types.UID]string
+	// No pod is frozen once the daemon stops
+	stopped bool
+}
+
+func newFrozenPods(freezer *container.Freezer) *frozenPods {
+	return &frozenPods{freezer: freezer, cgroups: map[types.UID]string{}}
+}
+
+func (f *frozenPods) kind() *flow.PodFault {
+	return flow.FreezeFault
+}
+
+func (f *frozenPods) prepare(pod *v1.Pod, spec string) (string, time.Duration, error) {
+	freeze, err := flow.ParsePodFreeze(spec)
+	if err != nil {
+		return "", 0, err
+	}
+	return "", freeze.Duration, nil
+}
+
+// Freeze the pod's cgroup, again if it is already frozen
+func (f *frozenPods) start(pod *v1.Pod, spec, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	cgroup, err := f.freezer.PodCgroup(string(pod.UID))
+	if err != nil {
+		return err
+	}
+	if err := f.freezer.Freeze(cgroup); err != nil {
+		return err
+	}
+	f.cgroups[pod.UID] = cgroup
+	return nil
+}
+
+func (f *frozenPods) active(uid types.UID) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, found := f.cgroups[uid]
+	return found
+}
+
+// Thaw the pod's cgroup, also when it was frozen before the daemon started
+func (f *frozenPods) stop(pod *v1.Pod, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cgroup, found := f.cgroups[pod.UID]
+	if !found {
+		var err error
+		if cgroup, err = f.freezer.PodCgroup(string(pod.UID)); err != nil {
+			return err
+		}
+	}
+	if err := f.freezer.Thaw(cgroup); err != nil {
+		return err
+	}
+	delete(f.cgroups, pod.UID)
+	return nil
+}
+
+func (f *frozenPods) stopExcept(keep map[types.UID]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for uid, cgroup := range f.cgroups {
+		if keep[uid] {
+			continue
+		}
+		// The cgroup of a deleted pod is gone with its processes
+		if err := f.freezer.Thaw(cgroup); err != nil {
+			glog.Warningf("Failed to thaw pod %s: %v", uid, err)
+		}
+		glog.Infof("Thawed pod %s no longer selected", uid)
+		delete(f.cgroups, uid)
+	}
+}
+
+func (f *frozenPods) stopAll(stop bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = f.stopped || stop
+	for uid, cgroup := range f.cgroups {
+		if err := f.freezer.Thaw(cgroup); err != nil {
+			glog.Errorf("Failed to thaw pod %s: %v", uid, err)
+			continue
+		}
+		glog.Infof("Thawed pod %s", uid)
+		delete(f.cgroups, uid)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"github.com/huanwei/kube-chaos/pkg/httpchaos"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Time to wait for a connection to the pod's port
+const httpDialTimeout = 5 * time.Second
+
+// Where the requests to a pod under HTTP chaos are redirected
+type httpTarget struct {
+	podIP  string
+	hostIP string
+	// A process of the pod, the network namespace is opened from, 0 if none is running
+	pid int
+}
+
+// A pod whose ports are redirected to proxies in its network namespace
+type httpPod struct {
+	target  httpTarget
+	netns   *container.NetNS
+	proxies map[int]*httpchaos.Proxy
+}
+
+// Pods under HTTP chaos on the node, kept across rounds so their ports are no longer
+// redirected when they leave the node's selection, chaos is aborted or the daemon stops
+type httpPods struct {
+	procRoot   string
+	redirector *httpchaos.Redirector
+	mu         sync.Mutex
+	pods       map[types.UID]*httpPod
+	// No pod is redirected once the daemon stops
+	stopped bool
+}
+
+func newHTTPPods(procRoot string, redirector *httpchaos.Redirector) *httpPods {
+	return &httpPods{procRoot: procRoot, redirector: redirector, pods: map[types.UID]*httpPod{}}
+}
+
+// Apply the rules to the requests to the pod's ports, starting a proxy for each port
+func (h *httpPods) set(uid types.UID, target httpTarget, rules []httpchaos.Rule) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	pod := h.pods[uid]
+	// The pod's IP changed with a new sandbox
+	if pod != nil && pod.target.podIP != target.podIP {
+		h.removeLocked(uid, pod.target)
+		pod = nil
+	}
+	if pod == nil {
+		if target.pid == 0 {
+			return fmt.Errorf("no container of the pod is running")
+		}
+		netns, err := container.OpenNetNS(h.procRoot, target.pid)
+		if err != nil {
+			return err
+		}
+		pod = &httpPod{target: target, netns: netns, proxies: map[int]*httpchaos.Proxy{}}
+	}
+	h.pods[uid] = pod
+
+	redirects := map[int]int{}
+	for _, port := range httpchaos.Ports(rules) {
+		proxy, found := pod.proxies[port]
+		if !found {
+			var err error
+			if proxy, err = h.startProxy(pod, port); err != nil {
+				h.removeLocked(uid, target)
+				return err
+			}
+			pod.proxies[port] = proxy
+		}
+		proxy.SetRules(rules)
+		redirects[port] = proxy.ListenPort()
+	}
+	if err := pod.netns.Do(func() error { return h.redirector.Redirect(target.hostIP, redirects) }); err != nil {
+		h.removeLocked(uid, target)
+		return err
+	}
+	// Ports no longer in the rules are redirected back to the pod already
+	for port, proxy := range pod.proxies {
+		if _, found := redirects[port]; !found {
+			proxy.Close()
+			delete(pod.proxies, port)
+		}
+	}
+	return nil
+}
+
+// Start a proxy listening on a free port of the pod's IP, forwarding to the port
+func (h *httpPods) startProxy(pod *httpPod, port int) (*httpchaos.Proxy, error) {
+	var listener net.Listener
+	err := pod.netns.Do(func() error {
+		var err error
+		listener, err = net.Listen("tcp", net.JoinHostPort(pod.target.podIP, "0"))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen in the pod: %v", err)
+	}
+	// Connecting from the pod's namespace goes through the loopback, without being redirected
+	dial := func(network, address string) (net.Conn, error) {
+		var conn net.Conn
+		err := pod.netns.Do(func() error {
+			var err error
+			conn, err = net.DialTimeout(network, address, httpDialTimeout)
+			return err
+		})
+		return conn, err
+	}
+	proxy := httpchaos.NewProxy(listener, port, net.JoinHostPort(pod.target.podIP, strconv.Itoa(port)), dial)
+	go func() {
+		if err := proxy.Serve(); err != nil {
+			glog.Errorf("HTTP proxy of %s:%d stopped: %v", pod.target.podIP, port, err)
+		}
+	}()
+	return proxy, nil
+}
+
+// Whether the daemon redirects the pod's ports
+func (h *httpPods) redirected(uid types.UID) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, found := h.pods[uid]
+	return found
+}
+
+// Stop redirecting the pod's ports, target is used if the daemon didn't redirect them itself
+func (h *httpPods) remove(uid types.UID, target httpTarget) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.removeLocked(uid, target)
+}
+
+func (h *httpPods) removeLocked(uid types.UID, target httpTarget) error {
+	pod, found := h.pods[uid]
+	delete(h.pods, uid)
+	if !found {
+		// Redirected before the daemon restarted, the chain is left in the pod
+		if target.pid == 0 {
+			return nil
+		}
+		netns, err := container.OpenNetNS(h.procRoot, target.pid)
+		if err != nil {
+			return err
+		}
+		pod = &httpPod{target: target, netns: netns}
+	}
+	err := pod.netns.Do(h.redirector.Clear)
+	for _, proxy := range pod.proxies {
+		proxy.Close()
+	}
+	pod.netns.Close()
+	return err
+}
+
+// Stop redirecting the ports of the pods not in keep, those deleted or no longer selected
+func (h *httpPods) removeExcept(keep map[types.UID]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for uid, pod := range h.pods {
+		if keep[uid] {
+			continue
+		}
+		if err := h.removeLocked(uid, pod.target); err != nil {
+			glog.Warningf("Failed to stop the http chaos of pod %s: %v", uid, err)
+		}
+		glog.Infof("Stopped the http chaos of pod %s no longer selected", uid)
+	}
+}
+
+// Stop redirecting the ports of all pods, and redirect none anymore if stop is set
+func (h *httpPods) removeAll(stop bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = h.stopped || stop
+	for uid, pod := range h.pods {
+		if err := h.removeLocked(uid, pod.target); err != nil {
+			glog.Errorf("Failed to stop the http chaos of pod %s: %v", uid, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The cgroup and disk of a throttled pod
+type throttledIO struct {
+	cgroup string
+	device string
+}
+
+// Pods whose IO the daemon throttles, kept across rounds so the limits are removed when their
+// pod leaves the node's selection, chaos is aborted or the daemon stops. The limits stay in the
+// pods' cgroups if the daemon dies, the devices are kept in the pods' status to remove them
+type throttledPods struct {
+	cgroups *container.Cgroups
+	// Processes of the node, to find the disks of the paths in the containers
+	processes *container.Processes
+	// The host's /sys, to find the disks of devices
+	sysRoot string
+	mu      sync.Mutex
+	pods    map[types.UID]throttledIO
+	// No pod is throttled once the daemon stops
+	stopped bool
+}
+
+func newThrottledPods(cgroups *container.Cgroups, processes *container.Processes, sysRoot string) *throttledPods {
+	return &throttledPods{cgroups: cgroups, processes: processes, sysRoot: sysRoot, pods: map[types.UID]throttledIO{}}
+}
+
+func (t *throttledPods) kind() *flow.PodFault {
+	return flow.IOFault
+}
+
+// The target is the disk of the path, in the container's mount namespace
+func (t *throttledPods) prepare(pod *v1.Pod, spec string) (string, time.Duration, error) {
+	settings, err := flow.ParsePodIO(spec)
+	if err != nil {
+		return "", 0, err
+	}
+	pid, err := containerPID(t.processes, pod, settings.Container)
+	if err != nil {
+		return "", 0, err
+	}
+	device, err := t.processes.MountDevice(pid, settings.Path)
+	if err != nil {
+		return "", 0, err
+	}
+	disk, err := container.WholeDisk(t.sysRoot, device)
+	if err != nil {
+		return "", 0, err
+	}
+	return disk, settings.Duration, nil
+}
+
+// Throttle the pod's IO on the device
+func (t *throttledPods) start(pod *v1.Pod, spec, device string) error {
+	settings, err := flow.ParsePodIO(spec)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	cgroup, err := t.cgroups.PodIOCgroup(string(pod.UID))
+	if err != nil {
+		return err
+	}
+	if err := t.cgroups.ThrottleIO(cgroup, device, settings.Limits); err != nil {
+		return err
+	}
+	t.pods[pod.UID] = throttledIO{cgroup: cgroup, device: device}
+	return nil
+}
+
+func (t *throttledPods) active(uid types.UID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, found := t.pods[uid]
+	return found
+}
+
+// Remove the limits of the pod on the device, also when it was throttled before the daemon started
+func (t *throttledPods) stop(pod *v1.Pod, device string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	throttled, found := t.pods[pod.UID]
+	if !found {
+		cgroup, err := t.cgroups.PodIOCgroup(string(pod.UID))
+		if err != nil {
+			return err
+		}
+		throttled = throttledIO{cgroup: cgroup, device: device}
+	}
+	if err := t.cgroups.ThrottleIO(throttled.cgroup, throttled.device, container.IOLimits{}); err != nil {
+		return err
+	}
+	delete(t.pods, pod.UID)
+	return nil
+}
+
+func (t *throttledPods) stopExcept(keep map[types.UID]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for uid, throttled := range t.pods {
+		if keep[uid] {
+			continue
+		}
+		// The cgroup of a deleted pod is gone with its limits
+		if err := t.cgroups.ThrottleIO(throttled.cgroup, throttled.device, container.IOLimits{}); err != nil {
+			glog.Warningf("Failed to restore the io of pod %s: %v", uid, err)
+		}
+		glog.Infof("Restored the io of pod %s no longer selected", uid)
+		delete(t.pods, uid)
+	}
+}
+
+func (t *throttledPods) stopAll(stop bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = t.stopped || stop
+	for uid, throttled := range t.pods {
+		if err := t.cgroups.ThrottleIO(throttled.cgroup, throttled.device, container.IOLimits{}); err != nil {
+			glog.Errorf("Failed to restore the io of pod %s: %v", uid, err)
+			continue
+		}
+		glog.Infof("Restored the io of pod %s", uid)
+		delete(t.pods, uid)
+	}
+}
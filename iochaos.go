@@ -0,0 +1,167 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/iochaos"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Pods whose file operations the daemon injects faults into, kept across rounds so the faults
+// are unmounted when their pod leaves the node's selection, chaos is aborted or the daemon
+// stops. The mounts are served by the daemon, they fail with ENOTCONN if it dies until it
+// unmounts them again
+type injectedPods struct {
+	processes *container.Processes
+	procRoot  string
+	mu        sync.Mutex
+	servers   map[types.UID]*iochaos.Server
+	// No faults are injected once the daemon stops
+	stopped bool
+}
+
+func newInjectedPods(processes *container.Processes, procRoot string) *injectedPods {
+	return &injectedPods{processes: processes, procRoot: procRoot, servers: map[types.UID]*iochaos.Server{}}
+}
+
+func (i *injectedPods) kind() *flow.PodFault {
+	return flow.IOChaosFault
+}
+
+// The target is the container and the path, container:path
+func (i *injectedPods) prepare(pod *v1.Pod, spec string) (string, time.Duration, error) {
+	settings, err := flow.ParsePodIOChaos(spec)
+	if err != nil {
+		return "", 0, err
+	}
+	name := settings.Container
+	if name == "" {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Running != nil {
+				name = status.Name
+				break
+			}
+		}
+	}
+	if _, err := containerPID(i.processes, pod, name); err != nil {
+		return "", 0, err
+	}
+	return name + ":" + settings.Path, settings.Duration, nil
+}
+
+// Mount the faults over the path, again if the container restarted and took the mount with it.
+// The mounts left by a daemon that exited are unmounted first
+func (i *injectedPods) start(pod *v1.Pod, spec, target string) error {
+	settings, err := flow.ParsePodIOChaos(spec)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.stopped {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	if server, found := i.servers[pod.UID]; found && !server.Exited() {
+		return nil
+	}
+	delete(i.servers, pod.UID)
+
+	pid, err := containerPID(i.processes, pod, targetContainer(target))
+	if err != nil {
+		return err
+	}
+	if _, err := iochaos.Unmount(i.procRoot, pid); err != nil {
+		return err
+	}
+	server, err := iochaos.Mount(i.procRoot, pid, settings.Path, settings.Faults)
+	if err != nil {
+		return err
+	}
+	i.servers[pod.UID] = server
+	return nil
+}
+
+func (i *injectedPods) active(uid types.UID) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	_, found := i.servers[uid]
+	return found
+}
+
+// Unmount the faults, also those mounted before the daemon started, a container that is not
+// running has no mounts left
+func (i *injectedPods) stop(pod *v1.Pod, target string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if server, found := i.servers[pod.UID]; found {
+		if err := server.Unmount(); err != nil {
+			return err
+		}
+		delete(i.servers, pod.UID)
+		return nil
+	}
+	pid, err := containerPID(i.processes, pod, targetContainer(target))
+	if err != nil {
+		return nil
+	}
+	_, err = iochaos.Unmount(i.procRoot, pid)
+	return err
+}
+
+func (i *injectedPods) stopExcept(keep map[types.UID]bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for uid, server := range i.servers {
+		if keep[uid] {
+			continue
+		}
+		// The mount of a deleted pod is gone with it
+		if err := server.Unmount(); err != nil {
+			glog.Warningf("Failed to remove the io faults of pod %s: %v", uid, err)
+		}
+		glog.Infof("Removed the io faults of pod %s no longer selected", uid)
+		delete(i.servers, uid)
+	}
+}
+
+func (i *injectedPods) stopAll(stop bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.stopped = i.stopped || stop
+	for uid, server := range i.servers {
+		if err := server.Unmount(); err != nil {
+			glog.Errorf("Failed to remove the io faults of pod %s: %v", uid, err)
+			continue
+		}
+		glog.Infof("Removed the io faults of pod %s", uid)
+		delete(i.servers, uid)
+	}
+}
+
+// The container of an io chaos target, container:path
+func targetContainer(target string) string {
+	return strings.SplitN(target, ":", 2)[0]
+}
@@ -24,34 +24,92 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/huanwei/kube-chaos/pkg/calico"
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"github.com/huanwei/kube-chaos/pkg/dns"
 	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/httpchaos"
+	"github.com/huanwei/kube-chaos/pkg/metrics"
+	"github.com/huanwei/kube-chaos/pkg/stress"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/api/core/v1"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 func main() {
+	// Run against a single interface without Kubernetes
+	if len(os.Args) > 1 && os.Args[1] == "local" {
+		runLocal(os.Args[2:])
+		return
+	}
+	// Burn a CPU or hold memory in a stressed pod's cgroup
+	if len(os.Args) > 1 && os.Args[1] == stress.WorkerCommand {
+		runStressWorker(os.Args[2:])
+		return
+	}
+	// Serve the admission webhook validating the chaos annotations
+	if len(os.Args) > 1 && os.Args[1] == "webhook" {
+		runWebhook(os.Args[2:])
+		return
+	}
+
 	var (
 		kubeconfig    string
 		endpoint      string
 		labelSelector string
 		firstIFB      int
 		secondIFB     int
+		maxPodsPerIFB int
+		maxIFB        int
 		syncDuration  int
-		shaper        flow.Shaper
+		workers       int
+		metricsAddr   string
+		profileMap    string
+		controlMap    string
+		timezone      string
+		procRoot      string
+		cgroupRoot    string
+		sysRoot       string
+		dnsPort       int
+		dnsUpstream   string
 	)
 
-	flag.StringVar(&kubeconfig, "kubeconfig", "/etc/kubernetes/kubelet.conf", "absolute path to the kubeconfig file")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file, empty to use the service account of the pod")
 	flag.StringVar(&endpoint, "etcd-endpoint", "", "the calico etcd endpoint, use standalone etcd cluster, if not set we use the default in-cluster Calico etcd. e.g. http://10.96.232.136:6666")
 	flag.StringVar(&labelSelector, "labelSelector", "chaos=on", "select pods to do chaos, e.g. chaos=on")
 	flag.IntVar(&firstIFB, "firstIFB", 0, "first available ifb, default 0 e.g. 2")
 	flag.IntVar(&secondIFB, "secondIFB", 1, "second available ifb, default 1 e.g. 4")
+	flag.IntVar(&maxPodsPerIFB, "maxPodsPerIFB", 32, "pods sharing an ifb device before another one is created")
+	flag.IntVar(&maxIFB, "maxIFB", 8, "maximum ifb devices of each direction, including the first or second ifb")
 	flag.IntVar(&syncDuration, "syncDuration", 1, "sync duration(seconds)")
+	flag.IntVar(&workers, "workers", 4, "number of pods reconciled in parallel")
+	flag.StringVar(&metricsAddr, "metricsAddress", ":9465", "address serving the pods' chaos statistics at /metrics, empty to disable")
+	flag.StringVar(&profileMap, "profileConfigMap", "kube-system/kube-chaos-profiles", "namespace/name of the ConfigMap adding network profiles to the built-in ones, empty to use only the built-in ones")
+	flag.StringVar(&controlMap, "controlConfigMap", flow.DefaultControlConfigMap, "namespace/name of the ConfigMap whose state key pauses, aborts or resumes chaos on all nodes, empty to disable")
+	flag.StringVar(&timezone, "timezone", "Local", "timezone of the chaos schedules without TZ=, e.g. Asia/Shanghai, the node's by default")
+	flag.StringVar(&procRoot, "procRoot", "/proc", "proc filesystem of the host's pid namespace, to find the containers' processes")
+	flag.StringVar(&cgroupRoot, "cgroupRoot", "/sys/fs/cgroup", "cgroup filesystem of the host, to freeze, stress and throttle the pods")
+	flag.StringVar(&sysRoot, "sysRoot", "/sys", "sysfs of the host, to find the disks of the pods' volumes")
+	flag.IntVar(&dnsPort, "dnsPort", 10053, "port of the node's IP the DNS queries of pods under DNS chaos are redirected to")
+	flag.StringVar(&dnsUpstream, "dnsUpstream", "", "resolver the DNS queries not failed are forwarded to, e.g. 10.96.0.10:53, the first nameserver of /etc/resolv.conf by default")
 	flag.Parse()
+	if workers < 1 {
+		workers = 1
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		panic(err.Error())
+	}
 
-	// Uses the current context in kubeconfig
+	// Uses the current context in kubeconfig, or the in-cluster config without one
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
 		fmt.Println(err)
@@ -71,13 +129,71 @@ func main() {
 	hostname, _ := os.Hostname()
 
 	// Init ifb module
-	err = flow.InitIfbModule(firstIFB, secondIFB)
+	pool := flow.NewIfbPool(firstIFB, secondIFB, maxPodsPerIFB, maxIFB)
+	err = pool.Init()
 	if err != nil {
 		glog.Errorf("Failed init ifb: %v", err)
 	}
 
+	// Serve the statistics of the latest sync
+	registry := metrics.NewRegistry()
+	if metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", registry)
+			glog.Errorf("Metrics server stopped: %v", http.ListenAndServe(metricsAddr, mux))
+		}()
+	}
+
 	glog.Flush()
 
+	// Whether the ifb devices were cleared, by an abort or the node's clear flag
+	poolCleared := false
+	state := flow.ControlRunning
+	guards := flow.DefaultGuards()
+	var profiles flow.Profiles
+	processes := container.NewProcesses(procRoot)
+	chance := &lockedRand{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+	// Frozen, stressed, throttled, io faulted and skewed pods must not stay so after the daemon is gone
+	faults := []podFault{
+		newFrozenPods(container.NewFreezer(cgroupRoot)),
+		newStressedPods(container.NewCgroups(cgroupRoot)),
+		newThrottledPods(container.NewCgroups(cgroupRoot), processes, sysRoot),
+		newInjectedPods(processes, procRoot),
+		newSkewedPods(procRoot),
+	}
+	// Nor the node's interface shaped by node chaos
+	shaped := newShapedNode(pool)
+
+	// Answer the DNS queries redirected from the pods under DNS chaos, the server only
+	// listens while a pod is under DNS chaos
+	if dnsUpstream == "" {
+		if dnsUpstream, err = defaultNameserver("/etc/resolv.conf"); err != nil {
+			glog.Errorf("Failed to find the DNS resolver: %v", err)
+		}
+	}
+	redirector := dns.NewRedirector(dnsPort)
+	// The redirection left by a previous daemon goes nowhere, the pods still under DNS
+	// chaos are redirected again in the first round
+	if err := redirector.Clear(); err != nil {
+		glog.Errorf("Failed to clear the dns redirection: %v", err)
+	}
+	dnsRedirected := newDNSPods(dnsUpstream, dnsPort, redirector)
+	httpRedirected := newHTTPPods(procRoot, httpchaos.NewRedirector())
+	stopping := make(chan os.Signal, 1)
+	signal.Notify(stopping, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stopping
+		glog.Info("Stopping, thawing the frozen pods and stopping the stress...")
+		stopFaults(faults, true, nil)
+		dnsRedirected.removeAll(true)
+		httpRedirected.removeAll(true)
+		shaped.clearAll(true, nil)
+		glog.Flush()
+		os.Exit(0)
+	}()
+
 	// Synchronize pods and do chaos
 	for {
 		//now:=time.Now()
@@ -94,41 +210,52 @@ func main() {
 		}
 		glog.V(4).Infof("There are %d pods need to do chaos in the cluster\n", len(pods.Items))
 
-		// Used for checking which tc class isn't used, and del it
-		egressPodsCIDRs := []string{}
-		ingressPodsCIDRs := []string{}
+		// Check the cluster-wide state, an abort clears all faults until resumed
+		state, guards = loadControl(clientset, controlMap, state, guards)
+		if state == flow.ControlAbort {
+			if !poolCleared {
+				glog.Info("Chaos aborted, clearing all faults...")
+				stopFaults(faults, false, pods.Items)
+				dnsRedirected.removeAll(false)
+				httpRedirected.removeAll(false)
+				shaped.clearAll(false, node)
+				if flow.SetNodeChaosPending(node.Annotations) {
+					clientset.CoreV1().Nodes().UpdateStatus(node.DeepCopy())
+				}
+				clearNodeChaos(clientset, pool, endpoint, pods.Items, func(annotations map[string]string) {
+					flow.SetPodChaosPending(annotations)
+					for _, fault := range flow.PodFaults {
+						fault.SetEnded(annotations)
+					}
+				})
+				registry.Publish(metrics.NewRound())
+				poolCleared = true
+				glog.Info("Chaos aborted, waiting to be resumed")
+			}
+			glog.Flush()
+			time.Sleep(time.Duration(syncDuration) * time.Second)
+			continue
+		}
 
 		// Check Node's clear flag, if it exists, clear all settings and close
 		_, clearNode := node.Annotations["kubernetes.io/clear-chaos"]
 		if clearNode {
-			// First close the ifb of node
 			glog.Info("Closing chaos...")
-			err := flow.ClearIfb(firstIFB, secondIFB)
-			if err != nil {
-				glog.Error(err)
-			}
-
-			// Then clean each pod
-			for _, pod := range pods.Items {
-				// Get network card name
-				workload := calico.GetWorkload(pod.Namespace, pod.Spec.NodeName, pod.Name, endpoint)
-
-				// Clear network card settings
-				err = flow.ClearIngressMirroring(workload.Spec.InterfaceName)
-				if err != nil {
-					glog.Errorf("Fail to clear pod %s's ingress settings: %s", pod.Name, err)
+			stopFaults(faults, false, pods.Items)
+			dnsRedirected.removeAll(false)
+			httpRedirected.removeAll(false)
+			shaped.clearAll(false, node)
+			clearNodeChaos(clientset, pool, endpoint, pods.Items, func(annotations map[string]string) {
+				flow.SetPodChaosUpdated(false, false, true, true, annotations)
+				flow.ClearPodFailure(annotations)
+				for _, fault := range flow.PodFaults {
+					fault.Clear(annotations)
 				}
-				err = flow.ClearEgressMirroring(workload.Spec.InterfaceName)
-				if err != nil {
-					glog.Errorf("Fail to clear pod %s's egress settings: %s", pod.Name, err)
-				}
-
-				// Delete Pod flag
-				pod.SetAnnotations(flow.SetPodChaosUpdated(false, false, true, true, pod.Annotations))
-				clientset.CoreV1().Pods(pod.Namespace).UpdateStatus(pod.DeepCopy())
-
-				glog.Infof("Pod %s cleared", pod.Name)
-			}
+				flow.ClearPodDNSChaos(annotations)
+				flow.ClearPodHTTPChaos(annotations)
+			})
+			registry.Publish(metrics.NewRound())
+			poolCleared = true
 
 			// Force update log
 			glog.Infof("Closing complete")
@@ -137,137 +264,958 @@ func main() {
 			// Clear Node's annotation and label
 			annotations := node.Annotations
 			delete(annotations, "kubernetes.io/clear-chaos")
+			flow.ClearNodeChaos(annotations)
 			labels := node.Labels
 			delete(labels, strings.Split(labelSelector, "=")[0])
 			node.SetAnnotations(annotations)
 			node.SetLabels(labels)
 			clientset.CoreV1().Nodes().UpdateStatus(node.DeepCopy())
 
-			// After label removed, k8s will delete kube-chaos from the node
-			// Wait for terminating
-			for {
+			// After label removed, k8s will delete kube-chaos from the node,
+			// until then the pods have no chaos settings left to apply
+			time.Sleep(time.Duration(syncDuration) * time.Second)
+			continue
+		}
+
+		// Bring the ifb devices back after they were cleared
+		if poolCleared {
+			if err := pool.Init(); err != nil {
+				glog.Errorf("Failed init ifb: %v", err)
 				time.Sleep(time.Duration(syncDuration) * time.Second)
+				continue
 			}
+			poolCleared = false
+			glog.Info("Chaos resumed")
 		}
+		if state == flow.ControlPaused {
+			glog.V(4).Infof("Chaos paused, new chaos settings wait until resumed")
+		}
+		// Profiles of this round, profile:<name> settings are expanded from them
+		profiles = loadProfiles(clientset, profileMap, profiles)
+		if profiles == nil {
+			glog.V(4).Infof("Profiles unknown, new chaos settings wait until they are read")
+		}
+
+		// Used for checking which tc class isn't used, and del it
+		egressPodsCIDRs := []string{}
+		ingressPodsCIDRs := []string{}
 
 		// clear flag isn't exists, do chaos on all labeled pods
-		for _, pod := range pods.Items {
-			// Extract chaosInfo from pod's annotation
-			ingressChaosInfo, egressChaosInfo, ingressNeedUpdate, egressNeedUpdate, err := flow.ExtractPodChaosInfo(pod.Annotations)
-			if err != nil {
-				glog.Errorf("Failed extract pod's chaos info: %v", err)
-			}
+		// Pods are synced in parallel, bounded by the number of workers
+		s := &podSyncer{
+			clientset:     clientset,
+			pool:          pool,
+			endpoint:      endpoint,
+			hostname:      hostname,
+			profiles:      profiles,
+			guards:        guards,
+			paused:        state == flow.ControlPaused || profiles == nil,
+			location:      location,
+			round:         metrics.NewRound(),
+			processes:     processes,
+			chance:        chance,
+			faults:        faults,
+			dns:           dnsRedirected,
+			http:          httpRedirected,
+			shaped:        shaped,
+			server:        config.Host,
+			namespacePods: map[string][]v1.Pod{},
+		}
+		podsToSync := make(chan v1.Pod)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for pod := range podsToSync {
+					s.syncPod(pod)
+				}
+			}()
+		}
 
+		for _, pod := range pods.Items {
 			// Store the cidr of the pod
 			cidr := fmt.Sprintf("%s/32", pod.Status.PodIP) //192.168.0.10/32
 			egressPodsCIDRs = append(egressPodsCIDRs, cidr)
 			ingressPodsCIDRs = append(ingressPodsCIDRs, cidr)
+			podsToSync <- pod
+		}
+		close(podsToSync)
+		wg.Wait()
+		registry.Publish(s.round)
+		s.syncNode(node)
 
-			// Neither ingress nor egress need update, skip
-			if !ingressNeedUpdate && !egressNeedUpdate {
-				//glog.Infof("pod %s's setting has deployed, skip", pod.Name)
-				continue
+		// Stop the faults of the pods deleted or no longer selected
+		selected := map[types.UID]bool{}
+		for _, pod := range pods.Items {
+			selected[pod.UID] = true
+		}
+		for _, fault := range faults {
+			fault.stopExcept(selected)
+		}
+		dnsRedirected.removeExcept(selected)
+		httpRedirected.removeExcept(selected)
+
+		// Delete chaos on pods not labeled
+		if err := flow.DeleteExtraChaos(egressPodsCIDRs, ingressPodsCIDRs, pool); err != nil {
+			glog.Errorf("Failed to delete extra chaos: %v", err)
+		}
+		// Delete ifb devices no pod uses anymore
+		if err := pool.Release(); err != nil {
+			glog.Errorf("Failed to release ifb: %v", err)
+		}
+
+		//elapsed:=time.Since(now)
+		//glog.Infof("iteration time used: %v",elapsed)
+
+		// Flush log
+		glog.Flush()
+		// Sleep to avoid high CPU usage
+		time.Sleep(time.Duration(syncDuration) * time.Second)
+	}
+
+}
+
+// Shared by the workers of a sync round
+type podSyncer struct {
+	clientset *kubernetes.Clientset
+	pool      *flow.IfbPool
+	endpoint  string
+	hostname  string
+	profiles  flow.Profiles
+	guards    *flow.Guards
+	// New and changed chaos settings are left undone while paused
+	paused bool
+	// Location of the schedules without a timezone
+	location *time.Location
+	round    *metrics.Round
+	// Processes of the node, to kill the containers
+	processes *container.Processes
+	chance    *lockedRand
+	faults    []podFault
+	dns       *dnsPods
+	http      *httpPods
+	shaped    *shapedNode
+	// The API server the daemon talks to, protected from node chaos
+	server string
+
+	// Pods of the namespaces listed in this round, to check the owner limits
+	mu            sync.Mutex
+	namespacePods map[string][]v1.Pod
+	ownerMu       sync.Mutex
+}
+
+// Apply the pod's chaos settings if they changed, and publish its statistics
+func (s *podSyncer) syncPod(pod v1.Pod) {
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	changed := false
+
+	// Scheduled chaos is applied inside its windows only, and cleared outside of them
+	hold, outside := s.paused, false
+	scheduled, err := flow.GetPodSchedule(pod.Annotations, s.location)
+	switch {
+	case err != nil:
+		changed = s.rejectSchedule(&pod, err)
+		if flow.SetPodScheduleStatus(nil, pod.Annotations) {
+			changed = true
+		}
+	case scheduled != nil:
+		status := flow.NewScheduleStatus(scheduled, time.Now())
+		if !status.Active {
+			hold, outside = true, true
+			if flow.IsPodUnderChaos(pod.Annotations) {
+				s.deactivatePod(&pod)
+				changed = true
+			}
+			if s.deactivateFaults(&pod) {
+				changed = true
 			}
+		}
+		if flow.SetPodScheduleStatus(status, pod.Annotations) {
+			changed = true
+		}
+	default:
+		changed = flow.SetPodScheduleStatus(nil, pod.Annotations)
+	}
 
-			// Get pod clear flag
-			ingressNeedClear, egressNeedClear := flow.GetClearFlag(pod.Annotations)
+	_, _, ingressNeedUpdate, egressNeedUpdate, _ := flow.ExtractPodChaosInfo(pod.Annotations)
+	if ingressNeedUpdate || egressNeedUpdate {
+		if s.reconcilePod(pod, hold) {
+			changed = true
+		}
+	}
+	if s.dnsPod(&pod, hold) {
+		changed = true
+	}
+	if s.httpPod(&pod, hold) {
+		changed = true
+	}
+	if !hold && s.rampPod(&pod) {
+		changed = true
+	}
+	for _, fault := range s.faults {
+		if !outside && s.syncFault(&pod, fault, hold) {
+			changed = true
+		}
+	}
+	if !hold {
+		failed, deleted := s.failPod(&pod)
+		if deleted {
+			return
+		}
+		if failed {
+			changed = true
+		}
+	}
 
-			// Get pod's veth interface name
-			workload := calico.GetWorkload(pod.Namespace, pod.Spec.NodeName, pod.Name, endpoint)
+	if pod.Status.PodIP != "" {
+		cidr := fmt.Sprintf("%s/32", pod.Status.PodIP)
+		ingress, err := flow.GetChaosStats(cidr, true, s.pool)
+		if err != nil {
+			glog.Errorf("Failed to get ingress stats of %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		egress, err := flow.GetChaosStats(cidr, false, s.pool)
+		if err != nil {
+			glog.Errorf("Failed to get egress stats of %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		s.round.Set(pod.Namespace, pod.Name, "ingress", ingress)
+		s.round.Set(pod.Namespace, pod.Name, "egress", egress)
+		if flow.SetPodChaosStats(ingress, egress, pod.Annotations) {
+			changed = true
+		}
+	}
 
-			// Create a shaper
-			shaper = flow.NewTCShaper(workload.Spec.InterfaceName, firstIFB, secondIFB)
+	if changed {
+		if _, err := s.clientset.CoreV1().Pods(pod.Namespace).UpdateStatus(pod.DeepCopy()); err != nil {
+			glog.Errorf("Failed to update pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+}
 
-			if ingressNeedUpdate {
-				if !ingressNeedClear {
-					// Create ingress mirroring
-					if err := shaper.ReconcileIngressMirroring(cidr); err != nil {
-						glog.Errorf("Failed to mirror veth(%s) to ifb1: %v", workload.Spec.InterfaceName, err)
-					}
+// Apply or clear the pod's chaos settings and mark them done, only clearing if hold is set,
+// return false if nothing was done
+func (s *podSyncer) reconcilePod(pod v1.Pod, hold bool) bool {
+	// Extract chaosInfo from pod's annotation
+	ingressChaosInfo, egressChaosInfo, ingressNeedUpdate, egressNeedUpdate, err := flow.ExtractPodChaosInfo(pod.Annotations)
+	if err != nil {
+		glog.Errorf("Failed extract pod's chaos info: %v", err)
+	}
+	cidr := fmt.Sprintf("%s/32", pod.Status.PodIP)
 
-					// First clear interface
-					shaper.ClearIngressInterface()
+	// Get pod clear flag
+	ingressNeedClear, egressNeedClear := flow.GetClearFlag(pod.Annotations)
 
-					// Config pod interface  qdisc
-					if err := shaper.ReconcileIngressInterface(); err != nil {
-						glog.Errorf("Failed to init veth(%s): %v", workload.Spec.InterfaceName, err)
-					}
+	// Clearing goes on while paused or outside the schedule, applying waits
+	if hold {
+		ingressNeedUpdate = ingressNeedUpdate && ingressNeedClear
+		egressNeedUpdate = egressNeedUpdate && egressNeedClear
+		if !ingressNeedUpdate && !egressNeedUpdate {
+			return false
+		}
+	}
 
-					if err := shaper.ReconcileIngressCIDR(cidr, ingressChaosInfo); err != nil {
-						glog.Errorf("Failed to reconcile CIDR %s: %v", cidr, err)
-					}
-					glog.V(4).Infof("reconcile cidr %s with ingressChaosInfo %s ", cidr, ingressChaosInfo)
-
-					// Execute tc command in ingress
-					shaper.ExecTcChaos(true, ingressChaosInfo)
-				} else {
-					// Clear ingress mirroring
-					err := flow.ClearIngressMirroring(workload.Spec.InterfaceName)
-					if err != nil {
-						glog.Errorf("Fail to clear ingress mirroring: %s", err)
-					}
-					// Clear ingress ifb class
-					err = flow.Reset(cidr, fmt.Sprintf("ifb%d", secondIFB))
-					if err != nil {
-						glog.Errorf("Fail to clear ingress ifb class: %s", err)
-					}
-				}
+	// Get pod's veth interface name
+	workload := calico.GetWorkload(pod.Namespace, pod.Spec.NodeName, pod.Name, s.endpoint)
+
+	// Create a shaper
+	shaper := flow.NewTCShaper(workload.Spec.InterfaceName, s.pool)
+
+	if ingressNeedUpdate {
+		if !ingressNeedClear {
+			ingressNeedUpdate = s.applyChaos(&pod, shaper, workload.Spec.InterfaceName, cidr, ingressChaosInfo, true)
+		} else {
+			clearIngressChaos(workload.Spec.InterfaceName, cidr, s.pool)
+		}
+	}
+
+	if egressNeedUpdate {
+		if !egressNeedClear {
+			egressNeedUpdate = s.applyChaos(&pod, shaper, workload.Spec.InterfaceName, cidr, egressChaosInfo, false)
+		} else {
+			clearEgressChaos(workload.Spec.InterfaceName, cidr, s.pool)
+		}
+	}
+
+	// Update chaos-done flag
+	pod.SetAnnotations(flow.SetPodChaosUpdated(ingressNeedUpdate, egressNeedUpdate, ingressNeedClear, egressNeedClear, pod.Annotations))
+	return true
+}
+
+// Check the pod's chaos settings against the guards and apply them, return false if they
+// were rejected or failed, a failed pod is left undone so it is retried in the next round
+func (s *podSyncer) applyChaos(pod *v1.Pod, shaper flow.Shaper, iface, cidr, info string, isIngress bool) bool {
+	direction := "egress"
+	if isIngress {
+		direction = "ingress"
+	}
+	return s.checkOwner(pod, direction+" chaos", func(pods []v1.Pod) bool {
+		return s.startChaos(pod, shaper, iface, cidr, info, isIngress, pods)
+	})
+}
+
+// Check the pod's chaos settings against the guards and apply them, pods are the ones of the
+// pod's namespace and only needed with owner limits
+func (s *podSyncer) startChaos(pod *v1.Pod, shaper flow.Shaper, iface, cidr, info string, isIngress bool, pods []v1.Pod) bool {
+	direction := "egress"
+	if isIngress {
+		direction = "ingress"
+	}
+	info, err := flow.CheckPodChaos(pod, info, isIngress, s.profiles, s.guards, pods)
+	if err != nil {
+		glog.Warningf("Rejected %s chaos of %s/%s: %v", direction, pod.Namespace, pod.Name, err)
+		flow.SetPodChaosRejected(isIngress, err.Error(), pod.Annotations)
+		s.recordEvent(pod, "ChaosRejected", fmt.Sprintf("Rejected %s chaos: %v", direction, err))
+		return false
+	}
+
+	// A ramp starts at its first step, the next ones are changed in place
+	var rampStatus *flow.RampStatus
+	ramp, _ := flow.GetPodChaosRamp(isIngress, pod.Annotations)
+	if ramp != nil {
+		from, _ := s.profiles.Resolve(ramp.From, isIngress)
+		if info, err = flow.RampChaos(from, info, 0, ramp.Steps, isIngress); err != nil {
+			glog.Warningf("Rejected %s chaos of %s/%s: %v", direction, pod.Namespace, pod.Name, err)
+			flow.SetPodChaosRejected(isIngress, err.Error(), pod.Annotations)
+			s.recordEvent(pod, "ChaosRejected", fmt.Sprintf("Rejected %s chaos: %v", direction, err))
+			return false
+		}
+		rampStatus = &flow.RampStatus{Phase: flow.RampUp, Steps: ramp.Steps, Started: time.Now().UTC().Format(time.RFC3339)}
+	}
+
+	if isIngress {
+		err = doIngressChaos(shaper, iface, cidr, info)
+	} else {
+		err = doEgressChaos(shaper, iface, cidr, info)
+	}
+	if err != nil {
+		glog.Errorf("Failed to apply %s chaos of %s/%s: %v", direction, pod.Namespace, pod.Name, err)
+		return false
+	}
+	flow.SetEffectiveChaos(isIngress, info, pod.Annotations)
+	flow.SetPodRampStatus(isIngress, rampStatus, pod.Annotations)
+	s.setUnderChaos(pod, direction)
+	return true
+}
+
+// Apply or clear the pod's DNS chaos rules, only clearing if hold is set, return false if
+// nothing was done
+func (s *podSyncer) dnsPod(pod *v1.Pod, hold bool) bool {
+	spec, needUpdate, needClear := flow.GetPodDNSChaos(pod.Annotations)
+	if needClear {
+		if err := s.dns.remove(pod.UID, s.dnsTarget(pod)); err != nil {
+			glog.Errorf("Failed to clear dns chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+			return false
+		}
+		glog.Infof("Cleared dns chaos of %s/%s", pod.Namespace, pod.Name)
+		flow.ClearPodDNSChaos(pod.Annotations)
+		return true
+	}
+
+	if !needUpdate {
+		// Redirected again after the daemon restarted
+		if flow.IsPodDNSChaosDone(pod.Annotations) && !s.dns.redirected(pod.UID) {
+			rules, err := dns.ParseRules(spec)
+			if err == nil {
+				err = s.dns.set(pod.UID, s.dnsTarget(pod), rules)
 			}
+			if err != nil {
+				glog.Errorf("Failed to apply dns chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+		}
+		return false
+	}
+	if hold {
+		return false
+	}
 
-			if egressNeedUpdate {
-				if !egressNeedClear {
-					// Create egress mirroring
-					if err := shaper.ReconcileEgressMirroring(cidr); err != nil {
-						glog.Errorf("Failed to mirror veth(%s) to ifb0: %v", workload.Spec.InterfaceName, err)
-					}
+	return s.checkOwner(pod, "dns chaos", func(pods []v1.Pod) bool {
+		rules, err := flow.CheckPodDNSChaos(pod, spec, s.guards, pods)
+		if err != nil {
+			glog.Warningf("Rejected dns chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+			flow.SetPodDNSChaosRejected(err.Error(), pod.Annotations)
+			s.recordEvent(pod, "ChaosRejected", fmt.Sprintf("Rejected dns chaos: %v", err))
+			return true
+		}
+		if err := s.dns.set(pod.UID, s.dnsTarget(pod), rules); err != nil {
+			glog.Errorf("Failed to apply dns chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+			return false
+		}
+		glog.Infof("Applied dns chaos of %s/%s: %s", pod.Namespace, pod.Name, spec)
+		flow.SetPodDNSChaosDone(pod.Annotations)
+		s.setUnderChaos(pod, "dns")
+		return true
+	})
+}
 
-					// First clear interface
-					shaper.ClearEgressInterface()
+// Apply or clear the pod's HTTP chaos rules, only clearing if hold is set, return false if
+// nothing was done
+func (s *podSyncer) httpPod(pod *v1.Pod, hold bool) bool {
+	spec, needUpdate, needClear := flow.GetPodHTTPChaos(pod.Annotations)
+	if needClear {
+		if err := s.http.remove(pod.UID, s.httpTarget(pod)); err != nil {
+			glog.Errorf("Failed to clear http chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+			return false
+		}
+		glog.Infof("Cleared http chaos of %s/%s", pod.Namespace, pod.Name)
+		flow.ClearPodHTTPChaos(pod.Annotations)
+		return true
+	}
 
-					// Config pod interface  qdisc, and mirror to ifb
-					if err := shaper.ReconcileEgressInterface(); err != nil {
-						glog.Errorf("Failed to init veth(%s): %v", workload.Spec.InterfaceName, err)
-					}
+	if !needUpdate {
+		// Redirected again after the daemon restarted, the proxies are gone
+		if flow.IsPodHTTPChaosDone(pod.Annotations) && !s.http.redirected(pod.UID) {
+			rules, err := httpchaos.ParseRules(spec)
+			if err == nil {
+				err = s.http.set(pod.UID, s.httpTarget(pod), rules)
+			}
+			if err != nil {
+				glog.Errorf("Failed to apply http chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+		}
+		return false
+	}
+	if hold {
+		return false
+	}
 
-					if err := shaper.ReconcileEgressCIDR(cidr, egressChaosInfo); err != nil {
-						glog.Errorf("Failed to reconcile CIDR %s: %v", cidr, err)
-					}
-					glog.V(4).Infof("reconcile cidr %s with egressChaosInfo %s ", cidr, egressChaosInfo)
-
-					// Execute tc command in egress
-					shaper.ExecTcChaos(false, egressChaosInfo)
-				} else {
-					// Clear egress mirroring
-					err := flow.ClearEgressMirroring(workload.Spec.InterfaceName)
-					if err != nil {
-						glog.Errorf("Fail to clear egress mirroring: %s", err)
-					}
-					// Clear egress ifb class
-					err = flow.Reset(cidr, fmt.Sprintf("ifb%d", firstIFB))
-					if err != nil {
-						glog.Errorf("Fail to clear egress ifb class: %s", err)
-					}
-				}
+	return s.checkOwner(pod, "http chaos", func(pods []v1.Pod) bool {
+		rules, err := flow.CheckPodHTTPChaos(pod, spec, s.guards, pods)
+		if err != nil {
+			glog.Warningf("Rejected http chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+			flow.SetPodHTTPChaosRejected(err.Error(), pod.Annotations)
+			s.recordEvent(pod, "ChaosRejected", fmt.Sprintf("Rejected http chaos: %v", err))
+			return true
+		}
+		if err := s.http.set(pod.UID, s.httpTarget(pod), rules); err != nil {
+			glog.Errorf("Failed to apply http chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+			return false
+		}
+		glog.Infof("Applied http chaos of %s/%s: %s", pod.Namespace, pod.Name, spec)
+		flow.SetPodHTTPChaosDone(pod.Annotations)
+		s.setUnderChaos(pod, "http")
+		return true
+	})
+}
 
+// Where the pod's requests are redirected, with a process of the first running container
+func (s *podSyncer) httpTarget(pod *v1.Pod) httpTarget {
+	target := httpTarget{podIP: pod.Status.PodIP, hostIP: pod.Status.HostIP}
+	if pid, err := containerPID(s.processes, pod, ""); err == nil {
+		target.pid = pid
+	}
+	return target
+}
+
+// Where the pod's DNS queries are redirected from
+func (s *podSyncer) dnsTarget(pod *v1.Pod) dnsTarget {
+	workload := calico.GetWorkload(pod.Namespace, pod.Spec.NodeName, pod.Name, s.endpoint)
+	return dnsTarget{iface: workload.Spec.InterfaceName, hostIP: pod.Status.HostIP, podIP: pod.Status.PodIP}
+}
+
+// Move the ramps of the pod's applied chaos settings to their current step,
+// return false if none of them moved
+func (s *podSyncer) rampPod(pod *v1.Pod) bool {
+	changed := false
+	cidr := fmt.Sprintf("%s/32", pod.Status.PodIP)
+	for _, isIngress := range []bool{true, false} {
+		direction := "egress"
+		if isIngress {
+			direction = "ingress"
+		}
+		if pod.Annotations["kubernetes.io/done-"+direction+"-chaos"] != "yes" {
+			continue
+		}
+		status, err := flow.GetPodRampStatus(isIngress, pod.Annotations)
+		if err != nil || status == nil || status.Phase == flow.RampDone {
+			continue
+		}
+		ramp, err := flow.GetPodChaosRamp(isIngress, pod.Annotations)
+		if err != nil || ramp == nil {
+			continue
+		}
+		started, err := time.Parse(time.RFC3339, status.Started)
+		if err != nil {
+			glog.Errorf("Invalid %s ramp status of %s/%s: %v", direction, pod.Namespace, pod.Name, err)
+			continue
+		}
+		phase, step := ramp.At(time.Since(started))
+		if phase == status.Phase && step == status.Step {
+			continue
+		}
+
+		target, err := s.profiles.Resolve(pod.Annotations["kubernetes.io/"+direction+"-chaos"], isIngress)
+		var from, info string
+		if err == nil {
+			from, err = s.profiles.Resolve(ramp.From, isIngress)
+		}
+		if err == nil {
+			info, err = flow.RampChaos(from, target, step, ramp.Steps, isIngress)
+		}
+		if err == nil && info != flow.GetEffectiveChaos(isIngress, pod.Annotations) {
+			err = flow.ChangeChaos(cidr, isIngress, info, s.pool)
+		}
+		if err != nil {
+			glog.Errorf("Failed to ramp %s chaos of %s/%s: %v", direction, pod.Namespace, pod.Name, err)
+			continue
+		}
+		glog.Infof("Ramped %s chaos of %s/%s %s to step %d/%d: %s", direction, pod.Namespace, pod.Name, phase, step, ramp.Steps, info)
+		flow.SetEffectiveChaos(isIngress, info, pod.Annotations)
+		flow.SetPodRampStatus(isIngress, &flow.RampStatus{Phase: phase, Step: step, Steps: ramp.Steps, Started: status.Started}, pod.Annotations)
+		changed = true
+	}
+	return changed
+}
+
+// Kill the pod or one of its containers when its failure is due, with the failure's chance,
+// return whether the annotations changed and whether the pod was deleted
+func (s *podSyncer) failPod(pod *v1.Pod) (bool, bool) {
+	failure, err := flow.GetPodFailure(pod.Annotations)
+	if err != nil {
+		glog.Errorf("Invalid pod failure of %s/%s: %v", pod.Namespace, pod.Name, err)
+		return false, false
+	}
+	if failure == nil {
+		return false, false
+	}
+	// The first chance is an interval after the failure is seen
+	now := time.Now()
+	last := flow.GetPodFailureLast(pod.Annotations)
+	if !last.IsZero() && now.Sub(last) < failure.Interval {
+		return false, false
+	}
+	flow.SetPodFailureLast(now, pod.Annotations)
+	if last.IsZero() || !s.chance.hit(failure.Percent) {
+		return true, false
+	}
+
+	deleted := s.checkOwner(pod, "pod failure", func(pods []v1.Pod) bool {
+		if err := flow.CheckPodFailure(pod, failure, s.guards, pods); err != nil {
+			glog.Warningf("Rejected pod failure of %s/%s: %v", pod.Namespace, pod.Name, err)
+			s.recordEvent(pod, "ChaosRejected", fmt.Sprintf("Rejected pod failure: %v", err))
+			return false
+		}
+
+		if failure.Action == flow.FailureDelete {
+			options := &meta_v1.DeleteOptions{GracePeriodSeconds: failure.GracePeriod}
+			if err := s.clientset.CoreV1().Pods(pod.Namespace).Delete(pod.Name, options); err != nil {
+				glog.Errorf("Failed to delete pod %s/%s: %v", pod.Namespace, pod.Name, err)
+				return false
 			}
+			glog.Infof("Deleted pod %s/%s", pod.Namespace, pod.Name)
+			s.recordEvent(pod, "ChaosPodKilled", "Deleted pod")
+			s.setNotReady(pod)
+			return true
+		}
 
-			// Update chaos-done flag
-			pod.SetAnnotations(flow.SetPodChaosUpdated(ingressNeedUpdate, egressNeedUpdate, ingressNeedClear, egressNeedClear, pod.Annotations))
-			clientset.CoreV1().Pods(pod.Namespace).UpdateStatus(pod.DeepCopy())
+		name, pid, err := s.killContainer(pod, failure)
+		if err != nil {
+			glog.Errorf("Failed to kill container of %s/%s: %v", pod.Namespace, pod.Name, err)
+			return false
+		}
+		glog.Infof("Sent %s to container %s of %s/%s, pid %d", failure.Signal, name, pod.Namespace, pod.Name, pid)
+		s.recordEvent(pod, "ChaosContainerKilled", fmt.Sprintf("Sent %s to container %s", failure.Signal, name))
+		s.setNotReady(pod)
+		return false
+	})
+	return !deleted, deleted
+}
 
+// The main process of the named container, of the first running one if name is empty
+func containerPID(processes *container.Processes, pod *v1.Pod, name string) (int, error) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if name != "" && status.Name != name {
+			continue
 		}
-		// Delete chaos on pods not labeled
-		if err := flow.DeleteExtraChaos(egressPodsCIDRs, ingressPodsCIDRs, firstIFB, secondIFB); err != nil {
-			glog.Errorf("Failed to delete extra chaos: %v", err)
+		if status.State.Running == nil {
+			if name != "" {
+				return 0, fmt.Errorf("container %s is not running", name)
+			}
+			continue
+		}
+		id, err := container.ParseContainerID(status.ContainerID)
+		if err != nil {
+			return 0, err
 		}
+		return processes.MainPID(id)
+	}
+	if name != "" {
+		return 0, fmt.Errorf("container %s not found", name)
+	}
+	return 0, fmt.Errorf("no container is running")
+}
 
-		//elapsed:=time.Since(now)
-		//glog.Infof("iteration time used: %v",elapsed)
+// Send the failure's signal to the main process of the container, return the container's name
+// and the process killed
+func (s *podSyncer) killContainer(pod *v1.Pod, failure *flow.PodFailure) (string, int, error) {
+	name := failure.Container
+	if name == "" && len(pod.Spec.Containers) > 0 {
+		name = pod.Spec.Containers[0].Name
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != name {
+			continue
+		}
+		if status.State.Running == nil {
+			return name, 0, fmt.Errorf("container %s is not running", name)
+		}
+		id, err := container.ParseContainerID(status.ContainerID)
+		if err != nil {
+			return name, 0, err
+		}
+		signal, err := container.ParseSignal(failure.Signal)
+		if err != nil {
+			return name, 0, err
+		}
+		pid, err := s.processes.Kill(id, signal)
+		return name, pid, err
+	}
+	return name, 0, fmt.Errorf("container %s not found", name)
+}
 
-		// Flush log
-		glog.Flush()
-		// Sleep to avoid high CPU usage
-		time.Sleep(time.Duration(syncDuration) * time.Second)
+// Clear the faults of a pod whose schedule ended, they are applied again in the next window
+func (s *podSyncer) deactivatePod(pod *v1.Pod) {
+	workload := calico.GetWorkload(pod.Namespace, pod.Spec.NodeName, pod.Name, s.endpoint)
+	cidr := fmt.Sprintf("%s/32", pod.Status.PodIP)
+	if pod.Annotations["kubernetes.io/done-ingress-chaos"] == "yes" {
+		clearIngressChaos(workload.Spec.InterfaceName, cidr, s.pool)
+	}
+	if pod.Annotations["kubernetes.io/done-egress-chaos"] == "yes" {
+		clearEgressChaos(workload.Spec.InterfaceName, cidr, s.pool)
+	}
+	if flow.IsPodDNSChaosDone(pod.Annotations) {
+		target := dnsTarget{iface: workload.Spec.InterfaceName, hostIP: pod.Status.HostIP, podIP: pod.Status.PodIP}
+		if err := s.dns.remove(pod.UID, target); err != nil {
+			glog.Errorf("Failed to clear dns chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+	if flow.IsPodHTTPChaosDone(pod.Annotations) {
+		if err := s.http.remove(pod.UID, s.httpTarget(pod)); err != nil {
+			glog.Errorf("Failed to clear http chaos of %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+	flow.SetPodChaosPending(pod.Annotations)
+	glog.Infof("Chaos of %s/%s deactivated until its next window", pod.Namespace, pod.Name)
+}
+
+// Stop the pod's faults until its next window and remove their status, so they start again
+// then, return false if it had none
+func (s *podSyncer) deactivateFaults(pod *v1.Pod) bool {
+	changed := false
+	for _, fault := range s.faults {
+		kind := fault.kind()
+		status, _ := kind.GetStatus(pod.Annotations)
+		if status == nil {
+			continue
+		}
+		if status.Active {
+			if err := fault.stop(pod, status.Target); err != nil {
+				glog.Errorf("Failed to stop the %s of %s/%s: %v", kind.Kind, pod.Namespace, pod.Name, err)
+				continue
+			}
+			glog.Infof("Stopped the %s of %s/%s until its next window", kind.Kind, pod.Namespace, pod.Name)
+		}
+		kind.SetStatus(nil, pod.Annotations)
+		changed = true
+	}
+	return changed
+}
+
+// Clear the faults of a pod whose schedule is invalid and reject its pending settings,
+// return false if nothing was done
+func (s *podSyncer) rejectSchedule(pod *v1.Pod, err error) bool {
+	changed := false
+	if flow.IsPodUnderChaos(pod.Annotations) {
+		s.deactivatePod(pod)
+		changed = true
+	}
+	_, _, ingressNeedUpdate, egressNeedUpdate, _ := flow.ExtractPodChaosInfo(pod.Annotations)
+	ingressNeedClear, egressNeedClear := flow.GetClearFlag(pod.Annotations)
+	reason := fmt.Sprintf("invalid schedule: %v", err)
+	for _, isIngress := range []bool{true, false} {
+		needUpdate, needClear, direction := egressNeedUpdate, egressNeedClear, "egress"
+		if isIngress {
+			needUpdate, needClear, direction = ingressNeedUpdate, ingressNeedClear, "ingress"
+		}
+		// Clearing doesn't need the schedule
+		if !needUpdate || needClear {
+			continue
+		}
+		glog.Warningf("Rejected %s chaos of %s/%s: %s", direction, pod.Namespace, pod.Name, reason)
+		flow.SetPodChaosRejected(isIngress, reason, pod.Annotations)
+		s.recordEvent(pod, "ChaosRejected", fmt.Sprintf("Rejected %s chaos: %s", direction, reason))
+		changed = true
+	}
+	return changed
+}
+
+// Pods of the namespace, listed once per round
+func (s *podSyncer) listNamespacePods(namespace string) ([]v1.Pod, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pods, found := s.namespacePods[namespace]; found {
+		return pods, nil
+	}
+	list, err := s.clientset.CoreV1().Pods(namespace).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	s.namespacePods[namespace] = list.Items
+	return list.Items, nil
+}
+
+// Count the pod as under chaos for the rest of the round
+func (s *podSyncer) setUnderChaos(pod *v1.Pod, direction string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pods := s.namespacePods[pod.Namespace]
+	for i := range pods {
+		if pods[i].UID == pod.UID {
+			annotations := map[string]string{}
+			for key, value := range pods[i].Annotations {
+				annotations[key] = value
+			}
+			annotations["kubernetes.io/done-"+direction+"-chaos"] = "yes"
+			pods[i].Annotations = annotations
+		}
 	}
+}
+
+// Count the pod as not ready for the rest of the round
+func (s *podSyncer) setNotReady(pod *v1.Pod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pods := s.namespacePods[pod.Namespace]
+	for i := range pods {
+		if pods[i].UID == pod.UID {
+			pods[i].Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionFalse}}
+		}
+	}
+}
+
+// Random numbers shared by the workers
+type lockedRand struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// Whether a chance of percent hits
+func (r *lockedRand) hit(percent float64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Float64()*100 < percent
+}
+
+// Record a warning event on the pod
+func (s *podSyncer) recordEvent(pod *v1.Pod, reason, message string) {
+	s.createEvent(v1.ObjectReference{
+		Kind:            "Pod",
+		APIVersion:      "v1",
+		Namespace:       pod.Namespace,
+		Name:            pod.Name,
+		UID:             pod.UID,
+		ResourceVersion: pod.ResourceVersion,
+	}, reason, message)
+}
+
+// Record a warning event on the node
+func (s *podSyncer) recordNodeEvent(node *v1.Node, reason, message string) {
+	s.createEvent(v1.ObjectReference{
+		Kind:       "Node",
+		APIVersion: "v1",
+		Name:       node.Name,
+		UID:        node.UID,
+	}, reason, message)
+}
+
+// Events of cluster-scoped objects go to the default namespace
+func (s *podSyncer) createEvent(object v1.ObjectReference, reason, message string) {
+	namespace := object.Namespace
+	if namespace == "" {
+		namespace = meta_v1.NamespaceDefault
+	}
+	now := meta_v1.Now()
+	event := &v1.Event{
+		ObjectMeta:     meta_v1.ObjectMeta{GenerateName: object.Name + ".", Namespace: namespace},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Type:           v1.EventTypeWarning,
+		Source:         v1.EventSource{Component: "kube-chaos", Host: s.hostname},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := s.clientset.CoreV1().Events(event.Namespace).Create(event); err != nil {
+		glog.Errorf("Failed to record event on %s %s: %v", object.Kind, object.Name, err)
+	}
+}
+
+// Clear the ifb devices and the pods' mirroring, and update the pods' annotations
+func clearNodeChaos(clientset *kubernetes.Clientset, pool *flow.IfbPool, endpoint string, pods []v1.Pod, update func(annotations map[string]string)) {
+	// First close the ifb of node
+	err := pool.Clear()
+	if err != nil {
+		glog.Error(err)
+	}
+
+	// Then clean each pod
+	for _, pod := range pods {
+		// Get network card name
+		workload := calico.GetWorkload(pod.Namespace, pod.Spec.NodeName, pod.Name, endpoint)
+
+		// Clear network card settings
+		err = flow.ClearIngressMirroring(workload.Spec.InterfaceName)
+		if err != nil {
+			glog.Errorf("Fail to clear pod %s's ingress settings: %s", pod.Name, err)
+		}
+		err = flow.ClearEgressMirroring(workload.Spec.InterfaceName)
+		if err != nil {
+			glog.Errorf("Fail to clear pod %s's egress settings: %s", pod.Name, err)
+		}
+
+		// Update Pod flag
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		update(pod.Annotations)
+		clientset.CoreV1().Pods(pod.Namespace).UpdateStatus(pod.DeepCopy())
+
+		glog.Infof("Pod %s cleared", pod.Name)
+	}
+}
+
+// The cluster-wide state and guards from the control ConfigMap, the defaults if it does
+// not exist. If it cannot be read the last guards are kept, and so is the last state if it
+// stopped chaos, otherwise chaos is paused until it can be read
+func loadControl(clientset *kubernetes.Clientset, controlMap, lastState string, lastGuards *flow.Guards) (string, *flow.Guards) {
+	if controlMap == "" {
+		return flow.ControlRunning, flow.DefaultGuards()
+	}
+	data, err := flow.GetConfigMapData(clientset, controlMap)
+	if err != nil {
+		glog.Errorf("Failed get control ConfigMap %s: %v", controlMap, err)
+		if lastState == flow.ControlAbort {
+			return lastState, lastGuards
+		}
+		return flow.ControlPaused, lastGuards
+	}
+	state, err := flow.ParseControlState(data)
+	if err != nil {
+		glog.Errorf("ConfigMap %s: %v", controlMap, err)
+	}
+	guards, err := flow.ParseGuards(data)
+	if err != nil {
+		glog.Errorf("ConfigMap %s: %v", controlMap, err)
+	}
+	return state, guards
+}
 
+// The built-in profiles and the ones of the ConfigMap, which may not exist. If it cannot be
+// read the last ones, nil if it has never been read
+func loadProfiles(clientset *kubernetes.Clientset, profileMap string, last flow.Profiles) flow.Profiles {
+	if profileMap == "" {
+		return flow.BuiltinProfiles()
+	}
+	data, err := flow.GetConfigMapData(clientset, profileMap)
+	if err != nil {
+		glog.Errorf("Failed get profile ConfigMap %s: %v", profileMap, err)
+		return last
+	}
+	profiles, err := flow.LoadProfiles(data)
+	if err != nil {
+		glog.Errorf("ConfigMap %s: %v", profileMap, err)
+	}
+	return profiles
+}
+
+// Mirror the pod's ingress traffic to ifb and apply the chaos settings
+func doIngressChaos(shaper flow.Shaper, iface, cidr, info string) error {
+	// Queue the tc changes, so they are applied or rolled back as a whole
+	shaper.Begin()
+
+	// Create ingress mirroring
+	if err := shaper.ReconcileIngressMirroring(cidr); err != nil {
+		glog.Errorf("Failed to mirror veth(%s) to ingress ifb: %v", iface, err)
+	}
+
+	// First clear interface
+	shaper.ClearIngressInterface()
+
+	// Config pod interface  qdisc
+	if err := shaper.ReconcileIngressInterface(); err != nil {
+		glog.Errorf("Failed to init veth(%s): %v", iface, err)
+	}
+
+	if err := shaper.ReconcileIngressCIDR(cidr, info); err != nil {
+		glog.Errorf("Failed to reconcile CIDR %s: %v", cidr, err)
+	}
+	glog.V(4).Infof("reconcile cidr %s with ingressChaosInfo %s ", cidr, info)
+
+	// Execute tc command in ingress
+	if err := shaper.ExecTcChaos(true, info); err != nil {
+		glog.Errorf("Failed to execute ingress chaos %s: %v", info, err)
+	}
+
+	return shaper.Commit()
+}
+
+// Mirror the pod's egress traffic to ifb and apply the chaos settings
+func doEgressChaos(shaper flow.Shaper, iface, cidr, info string) error {
+	// Queue the tc changes, so they are applied or rolled back as a whole
+	shaper.Begin()
+
+	// Create egress mirroring
+	if err := shaper.ReconcileEgressMirroring(cidr); err != nil {
+		glog.Errorf("Failed to mirror veth(%s) to egress ifb: %v", iface, err)
+	}
+
+	// First clear interface
+	shaper.ClearEgressInterface()
+
+	// Config pod interface  qdisc, and mirror to ifb
+	if err := shaper.ReconcileEgressInterface(); err != nil {
+		glog.Errorf("Failed to init veth(%s): %v", iface, err)
+	}
+
+	if err := shaper.ReconcileEgressCIDR(cidr, info); err != nil {
+		glog.Errorf("Failed to reconcile CIDR %s: %v", cidr, err)
+	}
+	glog.V(4).Infof("reconcile cidr %s with egressChaosInfo %s ", cidr, info)
+
+	// Execute tc command in egress
+	if err := shaper.ExecTcChaos(false, info); err != nil {
+		glog.Errorf("Failed to execute egress chaos %s: %v", info, err)
+	}
+
+	return shaper.Commit()
+}
+
+// Remove the ingress mirroring of the interface and the pod's ifb class
+func clearIngressChaos(iface, cidr string, pool *flow.IfbPool) {
+	// Clear ingress mirroring
+	err := flow.ClearIngressMirroring(iface)
+	if err != nil {
+		glog.Errorf("Fail to clear ingress mirroring: %s", err)
+	}
+	// Clear ingress ifb class
+	err = pool.Reset(cidr, true)
+	if err != nil {
+		glog.Errorf("Fail to clear ingress ifb class: %s", err)
+	}
+}
+
+// Remove the egress mirroring of the interface and the pod's ifb class
+func clearEgressChaos(iface, cidr string, pool *flow.IfbPool) {
+	// Clear egress mirroring
+	err := flow.ClearEgressMirroring(iface)
+	if err != nil {
+		glog.Errorf("Fail to clear egress mirroring: %s", err)
+	}
+	// Clear egress ifb class
+	err = pool.Reset(cidr, false)
+	if err != nil {
+		glog.Errorf("Fail to clear egress ifb class: %s", err)
+	}
 }
@@ -0,0 +1,185 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+)
+
+// localState records what "local" mode has set up, so that "local --clear" can undo it
+type localState struct {
+	Iface     string
+	IP        string
+	FirstIFB  int
+	SecondIFB int
+}
+
+// A single pod never needs more than the first and second ifb
+const (
+	maxPodsPerIFB = 1
+	maxIFB        = 1
+)
+
+// Run the shaper against a single interface and IP, without kubeconfig, Calico or etcd
+func runLocal(args []string) {
+	var (
+		iface     string
+		ip        string
+		ingress   string
+		egress    string
+		firstIFB  int
+		secondIFB int
+		clear     bool
+		stateFile string
+	)
+
+	flag.StringVar(&iface, "iface", "", "the interface to do chaos on, e.g. veth0")
+	flag.StringVar(&ip, "ip", "", "the IP address behind the interface, e.g. 10.0.0.2")
+	flag.StringVar(&ingress, "ingress", "", "ingress chaos settings, same format as kubernetes.io/ingress-chaos, e.g. 100kbps,delay,100ms or profile:3g")
+	flag.StringVar(&egress, "egress", "", "egress chaos settings, same format as kubernetes.io/egress-chaos, e.g. 100kbps,delay,100ms or profile:3g")
+	flag.IntVar(&firstIFB, "firstIFB", 0, "first available ifb, default 0 e.g. 2")
+	flag.IntVar(&secondIFB, "secondIFB", 1, "second available ifb, default 1 e.g. 4")
+	flag.BoolVar(&clear, "clear", false, "clear the chaos settings made by a previous run")
+	flag.StringVar(&stateFile, "state-file", "/var/run/kube-chaos-local.json", "file recording the interface and IP of the last run, used by --clear")
+	// Parse into the global flag set, so glog's flags also work in local mode
+	flag.CommandLine.Parse(args)
+	defer glog.Flush()
+
+	if clear {
+		// Fall back to the last run for anything not given on the command line
+		state, err := readLocalState(stateFile)
+		if err != nil {
+			glog.Warningf("Failed to read local state: %v", err)
+		}
+		if iface == "" {
+			iface = state.Iface
+		}
+		if ip == "" {
+			ip = state.IP
+		}
+		if !isFlagSet("firstIFB") && state.Iface != "" {
+			firstIFB = state.FirstIFB
+		}
+		if !isFlagSet("secondIFB") && state.Iface != "" {
+			secondIFB = state.SecondIFB
+		}
+		if iface == "" || net.ParseIP(ip) == nil {
+			exitLocal(fmt.Errorf("--iface and a valid --ip are required, none recorded in %s", stateFile))
+		}
+		cidr := fmt.Sprintf("%s/32", ip)
+
+		pool := flow.NewIfbPool(firstIFB, secondIFB, maxPodsPerIFB, maxIFB)
+		if err := pool.Load(); err != nil {
+			exitLocal(fmt.Errorf("failed to find ifb devices: %v", err))
+		}
+		clearIngressChaos(iface, cidr, pool)
+		clearEgressChaos(iface, cidr, pool)
+		if err := pool.Clear(); err != nil {
+			glog.Errorf("Failed to clear ifb: %v", err)
+		}
+		os.Remove(stateFile)
+		glog.Infof("Local chaos on %s(%s) cleared", iface, ip)
+		return
+	}
+
+	if iface == "" {
+		exitLocal(fmt.Errorf("--iface is required"))
+	}
+	if net.ParseIP(ip) == nil {
+		exitLocal(fmt.Errorf("invalid --ip %q", ip))
+	}
+	if ingress == "" && egress == "" {
+		exitLocal(fmt.Errorf("at least one of --ingress and --egress is required"))
+	}
+	cidr := fmt.Sprintf("%s/32", ip)
+
+	// Init ifb module
+	pool := flow.NewIfbPool(firstIFB, secondIFB, maxPodsPerIFB, maxIFB)
+	if err := pool.Init(); err != nil {
+		exitLocal(fmt.Errorf("failed init ifb: %v", err))
+	}
+
+	if err := writeLocalState(stateFile, localState{Iface: iface, IP: ip, FirstIFB: firstIFB, SecondIFB: secondIFB}); err != nil {
+		glog.Warningf("Failed to write local state: %v", err)
+	}
+
+	// Only the built-in profiles are known without Kubernetes
+	profiles := flow.BuiltinProfiles()
+	shaper := flow.NewTCShaper(iface, pool)
+	if ingress != "" {
+		ingress, err := profiles.Resolve(ingress, true)
+		if err != nil {
+			exitLocal(err)
+		}
+		if err := doIngressChaos(shaper, iface, cidr, ingress); err != nil {
+			exitLocal(fmt.Errorf("failed to apply ingress chaos: %v", err))
+		}
+	}
+	if egress != "" {
+		egress, err := profiles.Resolve(egress, false)
+		if err != nil {
+			exitLocal(err)
+		}
+		if err := doEgressChaos(shaper, iface, cidr, egress); err != nil {
+			exitLocal(fmt.Errorf("failed to apply egress chaos: %v", err))
+		}
+	}
+	glog.Infof("Local chaos on %s(%s) applied", iface, ip)
+}
+
+func isFlagSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+func readLocalState(path string) (localState, error) {
+	state := localState{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func writeLocalState(path string, state localState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func exitLocal(err error) {
+	glog.Error(err)
+	glog.Flush()
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The node chaos the daemon applied, kept across rounds so the peers are followed and the
+// interface is cleared when the chaos is removed or aborted, or the daemon stops. The shaping
+// stays on the interface if the daemon dies, the node's status tells to clear it
+type shapedNode struct {
+	pool *flow.IfbPool
+	mu   sync.Mutex
+	// What is set on the interface, nil if nothing
+	shaping *flow.NodeShaping
+	// Qdiscs of the interface installed for it
+	qdiscs []string
+	// The node is not shaped once the daemon stops
+	stopped bool
+}
+
+func newShapedNode(pool *flow.IfbPool) *shapedNode {
+	return &shapedNode{pool: pool}
+}
+
+// Shape the node's interface, unless it already is so
+func (n *shapedNode) apply(shaping *flow.NodeShaping) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	if reflect.DeepEqual(n.shaping, shaping) {
+		return nil
+	}
+	// A direction no longer shaped keeps its redirect unless the interface is cleared
+	if n.shaping != nil && (n.shaping.Iface != shaping.Iface ||
+		(n.shaping.Ingress == "") != (shaping.Ingress == "") || (n.shaping.Egress == "") != (shaping.Egress == "")) {
+		if err := flow.ClearNodeShaping(n.shaping.Iface, n.qdiscs, n.pool); err != nil {
+			return err
+		}
+		n.shaping, n.qdiscs = nil, nil
+	}
+	if err := flow.ApplyNodeShaping(shaping, n.pool); err != nil {
+		return err
+	}
+	n.shaping, n.qdiscs = shaping, flow.NodeShapingQdiscs(shaping)
+	return nil
+}
+
+// Clear the node's interface, also when it was shaped before the daemon started with the
+// qdiscs installed then
+func (n *shapedNode) clear(iface string, installed []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.shaping != nil {
+		iface, installed = n.shaping.Iface, n.qdiscs
+	}
+	if err := flow.ClearNodeShaping(iface, installed, n.pool); err != nil {
+		return err
+	}
+	n.shaping, n.qdiscs = nil, nil
+	return nil
+}
+
+// Clear the node's interface, also the one in the node's status shaped before the daemon
+// started, and shape it no more if stop is set
+func (n *shapedNode) clearAll(stop bool, node *v1.Node) {
+	iface, installed := "", []string{}
+	if node != nil {
+		if status, _ := flow.GetNodeChaosStatus(node.Annotations); status != nil && status.Applied {
+			iface, installed = status.Iface, status.Qdiscs
+		}
+	}
+	n.mu.Lock()
+	n.stopped = n.stopped || stop
+	if n.shaping != nil {
+		iface = n.shaping.Iface
+	}
+	n.mu.Unlock()
+	if iface == "" {
+		return
+	}
+	if err := n.clear(iface, installed); err != nil {
+		glog.Errorf("Failed to clear the node chaos of %s: %v", iface, err)
+		return
+	}
+	glog.Infof("Cleared the node chaos of %s", iface)
+}
+
+// Apply, keep up or end the chaos of the node's interface, and update the node's status
+func (s *podSyncer) syncNode(node *v1.Node) {
+	spec, found := node.Annotations[flow.NodeChaosAnnotation]
+	status, err := flow.GetNodeChaosStatus(node.Annotations)
+	if err != nil {
+		glog.Errorf("Invalid node chaos status of %s: %v", node.Name, err)
+	}
+	changed := false
+
+	// Chaos removed or changed ends the one in progress
+	if status != nil && (!found || status.Spec != spec) {
+		if status.Applied {
+			if err := s.shaped.clear(status.Iface, status.Qdiscs); err != nil {
+				glog.Errorf("Failed to clear the node chaos of %s: %v", status.Iface, err)
+				return
+			}
+			glog.Infof("Cleared the node chaos of %s, its settings were removed", status.Iface)
+		}
+		flow.SetNodeChaosStatus(nil, node.Annotations)
+		status, changed = nil, true
+	}
+	if found {
+		switch {
+		case status == nil && !s.paused:
+			changed = s.startNodeChaos(node, spec) || changed
+		case status != nil && status.Applied:
+			changed = s.keepNodeChaos(node, status) || changed
+		}
+	}
+	if !changed {
+		return
+	}
+	if _, err := s.clientset.CoreV1().Nodes().UpdateStatus(node.DeepCopy()); err != nil {
+		glog.Errorf("Failed to update node %s: %v", node.Name, err)
+	}
+}
+
+// Check new node chaos against the guards and shape the interface, return false if it failed
+// and is retried in the next round
+func (s *podSyncer) startNodeChaos(node *v1.Node, spec string) bool {
+	status := &flow.NodeChaosStatus{Spec: spec}
+	settings, err := flow.ParseNodeChaos(spec)
+	var ingress, egress string
+	if err == nil {
+		ingress, egress, err = flow.CheckNodeChaos(settings, s.profiles, s.guards)
+	}
+	if err != nil {
+		glog.Warningf("Rejected node chaos of %s: %v", node.Name, err)
+		s.recordNodeEvent(node, "ChaosRejected", fmt.Sprintf("Rejected node chaos: %v", err))
+		status.Rejected = err.Error()
+		flow.SetNodeChaosStatus(status, node.Annotations)
+		return true
+	}
+
+	shaping, err := s.nodeShaping(node, settings, ingress, egress)
+	if err != nil {
+		glog.Errorf("Failed to shape %s of %s: %v", settings.Iface, node.Name, err)
+		return false
+	}
+	// The qdiscs of an operator or the CNI are never replaced
+	if err := flow.CheckNodeInterface(shaping.Iface, flow.NodeShapingQdiscs(shaping)); err != nil {
+		glog.Warningf("Rejected node chaos of %s: %v", node.Name, err)
+		s.recordNodeEvent(node, "ChaosRejected", fmt.Sprintf("Rejected node chaos: %v", err))
+		status.Rejected = err.Error()
+		flow.SetNodeChaosStatus(status, node.Annotations)
+		return true
+	}
+	if err := s.shaped.apply(shaping); err != nil {
+		glog.Errorf("Failed to shape %s of %s: %v", settings.Iface, node.Name, err)
+		return false
+	}
+	status.Iface, status.Peers, status.Applied = shaping.Iface, shaping.Peers, true
+	status.Qdiscs = flow.NodeShapingQdiscs(shaping)
+	if settings.Duration > 0 {
+		status.Until = time.Now().Add(settings.Duration).UTC().Format(time.RFC3339)
+	}
+	glog.Infof("Shaping %s of %s: %s", settings.Iface, node.Name, spec)
+	s.recordNodeEvent(node, "ChaosShaped", fmt.Sprintf("Shaping %s: %s", settings.Iface, spec))
+	flow.SetNodeChaosStatus(status, node.Annotations)
+	return true
+}
+
+// Follow the peers of the node chaos in progress, or shape the interface again after the
+// daemon restarted, until the chaos ends
+func (s *podSyncer) keepNodeChaos(node *v1.Node, status *flow.NodeChaosStatus) bool {
+	until, err := time.Parse(time.RFC3339, status.Until)
+	if status.Until == "" || (err == nil && time.Now().Before(until)) {
+		settings, err := flow.ParseNodeChaos(status.Spec)
+		var ingress, egress string
+		if err == nil {
+			ingress, egress, err = flow.CheckNodeChaos(settings, s.profiles, s.guards)
+		}
+		var shaping *flow.NodeShaping
+		if err == nil {
+			shaping, err = s.nodeShaping(node, settings, ingress, egress)
+		}
+		if err == nil {
+			err = s.shaped.apply(shaping)
+		}
+		if err != nil {
+			glog.Warningf("Failed to keep up the node chaos of %s: %v", node.Name, err)
+			return false
+		}
+		if reflect.DeepEqual(status.Peers, shaping.Peers) {
+			return false
+		}
+		glog.Infof("Peers of the node chaos of %s changed: %v", node.Name, shaping.Peers)
+		status.Peers = shaping.Peers
+		flow.SetNodeChaosStatus(status, node.Annotations)
+		return true
+	}
+	if err := s.shaped.clear(status.Iface, status.Qdiscs); err != nil {
+		glog.Errorf("Failed to clear the node chaos of %s: %v", status.Iface, err)
+		return false
+	}
+	glog.Infof("Cleared the node chaos of %s", status.Iface)
+	status.Applied = false
+	flow.SetNodeChaosStatus(status, node.Annotations)
+	return true
+}
+
+// The node chaos resolved against the current peer nodes and control plane
+func (s *podSyncer) nodeShaping(node *v1.Node, settings *flow.NodeChaos, ingress, egress string) (*flow.NodeShaping, error) {
+	shaping := &flow.NodeShaping{Iface: settings.Iface, Ingress: ingress, Egress: egress, Peers: settings.Peers, ProtectedCIDRs: settings.Protect}
+	if settings.PeerNodes != "" {
+		nodes, err := s.clientset.CoreV1().Nodes().List(meta_v1.ListOptions{LabelSelector: settings.PeerNodes})
+		if err != nil {
+			return nil, err
+		}
+		peers := flow.NodePeers(nodes.Items, node.Name)
+		// Shaping all traffic instead would hit more than asked
+		if len(peers) == 0 {
+			return nil, fmt.Errorf("no other node matches %s", settings.PeerNodes)
+		}
+		shaping.Peers = append(append([]string{}, settings.Peers...), peers...)
+	}
+	if settings.ProtectControlPlane {
+		endpoints, err := s.clientset.CoreV1().Endpoints("default").Get("kubernetes", meta_v1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the API server to protect: %v", err)
+		}
+		shaping.ProtectedEndpoints = flow.ControlPlaneProtection(endpoints, s.server, node)
+	}
+	return shaping, nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Get, change and patch the claims of an owner, again if it changed in between. The patch is
+// guarded by the resourceVersion the claims were read at, so of two daemons claiming pods of
+// the owner at once, one reads the other's claim and checks again. Update returns false if
+// there is nothing to change. Nil claims if the owner is gone or of a kind that can't be got
+func (s *podSyncer) updateOwnerClaims(namespace string, owner *meta_v1.OwnerReference, update func(claims flow.OwnerClaims) bool) (flow.OwnerClaims, error) {
+	path := ownerPath(namespace, owner)
+	client := s.clientset.CoreV1().RESTClient()
+	for retries := 0; ; retries++ {
+		data, err := client.Get().AbsPath(path).DoRaw()
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		object := struct {
+			Metadata meta_v1.ObjectMeta `json:"metadata"`
+		}{}
+		if err := json.Unmarshal(data, &object); err != nil {
+			return nil, err
+		}
+		if object.Metadata.UID != owner.UID {
+			return nil, nil
+		}
+
+		claims := flow.GetOwnerClaims(object.Metadata.Annotations, time.Now())
+		if !update(claims) {
+			return claims, nil
+		}
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": object.Metadata.ResourceVersion,
+				"annotations":     map[string]string{flow.OwnerClaimsAnnotation: claims.String()},
+			},
+		})
+		err = client.Patch(types.MergePatchType).AbsPath(path).Body(patch).Do().Error()
+		if err == nil || !apierrors.IsConflict(err) || retries >= 4 {
+			return claims, err
+		}
+	}
+}
+
+// The API path of an owner, e.g. /apis/apps/v1/namespaces/default/replicasets/web
+func ownerPath(namespace string, owner *meta_v1.OwnerReference) string {
+	prefix := "/apis/" + owner.APIVersion
+	if !strings.Contains(owner.APIVersion, "/") {
+		prefix = "/api/" + owner.APIVersion
+	}
+	return fmt.Sprintf("%s/namespaces/%s/%ss/%s", prefix, namespace, strings.ToLower(owner.Kind), owner.Name)
+}
+
+// Whether the pod counts against its owner's limits for the rest of the round
+func (s *podSyncer) isDisrupted(pod *v1.Pod) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cached := range s.namespacePods[pod.Namespace] {
+		if cached.UID == pod.UID {
+			return flow.IsPodUnderChaos(cached.Annotations) || !flow.IsPodReady(&cached)
+		}
+	}
+	return false
+}
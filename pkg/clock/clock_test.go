@@ -0,0 +1,85 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeconds(t *testing.T) {
+	for _, test := range []struct {
+		offset  time.Duration
+		seconds int64
+		valid   bool
+	}{
+		{offset: -48 * time.Hour, seconds: -172800, valid: true},
+		{offset: 90 * time.Second, seconds: 90, valid: true},
+		{offset: 0},
+		{offset: 1500 * time.Millisecond},
+	} {
+		seconds, err := Seconds(test.offset)
+		if (err == nil) != test.valid || seconds != test.seconds {
+			t.Errorf("Seconds(%v) = %d, %v, expected %d, valid %v", test.offset, seconds, err, test.seconds, test.valid)
+		}
+	}
+}
+
+func TestJump(t *testing.T) {
+	for _, test := range []struct {
+		from, to uint64
+		found    bool
+	}{
+		{from: 0x7ffd1234fec0, to: 0x7ffd0c000080, found: true},
+		{from: 0x7ffd1234fec0, to: 0x7ffd1234f840, found: true},
+		{from: 0x7ffd1234fec0, to: 0x7ffc12000000},
+	} {
+		code, found := jumpCode(test.from, test.to)
+		if found != test.found {
+			t.Errorf("jumpCode(%#x, %#x) found %v, expected %v", test.from, test.to, found, test.found)
+			continue
+		}
+		if !found {
+			continue
+		}
+		if len(code) != jumpSize {
+			t.Errorf("jump of %d bytes, expected %d", len(code), jumpSize)
+		}
+		if target, found := jumpTarget(test.from, code); !found || target != test.to {
+			t.Errorf("jumpTarget = %#x, %v, expected %#x", target, found, test.to)
+		}
+	}
+	// The usual entry of a function is no jump
+	if _, found := jumpTarget(0x7ffd1234fec0, []byte{0x55, 0x48, 0x89, 0xe5, 0x41}); found {
+		t.Errorf("a function entry taken for a jump")
+	}
+}
+
+func TestCode(t *testing.T) {
+	for _, f := range functions {
+		code := f.code(-1)
+		if len(code) > codeSize {
+			t.Errorf("code of %s is %d bytes, more than %d", f.symbol, len(code), codeSize)
+		}
+		if code[len(code)-1] != 0xc3 {
+			t.Errorf("code of %s does not return", f.symbol)
+		}
+	}
+	if codeOffset+len(functions)*codeSize > pageSize || slotsOffset+len(functions)*slotSize > codeOffset {
+		t.Errorf("the page does not fit the slots and code")
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package clock offsets the real time clocks of running processes: the vDSO functions reading
+// the time are patched to jump to code making the system call instead and adding the offset,
+// the monotonic clocks are left alone.
+package clock
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Functions of the x86-64 vDSO patched, with the code replacing them
+var functions = []struct {
+	symbol string
+	code   func(seconds int64) []byte
+}{
+	{"__vdso_clock_gettime", clockGettimeCode},
+	{"__vdso_gettimeofday", gettimeofdayCode},
+	{"__vdso_time", timeCode},
+}
+
+// Layout of the page mapped into a skewed process: a magic, the address and original bytes
+// of each patched function so they can be restored by another daemon, then the code
+const (
+	pageSize    = 4096
+	magic       = "KCHAOSCK"
+	slotsOffset = 8
+	slotSize    = 24
+	codeOffset  = 128
+	codeSize    = 64
+)
+
+// The whole seconds of an offset, the nanoseconds of the clocks are not changed
+func Seconds(offset time.Duration) (int64, error) {
+	if offset == 0 || offset%time.Second != 0 {
+		return 0, fmt.Errorf("invalid offset %v, expected whole seconds", offset)
+	}
+	return int64(offset / time.Second), nil
+}
+
+// Length of the jump written over a function's entry, the entries of the vDSO functions are
+// often a jump of this length themselves
+const jumpSize = 5
+
+// jmp rel32 at from to to, false if to is out of reach
+func jumpCode(from, to uint64) ([]byte, bool) {
+	offset := int64(to - from - jumpSize)
+	if offset != int64(int32(offset)) {
+		return nil, false
+	}
+	code := []byte{0xe9, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(code[1:], uint32(int32(offset)))
+	return code, true
+}
+
+// The target of the jump at from, false if the code is not one
+func jumpTarget(from uint64, code []byte) (uint64, bool) {
+	if len(code) < jumpSize || code[0] != 0xe9 {
+		return 0, false
+	}
+	return from + jumpSize + uint64(int64(int32(binary.LittleEndian.Uint32(code[1:])))), true
+}
+
+// clock_gettime(clock, ts) through the system call, adding the seconds to the realtime clocks
+func clockGettimeCode(seconds int64) []byte {
+	code := []byte{
+		0x48, 0xc7, 0xc0, 0xe4, 0x00, 0x00, 0x00, // mov rax, 228
+		0x0f, 0x05, // syscall
+		0x48, 0x85, 0xc0, // test rax, rax
+		0x75, 0x1c, // jnz done
+		0x83, 0xff, 0x00, // cmp edi, CLOCK_REALTIME
+		0x74, 0x0a, // je add
+		0x83, 0xff, 0x05, // cmp edi, CLOCK_REALTIME_COARSE
+		0x74, 0x05, // je add
+		0x83, 0xff, 0x0b, // cmp edi, CLOCK_TAI
+		0x75, 0x0d, // jne done
+		0x49, 0xbb, 0, 0, 0, 0, 0, 0, 0, 0, // add: movabs r11, seconds
+		0x4c, 0x01, 0x1e, // add [rsi], r11
+		0xc3, // done: ret
+	}
+	binary.LittleEndian.PutUint64(code[31:39], uint64(seconds))
+	return code
+}
+
+// gettimeofday(tv, tz) through the system call, adding the seconds to tv
+func gettimeofdayCode(seconds int64) []byte {
+	code := []byte{
+		0x48, 0xc7, 0xc0, 0x60, 0x00, 0x00, 0x00, // mov rax, 96
+		0x0f, 0x05, // syscall
+		0x48, 0x85, 0xc0, // test rax, rax
+		0x75, 0x12, // jnz done
+		0x48, 0x85, 0xff, // test rdi, rdi
+		0x74, 0x0d, // jz done
+		0x49, 0xbb, 0, 0, 0, 0, 0, 0, 0, 0, // movabs r11, seconds
+		0x4c, 0x01, 0x1f, // add [rdi], r11
+		0xc3, // done: ret
+	}
+	binary.LittleEndian.PutUint64(code[21:29], uint64(seconds))
+	return code
+}
+
+// time(t) through the system call, adding the seconds to the result and to t
+func timeCode(seconds int64) []byte {
+	code := []byte{
+		0x48, 0xc7, 0xc0, 0xc9, 0x00, 0x00, 0x00, // mov rax, 201
+		0x0f, 0x05, // syscall
+		0x49, 0xbb, 0, 0, 0, 0, 0, 0, 0, 0, // movabs r11, seconds
+		0x4c, 0x01, 0xd8, // add rax, r11
+		0x48, 0x85, 0xff, // test rdi, rdi
+		0x74, 0x03, // jz done
+		0x48, 0x89, 0x07, // mov [rdi], rax
+		0xc3, // done: ret
+	}
+	binary.LittleEndian.PutUint64(code[11:19], uint64(seconds))
+	return code
+}
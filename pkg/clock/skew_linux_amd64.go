@@ -0,0 +1,463 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clock
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// Skewer offsets the clocks of processes by patching their vDSO through ptrace, all the
+// threads of a process are stopped while it is patched
+type Skewer struct {
+	procRoot string
+}
+
+// A skewer of the processes under procRoot, the host's /proc
+func NewSkewer(procRoot string) *Skewer {
+	return &Skewer{procRoot: procRoot}
+}
+
+// Offset the realtime clocks of the process by the seconds, an offset already set is replaced
+func (s *Skewer) Skew(pid int, seconds int64) error {
+	// ptrace requests are only accepted from the thread that attached
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	t, err := seize(s.procRoot, pid)
+	if err != nil {
+		return err
+	}
+	defer t.detach()
+	entries, err := t.entries()
+	if err != nil {
+		return err
+	}
+	page, err := t.patchedPage(entries[0])
+	if err != nil {
+		return err
+	}
+	if page != 0 {
+		for i, f := range functions {
+			if err := t.poke(page+codeOffset+uintptr(i*codeSize), f.code(seconds)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := t.checkOutside(entries, jumpSize); err != nil {
+		return err
+	}
+	if page, err = t.mapNear(entries[0]); err != nil {
+		return err
+	}
+	data := make([]byte, pageSize)
+	copy(data, magic)
+	for i, f := range functions {
+		if entries[i] == 0 {
+			continue
+		}
+		original := make([]byte, slotSize-8)
+		if err := t.peek(entries[i], original); err != nil {
+			return err
+		}
+		slot := data[slotsOffset+i*slotSize:]
+		binary.LittleEndian.PutUint64(slot, uint64(entries[i]))
+		copy(slot[8:], original)
+		copy(data[codeOffset+i*codeSize:], f.code(seconds))
+	}
+	if err := t.poke(page, data); err != nil {
+		return err
+	}
+	// The first function is patched first, a process is skewed once it is
+	for i := range functions {
+		if entries[i] == 0 {
+			continue
+		}
+		jump, _ := jumpCode(uint64(entries[i]), uint64(page+codeOffset+uintptr(i*codeSize)))
+		if err := t.poke(entries[i], jump); err != nil {
+			return fmt.Errorf("failed to patch %s: %v", functions[i].symbol, err)
+		}
+	}
+	return nil
+}
+
+// Restore the clocks of the process, nothing is done if it is not skewed
+func (s *Skewer) Restore(pid int) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	t, err := seize(s.procRoot, pid)
+	if err != nil {
+		return err
+	}
+	defer t.detach()
+	entries, err := t.entries()
+	if err != nil {
+		return err
+	}
+	page, err := t.patchedPage(entries[0])
+	if err != nil || page == 0 {
+		return err
+	}
+	if err := t.checkOutside(entries, jumpSize); err != nil {
+		return err
+	}
+	slots := make([]byte, len(functions)*slotSize)
+	if err := t.peek(page+slotsOffset, slots); err != nil {
+		return err
+	}
+	for i := range functions {
+		slot := slots[i*slotSize:]
+		entry := uintptr(binary.LittleEndian.Uint64(slot))
+		if entry == 0 {
+			continue
+		}
+		if err := t.poke(entry, slot[8:8+jumpSize]); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", functions[i].symbol, err)
+		}
+	}
+	// A thread in the code keeps it mapped, it returns to the restored functions
+	if err := t.checkOutside([]uintptr{page}, pageSize); err != nil {
+		return nil
+	}
+	if _, err := t.syscall(unix.SYS_MUNMAP, page, pageSize); err != nil {
+		return fmt.Errorf("failed to unmap the code: %v", err)
+	}
+	return nil
+}
+
+// A process whose threads are all stopped by ptrace
+type tracee struct {
+	procRoot string
+	pid      int
+	tids     []int
+	// Signals the threads stopped with, delivered when they are detached
+	signals map[int]syscall.Signal
+}
+
+// Attach to all the threads of the process and stop them, threads started meanwhile are
+// looked for until there are none
+func seize(procRoot string, pid int) (*tracee, error) {
+	t := &tracee{procRoot: procRoot, pid: pid, signals: map[int]syscall.Signal{}}
+	seized := map[int]bool{}
+	for {
+		tids, err := t.threads()
+		if err != nil {
+			t.detach()
+			return nil, err
+		}
+		found := false
+		for _, tid := range tids {
+			if seized[tid] {
+				continue
+			}
+			seized[tid] = true
+			found = true
+			if err := ptrace(unix.PTRACE_SEIZE, tid, 0); err != nil {
+				if err == unix.ESRCH {
+					continue
+				}
+				t.detach()
+				return nil, fmt.Errorf("failed to attach to thread %d of process %d: %v", tid, pid, err)
+			}
+			if err := ptrace(unix.PTRACE_INTERRUPT, tid, 0); err != nil {
+				// Seized threads exiting are reaped by the wait
+				if err != unix.ESRCH {
+					t.detach()
+					return nil, fmt.Errorf("failed to stop thread %d of process %d: %v", tid, pid, err)
+				}
+			}
+			status, err := wait(tid)
+			if err != nil || !status.Stopped() {
+				continue
+			}
+			if !eventStop(status) {
+				t.signals[tid] = status.StopSignal()
+			}
+			t.tids = append(t.tids, tid)
+		}
+		if !found {
+			break
+		}
+	}
+	if len(t.tids) == 0 {
+		return nil, fmt.Errorf("process %d has no threads left", pid)
+	}
+	return t, nil
+}
+
+// Let the threads run again
+func (t *tracee) detach() {
+	for _, tid := range t.tids {
+		if err := ptrace(unix.PTRACE_DETACH, tid, uintptr(t.signals[tid])); err != nil && err != unix.ESRCH {
+			// A thread still attached is detached when the daemon exits
+			glog.Warningf("Failed to detach from thread %d: %v", tid, err)
+		}
+	}
+	t.tids = nil
+}
+
+func (t *tracee) threads() ([]int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(t.procRoot, strconv.Itoa(t.pid), "task"))
+	if err != nil {
+		return nil, err
+	}
+	var tids []int
+	for _, file := range files {
+		if tid, err := strconv.Atoi(file.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+// The addresses of the patched functions in the process's vDSO, zero for those it lacks
+func (t *tracee) entries() ([]uintptr, error) {
+	start, end, err := t.vdso()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, end-start)
+	if err := t.peek(start, data); err != nil {
+		return nil, fmt.Errorf("failed to read the vdso: %v", err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid vdso: %v", err)
+	}
+	var base uint64
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			base = prog.Vaddr
+			break
+		}
+	}
+	symbols, err := f.DynamicSymbols()
+	if err != nil {
+		return nil, fmt.Errorf("invalid vdso: %v", err)
+	}
+	entries := make([]uintptr, len(functions))
+	for i, function := range functions {
+		for _, symbol := range symbols {
+			if symbol.Name == function.symbol && symbol.Size >= jumpSize {
+				entries[i] = start + uintptr(symbol.Value-base)
+			}
+		}
+	}
+	if entries[0] == 0 {
+		return nil, fmt.Errorf("no %s in the vdso", functions[0].symbol)
+	}
+	return entries, nil
+}
+
+// The start and end of the process's vDSO mapping
+func (t *tracee) vdso() (uintptr, uintptr, error) {
+	f, err := os.Open(filepath.Join(t.procRoot, strconv.Itoa(t.pid), "maps"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// start-end perms offset device inode path
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[5] != "[vdso]" {
+			continue
+		}
+		bounds := strings.SplitN(fields[0], "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 16, 64)
+		if err != nil || len(bounds) != 2 {
+			return 0, 0, fmt.Errorf("invalid mapping %q", fields[0])
+		}
+		end, err := strconv.ParseUint(bounds[1], 16, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid mapping %q", fields[0])
+		}
+		return uintptr(start), uintptr(end), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("process %d has no vdso", t.pid)
+}
+
+// The page of the code the function jumps to, zero if it is not patched
+func (t *tracee) patchedPage(entry uintptr) (uintptr, error) {
+	code := make([]byte, jumpSize)
+	if err := t.peek(entry, code); err != nil {
+		return 0, err
+	}
+	target, found := jumpTarget(uint64(entry), code)
+	if !found {
+		return 0, nil
+	}
+	// The function jumps to its implementation in the vDSO unless it is patched
+	page := uintptr(target) &^ (pageSize - 1)
+	header := make([]byte, len(magic))
+	if err := t.peek(page, header); err != nil || string(header) != magic {
+		return 0, nil
+	}
+	return page, nil
+}
+
+// Map a page for the code close enough to the vDSO for its functions to jump to it
+func (t *tracee) mapNear(entry uintptr) (uintptr, error) {
+	// Below the vDSO and its data first, anywhere the kernel chooses last
+	for _, hint := range []uintptr{entry&^(pageSize-1) - 64<<20, entry&^(pageSize-1) - 1<<30, 0} {
+		page, err := t.syscall(unix.SYS_MMAP, hint, pageSize, unix.PROT_READ|unix.PROT_EXEC,
+			unix.MAP_PRIVATE|unix.MAP_ANONYMOUS, ^uintptr(0), 0)
+		if err != nil {
+			return 0, fmt.Errorf("failed to map the code: %v", err)
+		}
+		if _, found := jumpCode(uint64(entry), uint64(page+codeOffset+uintptr(len(functions)*codeSize))); found {
+			if _, found := jumpCode(uint64(entry), uint64(page)); found {
+				return page, nil
+			}
+		}
+		if _, err := t.syscall(unix.SYS_MUNMAP, page, pageSize); err != nil {
+			return 0, fmt.Errorf("failed to unmap the code: %v", err)
+		}
+	}
+	return 0, fmt.Errorf("no page could be mapped close to the vdso of process %d", t.pid)
+}
+
+// Fail if a thread is stopped within size bytes from one of the addresses, patching them
+// would break the instruction it runs
+func (t *tracee) checkOutside(addresses []uintptr, size uintptr) error {
+	for _, tid := range t.tids {
+		var regs unix.PtraceRegs
+		if err := unix.PtraceGetRegs(tid, &regs); err != nil {
+			return err
+		}
+		for _, address := range addresses {
+			if address != 0 && uintptr(regs.Rip) >= address && uintptr(regs.Rip) < address+size {
+				return fmt.Errorf("thread %d is running the patched code, retry later", tid)
+			}
+		}
+	}
+	return nil
+}
+
+// Make a system call from the first thread, its instruction is written where the thread
+// stopped and the thread's code and registers are restored after it
+func (t *tracee) syscall(number uintptr, args ...uintptr) (uintptr, error) {
+	tid := t.tids[0]
+	var saved unix.PtraceRegs
+	if err := unix.PtraceGetRegs(tid, &saved); err != nil {
+		return 0, err
+	}
+	original := make([]byte, 8)
+	if err := t.peek(uintptr(saved.Rip), original); err != nil {
+		return 0, err
+	}
+	// syscall; int3
+	code := append([]byte{0x0f, 0x05, 0xcc}, original[3:]...)
+	if err := t.poke(uintptr(saved.Rip), code); err != nil {
+		return 0, err
+	}
+	defer func() {
+		t.poke(uintptr(saved.Rip), original)
+		unix.PtraceSetRegs(tid, &saved)
+	}()
+
+	regs := saved
+	regs.Rax = uint64(number)
+	values := make([]uintptr, 6)
+	copy(values, args)
+	regs.Rdi, regs.Rsi, regs.Rdx = uint64(values[0]), uint64(values[1]), uint64(values[2])
+	regs.R10, regs.R8, regs.R9 = uint64(values[3]), uint64(values[4]), uint64(values[5])
+	// Not in a system call, an interrupted one is not restarted at the injected instruction
+	regs.Orig_rax = ^uint64(0)
+	if err := unix.PtraceSetRegs(tid, &regs); err != nil {
+		return 0, err
+	}
+	for {
+		if err := unix.PtraceCont(tid, 0); err != nil {
+			return 0, err
+		}
+		status, err := wait(tid)
+		if err != nil {
+			return 0, err
+		}
+		if !status.Stopped() {
+			return 0, fmt.Errorf("thread %d exited", tid)
+		}
+		if status.StopSignal() == unix.SIGTRAP && status.TrapCause() == 0 {
+			break
+		}
+		// Signals arriving meanwhile are delivered on detach, when the registers are restored
+		if !eventStop(status) && t.signals[tid] == 0 {
+			t.signals[tid] = status.StopSignal()
+		}
+	}
+	if err := unix.PtraceGetRegs(tid, &regs); err != nil {
+		return 0, err
+	}
+	if result := int64(regs.Rax); result < 0 && result > -4096 {
+		return 0, syscall.Errno(-result)
+	}
+	return uintptr(regs.Rax), nil
+}
+
+func (t *tracee) peek(address uintptr, data []byte) error {
+	if _, err := unix.PtracePeekData(t.tids[0], address, data); err != nil {
+		return fmt.Errorf("failed to read %#x: %v", address, err)
+	}
+	return nil
+}
+
+func (t *tracee) poke(address uintptr, data []byte) error {
+	if _, err := unix.PtracePokeData(t.tids[0], address, data); err != nil {
+		return fmt.Errorf("failed to write %#x: %v", address, err)
+	}
+	return nil
+}
+
+func ptrace(request int, tid int, data uintptr) error {
+	if _, _, errno := unix.Syscall6(unix.SYS_PTRACE, uintptr(request), uintptr(tid), 0, data, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func wait(tid int) (unix.WaitStatus, error) {
+	var status unix.WaitStatus
+	for {
+		_, err := unix.Wait4(tid, &status, unix.WALL, nil)
+		if err != unix.EINTR {
+			return status, err
+		}
+	}
+}
+
+// Whether the thread stopped on a ptrace interrupt or a group stop, and not for a signal
+func eventStop(status unix.WaitStatus) bool {
+	return uint32(status)>>16 == unix.PTRACE_EVENT_STOP
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clock
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The test binary prints the time for each line read when started with this variable
+const helperEnv = "KUBE_CHAOS_CLOCK_HELPER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) != "" {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			fmt.Println(time.Now().Unix())
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type helper struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+}
+
+func (h *helper) now(t *testing.T) int64 {
+	if _, err := fmt.Fprintln(h.stdin); err != nil {
+		t.Fatal(err)
+	}
+	if !h.stdout.Scan() {
+		t.Fatalf("the helper exited: %v", h.stdout.Err())
+	}
+	now, err := strconv.ParseInt(strings.TrimSpace(h.stdout.Text()), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return now
+}
+
+func TestSkew(t *testing.T) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), helperEnv+"=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	h := &helper{cmd: cmd, stdin: stdin, stdout: bufio.NewScanner(stdout)}
+	h.now(t)
+
+	skewer := NewSkewer("/proc")
+	check := func(offset int64) {
+		// One second passing between the readings
+		if delta := h.now(t) - time.Now().Unix() - offset; delta < -1 || delta > 1 {
+			t.Errorf("clock off by %d seconds, expected %d", delta+offset, offset)
+		}
+	}
+	if err := skewer.Skew(cmd.Process.Pid, 86400); err != nil {
+		if strings.Contains(err.Error(), unix.EPERM.Error()) {
+			t.Skipf("ptrace not permitted: %v", err)
+		}
+		t.Fatal(err)
+	}
+	check(86400)
+	if err := skewer.Skew(cmd.Process.Pid, -3600); err != nil {
+		t.Fatal(err)
+	}
+	check(-3600)
+	if err := skewer.Restore(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+	check(0)
+	// Restoring a process not skewed does nothing
+	if err := skewer.Restore(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+	check(0)
+}
@@ -0,0 +1,41 @@
+//go:build !linux || !amd64
+// +build !linux !amd64
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clock
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Skewer offsets the clocks of processes, only supported on Linux on x86-64
+type Skewer struct{}
+
+func NewSkewer(procRoot string) *Skewer {
+	return &Skewer{}
+}
+
+func (s *Skewer) Skew(pid int, seconds int64) error {
+	return fmt.Errorf("clock skew is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// No process is skewed
+func (s *Skewer) Restore(pid int) error {
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// IOLimits throttles the reads and writes of a cgroup on a device, zero is no limit
+type IOLimits struct {
+	ReadBPS   int64
+	WriteBPS  int64
+	ReadIOPS  int64
+	WriteIOPS int64
+}
+
+// A mount of a process's mount namespace
+type Mount struct {
+	ID     string
+	Parent string
+	// major:minor
+	Device string
+	// Where it is mounted, from the process's root
+	Point  string
+	FSType string
+	Source string
+}
+
+// The mounts of the process's mount namespace, in the order they were mounted
+func (p *Processes) Mounts(pid int) ([]Mount, error) {
+	f, err := os.Open(filepath.Join(p.procRoot, strconv.Itoa(pid), "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mounts := []Mount{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mount-point options [optional...] - fstype source ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mount := Mount{ID: fields[0], Parent: fields[1], Device: fields[2], Point: unescapeMount(fields[4])}
+		for i := 5; i < len(fields)-2; i++ {
+			if fields[i] == "-" {
+				mount.FSType, mount.Source = fields[i+1], unescapeMount(fields[i+2])
+				break
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// The device, major:minor, of the mount the path is on in the process's mount namespace
+func (p *Processes) MountDevice(pid int, path string) (string, error) {
+	mounts, err := p.Mounts(pid)
+	if err != nil {
+		return "", err
+	}
+	path = filepath.Clean(path)
+	device, mountPoint := "", ""
+	for _, mount := range mounts {
+		if !underMount(path, mount.Point) || len(mount.Point) < len(mountPoint) {
+			continue
+		}
+		// Later mounts over the same point hide the earlier ones
+		device, mountPoint = mount.Device, mount.Point
+	}
+	if device == "" {
+		return "", fmt.Errorf("no mount of %s found", path)
+	}
+	if strings.HasPrefix(device, "0:") {
+		return "", fmt.Errorf("%s is not on a block device, %s is mounted from %s", path, mountPoint, device)
+	}
+	return device, nil
+}
+
+func underMount(path, mountPoint string) bool {
+	return mountPoint == "/" || path == mountPoint || strings.HasPrefix(path, mountPoint+"/")
+}
+
+// Mount points escape spaces, tabs, newlines and backslashes in octal
+func unescapeMount(point string) string {
+	for _, escape := range []struct{ code, char string }{{`\040`, " "}, {`\011`, "\t"}, {`\012`, "\n"}, {`\134`, `\`}} {
+		point = strings.Replace(point, escape.code, escape.char, -1)
+	}
+	return point
+}
+
+// The whole disk of a device, only disks are throttled and not their partitions, sysRoot is
+// the host's /sys
+func WholeDisk(sysRoot, device string) (string, error) {
+	path, err := filepath.EvalSymlinks(filepath.Join(sysRoot, "dev", "block", device))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(path, "partition")); err != nil {
+		return device, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(path), "dev"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// The pod's cgroup the IO of its containers is throttled in
+func (c *Cgroups) PodIOCgroup(uid string) (string, error) {
+	return c.PodCgroup("blkio", uid)
+}
+
+// Throttle the IO of the cgroup on the device, zero limits remove the throttling
+func (c *Cgroups) ThrottleIO(cgroup, device string, limits IOLimits) error {
+	if c.Unified() {
+		value := fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s", device,
+			ioMax(limits.ReadBPS), ioMax(limits.WriteBPS), ioMax(limits.ReadIOPS), ioMax(limits.WriteIOPS))
+		return ioutil.WriteFile(filepath.Join(cgroup, "io.max"), []byte(value), 0644)
+	}
+	files := []struct {
+		name  string
+		limit int64
+	}{
+		{"blkio.throttle.read_bps_device", limits.ReadBPS},
+		{"blkio.throttle.write_bps_device", limits.WriteBPS},
+		{"blkio.throttle.read_iops_device", limits.ReadIOPS},
+		{"blkio.throttle.write_iops_device", limits.WriteIOPS},
+	}
+	for _, file := range files {
+		// Writing 0 removes the device's limit
+		value := fmt.Sprintf("%s %d", device, file.limit)
+		if err := ioutil.WriteFile(filepath.Join(cgroup, file.name), []byte(value), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ioMax(limit int64) string {
+	if limit == 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
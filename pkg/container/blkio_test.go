@@ -0,0 +1,150 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const mountinfo = `22 1 0:21 / / rw,relatime - overlay overlay rw,lowerdir=/l,upperdir=/u,workdir=/w
+23 22 0:22 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+30 22 8:1 /var/lib/kubelet/pods/1a2b/volumes/kubernetes.io~empty-dir/data /var/lib/mysql rw,relatime - ext4 /dev/sda1 rw
+31 22 253:0 /pvc /var/lib/my\040data rw,relatime - xfs /dev/mapper/vg-pvc rw
+32 30 0:40 / /var/lib/mysql/tmp rw,relatime - tmpfs tmpfs rw
+`
+
+func TestMountDevice(t *testing.T) {
+	root := fakeCgroups(t, "130/")
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "130", "mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcesses(root)
+
+	cases := map[string]string{
+		"/var/lib/mysql":          "8:1",
+		"/var/lib/mysql/db/":      "8:1",
+		"/var/lib/my data/x":      "253:0",
+		"/var/lib/mysqlx":         "",
+		"/var/lib/mysql/tmp/sort": "",
+	}
+	for path, expected := range cases {
+		device, err := p.MountDevice(130, path)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected not to be on a block device, got %s", path, device)
+			}
+			continue
+		}
+		if err != nil || device != expected {
+			t.Errorf("%s: expected %s, got %s %v", path, expected, device, err)
+		}
+	}
+}
+
+func TestMounts(t *testing.T) {
+	root := fakeCgroups(t, "130/")
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "130", "mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := NewProcesses(root).Mounts(130)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 5 {
+		t.Fatalf("expected 5 mounts, got %v", mounts)
+	}
+	expected := Mount{ID: "31", Parent: "22", Device: "253:0", Point: "/var/lib/my data", FSType: "xfs", Source: "/dev/mapper/vg-pvc"}
+	if mounts[3] != expected {
+		t.Errorf("expected %+v, got %+v", expected, mounts[3])
+	}
+}
+
+func TestWholeDisk(t *testing.T) {
+	root := fakeCgroups(t,
+		"devices/sda/dev",
+		"devices/sda/sda1/partition",
+		"devices/dm-0/dev",
+		"dev/block/")
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "devices/sda/dev"), []byte("8:0\n"), 0644)
+	for device, target := range map[string]string{"8:0": "devices/sda", "8:1": "devices/sda/sda1", "253:0": "devices/dm-0"} {
+		if err := os.Symlink(filepath.Join(root, target), filepath.Join(root, "dev/block", device)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for device, expected := range map[string]string{"8:0": "8:0", "8:1": "8:0", "253:0": "253:0"} {
+		if disk, err := WholeDisk(root, device); err != nil || disk != expected {
+			t.Errorf("%s: expected %s, got %s %v", device, expected, disk, err)
+		}
+	}
+	if _, err := WholeDisk(root, "9:9"); err == nil {
+		t.Errorf("expected an unknown device to fail")
+	}
+}
+
+func TestThrottleIO(t *testing.T) {
+	read := func(path string) string {
+		data, _ := ioutil.ReadFile(path)
+		return string(data)
+	}
+
+	root := fakeCgroups(t, "blkio/kubepods/burstable/pod1a2b/")
+	defer os.RemoveAll(root)
+	c := NewCgroups(root)
+	cgroup, err := c.PodIOCgroup("1a2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ThrottleIO(cgroup, "8:0", IOLimits{ReadBPS: 1048576, WriteIOPS: 20}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"blkio.throttle.read_bps_device":   "8:0 1048576",
+		"blkio.throttle.write_bps_device":  "8:0 0",
+		"blkio.throttle.read_iops_device":  "8:0 0",
+		"blkio.throttle.write_iops_device": "8:0 20",
+	}
+	for name, value := range expected {
+		if actual := read(filepath.Join(cgroup, name)); actual != value {
+			t.Errorf("%s: expected %q, got %q", name, value, actual)
+		}
+	}
+
+	root = fakeCgroups(t, "cgroup.controllers", "kubepods.slice/kubepods-pod1a2b.slice/")
+	defer os.RemoveAll(root)
+	c = NewCgroups(root)
+	if cgroup, err = c.PodIOCgroup("1a2b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ThrottleIO(cgroup, "8:0", IOLimits{ReadBPS: 1048576, WriteIOPS: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if actual := read(filepath.Join(cgroup, "io.max")); actual != "8:0 rbps=1048576 wbps=max riops=max wiops=20" {
+		t.Errorf("unexpected io.max %q", actual)
+	}
+	if err := c.ThrottleIO(cgroup, "8:0", IOLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if actual := read(filepath.Join(cgroup, "io.max")); actual != "8:0 rbps=max wbps=max riops=max wiops=max" {
+		t.Errorf("unexpected restored io.max %q", actual)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Cgroups finds the cgroups of pods under the root of the host's cgroup filesystems,
+// v1 with a hierarchy per controller or the unified v2 one
+type Cgroups struct {
+	root string
+}
+
+func NewCgroups(root string) *Cgroups {
+	return &Cgroups{root: root}
+}
+
+// Whether the unified hierarchy of cgroup v2 is mounted at the root
+func (c *Cgroups) Unified() bool {
+	_, err := os.Stat(filepath.Join(c.root, "cgroup.controllers"))
+	return err == nil
+}
+
+// The pod's cgroup in the hierarchy of the controller, the unified one with cgroup v2,
+// e.g. kubepods/burstable/pod<uid> with the cgroupfs driver or
+// kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice with systemd
+func (c *Cgroups) PodCgroup(controller, uid string) (string, error) {
+	base := c.root
+	if !c.Unified() {
+		base = filepath.Join(c.root, controller)
+	}
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		return "", err
+	}
+	names := []string{"pod" + uid, "pod" + strings.Replace(uid, "-", "_", -1)}
+	found := ""
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "kubepods") {
+			continue
+		}
+		top := filepath.Join(base, entry.Name())
+		// Pods are at most two levels below kubepods, under their QoS class
+		filepath.Walk(top, func(path string, info os.FileInfo, err error) error {
+			if err != nil || found != "" {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			name := strings.TrimSuffix(info.Name(), ".slice")
+			for _, podName := range names {
+				if strings.HasSuffix(name, podName) {
+					found = path
+					return filepath.SkipDir
+				}
+			}
+			if strings.Count(strings.TrimPrefix(path, top), string(filepath.Separator)) >= 2 {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if found != "" {
+			return found, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup of pod %s found in %s", uid, base)
+}
+
+// Create a child cgroup of the pod, beside the ones of its containers, in the hierarchies
+// of the controllers, so its processes count against the pod's limits
+func (c *Cgroups) CreatePodChild(uid, name string, controllers ...string) ([]string, error) {
+	if c.Unified() {
+		controllers = []string{""}
+	}
+	cgroups := []string{}
+	for _, controller := range controllers {
+		parent, err := c.PodCgroup(controller, uid)
+		if err != nil {
+			RemoveCgroups(cgroups)
+			return nil, err
+		}
+		cgroup := filepath.Join(parent, name)
+		// Left behind if the daemon died
+		if err := os.Mkdir(cgroup, 0755); err != nil && !os.IsExist(err) {
+			RemoveCgroups(cgroups)
+			return nil, err
+		}
+		cgroups = append(cgroups, cgroup)
+	}
+	return cgroups, nil
+}
+
+// Move the process into each of the cgroups
+func AddProcess(cgroups []string, pid int) error {
+	for _, cgroup := range cgroups {
+		if err := ioutil.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the cgroups, their processes must have exited
+func RemoveCgroups(cgroups []string) error {
+	var failed []string
+	for _, cgroup := range cgroups {
+		if err := os.Remove(cgroup); err != nil && !os.IsNotExist(err) {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove cgroups: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Freezer freezes and thaws the cgroup of a pod, with the v1 freezer controller or
+// cgroup.freeze of cgroup v2
+type Freezer struct {
+	cgroups *Cgroups
+}
+
+func NewFreezer(cgroupRoot string) *Freezer {
+	return &Freezer{cgroups: NewCgroups(cgroupRoot)}
+}
+
+// The pod's cgroup in the freezer hierarchy
+func (f *Freezer) PodCgroup(uid string) (string, error) {
+	return f.cgroups.PodCgroup("freezer", uid)
+}
+
+// Freeze the processes of the cgroup and its children
+func (f *Freezer) Freeze(cgroup string) error {
+	if f.cgroups.Unified() {
+		return ioutil.WriteFile(filepath.Join(cgroup, "cgroup.freeze"), []byte("1"), 0644)
+	}
+	return ioutil.WriteFile(filepath.Join(cgroup, "freezer.state"), []byte("FROZEN"), 0644)
+}
+
+// Thaw the processes of the cgroup and its children
+func (f *Freezer) Thaw(cgroup string) error {
+	if f.cgroups.Unified() {
+		return ioutil.WriteFile(filepath.Join(cgroup, "cgroup.freeze"), []byte("0"), 0644)
+	}
+	return ioutil.WriteFile(filepath.Join(cgroup, "freezer.state"), []byte("THAWED"), 0644)
+}
+
+// Whether the cgroup is frozen or being frozen
+func (f *Freezer) Frozen(cgroup string) (bool, error) {
+	if f.cgroups.Unified() {
+		data, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.freeze"))
+		return strings.TrimSpace(string(data)) == "1", err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cgroup, "freezer.state"))
+	return strings.TrimSpace(string(data)) != "THAWED", err
+}
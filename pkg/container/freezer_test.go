@@ -0,0 +1,148 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Create the empty files and the directories, ending with a slash, under root
+func fakeCgroups(t *testing.T, paths ...string) string {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if strings.HasSuffix(path, "/") {
+			err = os.MkdirAll(filepath.Join(root, path), 0755)
+		} else if err = os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755); err == nil {
+			err = ioutil.WriteFile(filepath.Join(root, path), nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestFreezerV1(t *testing.T) {
+	root := fakeCgroups(t,
+		"freezer/kubepods/cgroup.procs",
+		"freezer/kubepods/burstable/",
+		"freezer/kubepods/burstable/pod1a2b-3c4d/freezer.state",
+		"freezer/kubepods/pod5e6f/freezer.state")
+	defer os.RemoveAll(root)
+	f := NewFreezer(root)
+
+	cgroup, err := f.PodCgroup("1a2b-3c4d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(root, "freezer/kubepods/burstable/pod1a2b-3c4d"); cgroup != expected {
+		t.Errorf("expected %s, got %s", expected, cgroup)
+	}
+	if cgroup, err := f.PodCgroup("5e6f"); err != nil || filepath.Base(cgroup) != "pod5e6f" {
+		t.Errorf("expected the guaranteed pod's cgroup, got %s %v", cgroup, err)
+	}
+	if _, err := f.PodCgroup("missing"); err == nil {
+		t.Errorf("expected no cgroup of a missing pod")
+	}
+
+	if err := f.Freeze(cgroup); err != nil {
+		t.Fatal(err)
+	}
+	if frozen, err := f.Frozen(cgroup); err != nil || !frozen {
+		t.Errorf("expected frozen, got %v %v", frozen, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(cgroup, "freezer.state")); string(data) != "FROZEN" {
+		t.Errorf("expected FROZEN, got %q", data)
+	}
+	if err := f.Thaw(cgroup); err != nil {
+		t.Fatal(err)
+	}
+	if frozen, err := f.Frozen(cgroup); err != nil || frozen {
+		t.Errorf("expected thawed, got %v %v", frozen, err)
+	}
+}
+
+func TestFreezerV2(t *testing.T) {
+	root := fakeCgroups(t,
+		"cgroup.controllers",
+		"system.slice/cgroup.freeze",
+		"kubepods.slice/cgroup.freeze",
+		"kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1a2b_3c4d.slice/cgroup.freeze")
+	defer os.RemoveAll(root)
+	f := NewFreezer(root)
+
+	cgroup, err := f.PodCgroup("1a2b-3c4d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(root, "kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1a2b_3c4d.slice"); cgroup != expected {
+		t.Errorf("expected %s, got %s", expected, cgroup)
+	}
+	if err := f.Freeze(cgroup); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.freeze")); string(data) != "1" {
+		t.Errorf("expected 1, got %q", data)
+	}
+	if err := f.Thaw(cgroup); err != nil {
+		t.Fatal(err)
+	}
+	if frozen, err := f.Frozen(cgroup); err != nil || frozen {
+		t.Errorf("expected thawed, got %v %v", frozen, err)
+	}
+}
+
+func TestCreatePodChild(t *testing.T) {
+	root := fakeCgroups(t,
+		"cpu/kubepods/burstable/pod1a2b/",
+		"memory/kubepods/burstable/pod1a2b/")
+	defer os.RemoveAll(root)
+	c := NewCgroups(root)
+
+	cgroups, err := c.CreatePodChild("1a2b", "stress", "cpu", "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(root, "cpu/kubepods/burstable/pod1a2b/stress"),
+		filepath.Join(root, "memory/kubepods/burstable/pod1a2b/stress"),
+	}
+	if !reflect.DeepEqual(cgroups, expected) {
+		t.Errorf("expected %v, got %v", expected, cgroups)
+	}
+	// Left behind by a daemon that died
+	if _, err := c.CreatePodChild("1a2b", "stress", "cpu", "memory"); err != nil {
+		t.Errorf("expected existing cgroups to be reused, got %v", err)
+	}
+	if err := RemoveCgroups(cgroups); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cgroups[0]); !os.IsNotExist(err) {
+		t.Errorf("expected the cgroup to be removed, got %v", err)
+	}
+	if _, err := c.CreatePodChild("5e6f", "stress", "cpu"); err == nil {
+		t.Errorf("expected no cgroup of a missing pod")
+	}
+}
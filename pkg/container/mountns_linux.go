@@ -0,0 +1,54 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Run fn on a thread in the mount namespace of the process under procRoot, paths it opens are
+// looked up and mounts it makes are added in the namespace. Files it opens stay usable from
+// the other threads
+func InMountNS(procRoot string, pid int, fn func() error) error {
+	ns, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "ns", "mnt"))
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	errs := make(chan error, 1)
+	go func() {
+		// The thread can't leave the namespace, it stays locked and exits with the goroutine
+		runtime.LockOSThread()
+		// A thread sharing its root and working directory with the others can't enter it
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			errs <- fmt.Errorf("failed to unshare the filesystem attributes: %v", err)
+			return
+		}
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNS); err != nil {
+			errs <- fmt.Errorf("failed to enter the mount namespace: %v", err)
+			return
+		}
+		errs <- fn()
+	}()
+	return <-errs
+}
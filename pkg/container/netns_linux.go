@@ -0,0 +1,69 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// NetNS is the network namespace of a pod, kept open so it can be entered after the process
+// it was opened from exits
+type NetNS struct {
+	f *os.File
+}
+
+// Open the network namespace of the process under procRoot
+func OpenNetNS(procRoot string, pid int) (*NetNS, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "ns", "net"))
+	if err != nil {
+		return nil, err
+	}
+	return &NetNS{f: f}, nil
+}
+
+// Run fn on a thread in the namespace, sockets it creates stay in the namespace and
+// processes it starts run in it
+func (ns *NetNS) Do(fn func() error) error {
+	runtime.LockOSThread()
+	current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer current.Close()
+	if err := unix.Setns(int(ns.f.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter the network namespace: %v", err)
+	}
+	fnErr := fn()
+	// A thread left in the namespace stays locked, and exits with the goroutine
+	if err := unix.Setns(int(current.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("failed to leave the network namespace: %v", err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+func (ns *NetNS) Close() error {
+	return ns.f.Close()
+}
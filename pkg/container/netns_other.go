@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// NetNS is the network namespace of a pod, only supported on Linux
+type NetNS struct{}
+
+func OpenNetNS(procRoot string, pid int) (*NetNS, error) {
+	return nil, fmt.Errorf("network namespaces are not supported on %s", runtime.GOOS)
+}
+
+func (ns *NetNS) Do(fn func() error) error {
+	return fmt.Errorf("network namespaces are not supported on %s", runtime.GOOS)
+}
+
+func (ns *NetNS) Close() error {
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package container finds the processes of a pod's containers on the node from the
+// cgroups in /proc, whatever the container runtime is.
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Signals a container's main process may be sent
+var signals = map[string]syscall.Signal{
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+	"STOP": syscall.SIGSTOP,
+	"CONT": syscall.SIGCONT,
+}
+
+// Parse a signal name, with or without SIG, or number
+func ParseSignal(name string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(name); err == nil && number > 0 && number < 32 {
+		return syscall.Signal(number), nil
+	}
+	if signal, found := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; found {
+		return signal, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
+
+// The id of a container from its status, e.g. docker://<id> or containerd://<id>
+func ParseContainerID(containerID string) (string, error) {
+	parts := strings.SplitN(containerID, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("invalid container id %q", containerID)
+	}
+	return parts[1], nil
+}
+
+// Processes finds processes under procRoot, /proc of the host
+type Processes struct {
+	procRoot string
+}
+
+func NewProcesses(procRoot string) *Processes {
+	return &Processes{procRoot: procRoot}
+}
+
+// The processes whose cgroups contain the id, a container id or a pod UID
+func (p *Processes) InCgroup(id string) ([]int, error) {
+	entries, err := ioutil.ReadDir(p.procRoot)
+	if err != nil {
+		return nil, err
+	}
+	// Pod UIDs appear with underscores in systemd cgroup names
+	ids := []string{id, strings.Replace(id, "-", "_", -1)}
+	pids := []int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		// Processes may exit while scanning
+		data, err := ioutil.ReadFile(filepath.Join(p.procRoot, entry.Name(), "cgroup"))
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			if strings.Contains(string(data), id) {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids, nil
+}
+
+// The main process of a container, the one whose parent is not in the container
+func (p *Processes) MainPID(containerID string) (int, error) {
+	pids, err := p.InCgroup(containerID)
+	if err != nil {
+		return 0, err
+	}
+	inContainer := map[int]bool{}
+	for _, pid := range pids {
+		inContainer[pid] = true
+	}
+	mainPID := 0
+	for _, pid := range pids {
+		ppid, err := p.parent(pid)
+		if err != nil {
+			continue
+		}
+		if !inContainer[ppid] && (mainPID == 0 || pid < mainPID) {
+			mainPID = pid
+		}
+	}
+	if mainPID == 0 {
+		return 0, fmt.Errorf("no process of container %s found in %s", containerID, p.procRoot)
+	}
+	return mainPID, nil
+}
+
+func (p *Processes) parent(pid int) (int, error) {
+	f, err := os.Open(filepath.Join(p.procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "PPid:" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, fmt.Errorf("no parent of process %d", pid)
+}
+
+// Send a signal to the main process of a container, return its pid
+func (p *Processes) Kill(containerID string, signal syscall.Signal) (int, error) {
+	pid, err := p.MainPID(containerID)
+	if err != nil {
+		return 0, err
+	}
+	return pid, syscall.Kill(pid, signal)
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// A fake /proc with a containerd shim, the container's main process and its child
+func fakeProc(t *testing.T) string {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processes := []struct {
+		pid, ppid int
+		cgroup    string
+	}{
+		{1, 0, "0::/init.scope"},
+		{120, 1, "0::/system.slice/containerd.service"},
+		{130, 120, "0::/kubepods.slice/kubepods-pod1a2b_3c4d.slice/cri-containerd-abc123.scope"},
+		{131, 130, "0::/kubepods.slice/kubepods-pod1a2b_3c4d.slice/cri-containerd-abc123.scope"},
+		{140, 120, "12:pids:/kubepods/pod1a2b-3c4d/def456\n0::/"},
+	}
+	for _, p := range processes {
+		dir := filepath.Join(root, fmt.Sprint(p.pid))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		status := fmt.Sprintf("Name:\tproc\nPid:\t%d\nPPid:\t%d\n", p.pid, p.ppid)
+		if err := ioutil.WriteFile(filepath.Join(dir, "status"), []byte(status), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup"), []byte(p.cgroup+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not a process
+	if err := ioutil.WriteFile(filepath.Join(root, "uptime"), []byte("1.0 1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestProcesses(t *testing.T) {
+	root := fakeProc(t)
+	defer os.RemoveAll(root)
+	p := NewProcesses(root)
+
+	pids, err := p.InCgroup("1a2b-3c4d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pids, []int{130, 131, 140}) {
+		t.Errorf("expected the pod's processes, got %v", pids)
+	}
+	if pid, err := p.MainPID("abc123"); err != nil || pid != 130 {
+		t.Errorf("expected main process 130, got %d %v", pid, err)
+	}
+	if pid, err := p.MainPID("def456"); err != nil || pid != 140 {
+		t.Errorf("expected main process 140, got %d %v", pid, err)
+	}
+	if _, err := p.MainPID("missing"); err == nil {
+		t.Errorf("expected no process of a missing container")
+	}
+}
+
+func TestParse(t *testing.T) {
+	signals := map[string]syscall.Signal{"KILL": syscall.SIGKILL, "sigterm": syscall.SIGTERM, "1": syscall.SIGHUP}
+	for name, expected := range signals {
+		if signal, err := ParseSignal(name); err != nil || signal != expected {
+			t.Errorf("%s: expected %v, got %v %v", name, expected, signal, err)
+		}
+	}
+	for _, name := range []string{"", "USR3", "0", "64"} {
+		if _, err := ParseSignal(name); err == nil {
+			t.Errorf("%q: expected an invalid signal", name)
+		}
+	}
+	if id, err := ParseContainerID("docker://abc123"); err != nil || id != "abc123" {
+		t.Errorf("expected abc123, got %s %v", id, err)
+	}
+	if _, err := ParseContainerID("abc123"); err == nil {
+		t.Errorf("expected an invalid container id")
+	}
+}
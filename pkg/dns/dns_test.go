@@ -0,0 +1,151 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// A query of the name and type, with RD set
+func query(name string, qtype uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	return msg
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("*.Payments.svc.cluster.local.=nxdomain api.example.com=timeout,50% db.example.com=10.0.0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Rule{
+		{Pattern: "*.payments.svc.cluster.local", Action: ActionNXDomain, Percent: 100},
+		{Pattern: "api.example.com", Action: ActionTimeout, Percent: 50},
+		{Pattern: "db.example.com", Action: "10.0.0.9", Answer: net.ParseIP("10.0.0.9"), Percent: 100},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("expected %+v, got %+v", expected, rules)
+	}
+
+	invalid := map[string]string{
+		"":                      "no dns rules",
+		"example.com":           "invalid dns rule",
+		"=nxdomain":             "invalid dns rule",
+		"[.example.com=refused": "invalid pattern",
+		"example.com=drop":      "invalid action",
+		"example.com=refused,0": "invalid percent",
+	}
+	for spec, message := range invalid {
+		if _, err := ParseRules(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rules, _ := ParseRules("*.example.com=servfail example.com=refused")
+	if rule := Match(rules, "API.example.com."); rule == nil || rule.Action != ActionServFail {
+		t.Errorf("expected the wildcard rule, got %+v", rule)
+	}
+	if rule := Match(rules, "example.com"); rule == nil || rule.Action != ActionRefused {
+		t.Errorf("expected the exact rule, got %+v", rule)
+	}
+	if rule := Match(rules, "example.org"); rule != nil {
+		t.Errorf("expected no rule, got %+v", rule)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s := NewServer("")
+	rules, _ := ParseRules("gone.example.com=nxdomain slow.example.com=timeout db.example.com=10.0.0.9")
+	s.SetRules("10.1.0.5", rules)
+	forwarded := 0
+	forward := func(msg []byte) ([]byte, error) {
+		forwarded++
+		return []byte("upstream"), nil
+	}
+
+	response := s.handle("10.1.0.5", query("gone.example.com", typeA), forward)
+	if len(response) < headerLength || response[3]&0x0f != rcodeNXDomain || response[2]&0x80 == 0 || response[2]&0x01 == 0 {
+		t.Errorf("expected an NXDOMAIN response, got %v", response)
+	}
+	if response := s.handle("10.1.0.5", query("slow.example.com", typeA), forward); response != nil {
+		t.Errorf("expected no response, got %v", response)
+	}
+
+	msg := query("db.example.com", typeA)
+	response = s.handle("10.1.0.5", msg, forward)
+	if binary.BigEndian.Uint16(response[6:8]) != 1 || !net.IP(response[len(response)-4:]).Equal(net.ParseIP("10.0.0.9")) {
+		t.Errorf("expected an A answer of 10.0.0.9, got %v", response)
+	}
+	if response := s.handle("10.1.0.5", query("db.example.com", typeAAAA), forward); binary.BigEndian.Uint16(response[6:8]) != 0 {
+		t.Errorf("expected no AAAA answer for an IPv4 address, got %v", response)
+	}
+
+	// Other names go to the upstream resolver, the queries of other sources are dropped
+	if response := s.handle("10.1.0.5", query("example.org", typeA), forward); string(response) != "upstream" {
+		t.Errorf("expected the upstream response, got %v", response)
+	}
+	if response := s.handle("10.1.0.6", query("example.org", typeA), forward); response != nil {
+		t.Errorf("expected no response to another source, got %v", response)
+	}
+	s.RemoveRules("10.1.0.5")
+	if response := s.handle("10.1.0.5", query("gone.example.com", typeA), forward); response != nil {
+		t.Errorf("expected no response once removed, got %v", response)
+	}
+	if forwarded != 1 {
+		t.Errorf("expected 1 forwarded query, got %d", forwarded)
+	}
+}
+
+func TestRedirectorAdd(t *testing.T) {
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			// The udp rule exists already
+			func() ([]byte, error) { return nil, nil },
+			func() ([]byte, error) { return nil, &exec.FakeExitError{Status: 1} },
+			func() ([]byte, error) { return nil, nil },
+		},
+	}
+	fexec := exec.FakeExec{}
+	for range fcmd.CombinedOutputScript {
+		fexec.CommandScript = append(fexec.CommandScript,
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) })
+	}
+	r := &Redirector{e: &fexec, port: 10053}
+	if err := r.Add("cali123", "192.168.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	rule := func(op, protocol string) []string {
+		return []string{"iptables", "-w", "-t", "nat", op, Chain, "-i", "cali123", "-p", protocol, "--dport", "53",
+			"-m", "comment", "--comment", "kube-chaos dns", "-j", "DNAT", "--to-destination", "192.168.0.10:10053"}
+	}
+	expectedCalls := [][]string{rule("-C", "udp"), rule("-C", "tcp"), rule("-A", "tcp")}
+	if !reflect.DeepEqual(fcmd.CombinedOutputLog, expectedCalls) {
+		t.Errorf("expected calls %v, got %v", expectedCalls, fcmd.CombinedOutputLog)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const headerLength = 12
+
+// Response codes
+const (
+	rcodeSuccess  = 0
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+)
+
+// Query types with an address answer
+const (
+	typeA    = 1
+	typeAAAA = 28
+)
+
+// Seconds a wrong answer may be cached for
+const answerTTL = 30
+
+// The first question of a query
+type question struct {
+	name  string
+	qtype uint16
+	// Offset of the end of the question in the message
+	end int
+}
+
+func parseQuestion(msg []byte) (*question, error) {
+	if len(msg) < headerLength {
+		return nil, fmt.Errorf("message of %d bytes is too short", len(msg))
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return nil, fmt.Errorf("message has no question")
+	}
+	labels := []string{}
+	offset := headerLength
+	for {
+		if offset >= len(msg) {
+			return nil, fmt.Errorf("truncated name")
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// Queries are not compressed
+		if length > 63 || offset+length > len(msg) {
+			return nil, fmt.Errorf("invalid label")
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(msg) {
+		return nil, fmt.Errorf("truncated question")
+	}
+	return &question{
+		name:  strings.Join(labels, "."),
+		qtype: binary.BigEndian.Uint16(msg[offset : offset+2]),
+		end:   offset + 4,
+	}, nil
+}
+
+// A response to the query with its question only, and the response code
+func reply(msg []byte, q *question, rcode int) []byte {
+	response := make([]byte, q.end)
+	copy(response, msg[:q.end])
+	// QR and the query's opcode and RD, RA, then the response code
+	response[2] = 0x80 | msg[2]&0x79
+	response[3] = 0x80 | byte(rcode)
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	binary.BigEndian.PutUint16(response[6:8], 0)
+	binary.BigEndian.PutUint16(response[8:10], 0)
+	binary.BigEndian.PutUint16(response[10:12], 0)
+	return response
+}
+
+// A response answering the query with the address, without any answer if the address
+// doesn't fit the query's type
+func answer(msg []byte, q *question, ip net.IP) []byte {
+	response := reply(msg, q, rcodeSuccess)
+	var rdata []byte
+	switch {
+	case q.qtype == typeA && ip.To4() != nil:
+		rdata = ip.To4()
+	case q.qtype == typeAAAA && ip.To4() == nil:
+		rdata = ip.To16()
+	default:
+		return response
+	}
+	binary.BigEndian.PutUint16(response[6:8], 1)
+	rr := make([]byte, 12, 12+len(rdata))
+	// The name is a pointer to the question's
+	binary.BigEndian.PutUint16(rr[0:2], 0xc000|headerLength)
+	binary.BigEndian.PutUint16(rr[2:4], q.qtype)
+	binary.BigEndian.PutUint16(rr[4:6], 1)
+	binary.BigEndian.PutUint32(rr[6:10], answerTTL)
+	binary.BigEndian.PutUint16(rr[10:12], uint16(len(rdata)))
+	return append(append(response, rr...), rdata...)
+}
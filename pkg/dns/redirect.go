@@ -0,0 +1,102 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// Chain of the nat table redirecting the pods' queries to the server
+const Chain = "KUBE-CHAOS-DNS"
+
+// Redirector DNATs the DNS queries coming in from pods' interfaces to the server on the node
+type Redirector struct {
+	e    exec.Interface
+	port int
+}
+
+func NewRedirector(port int) *Redirector {
+	return &Redirector{e: exec.New(), port: port}
+}
+
+// Create the chain, jumped to first from PREROUTING so it comes before the DNAT of services
+func (r *Redirector) Init() error {
+	if out, err := r.iptables("-N", Chain); err != nil && !strings.Contains(out, "exists") {
+		return fmt.Errorf("failed to create chain %s: %v: %s", Chain, err, out)
+	}
+	if _, err := r.iptables("-C", "PREROUTING", "-j", Chain); err == nil {
+		return nil
+	}
+	if out, err := r.iptables("-I", "PREROUTING", "1", "-j", Chain); err != nil {
+		return fmt.Errorf("failed to jump to chain %s: %v: %s", Chain, err, out)
+	}
+	return nil
+}
+
+// Redirect the queries coming in from the pod's interface to the server at the node's IP
+func (r *Redirector) Add(iface, hostIP string) error {
+	for _, protocol := range []string{"udp", "tcp"} {
+		rule := r.rule(iface, hostIP, protocol)
+		if _, err := r.iptables(append([]string{"-C", Chain}, rule...)...); err == nil {
+			continue
+		}
+		if out, err := r.iptables(append([]string{"-A", Chain}, rule...)...); err != nil {
+			return fmt.Errorf("failed to redirect %s dns of %s: %v: %s", protocol, iface, err, out)
+		}
+	}
+	return nil
+}
+
+// Stop redirecting the queries from the pod's interface
+func (r *Redirector) Remove(iface, hostIP string) error {
+	for _, protocol := range []string{"udp", "tcp"} {
+		rule := r.rule(iface, hostIP, protocol)
+		// Removed already, or never added
+		if _, err := r.iptables(append([]string{"-C", Chain}, rule...)...); err != nil {
+			continue
+		}
+		if out, err := r.iptables(append([]string{"-D", Chain}, rule...)...); err != nil {
+			return fmt.Errorf("failed to stop redirecting %s dns of %s: %v: %s", protocol, iface, err, out)
+		}
+	}
+	return nil
+}
+
+// Remove the chain and the jump to it
+func (r *Redirector) Clear() error {
+	r.iptables("-D", "PREROUTING", "-j", Chain)
+	r.iptables("-F", Chain)
+	if out, err := r.iptables("-X", Chain); err != nil && !strings.Contains(out, "No chain") {
+		return fmt.Errorf("failed to delete chain %s: %v: %s", Chain, err, out)
+	}
+	return nil
+}
+
+func (r *Redirector) rule(iface, hostIP, protocol string) []string {
+	return []string{"-i", iface, "-p", protocol, "--dport", "53",
+		"-m", "comment", "--comment", "kube-chaos dns",
+		"-j", "DNAT", "--to-destination", hostIP + ":" + strconv.Itoa(r.port)}
+}
+
+func (r *Redirector) iptables(args ...string) (string, error) {
+	out, err := r.e.Command("iptables", append([]string{"-w", "-t", "nat"}, args...)...).CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dns answers the DNS queries of pods under DNS chaos: queries matching a rule fail,
+// time out or get a wrong answer, the others are forwarded to the real resolver.
+package dns
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+)
+
+// Actions of a rule, besides an IP address to answer with
+const (
+	ActionNXDomain = "nxdomain"
+	ActionServFail = "servfail"
+	ActionRefused  = "refused"
+	// No answer at all, the client times out
+	ActionTimeout = "timeout"
+)
+
+// Rule applies an action to the queries of names matching the pattern
+type Rule struct {
+	// Name pattern, * matches any characters, e.g. *.example.com
+	Pattern string
+	Action  string
+	// Answer of A or AAAA queries when the action is an address
+	Answer net.IP
+	// Percent of the matching queries the action applies to, the others are forwarded
+	Percent float64
+}
+
+// Parse space separated rules, pattern=action[,percent], e.g.
+// *.payments.svc.cluster.local=nxdomain api.example.com=timeout,50% db.example.com=10.0.0.9
+func ParseRules(spec string) ([]Rule, error) {
+	rules := []Rule{}
+	for _, field := range strings.Fields(spec) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid dns rule %q, expected pattern=action[,percent]", field)
+		}
+		rule := Rule{Pattern: normalize(parts[0]), Percent: 100}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", parts[0])
+		}
+		values := strings.SplitN(parts[1], ",", 2)
+		switch action := strings.ToLower(values[0]); action {
+		case ActionNXDomain, ActionServFail, ActionRefused, ActionTimeout:
+			rule.Action = action
+		default:
+			if rule.Answer = net.ParseIP(values[0]); rule.Answer == nil {
+				return nil, fmt.Errorf("invalid action %q, expected %s, %s, %s, %s or an IP address",
+					values[0], ActionNXDomain, ActionServFail, ActionRefused, ActionTimeout)
+			}
+			rule.Action = rule.Answer.String()
+		}
+		if len(values) == 2 {
+			percent, err := tcstate.ParsePercent(values[1])
+			if err != nil || percent <= 0 || percent > 100 {
+				return nil, fmt.Errorf("invalid percent %q", values[1])
+			}
+			rule.Percent = percent
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no dns rules")
+	}
+	return rules, nil
+}
+
+// The first rule matching the name, nil if none does
+func Match(rules []Rule, name string) *Rule {
+	name = normalize(name)
+	for i := range rules {
+		if matched, _ := path.Match(rules[i].Pattern, name); matched {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Names are matched in lower case without the root's dot
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Time to wait for the upstream resolver
+const upstreamTimeout = 5 * time.Second
+
+// Idle time before a TCP connection is closed
+const tcpIdleTimeout = 30 * time.Second
+
+// Server answers the queries redirected from the pods, with the rules of the pod the
+// query comes from, queries of the sources without rules are dropped
+type Server struct {
+	// Address of the real resolver, e.g. 10.96.0.10:53
+	upstream string
+
+	mu    sync.RWMutex
+	rules map[string][]Rule
+
+	// Listeners of the server, nil until it listens
+	udp net.PacketConn
+	tcp net.Listener
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+func NewServer(upstream string) *Server {
+	return &Server{
+		upstream: upstream,
+		rules:    map[string][]Rule{},
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Set the rules of the queries from the pod's IP
+func (s *Server) SetRules(ip string, rules []Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[ip] = rules
+}
+
+// Forward the queries from the pod's IP again
+func (s *Server) RemoveRules(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rules, ip)
+}
+
+// Listen on the address over UDP and TCP and serve the queries in the background, until closed
+func (s *Server) Listen(address string) error {
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	s.udp, s.tcp = udp, tcp
+
+	go func() {
+		if err := s.serveUDP(udp); !isClosed(err) {
+			glog.Errorf("DNS server stopped serving udp: %v", err)
+		}
+	}()
+	go func() {
+		if err := s.serveTCP(tcp); !isClosed(err) {
+			glog.Errorf("DNS server stopped serving tcp: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop listening
+func (s *Server) Close() error {
+	if s.udp == nil {
+		return nil
+	}
+	err := s.udp.Close()
+	if tcpErr := s.tcp.Close(); err == nil {
+		err = tcpErr
+	}
+	return err
+}
+
+// Whether serving stopped because the listener was closed
+func isClosed(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		go func() {
+			host, _, _ := net.SplitHostPort(addr.String())
+			if response := s.handle(host, msg, s.forwardUDP); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Answer the length prefixed queries of a TCP connection
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, err := readTCP(conn)
+		if err != nil {
+			return
+		}
+		response := s.handle(host, msg, s.forwardTCP)
+		// A query timing out leaves the connection without an answer
+		if response == nil {
+			continue
+		}
+		if err := writeTCP(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// The response to a query from the source IP, nil to drop it
+func (s *Server) handle(source string, msg []byte, forward func(msg []byte) ([]byte, error)) []byte {
+	s.mu.RLock()
+	rules, found := s.rules[source]
+	s.mu.RUnlock()
+	// Only the pods under DNS chaos are answered, the server is no open resolver
+	if !found {
+		glog.V(4).Infof("Dropped DNS query of %s, it is not under dns chaos", source)
+		return nil
+	}
+
+	if q, err := parseQuestion(msg); err == nil {
+		if rule := Match(rules, q.name); rule != nil && s.hit(rule.Percent) {
+			glog.V(4).Infof("DNS query of %s for %s: %s", source, q.name, rule.Action)
+			switch rule.Action {
+			case ActionNXDomain:
+				return reply(msg, q, rcodeNXDomain)
+			case ActionServFail:
+				return reply(msg, q, rcodeServFail)
+			case ActionRefused:
+				return reply(msg, q, rcodeRefused)
+			case ActionTimeout:
+				return nil
+			default:
+				return answer(msg, q, rule.Answer)
+			}
+		}
+	}
+
+	response, err := forward(msg)
+	if err != nil {
+		glog.V(4).Infof("Failed to forward DNS query of %s: %v", source, err)
+		return nil
+	}
+	return response
+}
+
+func (s *Server) hit(percent float64) bool {
+	if percent >= 100 {
+		return true
+	}
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return s.rand.Float64()*100 < percent
+}
+
+func (s *Server) forwardUDP(msg []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", s.upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (s *Server) forwardTCP(msg []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", s.upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if err := writeTCP(conn, msg); err != nil {
+		return nil, err
+	}
+	return readTCP(conn)
+}
+
+func readTCP(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCP(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
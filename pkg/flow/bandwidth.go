@@ -0,0 +1,211 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+)
+
+// Tested highest settable rate on tc, used when the chaos settings give no rate
+const defaultRate = "4gbps"
+
+const (
+	// htb stores the time to send burst at rate in 32-bit scheduler ticks, 15.625 ticks per microsecond
+	maxBurstSeconds = float64(1<<32) / 15.625 / 1e6
+	// htb warns about quantums outside of the range it clamps its own to
+	minQuantum = 1000
+	maxQuantum = 200000
+	// htb has 8 priorities, 0 is the highest
+	maxPrio = 7
+)
+
+// Bandwidth settings of a pod's class, from the first field of the chaos settings and
+// the key=value fields, e.g. 1mbit,ceil=2mbit,burst=15k,delay,100ms
+type Bandwidth struct {
+	Rate    string
+	Ceil    string
+	Burst   string
+	Cburst  string
+	Quantum string
+	Prio    string
+	// Token bucket under netem, ingress only
+	Tbf *TbfPolicer
+}
+
+// A token bucket filter limiting the traffic after netem, given as tbf=rate/burst[/latency]
+type TbfPolicer struct {
+	Rate    string
+	Burst   string
+	Latency string
+}
+
+// Split the chaos settings into the bandwidth settings and the netem arguments
+func ParseChaosInfo(info string, isIngress bool) (*Bandwidth, []string, error) {
+	if info == "" {
+		return nil, nil, fmt.Errorf("no chaos info set")
+	}
+	cmds := strings.Split(info, ",")
+	b := &Bandwidth{Rate: cmds[0]}
+	if b.Rate == "" {
+		b.Rate = defaultRate
+	}
+
+	netemArgs := []string{}
+	for _, cmd := range cmds[1:] {
+		parts := strings.SplitN(cmd, "=", 2)
+		if len(parts) != 2 {
+			netemArgs = append(netemArgs, cmd)
+			continue
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "ceil":
+			b.Ceil = value
+		case "burst":
+			b.Burst = value
+		case "cburst":
+			b.Cburst = value
+		case "quantum":
+			b.Quantum = value
+		case "prio":
+			b.Prio = value
+		case "tbf":
+			tbf := strings.Split(value, "/")
+			if len(tbf) < 2 || len(tbf) > 3 {
+				return nil, nil, fmt.Errorf("invalid tbf %q, expected rate/burst[/latency]", value)
+			}
+			b.Tbf = &TbfPolicer{Rate: tbf[0], Burst: tbf[1], Latency: "50ms"}
+			if len(tbf) == 3 {
+				b.Tbf.Latency = tbf[2]
+			}
+		default:
+			return nil, nil, fmt.Errorf("unknown bandwidth setting %q", key)
+		}
+	}
+
+	if err := b.validate(isIngress); err != nil {
+		return nil, nil, err
+	}
+	return b, netemArgs, nil
+}
+
+// Check the settings against what htb and tbf accept
+func (b *Bandwidth) validate(isIngress bool) error {
+	rate, err := parsePositiveRate("rate", b.Rate)
+	if err != nil {
+		return err
+	}
+	ceil := rate
+	if b.Ceil != "" {
+		if ceil, err = parsePositiveRate("ceil", b.Ceil); err != nil {
+			return err
+		}
+		if rate > 0 && ceil > 0 && ceil < rate {
+			return fmt.Errorf("ceil %s is lower than rate %s", b.Ceil, b.Rate)
+		}
+	}
+	if err := validateBurst("burst", b.Burst, rate); err != nil {
+		return err
+	}
+	if err := validateBurst("cburst", b.Cburst, ceil); err != nil {
+		return err
+	}
+	if b.Quantum != "" {
+		quantum, err := strconv.Atoi(b.Quantum)
+		if err != nil || quantum < minQuantum || quantum > maxQuantum {
+			return fmt.Errorf("invalid quantum %q, expected %d to %d bytes", b.Quantum, minQuantum, maxQuantum)
+		}
+	}
+	if b.Prio != "" {
+		prio, err := strconv.Atoi(b.Prio)
+		if err != nil || prio < 0 || prio > maxPrio {
+			return fmt.Errorf("invalid prio %q, expected 0 to %d", b.Prio, maxPrio)
+		}
+	}
+
+	if b.Tbf != nil {
+		if !isIngress {
+			return fmt.Errorf("tbf is only supported for ingress")
+		}
+		tbfRate, err := parsePositiveRate("tbf rate", b.Tbf.Rate)
+		if err != nil {
+			return err
+		}
+		if b.Tbf.Burst == "" {
+			return fmt.Errorf("tbf burst is required")
+		}
+		if err := validateBurst("tbf burst", b.Tbf.Burst, tbfRate); err != nil {
+			return err
+		}
+		latency, err := tcstate.ParseTime(b.Tbf.Latency)
+		if err != nil || latency <= 0 {
+			return fmt.Errorf("invalid tbf latency %q", b.Tbf.Latency)
+		}
+	}
+	return nil
+}
+
+// Parse a rate into bit/s, 0 for a percentage of the device's rate
+func parsePositiveRate(name, value string) (uint64, error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid %s %q", name, value)
+		}
+		return 0, nil
+	}
+	rate, err := tcstate.ParseRate(value)
+	if err != nil || rate == 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return rate, nil
+}
+
+func validateBurst(name, value string, rate uint64) error {
+	if value == "" {
+		return nil
+	}
+	burst, err := tcstate.ParseSize(value)
+	if err != nil || burst == 0 {
+		return fmt.Errorf("invalid %s %q", name, value)
+	}
+	if rate == 0 {
+		// Relative to the device's rate, which is unknown here
+		return nil
+	}
+	if seconds := float64(burst*8) / float64(rate); seconds > maxBurstSeconds {
+		return fmt.Errorf("%s %s takes %.0fs to send, more than the %.0fs htb supports", name, value, seconds, maxBurstSeconds)
+	}
+	return nil
+}
+
+// Arguments of "tc class change ... htb"
+func (b *Bandwidth) htbArgs() []string {
+	args := []string{"rate", b.Rate}
+	for _, option := range []struct{ name, value string }{
+		{"ceil", b.Ceil}, {"burst", b.Burst}, {"cburst", b.Cburst}, {"quantum", b.Quantum}, {"prio", b.Prio},
+	} {
+		if option.value != "" {
+			args = append(args, option.name, option.value)
+		}
+	}
+	return args
+}
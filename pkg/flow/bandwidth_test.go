@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChaosInfo(t *testing.T) {
+	cases := []struct {
+		info      string
+		isIngress bool
+		htbArgs   []string
+		netemArgs []string
+		tbf       *TbfPolicer
+	}{
+		{
+			info:      "100kbps,delay,100ms,10ms",
+			htbArgs:   []string{"rate", "100kbps"},
+			netemArgs: []string{"delay", "100ms", "10ms"},
+		},
+		{
+			info:      ",loss,1%",
+			htbArgs:   []string{"rate", defaultRate},
+			netemArgs: []string{"loss", "1%"},
+		},
+		{
+			info:      "384kbit,ceil=1mbit,burst=15k,cburst=3k,quantum=1500,prio=2,delay,150ms",
+			htbArgs:   []string{"rate", "384kbit", "ceil", "1mbit", "burst", "15k", "cburst", "3k", "quantum", "1500", "prio", "2"},
+			netemArgs: []string{"delay", "150ms"},
+		},
+		{
+			info:      "50%,ceil=80%,burst=15k,delay,100ms",
+			htbArgs:   []string{"rate", "50%", "ceil", "80%", "burst", "15k"},
+			netemArgs: []string{"delay", "100ms"},
+		},
+		{
+			info:      "10mbit,delay,300ms,tbf=2mbit/32k",
+			isIngress: true,
+			htbArgs:   []string{"rate", "10mbit"},
+			netemArgs: []string{"delay", "300ms"},
+			tbf:       &TbfPolicer{Rate: "2mbit", Burst: "32k", Latency: "50ms"},
+		},
+		{
+			info:      "10mbit,tbf=2mbit/32k/200ms",
+			isIngress: true,
+			htbArgs:   []string{"rate", "10mbit"},
+			netemArgs: []string{},
+			tbf:       &TbfPolicer{Rate: "2mbit", Burst: "32k", Latency: "200ms"},
+		},
+	}
+	for _, c := range cases {
+		bandwidth, netemArgs, err := ParseChaosInfo(c.info, c.isIngress)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.info, err)
+			continue
+		}
+		if !reflect.DeepEqual(bandwidth.htbArgs(), c.htbArgs) {
+			t.Errorf("%q: expected htb %v, got %v", c.info, c.htbArgs, bandwidth.htbArgs())
+		}
+		if !reflect.DeepEqual(netemArgs, c.netemArgs) {
+			t.Errorf("%q: expected netem %v, got %v", c.info, c.netemArgs, netemArgs)
+		}
+		if !reflect.DeepEqual(bandwidth.Tbf, c.tbf) {
+			t.Errorf("%q: expected tbf %+v, got %+v", c.info, c.tbf, bandwidth.Tbf)
+		}
+	}
+}
+
+func TestParseChaosInfoInvalid(t *testing.T) {
+	cases := []struct {
+		info      string
+		isIngress bool
+	}{
+		{info: ""},
+		{info: "fast,delay,100ms"},
+		{info: "0kbit"},
+		{info: "150%"},
+		{info: "1mbit,ceil=512kbit"},
+		{info: "1mbit,burst=lots"},
+		// Takes hours to send at 1kbit
+		{info: "1kbit,burst=1g"},
+		{info: "1mbit,quantum=10"},
+		{info: "1mbit,prio=8"},
+		{info: "1mbit,police=1mbit"},
+		{info: "1mbit,tbf=1mbit/32k", isIngress: false},
+		{info: "1mbit,tbf=1mbit", isIngress: true},
+		{info: "1mbit,tbf=1mbit/32k/soon", isIngress: true},
+	}
+	for _, c := range cases {
+		if _, _, err := ParseChaosInfo(c.info, c.isIngress); err == nil {
+			t.Errorf("%q: expected an error", c.info)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// A tc command, without the leading "tc"
+type tcStep struct {
+	// What the step does, used in error messages
+	desc string
+	args []string
+	// The commands undoing the step once applied, run in order, e.g. restoring the settings a
+	// change replaced, none if nothing needs to be undone
+	undo [][]string
+	// Cleanup steps fail when there is nothing to clean
+	ignoreError bool
+}
+
+// tcBatch accumulates the tc commands for a pod and applies them at once with "tc -force -batch".
+// If a command fails, the ones applied are undone in reverse order.
+type tcBatch struct {
+	steps []tcStep
+	// Device locks to release once the batch is applied
+	unlocks []func()
+}
+
+func (b *tcBatch) add(step tcStep) {
+	b.steps = append(b.steps, step)
+}
+
+// Apply the batch, reporting the first step failed
+func (b *tcBatch) apply(e exec.Interface) error {
+	defer func() {
+		for _, unlock := range b.unlocks {
+			unlock()
+		}
+		b.unlocks = nil
+	}()
+	if len(b.steps) == 0 {
+		return nil
+	}
+
+	lines := []string{}
+	for _, step := range b.steps {
+		lines = append(lines, strings.Join(step.args, " "))
+	}
+	glog.V(4).Infof("Running tc batch:\n%s", strings.Join(lines, "\n"))
+	out, err := runBatch(e, lines)
+	if err == nil {
+		return nil
+	}
+
+	// With -force tc goes on after a failure, so every failed line is known
+	failed := parseBatchFailures(out)
+	if len(failed) == 0 {
+		return fmt.Errorf("tc batch error: %v\n%s", err, out)
+	}
+	first := -1
+	for i, step := range b.steps {
+		if _, found := failed[i+1]; found && !step.ignoreError {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+
+	// Undo what was applied, latest first
+	undo, undone := []string{}, 0
+	for i := len(b.steps) - 1; i >= 0; i-- {
+		if _, found := failed[i+1]; found || len(b.steps[i].undo) == 0 {
+			continue
+		}
+		for _, args := range b.steps[i].undo {
+			undo = append(undo, strings.Join(args, " "))
+		}
+		undone++
+	}
+	if len(undo) > 0 {
+		glog.V(4).Infof("Rolling back tc batch:\n%s", strings.Join(undo, "\n"))
+		if out, err := runBatch(e, undo); err != nil {
+			glog.Errorf("Failed to roll back tc batch: %v\n%s", err, out)
+		}
+	}
+
+	return fmt.Errorf("step %d/%d failed (%s: tc %s): %s, %d applied steps rolled back",
+		first+1, len(b.steps), b.steps[first].desc, lines[first], failed[first+1], undone)
+}
+
+func runBatch(e exec.Interface, lines []string) ([]byte, error) {
+	cmd := e.Command("tc", "-force", "-batch", "-")
+	cmd.SetStdin(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+	return cmd.CombinedOutput()
+}
+
+// Extract failed lines and their error messages from the output of "tc -batch", e.g.
+// RTNETLINK answers: File exists
+// Command failed -:2
+func parseBatchFailures(out []byte) map[int]string {
+	failed := map[int]string{}
+	messages := []string{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "Command failed") {
+			if line != "" {
+				messages = append(messages, line)
+			}
+			continue
+		}
+		parts := strings.Split(line, ":")
+		n, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil {
+			continue
+		}
+		failed[n] = strings.Join(messages, "; ")
+		messages = []string{}
+	}
+	return failed
+}
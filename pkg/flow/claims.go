@@ -0,0 +1,80 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"encoding/json"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// Annotation of a pod's owner naming the pods the daemons are putting under chaos, so the
+// daemons of other nodes count them before the pods' own annotations are updated
+const OwnerClaimsAnnotation = "kubernetes.io/chaos-claims"
+
+// How long a claim counts, longer than a round takes to update the claimed pod
+const OwnerClaimTTL = 5 * time.Minute
+
+// Pods of an owner claimed by the daemons, by name, with when their claims expire
+type OwnerClaims map[string]time.Time
+
+// Get the claims of an owner's annotations, those expired at now are dropped
+func GetOwnerClaims(annotations map[string]string, now time.Time) OwnerClaims {
+	claims := OwnerClaims{}
+	var until map[string]string
+	if err := json.Unmarshal([]byte(annotations[OwnerClaimsAnnotation]), &until); err != nil {
+		return claims
+	}
+	for name, value := range until {
+		expiry, err := time.Parse(time.RFC3339, value)
+		if err == nil && expiry.After(now) {
+			claims[name] = expiry
+		}
+	}
+	return claims
+}
+
+func (c OwnerClaims) String() string {
+	until := map[string]string{}
+	for name, expiry := range c {
+		until[name] = expiry.UTC().Format(time.RFC3339)
+	}
+	data, _ := json.Marshal(until)
+	return string(data)
+}
+
+// Copies of pods with the claimed ones counted as under chaos by the owner checks
+func (c OwnerClaims) Mark(pods []v1.Pod) []v1.Pod {
+	if len(c) == 0 {
+		return pods
+	}
+	marked := make([]v1.Pod, len(pods))
+	copy(marked, pods)
+	for i := range marked {
+		if _, found := c[marked[i].Name]; !found || IsPodUnderChaos(marked[i].Annotations) {
+			continue
+		}
+		annotations := map[string]string{}
+		for key, value := range marked[i].Annotations {
+			annotations[key] = value
+		}
+		annotations["kubernetes.io/done-ingress-chaos"] = "yes"
+		marked[i].Annotations = annotations
+	}
+	return marked
+}
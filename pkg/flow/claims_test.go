@@ -0,0 +1,62 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestGetOwnerClaims(t *testing.T) {
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	claims := OwnerClaims{"web-1": now.Add(time.Minute), "web-2": now.Add(-time.Minute)}
+	annotations := map[string]string{OwnerClaimsAnnotation: claims.String()}
+
+	got := GetOwnerClaims(annotations, now)
+	if len(got) != 1 || !got["web-1"].Equal(now.Add(time.Minute)) {
+		t.Errorf("expected only the unexpired claim of web-1, got %v", got)
+	}
+	if got := GetOwnerClaims(map[string]string{OwnerClaimsAnnotation: "web-1"}, now); len(got) != 0 {
+		t.Errorf("expected no claims from an invalid annotation, got %v", got)
+	}
+	if got := GetOwnerClaims(nil, now); len(got) != 0 {
+		t.Errorf("expected no claims without the annotation, got %v", got)
+	}
+}
+
+func TestOwnerClaimsMark(t *testing.T) {
+	pods := []v1.Pod{
+		ownedPod("web-1", "web", false),
+		ownedPod("web-2", "web", false),
+		ownedPod("web-3", "web", false),
+	}
+	claims := OwnerClaims{"web-2": time.Now().Add(OwnerClaimTTL)}
+
+	guards := Guards{MaxPodsPerOwner: 1}
+	if err := guards.CheckOwner(&pods[0], pods); err != nil {
+		t.Fatalf("expected no pod under chaos before marking, got %v", err)
+	}
+	marked := claims.Mark(pods)
+	if err := guards.CheckOwner(&pods[0], marked); err == nil {
+		t.Errorf("expected the claimed pod to count as under chaos")
+	}
+	if IsPodUnderChaos(pods[1].Annotations) {
+		t.Errorf("expected the listed pods to be left alone")
+	}
+}
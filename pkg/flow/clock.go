@@ -0,0 +1,68 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/clock"
+)
+
+// Annotation offsetting the realtime clocks of the processes of the pod, e.g.
+// offset=-48h container=app duration=10m
+const PodClockAnnotation = "kubernetes.io/pod-clock"
+
+// PodClock offsets the time the pod's processes read, their monotonic clocks and the timers
+// they wait on are left alone
+type PodClock struct {
+	// Whole seconds, negative to go back in time
+	Offset time.Duration
+	// Container whose processes are skewed, all the pod's if empty
+	Container string
+	// Until the offset is removed if zero
+	Duration time.Duration
+}
+
+// Parse space separated key=value settings of clock skew, offset is required
+func ParsePodClock(spec string) (*PodClock, error) {
+	p := &PodClock{}
+	err := parseSettings("pod clock", spec, func(key, value string) error {
+		var err error
+		switch key {
+		case "offset":
+			if p.Offset, err = time.ParseDuration(value); err != nil {
+				return fmt.Errorf("invalid offset %q", value)
+			}
+			_, err = clock.Seconds(p.Offset)
+		case "container":
+			p.Container = value
+		case "duration":
+			p.Duration, err = parsePositiveDuration(key, value)
+		default:
+			err = errUnknownSetting
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.Offset == 0 {
+		return nil, fmt.Errorf("no offset")
+	}
+	return p, nil
+}
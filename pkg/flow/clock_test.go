@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestParsePodClock(t *testing.T) {
+	p, err := ParsePodClock("offset=-48h container=app duration=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PodClock{Offset: -48 * time.Hour, Container: "app", Duration: 10 * time.Minute}
+	if *p != expected {
+		t.Errorf("expected %+v, got %+v", expected, *p)
+	}
+
+	invalid := map[string]string{
+		"container=app":             "no offset",
+		"offset=0s":                 "invalid offset 0s",
+		"offset=soon":               "invalid offset",
+		"offset=1500ms":             "expected whole seconds",
+		"offset=1h duration=-1m":    "invalid duration",
+		"offset=1h clock=monotonic": "unknown pod clock setting",
+		"offset":                    "expected key=value",
+	}
+	for spec, message := range invalid {
+		if _, err := ParsePodClock(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestPodClockStatus(t *testing.T) {
+	annotations := map[string]string{}
+	ClockFault.SetStatus(&FaultStatus{Spec: "offset=-48h", Active: true, Until: "2018-06-01T10:10:00Z"}, annotations)
+	status, err := ClockFault.GetStatus(annotations)
+	if err != nil || ClockFault.Describe(status) != "skewed until 2018-06-01T10:10:00Z" {
+		t.Errorf("unexpected status %+v %v", status, err)
+	}
+
+	ready := []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	pods := []v1.Pod{ownedPod("web-1", "web", false), ownedPod("web-2", "web", false)}
+	for i := range pods {
+		pods[i].Status.Conditions = ready
+	}
+	pods[1].Annotations = annotations
+	if err := ClockFault.Check(&pods[0], &Guards{MaxPodsPerOwner: 1}, pods); err == nil {
+		t.Errorf("expected the skewed sibling to count")
+	}
+
+	ClockFault.SetEnded(annotations)
+	if status, _ := ClockFault.GetStatus(annotations); status.Active || ClockFault.Describe(status) != "restored" {
+		t.Errorf("expected the status restored, got %+v", status)
+	}
+	if err := ClockFault.Check(&pods[0], &Guards{MaxPodsPerOwner: 1}, pods); err != nil {
+		t.Errorf("expected the restored sibling not to count, got %v", err)
+	}
+	ClockFault.Clear(annotations)
+	if len(annotations) != 0 {
+		t.Errorf("expected no annotations left, got %v", annotations)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import "fmt"
+
+// Default namespace/name of the ConfigMap every daemon polls for the cluster-wide state
+const DefaultControlConfigMap = "kube-system/kube-chaos-control"
+
+// Key of the control ConfigMap holding the state
+const ControlStateKey = "state"
+
+// Cluster-wide states of kube-chaos
+const (
+	// Chaos settings are applied, the default when the ConfigMap does not exist
+	ControlRunning = "running"
+	// Faults in place are kept, new and changed settings wait until resumed
+	ControlPaused = "paused"
+	// All faults are cleared on all nodes, they are applied again when resumed
+	ControlAbort = "abort"
+)
+
+// Read the state from the control ConfigMap's data, an unknown state pauses chaos
+func ParseControlState(data map[string]string) (string, error) {
+	state, found := data[ControlStateKey]
+	if !found || state == "" {
+		return ControlRunning, nil
+	}
+	switch state {
+	case ControlRunning, ControlPaused, ControlAbort:
+		return state, nil
+	}
+	return ControlPaused, fmt.Errorf("unknown state %q, expected %s, %s or %s", state, ControlRunning, ControlPaused, ControlAbort)
+}
+
+// Mark the chaos settings of the pod to be applied again, after they were cleared from the node
+func SetPodChaosPending(podAnnotations map[string]string) {
+	for _, direction := range []string{"ingress", "egress"} {
+		if _, found := podAnnotations["kubernetes.io/"+direction+"-chaos"]; found {
+			podAnnotations["kubernetes.io/done-"+direction+"-chaos"] = "no"
+		}
+	}
+	if _, found := podAnnotations[DNSChaosAnnotation]; found {
+		podAnnotations[doneDNSAnnotation] = "no"
+	}
+	if _, found := podAnnotations[HTTPChaosAnnotation]; found {
+		podAnnotations[doneHTTPAnnotation] = "no"
+	}
+	delete(podAnnotations, effectiveIngressAnnotation)
+	delete(podAnnotations, effectiveEgressAnnotation)
+	delete(podAnnotations, chaosStatsAnnotation)
+	delete(podAnnotations, rampStatusAnnotation(true))
+	delete(podAnnotations, rampStatusAnnotation(false))
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseControlState(t *testing.T) {
+	cases := []struct {
+		data     map[string]string
+		expected string
+		invalid  bool
+	}{
+		{nil, ControlRunning, false},
+		{map[string]string{ControlStateKey: ""}, ControlRunning, false},
+		{map[string]string{ControlStateKey: "paused"}, ControlPaused, false},
+		{map[string]string{ControlStateKey: "abort"}, ControlAbort, false},
+		{map[string]string{ControlStateKey: "running"}, ControlRunning, false},
+		// A typo must not let chaos go on
+		{map[string]string{ControlStateKey: "abrot"}, ControlPaused, true},
+	}
+	for _, c := range cases {
+		state, err := ParseControlState(c.data)
+		if state != c.expected || (err != nil) != c.invalid {
+			t.Errorf("%v: expected %s (invalid %v), got %s (%v)", c.data, c.expected, c.invalid, state, err)
+		}
+	}
+}
+
+func TestSetPodChaosPending(t *testing.T) {
+	annotations := map[string]string{
+		"kubernetes.io/egress-chaos":      "profile:3g",
+		"kubernetes.io/done-egress-chaos": "yes",
+		effectiveEgressAnnotation:         "330kbit,delay,100ms,20ms,loss,0.5%",
+		chaosStatsAnnotation:              `{"egress":{"sentBytes":1}}`,
+		"app":                             "web",
+	}
+	SetPodChaosPending(annotations)
+	expected := map[string]string{
+		"kubernetes.io/egress-chaos":      "profile:3g",
+		"kubernetes.io/done-egress-chaos": "no",
+		"app":                             "web",
+	}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("expected %v, got %v", expected, annotations)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"github.com/huanwei/kube-chaos/pkg/dns"
+	"k8s.io/api/core/v1"
+)
+
+// Annotations of DNS chaos, with the same done, clear and rejected flags as network chaos
+const (
+	// Rules of the pod's queries, e.g. *.example.com=nxdomain api.example.com=timeout,50%
+	DNSChaosAnnotation    = "kubernetes.io/dns-chaos"
+	doneDNSAnnotation     = "kubernetes.io/done-dns-chaos"
+	clearDNSAnnotation    = "kubernetes.io/clear-dns-chaos"
+	rejectedDNSAnnotation = "kubernetes.io/rejected-dns-chaos"
+)
+
+// Get the pod's DNS chaos rules, whether they need to be applied or cleared
+func GetPodDNSChaos(podAnnotations map[string]string) (spec string, needUpdate, needClear bool) {
+	spec = podAnnotations[DNSChaosAnnotation]
+	_, needClear = podAnnotations[clearDNSAnnotation]
+	done, found := podAnnotations[doneDNSAnnotation]
+	needUpdate = found && done != "yes" && done != rejected
+	return spec, needUpdate, needClear
+}
+
+// Whether the pod's DNS chaos rules are applied
+func IsPodDNSChaosDone(podAnnotations map[string]string) bool {
+	return podAnnotations[doneDNSAnnotation] == "yes"
+}
+
+// Set the pod's DNS chaos rules to be applied
+func SetPodDNSChaos(spec string, podAnnotations map[string]string) {
+	podAnnotations[DNSChaosAnnotation] = spec
+	podAnnotations[doneDNSAnnotation] = "no"
+	delete(podAnnotations, clearDNSAnnotation)
+	delete(podAnnotations, rejectedDNSAnnotation)
+}
+
+// Set the clear flag of the pod's DNS chaos, the rules are removed once cleared
+func SetPodDNSChaosClear(podAnnotations map[string]string) {
+	podAnnotations[clearDNSAnnotation] = "yes"
+	podAnnotations[doneDNSAnnotation] = "no"
+}
+
+// Mark the pod's DNS chaos rules applied
+func SetPodDNSChaosDone(podAnnotations map[string]string) {
+	podAnnotations[doneDNSAnnotation] = "yes"
+	delete(podAnnotations, rejectedDNSAnnotation)
+}
+
+// Mark the pod's DNS chaos rules rejected, they are left alone until done is set to no again
+func SetPodDNSChaosRejected(reason string, podAnnotations map[string]string) {
+	podAnnotations[doneDNSAnnotation] = rejected
+	podAnnotations[rejectedDNSAnnotation] = reason
+}
+
+// Get why the pod's DNS chaos rules were rejected, empty if they were not
+func GetPodDNSChaosRejected(podAnnotations map[string]string) string {
+	return podAnnotations[rejectedDNSAnnotation]
+}
+
+// Remove the pod's DNS chaos rules and flags, once cleared
+func ClearPodDNSChaos(podAnnotations map[string]string) {
+	delete(podAnnotations, DNSChaosAnnotation)
+	delete(podAnnotations, doneDNSAnnotation)
+	delete(podAnnotations, clearDNSAnnotation)
+	delete(podAnnotations, rejectedDNSAnnotation)
+}
+
+// Parse the pod's DNS chaos rules and check them against the guards, pods are the ones of the
+// pod's namespace and only needed with owner limits
+func CheckPodDNSChaos(pod *v1.Pod, spec string, guards *Guards, pods []v1.Pod) ([]dns.Rule, error) {
+	rules, err := dns.ParseRules(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := guards.CheckNamespace(pod.Namespace); err != nil {
+		return nil, err
+	}
+	if err := guards.CheckOwner(pod, pods); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
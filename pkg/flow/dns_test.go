@@ -0,0 +1,74 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+)
+
+func TestPodDNSChaosLifecycle(t *testing.T) {
+	annotations := map[string]string{}
+	SetPodDNSChaos("*.example.com=nxdomain", annotations)
+	if spec, needUpdate, needClear := GetPodDNSChaos(annotations); spec != "*.example.com=nxdomain" || !needUpdate || needClear {
+		t.Errorf("expected the rules to need applying, got %q %v %v", spec, needUpdate, needClear)
+	}
+
+	SetPodDNSChaosRejected("too many pods", annotations)
+	if _, needUpdate, _ := GetPodDNSChaos(annotations); needUpdate || GetPodDNSChaosRejected(annotations) != "too many pods" {
+		t.Errorf("expected rejected rules to be left alone, got %v", annotations)
+	}
+	SetPodChaosPending(annotations)
+	if _, needUpdate, _ := GetPodDNSChaos(annotations); !needUpdate {
+		t.Errorf("expected pending rules to need applying, got %v", annotations)
+	}
+
+	SetPodDNSChaosDone(annotations)
+	if !IsPodDNSChaosDone(annotations) || !IsPodUnderChaos(annotations) || GetPodDNSChaosRejected(annotations) != "" {
+		t.Errorf("expected the pod under dns chaos, got %v", annotations)
+	}
+
+	SetPodDNSChaosClear(annotations)
+	if _, _, needClear := GetPodDNSChaos(annotations); !needClear {
+		t.Errorf("expected the rules to need clearing, got %v", annotations)
+	}
+	ClearPodDNSChaos(annotations)
+	if len(annotations) != 0 {
+		t.Errorf("expected no annotations left, got %v", annotations)
+	}
+}
+
+func TestCheckPodDNSChaos(t *testing.T) {
+	pods := []v1.Pod{ownedPod("web-1", "web", false), ownedPod("web-2", "web", false)}
+	SetPodDNSChaos("example.com=refused", pods[1].Annotations)
+	SetPodDNSChaosDone(pods[1].Annotations)
+	guards := &Guards{MaxPodsPerOwner: 1}
+	if _, err := CheckPodDNSChaos(&pods[0], "example.com=refused", guards, pods); err == nil {
+		t.Errorf("expected the sibling under dns chaos to count")
+	}
+	if _, err := CheckPodDNSChaos(&pods[0], "example.com", &Guards{}, nil); err == nil {
+		t.Errorf("expected invalid rules to be rejected")
+	}
+	if _, err := CheckPodDNSChaos(&pods[0], "example.com=refused", &Guards{ProtectedNamespaces: sets.NewString("default")}, nil); err == nil {
+		t.Errorf("expected the protected namespace to be rejected")
+	}
+	if rules, err := CheckPodDNSChaos(&pods[0], "example.com=refused", &Guards{}, pods); err != nil || len(rules) != 1 {
+		t.Errorf("expected the rules to be allowed, got %v %v", rules, err)
+	}
+}
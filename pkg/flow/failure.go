@@ -0,0 +1,145 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Annotation of the pod failure, e.g. action=delete interval=5m percent=20
+const PodFailureAnnotation = "kubernetes.io/pod-failure"
+
+const podFailureLastAnnotation = "kubernetes.io/pod-failure-last"
+
+// Actions of a pod failure
+const (
+	// Delete the pod, its controller creates another one
+	FailureDelete = "delete"
+	// Send a signal to the main process of a container, the kubelet restarts it
+	FailureKillContainer = "kill-container"
+)
+
+// PodFailure kills the pod or one of its containers every interval, with a chance of percent,
+// e.g. action=kill-container container=app signal=TERM interval=2m percent=50
+type PodFailure struct {
+	Action string
+	// Container to kill, the pod's first container if empty
+	Container string
+	Signal    string
+	// Grace period of the deletion, the pod's own if nil
+	GracePeriod *int64
+	Interval    time.Duration
+	Percent     float64
+}
+
+// Parse space separated key=value settings of a pod failure, action is required
+func ParsePodFailure(spec string) (*PodFailure, error) {
+	f := &PodFailure{Signal: "KILL", Interval: time.Minute, Percent: 100}
+	err := parseSettings("pod failure", spec, func(key, value string) error {
+		var err error
+		switch key {
+		case "action":
+			f.Action = value
+		case "container":
+			f.Container = value
+		case "signal":
+			_, err = container.ParseSignal(value)
+			f.Signal = value
+		case "grace":
+			grace, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || grace < 0 {
+				return fmt.Errorf("invalid grace period %q, expected seconds", value)
+			}
+			f.GracePeriod = &grace
+		case "interval":
+			f.Interval, err = parsePositiveDuration(key, value)
+		case "percent":
+			if f.Percent, err = tcstate.ParsePercent(value); err != nil || f.Percent <= 0 || f.Percent > 100 {
+				return fmt.Errorf("invalid percent %q", value)
+			}
+		default:
+			err = errUnknownSetting
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch f.Action {
+	case FailureDelete:
+		if f.Container != "" {
+			return nil, fmt.Errorf("container is only used by %s", FailureKillContainer)
+		}
+	case FailureKillContainer:
+		if f.GracePeriod != nil {
+			return nil, fmt.Errorf("grace is only used by %s", FailureDelete)
+		}
+	default:
+		return nil, fmt.Errorf("invalid action %q, expected %s or %s", f.Action, FailureDelete, FailureKillContainer)
+	}
+	return f, nil
+}
+
+// Check a pod failure against the guards, pods are the ones of the pod's namespace and
+// only needed with owner limits
+func CheckPodFailure(pod *v1.Pod, failure *PodFailure, guards *Guards, pods []v1.Pod) error {
+	if err := guards.CheckNamespace(pod.Namespace); err != nil {
+		return err
+	}
+	if failure.Action == FailureDelete && meta_v1.GetControllerOf(pod) == nil {
+		return fmt.Errorf("pod %s has no controller to create it again", pod.Name)
+	}
+	return guards.CheckOwnerFailure(pod, pods)
+}
+
+// Get the pod's failure settings, nil if it has none
+func GetPodFailure(podAnnotations map[string]string) (*PodFailure, error) {
+	spec, found := podAnnotations[PodFailureAnnotation]
+	if !found {
+		return nil, nil
+	}
+	return ParsePodFailure(spec)
+}
+
+// Set the pod's failure settings, the first kill is an interval later
+func SetPodFailure(spec string, podAnnotations map[string]string) {
+	podAnnotations[PodFailureAnnotation] = spec
+	delete(podAnnotations, podFailureLastAnnotation)
+}
+
+// Remove the pod's failure settings
+func ClearPodFailure(podAnnotations map[string]string) {
+	delete(podAnnotations, PodFailureAnnotation)
+	delete(podAnnotations, podFailureLastAnnotation)
+}
+
+// Get when the pod last had its chance of failing, zero if never
+func GetPodFailureLast(podAnnotations map[string]string) time.Time {
+	last, _ := time.Parse(time.RFC3339, podAnnotations[podFailureLastAnnotation])
+	return last
+}
+
+func SetPodFailureLast(last time.Time, podAnnotations map[string]string) {
+	podAnnotations[podFailureLastAnnotation] = last.UTC().Format(time.RFC3339)
+}
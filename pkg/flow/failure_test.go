@@ -0,0 +1,97 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestParsePodFailure(t *testing.T) {
+	failure, err := ParsePodFailure("action=delete grace=0 interval=5m percent=20%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failure.Action != FailureDelete || failure.GracePeriod == nil || *failure.GracePeriod != 0 ||
+		failure.Interval != 5*time.Minute || failure.Percent != 20 {
+		t.Errorf("unexpected pod failure %+v", failure)
+	}
+	failure, err = ParsePodFailure("action=kill-container container=app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failure.Signal != "KILL" || failure.Interval != time.Minute || failure.Percent != 100 {
+		t.Errorf("expected the defaults, got %+v", failure)
+	}
+
+	invalid := map[string]string{
+		"":                                  "invalid action",
+		"action=reboot":                     "invalid action",
+		"action=delete container=app":       "only used by kill-container",
+		"action=kill-container grace=10":    "only used by delete",
+		"action=kill-container signal=USR3": "unknown signal",
+		"action=delete interval=0s":         "invalid interval",
+		"action=delete percent=150":         "invalid percent",
+		"action=delete every=1m":            "unknown pod failure setting",
+	}
+	for spec, message := range invalid {
+		if _, err := ParsePodFailure(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestCheckPodFailure(t *testing.T) {
+	notReady := ownedPod("web-2", "web", false)
+	notReady.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionFalse}}
+	pods := []v1.Pod{ownedPod("web-1", "web", false), notReady, ownedPod("web-3", "web", false)}
+	for i := range pods {
+		if pods[i].Name != "web-2" {
+			pods[i].Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+		}
+	}
+	kill := &PodFailure{Action: FailureKillContainer}
+	del := &PodFailure{Action: FailureDelete}
+
+	if err := CheckPodFailure(&pods[0], kill, &Guards{MaxPodsPerOwner: 2}, pods); err != nil {
+		t.Errorf("expected a second disrupted pod to be allowed, got %v", err)
+	}
+	// The pod not ready counts as disrupted, unlike for network chaos
+	if err := CheckPodFailure(&pods[0], kill, &Guards{MaxPodsPerOwner: 1}, pods); err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Errorf("expected the pod not ready to be counted, got %v", err)
+	}
+	if err := (&Guards{MaxPodsPerOwner: 1}).CheckOwner(&pods[0], pods); err != nil {
+		t.Errorf("expected network chaos to ignore readiness, got %v", err)
+	}
+
+	orphan := pods[0]
+	orphan.OwnerReferences = nil
+	if err := CheckPodFailure(&orphan, del, &Guards{}, nil); err == nil || !strings.Contains(err.Error(), "no controller") {
+		t.Errorf("expected deleting a pod without controller to be rejected, got %v", err)
+	}
+	if err := CheckPodFailure(&orphan, kill, &Guards{}, nil); err != nil {
+		t.Errorf("expected killing a container of a pod without controller to be allowed, got %v", err)
+	}
+	protected := pods[0]
+	protected.Namespace = "kube-system"
+	if err := CheckPodFailure(&protected, kill, DefaultGuards(), nil); err == nil {
+		t.Errorf("expected a protected namespace to be rejected")
+	}
+}
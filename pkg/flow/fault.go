@@ -0,0 +1,156 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// PodFault is a kind of fault started from the settings of a pod annotation, e.g. a freeze.
+// It is active until its duration is over or the settings are removed, the settings changing
+// start another one. Its progress is kept in the annotation's status, <annotation>-status
+type PodFault struct {
+	// Name of the kind shown by chaosctl, e.g. "freeze"
+	Kind       string
+	Annotation string
+	// Reason of the event recorded when the fault starts
+	Event string
+	// Check the settings
+	parse func(spec string) error
+	// States of an active and an ended fault, e.g. "frozen" and "thawed"
+	active, ended string
+}
+
+// Kinds of pod faults
+var (
+	FreezeFault = &PodFault{Kind: "freeze", Annotation: PodFreezeAnnotation, Event: "ChaosFrozen", active: "frozen", ended: "thawed",
+		parse: func(spec string) error { _, err := ParsePodFreeze(spec); return err }}
+	StressFault = &PodFault{Kind: "stress", Annotation: PodStressAnnotation, Event: "ChaosStressed", active: "running", ended: "stopped",
+		parse: func(spec string) error { _, err := ParsePodStress(spec); return err }}
+	IOFault = &PodFault{Kind: "io", Annotation: PodIOAnnotation, Event: "ChaosThrottled", active: "throttled", ended: "restored",
+		parse: func(spec string) error { _, err := ParsePodIO(spec); return err }}
+	IOChaosFault = &PodFault{Kind: "io-chaos", Annotation: PodIOChaosAnnotation, Event: "ChaosIOInjected", active: "injecting", ended: "restored",
+		parse: func(spec string) error { _, err := ParsePodIOChaos(spec); return err }}
+	ClockFault = &PodFault{Kind: "clock", Annotation: PodClockAnnotation, Event: "ChaosSkewed", active: "skewed", ended: "restored",
+		parse: func(spec string) error { _, err := ParsePodClock(spec); return err }}
+)
+
+// Kinds of pod faults, in the order they are synced
+var PodFaults = []*PodFault{FreezeFault, StressFault, IOFault, IOChaosFault, ClockFault}
+
+// Check the fault's settings
+func (f *PodFault) Parse(spec string) error {
+	return f.parse(spec)
+}
+
+// Check the fault against the guards, a pod under a fault counts as disrupted for the owner
+// limits, pods are the ones of the pod's namespace and only needed with owner limits
+func (f *PodFault) Check(pod *v1.Pod, guards *Guards, pods []v1.Pod) error {
+	if err := guards.CheckNamespace(pod.Namespace); err != nil {
+		return err
+	}
+	return guards.CheckOwnerFailure(pod, pods)
+}
+
+// Progress of a pod fault
+type FaultStatus struct {
+	Spec   string `json:"spec"`
+	Active bool   `json:"active"`
+	// What the fault applies to, to end it also after the daemon restarted, e.g. the disk throttled
+	Target string `json:"target,omitempty"`
+	// When the fault ends, RFC3339, when the settings are removed if empty
+	Until    string `json:"until,omitempty"`
+	Rejected string `json:"rejected,omitempty"`
+}
+
+// Whether an active fault's duration is over, an invalid end is
+func (s *FaultStatus) Over(now time.Time) bool {
+	if s.Until == "" {
+		return false
+	}
+	until, err := time.Parse(time.RFC3339, s.Until)
+	return err != nil || !now.Before(until)
+}
+
+// Describe the status, e.g. "frozen until 2018-06-01T10:00:30Z"
+func (f *PodFault) Describe(status *FaultStatus) string {
+	switch {
+	case status.Rejected != "":
+		return fmt.Sprintf("rejected (%s)", status.Rejected)
+	case !status.Active:
+		return f.ended
+	}
+	state := f.active
+	if status.Target != "" {
+		state += " " + status.Target
+	}
+	if status.Until != "" {
+		state += " until " + status.Until
+	}
+	return state
+}
+
+func (f *PodFault) statusAnnotation() string {
+	return f.Annotation + "-status"
+}
+
+// Get the pod's status of the fault, nil if it never had one
+func (f *PodFault) GetStatus(podAnnotations map[string]string) (*FaultStatus, error) {
+	value, found := podAnnotations[f.statusAnnotation()]
+	if !found {
+		return nil, nil
+	}
+	status := &FaultStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", f.statusAnnotation(), err)
+	}
+	return status, nil
+}
+
+// Set the pod's status of the fault, nil removes it
+func (f *PodFault) SetStatus(status *FaultStatus, podAnnotations map[string]string) {
+	if status == nil {
+		delete(podAnnotations, f.statusAnnotation())
+		return
+	}
+	data, _ := json.Marshal(status)
+	podAnnotations[f.statusAnnotation()] = string(data)
+}
+
+// Whether the pod is under the fault
+func (f *PodFault) IsActive(podAnnotations map[string]string) bool {
+	status, _ := f.GetStatus(podAnnotations)
+	return status != nil && status.Active
+}
+
+// Mark the fault in progress as over, it was ended early
+func (f *PodFault) SetEnded(podAnnotations map[string]string) {
+	if status, _ := f.GetStatus(podAnnotations); status != nil && status.Active {
+		status.Active = false
+		f.SetStatus(status, podAnnotations)
+	}
+}
+
+// Remove the pod's settings and status of the fault
+func (f *PodFault) Clear(podAnnotations map[string]string) {
+	delete(podAnnotations, f.Annotation)
+	delete(podAnnotations, f.statusAnnotation())
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultStatusOver(t *testing.T) {
+	now := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		until string
+		over  bool
+	}{
+		// Until the settings are removed
+		{"", false},
+		{"2018-06-01T10:00:30Z", false},
+		{"2018-06-01T10:00:00Z", true},
+		{"soon", true},
+	}
+	for _, c := range cases {
+		if over := (&FaultStatus{Active: true, Until: c.until}).Over(now); over != c.over {
+			t.Errorf("until %q: expected over %v, got %v", c.until, c.over, over)
+		}
+	}
+}
+
+func TestDescribeFault(t *testing.T) {
+	cases := []struct {
+		fault    *PodFault
+		status   FaultStatus
+		expected string
+	}{
+		{StressFault, FaultStatus{Active: true}, "running"},
+		{StressFault, FaultStatus{}, "stopped"},
+		{IOFault, FaultStatus{Active: true, Target: "8:0"}, "throttled 8:0"},
+		{ClockFault, FaultStatus{Rejected: "namespace kube-system is protected"}, "rejected (namespace kube-system is protected)"},
+	}
+	for _, c := range cases {
+		if description := c.fault.Describe(&c.status); description != c.expected {
+			t.Errorf("%s %+v: expected %q, got %q", c.fault.Kind, c.status, c.expected, description)
+		}
+	}
+}
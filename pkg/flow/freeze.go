@@ -0,0 +1,53 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"time"
+)
+
+// Annotation freezing all containers of the pod for a while, e.g. duration=30s
+const PodFreezeAnnotation = "kubernetes.io/pod-freeze"
+
+// PodFreeze stops the processes of the pod's containers, as a long GC pause would,
+// and lets them go on after the duration
+type PodFreeze struct {
+	Duration time.Duration
+}
+
+// Parse space separated key=value settings of a freeze, duration is required
+func ParsePodFreeze(spec string) (*PodFreeze, error) {
+	f := &PodFreeze{}
+	err := parseSettings("pod freeze", spec, func(key, value string) error {
+		var err error
+		switch key {
+		case "duration":
+			f.Duration, err = parsePositiveDuration(key, value)
+		default:
+			err = errUnknownSetting
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.Duration == 0 {
+		return nil, fmt.Errorf("no duration")
+	}
+	return f, nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePodFreeze(t *testing.T) {
+	freeze, err := ParsePodFreeze("duration=30s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freeze.Duration != 30*time.Second {
+		t.Errorf("expected 30s, got %v", freeze.Duration)
+	}
+	invalid := map[string]string{
+		"":                "no duration",
+		"duration=0s":     "invalid duration",
+		"duration":        "expected key=value",
+		"duration=1m a=b": "unknown pod freeze setting",
+	}
+	for spec, message := range invalid {
+		if _, err := ParsePodFreeze(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestPodFreezeStatus(t *testing.T) {
+	annotations := map[string]string{PodFreezeAnnotation: "duration=30s"}
+	FreezeFault.SetStatus(&FaultStatus{Spec: "duration=30s", Active: true, Until: "2018-06-01T10:00:30Z"}, annotations)
+	status, err := FreezeFault.GetStatus(annotations)
+	if err != nil || FreezeFault.Describe(status) != "frozen until 2018-06-01T10:00:30Z" {
+		t.Fatalf("unexpected status %v %v", status, err)
+	}
+	FreezeFault.SetEnded(annotations)
+	if status, _ := FreezeFault.GetStatus(annotations); status.Active || FreezeFault.Describe(status) != "thawed" {
+		t.Errorf("expected the freeze to be over, got %v", status)
+	}
+	FreezeFault.Clear(annotations)
+	if len(annotations) != 0 {
+		t.Errorf("expected no annotations left, got %v", annotations)
+	}
+}
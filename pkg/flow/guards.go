@@ -0,0 +1,298 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Value of the chaos-done flag of rejected settings
+const rejected = "rejected"
+
+// Keys of the control ConfigMap holding the guards
+const (
+	protectedNamespacesKey = "protectedNamespaces"
+	maxPodsPerOwnerKey     = "maxPodsPerOwner"
+	maxPercentPerOwnerKey  = "maxPercentPerOwner"
+	maxLossKey             = "maxLoss"
+	maxDelayKey            = "maxDelay"
+)
+
+// Guards limit which pods chaos may hit and how hard, a zero limit is no limit
+type Guards struct {
+	// Namespaces no chaos is applied in
+	ProtectedNamespaces sets.String
+	// Pods of the same ReplicaSet, StatefulSet or other controller under chaos at once
+	MaxPodsPerOwner int
+	// Percentage of the controller's pods under chaos at once
+	MaxPercentPerOwner float64
+	// Highest netem loss percentage
+	MaxLoss float64
+	// Highest netem delay, jitter included
+	MaxDelay time.Duration
+}
+
+// Guards used when the control ConfigMap sets none
+func DefaultGuards() *Guards {
+	return &Guards{
+		ProtectedNamespaces: sets.NewString("kube-system"),
+		MaxLoss:             50,
+		MaxDelay:            5 * time.Second,
+	}
+}
+
+// Read the guards from the control ConfigMap's data over the default ones,
+// invalid values keep the default and are reported in the error
+func ParseGuards(data map[string]string) (*Guards, error) {
+	g := DefaultGuards()
+	invalid := []string{}
+	if value, found := data[protectedNamespacesKey]; found {
+		g.ProtectedNamespaces = sets.NewString()
+		for _, namespace := range strings.Split(value, ",") {
+			if namespace = strings.TrimSpace(namespace); namespace != "" {
+				g.ProtectedNamespaces.Insert(namespace)
+			}
+		}
+	}
+	if value, found := data[maxPodsPerOwnerKey]; found {
+		max, err := strconv.Atoi(value)
+		if err != nil || max < 0 {
+			invalid = append(invalid, fmt.Sprintf("%s %q", maxPodsPerOwnerKey, value))
+		} else {
+			g.MaxPodsPerOwner = max
+		}
+	}
+	if value, found := data[maxPercentPerOwnerKey]; found {
+		max, err := tcstate.ParsePercent(value)
+		if err != nil || max < 0 || max > 100 {
+			invalid = append(invalid, fmt.Sprintf("%s %q", maxPercentPerOwnerKey, value))
+		} else {
+			g.MaxPercentPerOwner = max
+		}
+	}
+	if value, found := data[maxLossKey]; found {
+		max, err := tcstate.ParsePercent(value)
+		if err != nil || max < 0 || max > 100 {
+			invalid = append(invalid, fmt.Sprintf("%s %q", maxLossKey, value))
+		} else {
+			g.MaxLoss = max
+		}
+	}
+	if value, found := data[maxDelayKey]; found {
+		max, err := tcstate.ParseTime(value)
+		if err != nil || max < 0 {
+			invalid = append(invalid, fmt.Sprintf("%s %q", maxDelayKey, value))
+		} else {
+			g.MaxDelay = max
+		}
+	}
+	if len(invalid) > 0 {
+		return g, fmt.Errorf("invalid guards: %s", strings.Join(invalid, ", "))
+	}
+	return g, nil
+}
+
+// Check the pod's namespace
+func (g *Guards) CheckNamespace(namespace string) error {
+	if g.ProtectedNamespaces.Has(namespace) {
+		return fmt.Errorf("namespace %s is protected from chaos", namespace)
+	}
+	return nil
+}
+
+// Check the severity of chaos settings, after profiles are expanded
+func (g *Guards) CheckSeverity(info string, isIngress bool) error {
+	_, netemArgs, err := ParseChaosInfo(info, isIngress)
+	if err != nil {
+		return err
+	}
+	for i, arg := range netemArgs {
+		switch arg {
+		case "delay":
+			if g.MaxDelay == 0 {
+				continue
+			}
+			var delay time.Duration
+			end := i + 3
+			if end > len(netemArgs) {
+				end = len(netemArgs)
+			}
+			// Delay and jitter, the correlation after them is not a time
+			for _, value := range netemArgs[i+1 : end] {
+				d, err := tcstate.ParseTime(value)
+				if err != nil {
+					break
+				}
+				delay += d
+			}
+			if delay > g.MaxDelay {
+				return fmt.Errorf("delay %v is more than the %v allowed", delay, g.MaxDelay)
+			}
+		case "loss":
+			if g.MaxLoss == 0 || i+1 >= len(netemArgs) {
+				continue
+			}
+			value := netemArgs[i+1]
+			if value == "random" && i+2 < len(netemArgs) {
+				value = netemArgs[i+2]
+			}
+			// Loss models (state, gemodel) are not bounded
+			loss, err := tcstate.ParsePercent(value)
+			if err == nil && loss > g.MaxLoss {
+				return fmt.Errorf("loss %v%% is more than the %v%% allowed", loss, g.MaxLoss)
+			}
+		}
+	}
+	return nil
+}
+
+// Check how many of the pod's siblings are under chaos, pods are the ones of the pod's namespace
+func (g *Guards) CheckOwner(pod *v1.Pod, pods []v1.Pod) error {
+	return g.checkOwner(pod, pods, "under chaos", func(sibling *v1.Pod) bool {
+		return IsPodUnderChaos(sibling.Annotations)
+	})
+}
+
+// Check how many of the pod's siblings are under chaos, frozen, stressed, throttled, with io faults, skewed
+// or not ready, before killing the pod or starting a fault of it
+func (g *Guards) CheckOwnerFailure(pod *v1.Pod, pods []v1.Pod) error {
+	return g.checkOwner(pod, pods, "under chaos, frozen, stressed, throttled, with io faults, skewed or not ready", func(sibling *v1.Pod) bool {
+		if IsPodUnderChaos(sibling.Annotations) || !IsPodReady(sibling) {
+			return true
+		}
+		for _, fault := range PodFaults {
+			if fault.IsActive(sibling.Annotations) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (g *Guards) checkOwner(pod *v1.Pod, pods []v1.Pod, state string, disrupted func(sibling *v1.Pod) bool) error {
+	if g.MaxPodsPerOwner == 0 && g.MaxPercentPerOwner == 0 {
+		return nil
+	}
+	owner := meta_v1.GetControllerOf(pod)
+	if owner == nil {
+		return nil
+	}
+
+	total, underChaos := 0, []string{}
+	for i := range pods {
+		sibling := &pods[i]
+		if ref := meta_v1.GetControllerOf(sibling); ref == nil || ref.UID != owner.UID {
+			continue
+		}
+		total++
+		if sibling.UID != pod.UID && disrupted(sibling) {
+			underChaos = append(underChaos, sibling.Name)
+		}
+	}
+	// The pod itself may not be listed yet
+	if total == 0 {
+		total = 1
+	}
+	sort.Strings(underChaos)
+
+	count := len(underChaos) + 1
+	if g.MaxPodsPerOwner > 0 && count > g.MaxPodsPerOwner {
+		return fmt.Errorf("%s %s already has %d pods %s (%s), at most %d allowed",
+			owner.Kind, owner.Name, len(underChaos), state, strings.Join(underChaos, ", "), g.MaxPodsPerOwner)
+	}
+	if g.MaxPercentPerOwner > 0 && float64(count)*100 > g.MaxPercentPerOwner*float64(total) {
+		return fmt.Errorf("%s %s would have %d of %d pods %s, at most %v%% allowed",
+			owner.Kind, owner.Name, count, total, state, g.MaxPercentPerOwner)
+	}
+	return nil
+}
+
+// Expand the pod's chaos settings of a direction and check them against the guards,
+// pods are the ones of the pod's namespace and only needed with owner limits
+func CheckPodChaos(pod *v1.Pod, info string, isIngress bool, profiles Profiles, guards *Guards, pods []v1.Pod) (string, error) {
+	if err := guards.CheckNamespace(pod.Namespace); err != nil {
+		return "", err
+	}
+	info, err := profiles.Resolve(info, isIngress)
+	if err != nil {
+		return "", err
+	}
+	if err := guards.CheckSeverity(info, isIngress); err != nil {
+		return "", err
+	}
+	// Steps of a ramp are between its start and the target, checking both bounds them
+	ramp, err := GetPodChaosRamp(isIngress, pod.Annotations)
+	if err != nil {
+		return "", err
+	}
+	if ramp != nil && ramp.From != "" {
+		from, err := profiles.Resolve(ramp.From, isIngress)
+		if err != nil {
+			return "", fmt.Errorf("invalid ramp start: %v", err)
+		}
+		if err := guards.CheckSeverity(from, isIngress); err != nil {
+			return "", fmt.Errorf("ramp start: %v", err)
+		}
+	}
+	if err := guards.CheckOwner(pod, pods); err != nil {
+		return "", err
+	}
+	return info, nil
+}
+
+// Whether the pod's Ready condition is true
+func IsPodReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Whether chaos settings of the pod are applied in either direction, or its DNS or HTTP chaos rules
+func IsPodUnderChaos(podAnnotations map[string]string) bool {
+	return podAnnotations["kubernetes.io/done-ingress-chaos"] == "yes" || podAnnotations["kubernetes.io/done-egress-chaos"] == "yes" ||
+		IsPodDNSChaosDone(podAnnotations) || IsPodHTTPChaosDone(podAnnotations)
+}
+
+// Mark the chaos settings of a direction rejected, they are left alone until done is set to no again
+func SetPodChaosRejected(isIngress bool, reason string, podAnnotations map[string]string) {
+	direction := "egress"
+	if isIngress {
+		direction = "ingress"
+	}
+	podAnnotations["kubernetes.io/done-"+direction+"-chaos"] = rejected
+	podAnnotations["kubernetes.io/rejected-"+direction+"-chaos"] = reason
+}
+
+// Get why the chaos settings of a direction were rejected, empty if they were not
+func GetPodChaosRejected(isIngress bool, podAnnotations map[string]string) string {
+	if isIngress {
+		return podAnnotations["kubernetes.io/rejected-ingress-chaos"]
+	}
+	return podAnnotations["kubernetes.io/rejected-egress-chaos"]
+}
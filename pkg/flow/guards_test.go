@@ -0,0 +1,143 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestParseGuards(t *testing.T) {
+	guards, err := ParseGuards(map[string]string{
+		"protectedNamespaces": "kube-system, monitoring",
+		"maxPodsPerOwner":     "2",
+		"maxPercentPerOwner":  "50%",
+		"maxLoss":             "20%",
+		"maxDelay":            "2s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !guards.ProtectedNamespaces.HasAll("kube-system", "monitoring") || guards.ProtectedNamespaces.Len() != 2 {
+		t.Errorf("unexpected protected namespaces %v", guards.ProtectedNamespaces.List())
+	}
+	if guards.MaxPodsPerOwner != 2 || guards.MaxPercentPerOwner != 50 || guards.MaxLoss != 20 || guards.MaxDelay != 2*time.Second {
+		t.Errorf("unexpected guards %+v", guards)
+	}
+
+	guards, err = ParseGuards(map[string]string{"maxLoss": "150%", "maxDelay": "soon"})
+	if err == nil || !strings.Contains(err.Error(), "maxLoss") || !strings.Contains(err.Error(), "maxDelay") {
+		t.Errorf("expected maxLoss and maxDelay to be invalid, got %v", err)
+	}
+	if guards.MaxLoss != 50 || guards.MaxDelay != 5*time.Second {
+		t.Errorf("expected the defaults for invalid values, got %+v", guards)
+	}
+}
+
+func TestCheckSeverity(t *testing.T) {
+	guards := DefaultGuards()
+	cases := []struct {
+		info  string
+		valid bool
+	}{
+		{"100kbps,delay,100ms,10ms", true},
+		{"1mbit,delay,4s,1s,25%", true},
+		{"1mbit,delay,4s,2s", false},
+		{",delay,6s", false},
+		{",loss,50%,25%", true},
+		{",loss,random,60%", false},
+		{",loss,0.6", true},
+		{",loss,state,1%,10%", true},
+		{"1mbit,ceil=100kbit", false},
+	}
+	for _, c := range cases {
+		if err := guards.CheckSeverity(c.info, true); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid %v, got %v", c.info, c.valid, err)
+		}
+	}
+}
+
+func ownedPod(name, owner string, underChaos bool) v1.Pod {
+	controller := true
+	pod := v1.Pod{ObjectMeta: meta_v1.ObjectMeta{
+		Name:            name,
+		Namespace:       "default",
+		UID:             types.UID(name),
+		OwnerReferences: []meta_v1.OwnerReference{{Kind: "ReplicaSet", Name: owner, UID: types.UID(owner), Controller: &controller}},
+		Annotations:     map[string]string{},
+	}}
+	if underChaos {
+		pod.Annotations["kubernetes.io/done-egress-chaos"] = "yes"
+	}
+	return pod
+}
+
+func TestCheckOwner(t *testing.T) {
+	pods := []v1.Pod{
+		ownedPod("web-1", "web", true),
+		ownedPod("web-2", "web", false),
+		ownedPod("web-3", "web", false),
+		ownedPod("web-4", "web", false),
+		ownedPod("db-1", "db", true),
+	}
+	cases := []struct {
+		guards Guards
+		pod    v1.Pod
+		valid  bool
+	}{
+		{Guards{}, pods[1], true},
+		{Guards{MaxPodsPerOwner: 2}, pods[1], true},
+		{Guards{MaxPodsPerOwner: 1}, pods[1], false},
+		// Checking a pod already under chaos again does not count it twice
+		{Guards{MaxPodsPerOwner: 1}, pods[0], true},
+		{Guards{MaxPercentPerOwner: 50}, pods[1], true},
+		{Guards{MaxPercentPerOwner: 25}, pods[1], false},
+		{Guards{MaxPodsPerOwner: 1}, ownedPod("db-2", "db", false), false},
+		{Guards{MaxPodsPerOwner: 1}, ownedPod("cache-1", "cache", false), true},
+	}
+	for i, c := range cases {
+		err := c.guards.CheckOwner(&c.pod, pods)
+		if (err == nil) != c.valid {
+			t.Errorf("case %d: expected valid %v, got %v", i, c.valid, err)
+		}
+	}
+}
+
+func TestRejectedChaosIsNotRetried(t *testing.T) {
+	annotations := map[string]string{
+		"kubernetes.io/ingress-chaos":      ",loss,90%",
+		"kubernetes.io/done-ingress-chaos": "no",
+	}
+	SetPodChaosRejected(true, "loss 90% is more than the 50% allowed", annotations)
+	if _, _, ingressNeedUpdate, _, _ := ExtractPodChaosInfo(annotations); ingressNeedUpdate {
+		t.Errorf("expected rejected settings to wait for done to be set to no")
+	}
+	if reason := GetPodChaosRejected(true, annotations); !strings.Contains(reason, "90%") {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	annotations["kubernetes.io/done-ingress-chaos"] = "no"
+	SetPodChaosUpdated(true, false, false, false, annotations)
+	if reason := GetPodChaosRejected(true, annotations); reason != "" {
+		t.Errorf("expected the reason to be removed once applied, got %q", reason)
+	}
+}
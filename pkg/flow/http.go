@@ -0,0 +1,106 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+
+	"github.com/huanwei/kube-chaos/pkg/httpchaos"
+	"k8s.io/api/core/v1"
+)
+
+// Annotations of HTTP chaos, with the same done, clear and rejected flags as network chaos
+const (
+	// Rules of the requests to the pod's ports, e.g. port=8080 path=/api/orders* abort=503,10%; port=8080 delay=2s
+	HTTPChaosAnnotation    = "kubernetes.io/http-chaos"
+	doneHTTPAnnotation     = "kubernetes.io/done-http-chaos"
+	clearHTTPAnnotation    = "kubernetes.io/clear-http-chaos"
+	rejectedHTTPAnnotation = "kubernetes.io/rejected-http-chaos"
+)
+
+// Get the pod's HTTP chaos rules, whether they need to be applied or cleared
+func GetPodHTTPChaos(podAnnotations map[string]string) (spec string, needUpdate, needClear bool) {
+	spec = podAnnotations[HTTPChaosAnnotation]
+	_, needClear = podAnnotations[clearHTTPAnnotation]
+	done, found := podAnnotations[doneHTTPAnnotation]
+	needUpdate = found && done != "yes" && done != rejected
+	return spec, needUpdate, needClear
+}
+
+// Whether the pod's HTTP chaos rules are applied
+func IsPodHTTPChaosDone(podAnnotations map[string]string) bool {
+	return podAnnotations[doneHTTPAnnotation] == "yes"
+}
+
+// Set the pod's HTTP chaos rules to be applied
+func SetPodHTTPChaos(spec string, podAnnotations map[string]string) {
+	podAnnotations[HTTPChaosAnnotation] = spec
+	podAnnotations[doneHTTPAnnotation] = "no"
+	delete(podAnnotations, clearHTTPAnnotation)
+	delete(podAnnotations, rejectedHTTPAnnotation)
+}
+
+// Set the clear flag of the pod's HTTP chaos, the rules are removed once cleared
+func SetPodHTTPChaosClear(podAnnotations map[string]string) {
+	podAnnotations[clearHTTPAnnotation] = "yes"
+	podAnnotations[doneHTTPAnnotation] = "no"
+}
+
+// Mark the pod's HTTP chaos rules applied
+func SetPodHTTPChaosDone(podAnnotations map[string]string) {
+	podAnnotations[doneHTTPAnnotation] = "yes"
+	delete(podAnnotations, rejectedHTTPAnnotation)
+}
+
+// Mark the pod's HTTP chaos rules rejected, they are left alone until done is set to no again
+func SetPodHTTPChaosRejected(reason string, podAnnotations map[string]string) {
+	podAnnotations[doneHTTPAnnotation] = rejected
+	podAnnotations[rejectedHTTPAnnotation] = reason
+}
+
+// Get why the pod's HTTP chaos rules were rejected, empty if they were not
+func GetPodHTTPChaosRejected(podAnnotations map[string]string) string {
+	return podAnnotations[rejectedHTTPAnnotation]
+}
+
+// Remove the pod's HTTP chaos rules and flags, once cleared
+func ClearPodHTTPChaos(podAnnotations map[string]string) {
+	delete(podAnnotations, HTTPChaosAnnotation)
+	delete(podAnnotations, doneHTTPAnnotation)
+	delete(podAnnotations, clearHTTPAnnotation)
+	delete(podAnnotations, rejectedHTTPAnnotation)
+}
+
+// Parse the pod's HTTP chaos rules and check them against the guards, pods are the ones of the
+// pod's namespace and only needed with owner limits
+func CheckPodHTTPChaos(pod *v1.Pod, spec string, guards *Guards, pods []v1.Pod) ([]httpchaos.Rule, error) {
+	rules, err := httpchaos.ParseRules(spec)
+	if err != nil {
+		return nil, err
+	}
+	// The proxy and the redirection are in the pod's own network namespace
+	if pod.Spec.HostNetwork {
+		return nil, fmt.Errorf("pods on the host network are not supported")
+	}
+	if err := guards.CheckNamespace(pod.Namespace); err != nil {
+		return nil, err
+	}
+	if err := guards.CheckOwner(pod, pods); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
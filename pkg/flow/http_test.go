@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+)
+
+func TestPodHTTPChaosLifecycle(t *testing.T) {
+	annotations := map[string]string{}
+	SetPodHTTPChaos("port=8080 abort=503", annotations)
+	if spec, needUpdate, needClear := GetPodHTTPChaos(annotations); spec != "port=8080 abort=503" || !needUpdate || needClear {
+		t.Errorf("expected the rules to need applying, got %q %v %v", spec, needUpdate, needClear)
+	}
+
+	SetPodHTTPChaosRejected("too many pods", annotations)
+	if _, needUpdate, _ := GetPodHTTPChaos(annotations); needUpdate || GetPodHTTPChaosRejected(annotations) != "too many pods" {
+		t.Errorf("expected rejected rules to be left alone, got %v", annotations)
+	}
+	SetPodChaosPending(annotations)
+	if _, needUpdate, _ := GetPodHTTPChaos(annotations); !needUpdate {
+		t.Errorf("expected pending rules to need applying, got %v", annotations)
+	}
+
+	SetPodHTTPChaosDone(annotations)
+	if !IsPodHTTPChaosDone(annotations) || !IsPodUnderChaos(annotations) || GetPodHTTPChaosRejected(annotations) != "" {
+		t.Errorf("expected the pod under http chaos, got %v", annotations)
+	}
+
+	SetPodHTTPChaosClear(annotations)
+	if _, _, needClear := GetPodHTTPChaos(annotations); !needClear {
+		t.Errorf("expected the rules to need clearing, got %v", annotations)
+	}
+	ClearPodHTTPChaos(annotations)
+	if len(annotations) != 0 {
+		t.Errorf("expected no annotations left, got %v", annotations)
+	}
+}
+
+func TestCheckPodHTTPChaos(t *testing.T) {
+	pods := []v1.Pod{ownedPod("web-1", "web", false), ownedPod("web-2", "web", false)}
+	SetPodHTTPChaos("port=8080 delay=1s", pods[1].Annotations)
+	SetPodHTTPChaosDone(pods[1].Annotations)
+	guards := &Guards{MaxPodsPerOwner: 1}
+	if _, err := CheckPodHTTPChaos(&pods[0], "port=8080 delay=1s", guards, pods); err == nil {
+		t.Errorf("expected the sibling under http chaos to count")
+	}
+	if _, err := CheckPodHTTPChaos(&pods[0], "port=8080", &Guards{}, nil); err == nil {
+		t.Errorf("expected invalid rules to be rejected")
+	}
+	if _, err := CheckPodHTTPChaos(&pods[0], "port=8080 delay=1s", &Guards{ProtectedNamespaces: sets.NewString("default")}, nil); err == nil {
+		t.Errorf("expected the protected namespace to be rejected")
+	}
+	if rules, err := CheckPodHTTPChaos(&pods[0], "port=8080 delay=1s", &Guards{}, pods); err != nil || len(rules) != 1 {
+		t.Errorf("expected the rules to be allowed, got %v %v", rules, err)
+	}
+}
+
+func TestCheckPodHTTPChaosHostNetwork(t *testing.T) {
+	pod := ownedPod("web-1", "web", false)
+	pod.Spec.HostNetwork = true
+	if _, err := CheckPodHTTPChaos(&pod, "port=8080 abort=503", &Guards{}, nil); err == nil {
+		t.Errorf("expected a pod on the host network to be rejected")
+	}
+}
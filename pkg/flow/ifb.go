@@ -17,97 +17,519 @@ limitations under the License.
 package flow
 
 import (
-	"errors"
+	"bufio"
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
 	"github.com/golang/glog"
 	"github.com/huanwei/kube-chaos/pkg/exec"
-	"strings"
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
 )
 
-// Initialize two ifb modules using input id
-func InitIfbModule(firstIFB, secondIFB int) error {
-	first := fmt.Sprintf("ifb%d", firstIFB)
-	second := fmt.Sprintf("ifb%d", secondIFB)
-	e := exec.New()
+const (
+	// Aliases marking the ifb devices owned by kube-chaos, and which direction they serve
+	egressIfbAlias  = "kube-chaos-egress"
+	ingressIfbAlias = "kube-chaos-ingress"
+	// The devices shaping the node's own traffic, outside of the pool
+	nodeEgressIfbAlias  = "kube-chaos-node-egress"
+	nodeIngressIfbAlias = "kube-chaos-node-ingress"
+)
+
+// Root qdiscs the kernel attaches to an unconfigured device
+var defaultRootQdiscs = sliceToSets([]string{"noop", "noqueue", "pfifo_fast", "fq_codel", "fq", "mq"})
+
+// IfbPool allocates ifb devices for pods. Pods' egress traffic is mirrored to egress devices
+// and ingress traffic to ingress devices, each pod gets a htb class on one of them.
+// When all devices of a direction are full, a new one is created with "ip link add",
+// and devices created this way are deleted again once idle.
+type IfbPool struct {
+	e         exec.Interface
+	firstIFB  string
+	secondIFB string
+	// Pods per device before another device is created
+	maxPodsPerIFB int
+	// Devices per direction, including the first or second ifb
+	maxIFB int
+
+	// Guards the device lists and locks
+	mu      sync.Mutex
+	egress  []string
+	ingress []string
+	// Serializes the choice of devices, so parallel pods don't all create a new one
+	allocMu sync.Mutex
+	// Held while allocating class ids on a device
+	locks map[string]*sync.Mutex
+	// rx_packets of idle devices seen by the last Release, devices still idle on the next one are deleted
+	idle map[string]string
+}
+
+// Create a pool on top of two fixed ifb devices, one for each direction
+func NewIfbPool(firstIFB, secondIFB, maxPodsPerIFB, maxIFB int) *IfbPool {
+	return &IfbPool{
+		e:             exec.New(),
+		firstIFB:      fmt.Sprintf("ifb%d", firstIFB),
+		secondIFB:     fmt.Sprintf("ifb%d", secondIFB),
+		maxPodsPerIFB: maxPodsPerIFB,
+		maxIFB:        maxIFB,
+		locks:         map[string]*sync.Mutex{},
+		idle:          map[string]string{},
+	}
+}
+
+// Load the ifb module, claim the first and second ifb and pick up devices created by a previous run
+func (p *IfbPool) Init() error {
+	if p.firstIFB == p.secondIFB {
+		return fmt.Errorf("first and second ifb must be different, both are %s", p.firstIFB)
+	}
 
 	// Load ifb module
-	if _, err := e.Command("modprobe", "ifb").CombinedOutput(); err != nil {
+	if _, err := p.e.Command("modprobe", "ifb").CombinedOutput(); err != nil {
 		return err
 	}
 	glog.Infof("IFB mod up")
 
-	// Set two ifb devices up
-	if _, err := e.Command("ip", "link", "set", "dev", first, "up").CombinedOutput(); err != nil {
+	if err := p.Load(); err != nil {
 		return err
 	}
-	glog.Infof("ifb%d up", first)
-	if _, err := e.Command("ip", "link", "set", "dev", second, "up").CombinedOutput(); err != nil {
+
+	// The first ifb serves egress and the second ingress, as before the pool existed
+	if err := p.claim(p.firstIFB, egressIfbAlias); err != nil {
 		return err
 	}
-	glog.Infof("%s up", second)
-
-	// Initialize two ifb interfaces' root queue discipline
-	if err := initIfb(first); err != nil {
+	if err := p.claim(p.secondIFB, ingressIfbAlias); err != nil {
 		return err
 	}
-	glog.Infof("ifb%d inited", first)
-	if err := initIfb(second); err != nil {
+	p.mu.Lock()
+	p.egress = prepend(p.firstIFB, p.egress)
+	p.ingress = prepend(p.secondIFB, p.ingress)
+	p.mu.Unlock()
+
+	// Initialize every device's root queue discipline
+	for _, ifb := range append(p.Devices(false), p.Devices(true)...) {
+		if err := p.up(ifb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find the devices owned by kube-chaos from their aliases, without changing anything
+func (p *IfbPool) Load() error {
+	links, err := p.links()
+	if err != nil {
 		return err
 	}
-	glog.Infof("ifb%d inited", second)
+	egress := []string{}
+	ingress := []string{}
+	for name, alias := range links {
+		switch alias {
+		case egressIfbAlias:
+			egress = append(egress, name)
+		case ingressIfbAlias:
+			ingress = append(ingress, name)
+		}
+	}
+	sortIfbs(egress)
+	sortIfbs(ingress)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.egress = egress
+	p.ingress = ingress
 	return nil
 }
 
-//Initialize ifb interface's root queue discipline
-func initIfb(ifb string) error {
-	e := exec.New()
+// Devices of the given direction, true for ingress, false for egress
+func (p *IfbPool) Devices(isIngress bool) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if isIngress {
+		return append([]string{}, p.ingress...)
+	}
+	return append([]string{}, p.egress...)
+}
 
-	// Check whether ifb has been initialized
-	out, err := e.Command("tc", "qdisc", "show", "dev", ifb).CombinedOutput()
+// Find the device holding the class of the CIDR
+func (p *IfbPool) Find(cidr string, isIngress bool) (string, bool, error) {
+	for _, ifb := range p.Devices(isIngress) {
+		_, _, found, err := findCIDRClass(p.e, cidr, ifb)
+		if err != nil {
+			return "", false, err
+		}
+		if found {
+			return ifb, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Choose the device for the CIDR: the one already holding it, otherwise the least used one,
+// creating a new device when all of them have reached maxPodsPerIFB
+func (p *IfbPool) Allocate(cidr string, isIngress bool) (string, error) {
+	p.allocMu.Lock()
+	defer p.allocMu.Unlock()
+
+	ifb, found, err := p.Find(cidr, isIngress)
+	if err != nil || found {
+		return ifb, err
+	}
+
+	best, bestCount := "", -1
+	for _, ifb := range p.Devices(isIngress) {
+		count, err := p.countClasses(ifb)
+		if err != nil {
+			return "", err
+		}
+		if bestCount < 0 || count < bestCount {
+			best, bestCount = ifb, count
+		}
+	}
+
+	devices := p.Devices(isIngress)
+	if best != "" && (bestCount < p.maxPodsPerIFB || len(devices) >= p.maxIFB) {
+		return best, nil
+	}
+
+	ifb, err = p.create(isIngress)
+	if err != nil {
+		// Overloading a device is better than no chaos at all
+		if best != "" {
+			glog.Errorf("Failed to create ifb device, using %s: %v", best, err)
+			return best, nil
+		}
+		return "", err
+	}
+	return ifb, nil
+}
+
+// Remove the class of the CIDR from whichever device holds it
+func (p *IfbPool) Reset(cidr string, isIngress bool) error {
+	ifb, found, err := p.Find(cidr, isIngress)
 	if err != nil {
 		return err
 	}
+	if !found {
+		return fmt.Errorf("Failed to find cidr: %s on any ifb", cidr)
+	}
+	defer p.lockDevice(ifb)()
+	return Reset(p.e, cidr, ifb)
+}
 
-	outs := strings.Split(string(out), " ")
-	// If it's already initialized, return
-	if len(outs) >= 12 && outs[0] == "qdisc" && outs[1] == "htb" && outs[2] == "1:" && outs[3] == "root" {
-		glog.Infof("%s has already initialized", ifb)
-		return nil
+// Lock the device against parallel class id allocation, returns the unlock function.
+// Finding a free class id and creating the class must happen under the same lock.
+func (p *IfbPool) lockDevice(ifb string) func() {
+	p.mu.Lock()
+	lock, found := p.locks[ifb]
+	if !found {
+		lock = &sync.Mutex{}
+		p.locks[ifb] = lock
 	}
+	p.mu.Unlock()
 
-	glog.Infof("%s not inited, initializing", ifb)
-	// Else reset ifb
-	e.Command("tc", "qdisc", "del", "dev", ifb, "root").CombinedOutput()
-	if _, err := e.Command("tc", "qdisc", "add", "dev", ifb, "root", "handle", "1:", "htb", "default", "0").CombinedOutput(); err != nil {
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Delete devices created by the pool which have no classes and received no traffic since the last call.
+// Must not run in parallel with pods' reconciliation.
+func (p *IfbPool) Release() error {
+	idle := map[string]string{}
+	for _, isIngress := range []bool{false, true} {
+		for _, ifb := range p.Devices(isIngress) {
+			if ifb == p.firstIFB || ifb == p.secondIFB {
+				continue
+			}
+			count, err := p.countClasses(ifb)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			// Veths of pods which lost the chaos label may still mirror to the device
+			rx, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/statistics/rx_packets", ifb))
+			if err != nil {
+				return err
+			}
+			if last, found := p.idle[ifb]; !found || last != string(rx) {
+				idle[ifb] = string(rx)
+				continue
+			}
+
+			if _, err := p.e.Command("ip", "link", "del", "dev", ifb).CombinedOutput(); err != nil {
+				return fmt.Errorf("fail to delete %s: %s", ifb, err)
+			}
+			p.remove(ifb)
+			glog.Infof("Idle %s deleted", ifb)
+		}
+	}
+	p.idle = idle
+	return nil
+}
+
+// Set all devices down and clean their root queue discipline, deleting the ones created by the pool
+func (p *IfbPool) Clear() error {
+	for _, isIngress := range []bool{false, true} {
+		for _, ifb := range p.Devices(isIngress) {
+			if ifb != p.firstIFB && ifb != p.secondIFB {
+				if _, err := p.e.Command("ip", "link", "del", "dev", ifb).CombinedOutput(); err != nil {
+					return fmt.Errorf("fail to delete %s: %s", ifb, err)
+				}
+				p.remove(ifb)
+				glog.Infof("%s deleted", ifb)
+				continue
+			}
+
+			// Set ifb devices down
+			if _, err := p.e.Command("ip", "link", "set", "dev", ifb, "down").CombinedOutput(); err != nil {
+				return err
+			}
+			glog.Infof("%s down", ifb)
+
+			// Clean the root queue discipline
+			if _, err := p.e.Command("tc", "qdisc", "del", "dev", ifb, "root").CombinedOutput(); err != nil {
+				return fmt.Errorf("fail to delete %s's root qdisc: %s", ifb, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Create a new device at the lowest free ifb index
+func (p *IfbPool) create(isIngress bool) (string, error) {
+	ifb, err := p.add()
+	if err != nil {
+		return "", err
+	}
+	alias := egressIfbAlias
+	if isIngress {
+		alias = ingressIfbAlias
+	}
+	if err := p.claim(ifb, alias); err != nil {
+		return "", err
+	}
+	if err := p.up(ifb); err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	if isIngress {
+		p.ingress = append(p.ingress, ifb)
+	} else {
+		p.egress = append(p.egress, ifb)
+	}
+	p.mu.Unlock()
+	glog.Infof("%s created for %s", ifb, alias)
+	return ifb, nil
+}
+
+// Add a device at the lowest free ifb index
+func (p *IfbPool) add() (string, error) {
+	links, err := p.links()
+	if err != nil {
+		return "", err
+	}
+	ifb := ""
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("ifb%d", i)
+		if _, found := links[name]; !found && name != p.firstIFB && name != p.secondIFB {
+			ifb = name
+			break
+		}
+	}
+
+	if _, err := p.e.Command("ip", "link", "add", ifb, "type", "ifb").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("fail to add %s: %s", ifb, err)
+	}
+	return ifb, nil
+}
+
+// The device shaping the node's own traffic of the given direction, created if missing.
+// The node's devices are not part of the pool, pods' classes are never allocated on them
+func (p *IfbPool) NodeDevice(isIngress bool) (string, error) {
+	alias := nodeEgressIfbAlias
+	if isIngress {
+		alias = nodeIngressIfbAlias
+	}
+	links, err := p.links()
+	if err != nil {
+		return "", err
+	}
+	for name, current := range links {
+		if current == alias {
+			return name, nil
+		}
+	}
+
+	ifb, err := p.add()
+	if err != nil {
+		return "", err
+	}
+	if _, err := p.e.Command("ip", "link", "set", "dev", ifb, "alias", alias).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("fail to set %s's alias: %s", ifb, err)
+	}
+	if err := p.up(ifb); err != nil {
+		return "", err
+	}
+	glog.Infof("%s created for %s", ifb, alias)
+	return ifb, nil
+}
+
+// Delete the devices shaping the node's own traffic
+func (p *IfbPool) DeleteNodeDevices() error {
+	links, err := p.links()
+	if err != nil {
 		return err
 	}
+	for name, alias := range links {
+		if alias != nodeEgressIfbAlias && alias != nodeIngressIfbAlias {
+			continue
+		}
+		if _, err := p.e.Command("ip", "link", "del", "dev", name).CombinedOutput(); err != nil {
+			return fmt.Errorf("fail to delete %s: %s", name, err)
+		}
+		glog.Infof("%s deleted", name)
+	}
 	return nil
 }
 
-// Set ifb devices down and clean the root queue discipline
-func ClearIfb(firstIFB, secondIFB int) error {
-	e := exec.New()
+// Mark the device as owned by kube-chaos, refusing devices used by other software
+func (p *IfbPool) claim(ifb, alias string) error {
+	links, err := p.links()
+	if err != nil {
+		return err
+	}
+	current, found := links[ifb]
+	if !found {
+		// Not created by modprobe, e.g. numifbs is smaller than the ifb id
+		if _, err := p.e.Command("ip", "link", "add", ifb, "type", "ifb").CombinedOutput(); err != nil {
+			return fmt.Errorf("fail to add %s: %s", ifb, err)
+		}
+	} else if current != alias {
+		if current == egressIfbAlias || current == ingressIfbAlias {
+			return fmt.Errorf("%s already serves the other direction: alias %q", ifb, current)
+		}
+		if current != "" {
+			return fmt.Errorf("%s is used by other software: alias %q", ifb, current)
+		}
+		// No alias, the device may still be configured by someone else
+		foreign, err := p.isForeign(ifb)
+		if err != nil {
+			return err
+		}
+		if foreign {
+			return fmt.Errorf("%s is used by other software: it has queue disciplines not created by kube-chaos", ifb)
+		}
+	}
 
-	// Set ifb devices down
-	if _, err := e.Command("ip", "link", "set", "dev", fmt.Sprintf("ifb%d", firstIFB), "down").CombinedOutput(); err != nil {
+	if _, err := p.e.Command("ip", "link", "set", "dev", ifb, "alias", alias).CombinedOutput(); err != nil {
+		return fmt.Errorf("fail to set %s's alias: %s", ifb, err)
+	}
+	return nil
+}
+
+// Check whether the root queue discipline of the device is neither the default nor the htb created by initIfb
+func (p *IfbPool) isForeign(ifb string) (bool, error) {
+	qdiscs, err := tcstate.Qdiscs(p.e, ifb)
+	if err != nil {
+		return false, err
+	}
+	for _, qdisc := range qdiscs {
+		if !qdisc.Root {
+			return true, nil
+		}
+		if defaultRootQdiscs.Has(qdisc.Kind) || (qdisc.Kind == "htb" && qdisc.Handle == "1:") {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Set the device up and initialize its root queue discipline
+func (p *IfbPool) up(ifb string) error {
+	if _, err := p.e.Command("ip", "link", "set", "dev", ifb, "up").CombinedOutput(); err != nil {
 		return err
 	}
-	glog.Infof("ifb%d down", firstIFB)
-	if _, err := e.Command("ip", "link", "set", "dev", fmt.Sprintf("ifb%d", secondIFB), "down").CombinedOutput(); err != nil {
+	glog.Infof("%s up", ifb)
+	if err := initIfb(ifb); err != nil {
 		return err
 	}
-	glog.Infof("ifb%d down", secondIFB)
+	glog.Infof("%s inited", ifb)
+	return nil
+}
+
+// Count the htb classes, i.e. the pods, on the device
+func (p *IfbPool) countClasses(ifb string) (int, error) {
+	classes, err := tcstate.Classes(p.e, ifb)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, class := range classes {
+		// Leave out the classes of netem and other qdiscs under the pods' classes
+		if class.Kind == "htb" {
+			count++
+		}
+	}
+	return count, nil
+}
 
-	// Clean the root queue discipline
-	_, err := e.Command("tc", "qdisc", "del", "dev", fmt.Sprintf("ifb%d", firstIFB), "root").CombinedOutput()
+// List ifb devices and their aliases
+func (p *IfbPool) links() (map[string]string, error) {
+	data, err := p.e.Command("ip", "-o", "link", "show", "type", "ifb").CombinedOutput()
 	if err != nil {
-		return errors.New(fmt.Sprintf("fail to delete ifb%d's root qdisc: %s", firstIFB, err))
+		return nil, fmt.Errorf("fail to list ifb devices: %s\n%s", err, data)
 	}
+	links := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		// Expected:
+		// 50: ifb9: <BROADCAST,NOARP> mtu 1500 qdisc noop state DOWN ...\    link/ether 1a:c1:75:e9:da:e5 brd ff:ff:ff:ff:ff:ff\    alias kube-chaos-egress
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		name := strings.TrimSuffix(parts[1], ":")
+		links[name] = fieldAfter(parts, "alias")
+	}
+	return links, nil
+}
+
+func (p *IfbPool) remove(ifb string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.egress = without(p.egress, ifb)
+	p.ingress = without(p.ingress, ifb)
+	delete(p.locks, ifb)
+	delete(p.idle, ifb)
+}
 
-	_, err = e.Command("tc", "qdisc", "del", "dev", fmt.Sprintf("ifb%d", secondIFB), "root").CombinedOutput()
+// Initialize ifb interface's root queue discipline
+func initIfb(ifb string) error {
+	e := exec.New()
+
+	// Check whether ifb has been initialized
+	qdiscs, err := tcstate.Qdiscs(e, ifb)
 	if err != nil {
-		return errors.New(fmt.Sprintf("fail to delete ifb%d's root qdisc: %s", secondIFB, err))
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		// If it's already initialized, return
+		if qdisc.Root && qdisc.Kind == "htb" && qdisc.Handle == "1:" {
+			glog.Infof("%s has already initialized", ifb)
+			return nil
+		}
 	}
 
+	glog.Infof("%s not inited, initializing", ifb)
+	// Else reset ifb
+	e.Command("tc", "qdisc", "del", "dev", ifb, "root").CombinedOutput()
+	if _, err := e.Command("tc", "qdisc", "add", "dev", ifb, "root", "handle", "1:", "htb", "default", "0").CombinedOutput(); err != nil {
+		return err
+	}
 	return nil
 }
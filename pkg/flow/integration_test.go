@@ -0,0 +1,741 @@
+//go:build integration && linux
+// +build integration,linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Integration tests of the shaper against a real kernel. They need root and
+// create a network namespace, a veth pair and two ifb devices, run with:
+//   go test -tags integration ./pkg/flow/
+
+package flow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	testNetns     = "kube-chaos-test"
+	testHostVeth  = "kchaos-host"
+	testPodVeth   = "kchaos-pod"
+	testHostIP    = "10.199.0.1"
+	testPodIP     = "10.199.0.2"
+	testFirstIFB  = 90
+	testSecondIFB = 91
+)
+
+// harness is a pod emulated by a network namespace, connected to the host by a veth pair
+type harness struct {
+	t          *testing.T
+	pool       *IfbPool
+	createdIFB []string
+	tmpDir     string
+	netem      bool
+}
+
+func run(t *testing.T, cmd string, args ...string) {
+	if out, err := osexec.Command(cmd, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s %s: %v\n%s", cmd, strings.Join(args, " "), err, out)
+	}
+}
+
+func setupHarness(t *testing.T) *harness {
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests need root")
+	}
+	for _, tool := range []string{"ip", "tc"} {
+		if _, err := osexec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	h := &harness{t: t}
+
+	// The ifb pool loads the ifb module, some test environments have it built in and lack modprobe
+	if _, err := osexec.LookPath("modprobe"); err != nil {
+		h.tmpDir, err = ioutil.TempDir("", "kube-chaos")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(h.tmpDir, "modprobe"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("PATH", h.tmpDir+":"+os.Getenv("PATH"))
+	}
+
+	// Clean up leftovers of an interrupted run
+	osexec.Command("ip", "netns", "del", testNetns).Run()
+	osexec.Command("ip", "link", "del", testHostVeth).Run()
+
+	for _, ifb := range []int{testFirstIFB, testSecondIFB} {
+		name := fmt.Sprintf("ifb%d", ifb)
+		if osexec.Command("ip", "link", "show", name).Run() != nil {
+			run(t, "ip", "link", "add", name, "type", "ifb")
+			h.createdIFB = append(h.createdIFB, name)
+		}
+	}
+
+	run(t, "ip", "netns", "add", testNetns)
+	run(t, "ip", "link", "add", testHostVeth, "type", "veth", "peer", "name", testPodVeth)
+	run(t, "ip", "link", "set", testPodVeth, "netns", testNetns)
+	run(t, "ip", "addr", "add", testHostIP+"/24", "dev", testHostVeth)
+	run(t, "ip", "link", "set", testHostVeth, "up")
+	run(t, "ip", "netns", "exec", testNetns, "ip", "addr", "add", testPodIP+"/24", "dev", testPodVeth)
+	run(t, "ip", "netns", "exec", testNetns, "ip", "link", "set", testPodVeth, "up")
+	run(t, "ip", "netns", "exec", testNetns, "ip", "link", "set", "lo", "up")
+
+	// Not every kernel has sch_netem, rate limiting only needs htb
+	if osexec.Command("tc", "qdisc", "add", "dev", testHostVeth, "root", "netem").Run() == nil {
+		h.netem = true
+		osexec.Command("tc", "qdisc", "del", "dev", testHostVeth, "root").Run()
+	}
+
+	h.pool = NewIfbPool(testFirstIFB, testSecondIFB, 32, 2)
+	if err := h.pool.Init(); err != nil {
+		h.teardown()
+		t.Fatalf("Init ifb pool: %v", err)
+	}
+	return h
+}
+
+func (h *harness) teardown() {
+	osexec.Command("ip", "netns", "del", testNetns).Run()
+	osexec.Command("ip", "link", "del", testHostVeth).Run()
+	h.pool.Clear()
+	for _, ifb := range h.createdIFB {
+		osexec.Command("ip", "link", "del", ifb).Run()
+	}
+	if h.tmpDir != "" {
+		os.RemoveAll(h.tmpDir)
+	}
+}
+
+func (h *harness) requireNetem() {
+	if !h.netem {
+		h.t.Skip("kernel has no netem qdisc")
+	}
+}
+
+// Run fn with the calling thread inside the pod's network namespace.
+// Sockets created by fn stay in the namespace after it returns.
+func (h *harness) inNetns(fn func() error) error {
+	runtime.LockOSThread()
+
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	target, err := os.Open(filepath.Join("/var/run/netns", testNetns))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	fnErr := fn()
+	// Leave the thread locked if it can't be switched back, the runtime then drops it
+	if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		return err
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// Start a UDP echo server inside the pod
+func (h *harness) udpEcho() net.PacketConn {
+	var conn net.PacketConn
+	err := h.inNetns(func() (err error) {
+		conn, err = net.ListenPacket("udp4", testPodIP+":0")
+		return err
+	})
+	if err != nil {
+		h.t.Fatalf("listen in netns: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// Send count UDP probes from the host to the echo server, return the median RTT and the lost probes
+func (h *harness) udpProbe(server net.PacketConn, count int) (time.Duration, int) {
+	conn, err := net.Dial("udp4", server.LocalAddr().String())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rtts := []time.Duration{}
+	lost := 0
+	buf := make([]byte, 8)
+	for seq := uint64(0); seq < uint64(count); seq++ {
+		binary.BigEndian.PutUint64(buf, seq)
+		start := time.Now()
+		if _, err := conn.Write(buf); err != nil {
+			h.t.Fatal(err)
+		}
+		conn.SetReadDeadline(start.Add(time.Second))
+		for {
+			reply := make([]byte, 8)
+			n, err := conn.Read(reply)
+			if err != nil {
+				lost++
+				break
+			}
+			// Skip late replies of earlier probes
+			if n == 8 && binary.BigEndian.Uint64(reply) == seq {
+				rtts = append(rtts, time.Since(start))
+				break
+			}
+		}
+	}
+	if len(rtts) == 0 {
+		return 0, lost
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	return rtts[len(rtts)/2], lost
+}
+
+// Measure the TCP throughput in bits/s from the host to the pod, or from the pod to the host
+func (h *harness) tcpThroughput(toPod bool, duration time.Duration) float64 {
+	var listener net.Listener
+	var err error
+	if toPod {
+		err = h.inNetns(func() (err error) {
+			listener, err = net.Listen("tcp4", testPodIP+":0")
+			return err
+		})
+	} else {
+		listener, err = net.Listen("tcp4", testHostIP+":0")
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var received int64
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(buf)
+			atomic.AddInt64(&received, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var conn net.Conn
+	if toPod {
+		conn, err = net.Dial("tcp4", listener.Addr().String())
+	} else {
+		err = h.inNetns(func() (err error) {
+			conn, err = net.Dial("tcp4", listener.Addr().String())
+			return err
+		})
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 64*1024)
+	start := time.Now()
+	conn.SetWriteDeadline(start.Add(duration))
+	for time.Since(start) < duration {
+		if _, err := conn.Write(buf); err != nil {
+			break
+		}
+	}
+	return float64(atomic.LoadInt64(&received)) * 8 / time.Since(start).Seconds()
+}
+
+// Mirror the pod's traffic and add netem to its class, the same way the daemon does
+func (h *harness) apply(isIngress bool, info string) *tcShaper {
+	s := NewTCShaper(testHostVeth, h.pool).(*tcShaper)
+	cidr := testPodIP + "/32"
+	if isIngress {
+		if err := s.ReconcileIngressMirroring(cidr); err != nil {
+			h.t.Fatalf("ReconcileIngressMirroring: %v", err)
+		}
+		s.ClearIngressInterface()
+		if err := s.ReconcileIngressInterface(); err != nil {
+			h.t.Fatalf("ReconcileIngressInterface: %v", err)
+		}
+	} else {
+		if err := s.ReconcileEgressMirroring(cidr); err != nil {
+			h.t.Fatalf("ReconcileEgressMirroring: %v", err)
+		}
+		s.ClearEgressInterface()
+		if err := s.ReconcileEgressInterface(); err != nil {
+			h.t.Fatalf("ReconcileEgressInterface: %v", err)
+		}
+	}
+	if err := s.ExecTcChaos(isIngress, info); err != nil {
+		h.t.Fatalf("ExecTcChaos(%v, %q): %v", isIngress, info, err)
+	}
+	return s
+}
+
+// Remove the pod's mirroring and ifb class in one direction
+func (h *harness) reset(isIngress bool) {
+	cidr := testPodIP + "/32"
+	if isIngress {
+		if err := ClearIngressMirroring(testHostVeth); err != nil {
+			h.t.Errorf("ClearIngressMirroring: %v", err)
+		}
+		if err := h.pool.Reset(cidr, true); err != nil {
+			h.t.Errorf("Reset ingress: %v", err)
+		}
+	} else {
+		if err := ClearEgressMirroring(testHostVeth); err != nil {
+			h.t.Errorf("ClearEgressMirroring: %v", err)
+		}
+		if err := h.pool.Reset(cidr, false); err != nil {
+			h.t.Errorf("Reset egress: %v", err)
+		}
+	}
+}
+
+func TestIngressDelay(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+	h.requireNetem()
+
+	server := h.udpEcho()
+	defer server.Close()
+
+	h.apply(true, ",delay,100ms")
+	rtt, lost := h.udpProbe(server, 10)
+	if lost != 0 || rtt < 100*time.Millisecond {
+		t.Errorf("expected RTT >= 100ms without loss, got %v and %d lost", rtt, lost)
+	}
+
+	h.reset(true)
+	rtt, lost = h.udpProbe(server, 10)
+	if lost != 0 || rtt >= 100*time.Millisecond {
+		t.Errorf("expected RTT < 100ms without loss after reset, got %v and %d lost", rtt, lost)
+	}
+}
+
+func TestEgressDelay(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+	h.requireNetem()
+
+	server := h.udpEcho()
+	defer server.Close()
+
+	h.apply(false, ",delay,100ms")
+	rtt, lost := h.udpProbe(server, 10)
+	if lost != 0 || rtt < 100*time.Millisecond {
+		t.Errorf("expected RTT >= 100ms without loss, got %v and %d lost", rtt, lost)
+	}
+
+	h.reset(false)
+	rtt, _ = h.udpProbe(server, 10)
+	if rtt >= 100*time.Millisecond {
+		t.Errorf("expected RTT < 100ms after reset, got %v", rtt)
+	}
+}
+
+func TestEgressLoss(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+	h.requireNetem()
+
+	server := h.udpEcho()
+	defer server.Close()
+
+	h.apply(false, ",loss,50%")
+	// Replies are lost with 50% probability, 200 probes keep the result far from the bounds
+	count := 200
+	if _, lost := h.udpProbe(server, count); lost < count/4 || lost > count*3/4 {
+		t.Errorf("expected about 50%% of %d probes lost, got %d", count, lost)
+	}
+
+	h.reset(false)
+	if _, lost := h.udpProbe(server, 20); lost != 0 {
+		t.Errorf("expected no loss after reset, got %d", lost)
+	}
+}
+
+func TestRate(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+
+	limit := 1000000.0
+	cases := []struct {
+		name      string
+		isIngress bool
+	}{
+		{name: "ingress", isIngress: true},
+		{name: "egress", isIngress: false},
+	}
+	for _, c := range cases {
+		// Only the htb class is needed for rate, so don't depend on netem here
+		s := NewTCShaper(testHostVeth, h.pool).(*tcShaper)
+		cidr := testPodIP + "/32"
+		if c.isIngress {
+			if err := s.ReconcileIngressMirroring(cidr); err != nil {
+				t.Fatalf("%s: ReconcileIngressMirroring: %v", c.name, err)
+			}
+			if err := s.Rate(s.ingressClassid, s.ingressIFB, "1mbit"); err != nil {
+				t.Fatalf("%s: Rate: %v", c.name, err)
+			}
+		} else {
+			if err := s.ReconcileEgressMirroring(cidr); err != nil {
+				t.Fatalf("%s: ReconcileEgressMirroring: %v", c.name, err)
+			}
+			if err := s.Rate(s.egressClassid, s.egressIFB, "1mbit"); err != nil {
+				t.Fatalf("%s: Rate: %v", c.name, err)
+			}
+		}
+
+		if rate := h.tcpThroughput(c.isIngress, 2*time.Second); rate > limit*1.5 {
+			t.Errorf("%s: expected throughput <= %.0f bit/s, got %.0f bit/s", c.name, limit*1.5, rate)
+		}
+
+		h.reset(c.isIngress)
+		if rate := h.tcpThroughput(c.isIngress, time.Second); rate < limit*5 {
+			t.Errorf("%s: expected throughput to recover after reset, got %.0f bit/s", c.name, rate)
+		}
+	}
+}
+
+func TestChaosStats(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+
+	cidr := testPodIP + "/32"
+	s := NewTCShaper(testHostVeth, h.pool).(*tcShaper)
+	if err := s.ReconcileIngressMirroring(cidr); err != nil {
+		t.Fatalf("ReconcileIngressMirroring: %v", err)
+	}
+	if err := s.Rate(s.ingressClassid, s.ingressIFB, "1mbit"); err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	h.tcpThroughput(true, time.Second)
+
+	stats, err := GetChaosStats(cidr, true, h.pool)
+	if err != nil {
+		t.Fatalf("GetChaosStats: %v", err)
+	}
+	if stats == nil || stats.SentPackets == 0 || stats.SentBytes == 0 {
+		t.Fatalf("expected packets sent through the class, got %+v", stats)
+	}
+	if stats.Overlimits == 0 {
+		t.Errorf("expected the rate limit to be hit, got %+v", stats)
+	}
+
+	// Nothing is set up for egress
+	if stats, err := GetChaosStats(cidr, false, h.pool); err != nil || stats != nil {
+		t.Errorf("expected no egress stats, got %+v (%v)", stats, err)
+	}
+
+	annotations := map[string]string{}
+	if !SetPodChaosStats(stats, nil, annotations) {
+		t.Errorf("expected the stats annotation to be set")
+	}
+	if SetPodChaosStats(stats, nil, annotations) {
+		t.Errorf("expected unchanged stats not to be set again")
+	}
+	published, err := GetPodChaosStats(annotations)
+	if err != nil || published.Ingress == nil || *published.Ingress != *stats || published.Egress != nil {
+		t.Errorf("expected %+v to be published, got %+v (%v)", stats, published, err)
+	}
+	h.reset(true)
+}
+
+func TestClearIfb(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+
+	server := h.udpEcho()
+	defer server.Close()
+
+	s := NewTCShaper(testHostVeth, h.pool).(*tcShaper)
+	if err := s.ReconcileIngressMirroring(testPodIP + "/32"); err != nil {
+		t.Fatalf("ReconcileIngressMirroring: %v", err)
+	}
+	if err := s.ReconcileEgressMirroring(testPodIP + "/32"); err != nil {
+		t.Fatalf("ReconcileEgressMirroring: %v", err)
+	}
+	if _, lost := h.udpProbe(server, 5); lost != 0 {
+		t.Errorf("expected traffic to pass through the ifb devices, got %d lost", lost)
+	}
+
+	// Tear everything down the way the daemon does on kubernetes.io/clear-chaos
+	if err := ClearIngressMirroring(testHostVeth); err != nil {
+		t.Errorf("ClearIngressMirroring: %v", err)
+	}
+	if err := ClearEgressMirroring(testHostVeth); err != nil {
+		t.Errorf("ClearEgressMirroring: %v", err)
+	}
+	if err := h.pool.Clear(); err != nil {
+		t.Errorf("Clear ifb pool: %v", err)
+	}
+
+	for _, ifb := range []int{testFirstIFB, testSecondIFB} {
+		out, err := osexec.Command("tc", "qdisc", "show", "dev", fmt.Sprintf("ifb%d", ifb)).CombinedOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(out), "htb") {
+			t.Errorf("expected no htb on ifb%d after clearing the ifb pool, got %s", ifb, out)
+		}
+	}
+	if _, lost := h.udpProbe(server, 5); lost != 0 {
+		t.Errorf("expected normal traffic after clearing the ifb pool, got %d lost", lost)
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+
+	server := h.udpEcho()
+	defer server.Close()
+
+	cidr := testPodIP + "/32"
+	s := NewTCShaper(testHostVeth, h.pool).(*tcShaper)
+	s.Begin()
+	if err := s.ReconcileIngressMirroring(cidr); err != nil {
+		t.Fatalf("ReconcileIngressMirroring: %v", err)
+	}
+	// The invalid rate is the last step, so everything before it has been applied when it fails
+	if err := s.Rate(s.ingressClassid, s.ingressIFB, "notarate"); err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	err := s.Commit()
+	if err == nil {
+		t.Fatalf("expected the batch to fail")
+	}
+	if !strings.Contains(err.Error(), "set rate notarate") {
+		t.Errorf("expected the error to name the failed step, got %v", err)
+	}
+
+	out, err := osexec.Command("tc", "qdisc", "show", "dev", testHostVeth).CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "htb") {
+		t.Errorf("expected no htb on %s after rollback, got %s", testHostVeth, out)
+	}
+	if count, err := h.pool.countClasses(s.ingressIFB); err != nil || count != 0 {
+		t.Errorf("expected no class on %s after rollback, got %d (%v)", s.ingressIFB, count, err)
+	}
+	if _, found, err := h.pool.Find(cidr, true); err != nil || found {
+		t.Errorf("expected no filter of %s after rollback, got %v (%v)", cidr, found, err)
+	}
+	if _, lost := h.udpProbe(server, 5); lost != 0 {
+		t.Errorf("expected normal traffic after rollback, got %d lost", lost)
+	}
+
+	// The device lock is released by Commit, so the pod can be set up again
+	if err := s.ReconcileIngressMirroring(cidr); err != nil {
+		t.Fatalf("ReconcileIngressMirroring after rollback: %v", err)
+	}
+	h.reset(true)
+}
+
+func TestBatchRollbackRestores(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+	h.requireNetem()
+
+	previous := h.apply(true, "1mbit,delay,100ms")
+	cidr := testPodIP + "/32"
+	s := NewTCShaper(testHostVeth, h.pool).(*tcShaper)
+	s.Begin()
+	if err := s.ReconcileIngressMirroring(cidr); err != nil {
+		t.Fatalf("ReconcileIngressMirroring: %v", err)
+	}
+	s.ClearIngressInterface()
+	if err := s.ReconcileIngressInterface(); err != nil {
+		t.Fatalf("ReconcileIngressInterface: %v", err)
+	}
+	if err := s.ExecTcChaos(true, "2mbit,delay,10ms"); err != nil {
+		t.Fatalf("ExecTcChaos: %v", err)
+	}
+	if err := s.Rate(s.ingressClassid, s.ingressIFB, "notarate"); err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	if err := s.Commit(); err == nil {
+		t.Fatalf("expected the batch to fail")
+	}
+
+	// The class and netem are back to the chaos applied before the batch
+	classes, err := tcstate.Classes(s.e, previous.ingressIFB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, class := range classes {
+		if class.Handle == previous.ingressClassid && (class.Htb == nil || class.Htb.Rate != 1000000) {
+			t.Errorf("expected the class rate restored to 1mbit, got %+v", class.Htb)
+		}
+	}
+	qdiscs, err := tcstate.Qdiscs(s.e, previous.ingressIFB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := false
+	for _, qdisc := range qdiscs {
+		if qdisc.Parent == previous.ingressClassid && qdisc.Netem != nil {
+			restored = qdisc.Netem.Delay == 100*time.Millisecond
+		}
+	}
+	if !restored {
+		t.Errorf("expected the netem delay restored to 100ms, got %+v", qdiscs)
+	}
+	h.reset(true)
+}
+
+func TestIfbPoolGrowAndRelease(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+	// One pod per device, so the second pod needs a new one
+	h.pool.maxPodsPerIFB = 1
+
+	s := NewTCShaper(testHostVeth, h.pool).(*tcShaper)
+	if err := s.ReconcileIngressMirroring(testPodIP + "/32"); err != nil {
+		t.Fatalf("ReconcileIngressMirroring: %v", err)
+	}
+	if s.ingressIFB != fmt.Sprintf("ifb%d", testSecondIFB) {
+		t.Errorf("expected the first pod on ifb%d, got %s", testSecondIFB, s.ingressIFB)
+	}
+
+	ifb, err := h.pool.Allocate("10.199.0.3/32", true)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if ifb == s.ingressIFB {
+		t.Fatalf("expected a new device for the second pod, got %s", ifb)
+	}
+	if devices := h.pool.Devices(true); len(devices) != 2 {
+		t.Errorf("expected 2 ingress devices, got %v", devices)
+	}
+	out, err := osexec.Command("ip", "link", "show", ifb).CombinedOutput()
+	if err != nil || !strings.Contains(string(out), ingressIfbAlias) {
+		t.Errorf("expected %s with alias %s, got %v %s", ifb, ingressIfbAlias, err, out)
+	}
+
+	// The pool is full, further pods share the existing devices
+	if another, err := h.pool.Allocate("10.199.0.4/32", true); err != nil || (another != ifb && another != s.ingressIFB) {
+		t.Errorf("expected an existing device once maxIFB is reached, got %s %v", another, err)
+	}
+
+	// The new device has no class, it's deleted once it stays idle between two releases
+	for i := 0; i < 2; i++ {
+		if err := h.pool.Release(); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	}
+	if osexec.Command("ip", "link", "show", ifb).Run() == nil {
+		t.Errorf("expected idle %s to be deleted", ifb)
+	}
+	if devices := h.pool.Devices(true); len(devices) != 1 {
+		t.Errorf("expected only ifb%d left, got %v", testSecondIFB, devices)
+	}
+
+	// A device configured by other software is refused
+	if osexec.Command("ip", "link", "show", "ifb92").Run() != nil {
+		run(t, "ip", "link", "add", "ifb92", "type", "ifb")
+		defer osexec.Command("ip", "link", "del", "ifb92").Run()
+	}
+	run(t, "tc", "qdisc", "replace", "dev", "ifb92", "root", "tbf", "rate", "1mbit", "burst", "10k", "latency", "50ms")
+	if err := NewIfbPool(92, testSecondIFB, 32, 2).Init(); err == nil {
+		t.Errorf("expected ifb92 with a tbf root qdisc to be refused")
+	}
+}
+
+func TestParallelClassAllocation(t *testing.T) {
+	h := setupHarness(t)
+	defer h.teardown()
+
+	// One veth per pod, the peers stay on the host since no traffic is sent
+	pods := 8
+	for i := 0; i < pods; i++ {
+		veth := fmt.Sprintf("kchaos-par%d", i)
+		run(t, "ip", "link", "add", veth, "type", "veth", "peer", "name", fmt.Sprintf("kchaos-peer%d", i))
+		defer osexec.Command("ip", "link", "del", veth).Run()
+		run(t, "ip", "link", "set", veth, "up")
+	}
+
+	shapers := make([]*tcShaper, pods)
+	errs := make([]error, pods)
+	var wg sync.WaitGroup
+	for i := 0; i < pods; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shapers[i] = NewTCShaper(fmt.Sprintf("kchaos-par%d", i), h.pool).(*tcShaper)
+			errs[i] = shapers[i].ReconcileIngressMirroring(fmt.Sprintf("10.199.1.%d/32", i+1))
+		}(i)
+	}
+	wg.Wait()
+
+	classes := map[string]int{}
+	for i, s := range shapers {
+		if errs[i] != nil {
+			t.Errorf("pod %d: ReconcileIngressMirroring: %v", i, errs[i])
+			continue
+		}
+		key := s.ingressIFB + " " + s.ingressClassid
+		if other, found := classes[key]; found {
+			t.Errorf("pods %d and %d both got class %s", other, i, key)
+		}
+		classes[key] = i
+	}
+	for i := 0; i < pods; i++ {
+		if err := h.pool.Reset(fmt.Sprintf("10.199.1.%d/32", i+1), true); err != nil {
+			t.Errorf("pod %d: Reset: %v", i, err)
+		}
+	}
+}
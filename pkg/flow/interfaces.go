@@ -35,4 +35,8 @@ type Shaper interface {
 	ReconcileEgressMirroring(cidr string) error
 	// Execute tc command on the veth, true for ingress, false for egress
 	ExecTcChaos(isIngress bool, info string) error
+	// Queue the following tc commands instead of running them one by one
+	Begin()
+	// Apply the queued tc commands at once, rolling them back if any of them fails
+	Commit() error
 }
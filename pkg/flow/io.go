@@ -0,0 +1,94 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Annotation throttling the IO of the pod on the disk of a path in a container, e.g.
+// path=/var/lib/mysql read-bps=1Mi write-iops=20 duration=5m
+const PodIOAnnotation = "kubernetes.io/pod-io"
+
+// PodIO throttles the reads and writes of the pod's cgroup on the disk the path is on
+type PodIO struct {
+	// Path in the container, a volume's mount path or below
+	Path string
+	// Container the path is looked up in, the first running one if empty
+	Container string
+	Limits    container.IOLimits
+	// Until the throttling is removed if zero
+	Duration time.Duration
+}
+
+// Parse space separated key=value settings of IO throttling, path and a limit are required
+func ParsePodIO(spec string) (*PodIO, error) {
+	p := &PodIO{}
+	err := parseSettings("pod io", spec, func(key, value string) error {
+		var err error
+		switch key {
+		case "path":
+			if !strings.HasPrefix(value, "/") {
+				return fmt.Errorf("invalid path %q, expected an absolute path", value)
+			}
+			p.Path = value
+		case "container":
+			p.Container = value
+		case "read-bps", "write-bps":
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil || quantity.Value() <= 0 {
+				return fmt.Errorf("invalid %s %q, expected bytes per second such as 1Mi", key, value)
+			}
+			if key == "read-bps" {
+				p.Limits.ReadBPS = quantity.Value()
+			} else {
+				p.Limits.WriteBPS = quantity.Value()
+			}
+		case "read-iops", "write-iops":
+			iops, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || iops <= 0 {
+				return fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "read-iops" {
+				p.Limits.ReadIOPS = iops
+			} else {
+				p.Limits.WriteIOPS = iops
+			}
+		case "duration":
+			p.Duration, err = parsePositiveDuration(key, value)
+		default:
+			err = errUnknownSetting
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.Path == "" {
+		return nil, fmt.Errorf("no path")
+	}
+	if p.Limits == (container.IOLimits{}) {
+		return nil, fmt.Errorf("no read-bps, write-bps, read-iops or write-iops")
+	}
+	return p, nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"k8s.io/api/core/v1"
+)
+
+func TestParsePodIO(t *testing.T) {
+	p, err := ParsePodIO("path=/var/lib/mysql container=db read-bps=1Mi write-iops=20 duration=5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PodIO{Path: "/var/lib/mysql", Container: "db", Limits: container.IOLimits{ReadBPS: 1 << 20, WriteIOPS: 20}, Duration: 5 * time.Minute}
+	if *p != expected {
+		t.Errorf("expected %+v, got %+v", expected, *p)
+	}
+
+	invalid := map[string]string{
+		"read-bps=1Mi":                       "no path",
+		"path=/data":                         "no read-bps",
+		"path=data read-iops=1":              "invalid path",
+		"path=/data read-bps=fast":           "invalid read-bps",
+		"path=/data write-iops=0":            "invalid write-iops",
+		"path=/data read-iops=1 duration=0s": "invalid duration",
+		"path=/data errors=10%":              "unknown pod io setting",
+		"path":                               "expected key=value",
+	}
+	for spec, message := range invalid {
+		if _, err := ParsePodIO(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestPodIOStatus(t *testing.T) {
+	annotations := map[string]string{}
+	IOFault.SetStatus(&FaultStatus{Spec: "path=/data read-iops=10", Target: "8:0", Active: true, Until: "2018-06-01T10:05:00Z"}, annotations)
+	status, err := IOFault.GetStatus(annotations)
+	if err != nil || IOFault.Describe(status) != "throttled 8:0 until 2018-06-01T10:05:00Z" {
+		t.Errorf("unexpected status %+v %v", status, err)
+	}
+
+	ready := []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	pods := []v1.Pod{ownedPod("web-1", "web", false), ownedPod("web-2", "web", false)}
+	for i := range pods {
+		pods[i].Status.Conditions = ready
+	}
+	pods[1].Annotations = annotations
+	if err := IOFault.Check(&pods[0], &Guards{MaxPodsPerOwner: 1}, pods); err == nil {
+		t.Errorf("expected the throttled sibling to count")
+	}
+
+	IOFault.SetEnded(annotations)
+	if status, _ := IOFault.GetStatus(annotations); status.Active || status.Target != "8:0" || IOFault.Describe(status) != "restored" {
+		t.Errorf("expected the status restored with its device, got %+v", status)
+	}
+	if err := IOFault.Check(&pods[0], &Guards{MaxPodsPerOwner: 1}, pods); err != nil {
+		t.Errorf("expected the restored sibling not to count, got %v", err)
+	}
+	IOFault.Clear(annotations)
+	if len(annotations) != 0 {
+		t.Errorf("expected no annotations left, got %v", annotations)
+	}
+}
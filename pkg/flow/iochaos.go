@@ -0,0 +1,91 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/iochaos"
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+)
+
+// Annotation injecting latency and errors into the file operations of the pod under a path in
+// a container, e.g. path=/var/lib/mysql delay=100ms errno=EIO percent=10 duration=5m
+const PodIOChaosAnnotation = "kubernetes.io/pod-io-chaos"
+
+// PodIOChaos delays the operations on the files under the path and fails them by a chance
+type PodIOChaos struct {
+	// Path in the container, a directory the faults are mounted over
+	Path string
+	// Container the path is in, the first running one if empty
+	Container string
+	Faults    iochaos.Faults
+	// Until the faults are removed if zero
+	Duration time.Duration
+}
+
+// Parse space separated key=value settings of IO chaos, path and a delay or percent are
+// required, the faults apply to reads and writes unless ops are given
+func ParsePodIOChaos(spec string) (*PodIOChaos, error) {
+	p := &PodIOChaos{Faults: iochaos.Faults{Ops: iochaos.DefaultOps}}
+	err := parseSettings("pod io chaos", spec, func(key, value string) error {
+		var err error
+		switch key {
+		case "path":
+			if !strings.HasPrefix(value, "/") {
+				return fmt.Errorf("invalid path %q, expected an absolute path", value)
+			}
+			p.Path = value
+		case "container":
+			p.Container = value
+		case "delay":
+			p.Faults.Delay, err = parsePositiveDuration(key, value)
+		case "errno":
+			p.Faults.Errno, err = iochaos.ParseErrno(value)
+		case "percent":
+			if p.Faults.Percent, err = tcstate.ParsePercent(value); err != nil || p.Faults.Percent <= 0 || p.Faults.Percent > 100 {
+				return fmt.Errorf("invalid percent %q", value)
+			}
+		case "ops":
+			p.Faults.Ops, err = iochaos.ParseOps(value)
+		case "duration":
+			p.Duration, err = parsePositiveDuration(key, value)
+		default:
+			err = errUnknownSetting
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.Path == "" {
+		return nil, fmt.Errorf("no path")
+	}
+	if p.Faults.Errno != 0 && p.Faults.Percent == 0 {
+		return nil, fmt.Errorf("no percent of the operations to fail with %v", p.Faults.Errno)
+	}
+	if p.Faults.Percent > 0 && p.Faults.Errno == 0 {
+		p.Faults.Errno = syscall.EIO
+	}
+	if p.Faults.Delay == 0 && p.Faults.Percent == 0 {
+		return nil, fmt.Errorf("no delay or percent")
+	}
+	return p, nil
+}
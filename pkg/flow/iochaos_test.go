@@ -0,0 +1,69 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParsePodIOChaos(t *testing.T) {
+	p, err := ParsePodIOChaos("path=/var/lib/mysql container=db delay=100ms errno=ENOSPC percent=10% ops=write,fsync duration=5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Path != "/var/lib/mysql" || p.Container != "db" || p.Duration != 5*time.Minute || p.Faults.Delay != 100*time.Millisecond ||
+		p.Faults.Errno != syscall.ENOSPC || p.Faults.Percent != 10 || len(p.Faults.Ops) != 2 || !p.Faults.Ops["fsync"] {
+		t.Errorf("unexpected settings %+v", *p)
+	}
+
+	p, err = ParsePodIOChaos("path=/data percent=50")
+	if err != nil || p.Faults.Errno != syscall.EIO || !p.Faults.Ops["read"] || !p.Faults.Ops["write"] || len(p.Faults.Ops) != 2 {
+		t.Errorf("expected EIO on reads and writes by default, got %+v %v", p, err)
+	}
+
+	invalid := map[string]string{
+		"delay=10ms":                    "no path",
+		"path=/data":                    "no delay or percent",
+		"path=/data errno=EIO":          "no percent",
+		"path=data delay=10ms":          "invalid path",
+		"path=/data percent=150":        "invalid percent",
+		"path=/data errno=EWHAT":        "unknown error",
+		"path=/data delay=1s ops=chmod": "unknown operation",
+		"path=/data delay=0s":           "invalid delay",
+		"path=/data delay=1s bps=1":     "unknown pod io chaos setting",
+	}
+	for spec, message := range invalid {
+		if _, err := ParsePodIOChaos(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestPodIOChaosStatus(t *testing.T) {
+	annotations := map[string]string{}
+	IOChaosFault.SetStatus(&FaultStatus{Spec: "path=/data delay=1s", Target: "db:/data", Active: true}, annotations)
+	status, err := IOChaosFault.GetStatus(annotations)
+	if err != nil || IOChaosFault.Describe(status) != "injecting db:/data" {
+		t.Errorf("unexpected status %+v %v", status, err)
+	}
+	if annotations["kubernetes.io/pod-io-chaos-status"] == "" {
+		t.Errorf("expected the status in kubernetes.io/pod-io-chaos-status, got %v", annotations)
+	}
+}
@@ -0,0 +1,567 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Annotation of a Node shaping the traffic of one of its host interfaces, e.g.
+// iface=eth0 egress=10mbit,delay,50ms peer-nodes=topology.kubernetes.io/zone=zone-b duration=10m
+const NodeChaosAnnotation = "kubernetes.io/node-chaos"
+
+const nodeChaosStatusAnnotation = "kubernetes.io/node-chaos-status"
+
+// Port of the kubelet's API, never shaped unless the control plane is not protected
+const kubeletPort = 10250
+
+// NodeChaos shapes the traffic a host interface receives and sends, all of it or only the
+// traffic with the peers. The API server and the kubelet are protected by default
+type NodeChaos struct {
+	Iface string
+	// Chaos settings of the received and sent traffic, same as the pods' ones
+	Ingress string
+	Egress  string
+	// CIDRs of the peers
+	Peers []string
+	// Label selector of the nodes whose addresses and pod CIDRs are peers, without spaces
+	PeerNodes string
+	// CIDRs never shaped
+	Protect []string
+	// Whether the API server and the kubelet are never shaped
+	ProtectControlPlane bool
+	// Until the chaos is removed if zero
+	Duration time.Duration
+}
+
+// Parse space separated key=value settings of node chaos, iface and a direction are required
+func ParseNodeChaos(spec string) (*NodeChaos, error) {
+	n := &NodeChaos{ProtectControlPlane: true}
+	err := parseSettings("node chaos", spec, func(key, value string) error {
+		var err error
+		switch key {
+		case "iface":
+			// Pods' veths and ifb devices are shaped by kube-chaos itself
+			if value == "" || value == "lo" || len(value) > 15 || strings.ContainsAny(value, "/:") ||
+				strings.HasPrefix(value, "ifb") || strings.HasPrefix(value, "cali") {
+				return fmt.Errorf("invalid iface %q, expected a host interface such as eth0", value)
+			}
+			n.Iface = value
+		case "ingress", "egress":
+			if value == "" {
+				return fmt.Errorf("invalid %s, expected chaos settings such as 10mbit,delay,50ms", key)
+			}
+			if key == "ingress" {
+				n.Ingress = value
+			} else {
+				n.Egress = value
+			}
+		case "peers", "protect":
+			cidrs, err := parseCIDRs(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			if key == "peers" {
+				n.Peers = cidrs
+			} else {
+				n.Protect = cidrs
+			}
+		case "peer-nodes":
+			if _, err := labels.Parse(value); err != nil || value == "" {
+				return fmt.Errorf("invalid peer-nodes %q, expected a label selector", value)
+			}
+			n.PeerNodes = value
+		case "protect-control-plane":
+			if n.ProtectControlPlane, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid protect-control-plane %q, expected true or false", value)
+			}
+		case "duration":
+			n.Duration, err = parsePositiveDuration(key, value)
+		default:
+			err = errUnknownSetting
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n.Iface == "" {
+		return nil, fmt.Errorf("no iface")
+	}
+	if n.Ingress == "" && n.Egress == "" {
+		return nil, fmt.Errorf("no ingress or egress")
+	}
+	return n, nil
+}
+
+// Comma separated CIDRs, an address is its own /32
+func parseCIDRs(value string) ([]string, error) {
+	cidrs := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if !strings.Contains(item, "/") {
+			item += "/32"
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, fmt.Errorf("%q is not an IPv4 CIDR", item)
+		}
+		cidrs = append(cidrs, ipNet.String())
+	}
+	return cidrs, nil
+}
+
+// Check node chaos against the guards, return the settings of each direction with the
+// profiles expanded
+func CheckNodeChaos(chaos *NodeChaos, profiles Profiles, guards *Guards) (ingress, egress string, err error) {
+	if chaos.Ingress != "" {
+		if ingress, err = profiles.Resolve(chaos.Ingress, true); err != nil {
+			return "", "", err
+		}
+		if err := guards.CheckSeverity(ingress, true); err != nil {
+			return "", "", fmt.Errorf("ingress: %v", err)
+		}
+	}
+	if chaos.Egress != "" {
+		if egress, err = profiles.Resolve(chaos.Egress, false); err != nil {
+			return "", "", err
+		}
+		if err := guards.CheckSeverity(egress, false); err != nil {
+			return "", "", fmt.Errorf("egress: %v", err)
+		}
+	}
+	return ingress, egress, nil
+}
+
+// The internal addresses and pod CIDRs of the nodes, leaving out the node named self
+func NodePeers(nodes []v1.Node, self string) []string {
+	peers := map[string]bool{}
+	for _, node := range nodes {
+		if node.Name == self {
+			continue
+		}
+		for _, address := range node.Status.Addresses {
+			if address.Type == v1.NodeInternalIP && net.ParseIP(address.Address).To4() != nil {
+				peers[address.Address+"/32"] = true
+			}
+		}
+		if cidrs, err := parseCIDRs(node.Spec.PodCIDR); node.Spec.PodCIDR != "" && err == nil {
+			peers[cidrs[0]] = true
+		}
+	}
+	return sortedKeys(peers)
+}
+
+// ProtectedEndpoint is an address and port whose traffic is never shaped, the traffic from and
+// to the port of the address, or to and from it if the endpoint is the node's own
+type ProtectedEndpoint struct {
+	CIDR string
+	Port int
+	// Whether the address is the node's, so the port is the one the traffic received goes to
+	Local bool
+}
+
+// The API server's addresses with their ports, from the endpoints of the kubernetes service and
+// the server the daemon talks to, and the kubelet's port of the node's own addresses
+func ControlPlaneProtection(endpoints *v1.Endpoints, server string, node *v1.Node) []ProtectedEndpoint {
+	protected := map[ProtectedEndpoint]bool{}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if net.ParseIP(address.IP).To4() == nil {
+				continue
+			}
+			for _, port := range subset.Ports {
+				protected[ProtectedEndpoint{CIDR: address.IP + "/32", Port: int(port.Port)}] = true
+			}
+		}
+	}
+	// The server may be a load balancer in front of the endpoints
+	if u, err := url.Parse(server); err == nil && net.ParseIP(u.Hostname()).To4() != nil {
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			port = 443
+			if u.Scheme == "http" {
+				port = 80
+			}
+		}
+		protected[ProtectedEndpoint{CIDR: u.Hostname() + "/32", Port: port}] = true
+	}
+	for _, address := range node.Status.Addresses {
+		if net.ParseIP(address.Address).To4() != nil {
+			protected[ProtectedEndpoint{CIDR: address.Address + "/32", Port: kubeletPort, Local: true}] = true
+		}
+	}
+
+	endpointList := []ProtectedEndpoint{}
+	for endpoint := range protected {
+		endpointList = append(endpointList, endpoint)
+	}
+	sort.Slice(endpointList, func(i, j int) bool {
+		if endpointList[i].CIDR != endpointList[j].CIDR {
+			return endpointList[i].CIDR < endpointList[j].CIDR
+		}
+		return endpointList[i].Port < endpointList[j].Port
+	})
+	return endpointList
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Progress of node chaos, the settings changing start another one
+type NodeChaosStatus struct {
+	Spec string `json:"spec"`
+	// Interface shaped, to clear it also after the daemon restarted
+	Iface string `json:"iface,omitempty"`
+	// Peers shaped, all traffic if empty
+	Peers   []string `json:"peers,omitempty"`
+	Applied bool     `json:"applied"`
+	// Qdiscs of the interface kube-chaos installed, root or ingress, the only ones it deletes
+	Qdiscs []string `json:"qdiscs,omitempty"`
+	// When the chaos is removed, RFC3339, until the settings are removed if empty
+	Until    string `json:"until,omitempty"`
+	Rejected string `json:"rejected,omitempty"`
+}
+
+func (s *NodeChaosStatus) String() string {
+	target := s.Iface
+	if len(s.Peers) > 0 {
+		target = fmt.Sprintf("%s towards %s", s.Iface, strings.Join(s.Peers, ","))
+	}
+	switch {
+	case s.Rejected != "":
+		return fmt.Sprintf("rejected (%s)", s.Rejected)
+	case s.Applied && s.Until != "":
+		return fmt.Sprintf("shaping %s until %s", target, s.Until)
+	case s.Applied:
+		return "shaping " + target
+	}
+	return "restored"
+}
+
+// Get the node's chaos status, nil if it was never shaped
+func GetNodeChaosStatus(nodeAnnotations map[string]string) (*NodeChaosStatus, error) {
+	value, found := nodeAnnotations[nodeChaosStatusAnnotation]
+	if !found {
+		return nil, nil
+	}
+	status := &NodeChaosStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", nodeChaosStatusAnnotation, err)
+	}
+	return status, nil
+}
+
+// Set the node's chaos status, nil removes it
+func SetNodeChaosStatus(status *NodeChaosStatus, nodeAnnotations map[string]string) {
+	if status == nil {
+		delete(nodeAnnotations, nodeChaosStatusAnnotation)
+		return
+	}
+	data, _ := json.Marshal(status)
+	nodeAnnotations[nodeChaosStatusAnnotation] = string(data)
+}
+
+// Mark node chaos in progress to be applied again, after it was cleared from the node,
+// return whether the status changed
+func SetNodeChaosPending(nodeAnnotations map[string]string) bool {
+	if status, _ := GetNodeChaosStatus(nodeAnnotations); status != nil && status.Applied {
+		SetNodeChaosStatus(nil, nodeAnnotations)
+		return true
+	}
+	return false
+}
+
+// Remove the node's chaos settings and status
+func ClearNodeChaos(nodeAnnotations map[string]string) {
+	delete(nodeAnnotations, NodeChaosAnnotation)
+	delete(nodeAnnotations, nodeChaosStatusAnnotation)
+}
+
+// NodeShaping is node chaos resolved into what is set on the interface
+type NodeShaping struct {
+	Iface string
+	// Chaos settings of the received and sent traffic, a direction is left alone if empty
+	Ingress string
+	Egress  string
+	// CIDRs of the traffic shaped, all traffic if empty
+	Peers []string
+	// Traffic of these CIDRs, source or destination, is never shaped
+	ProtectedCIDRs []string
+	// Nor the traffic of these addresses' ports
+	ProtectedEndpoints []ProtectedEndpoint
+}
+
+// Shape the interface's traffic through the node's ifb devices, replacing the previous shaping
+// of the directions set. The changes are applied or rolled back as a whole
+func ApplyNodeShaping(shaping *NodeShaping, pool *IfbPool) error {
+	t := &tcShaper{e: exec.New(), iface: shaping.Iface, pool: pool}
+	if shaping.Ingress != "" {
+		ifb, err := pool.NodeDevice(true)
+		if err != nil {
+			return err
+		}
+		t.ingressIFB, t.ingressClassid = ifb, "1:1"
+	}
+	if shaping.Egress != "" {
+		ifb, err := pool.NodeDevice(false)
+		if err != nil {
+			return err
+		}
+		t.egressIFB, t.egressClassid = ifb, "1:1"
+	}
+	t.Begin()
+	if err := t.shapeNode(shaping); err != nil {
+		t.batch = nil
+		return err
+	}
+	return t.Commit()
+}
+
+// Queue the tc changes shaping the node, t's ifb devices are set for the directions shaped
+func (t *tcShaper) shapeNode(shaping *NodeShaping) error {
+	for _, isIngress := range []bool{true, false} {
+		// The peers are the destination of the traffic sent and the source of the one received
+		ifb, info, direction := t.egressIFB, shaping.Egress, "dst"
+		if isIngress {
+			ifb, info, direction = t.ingressIFB, shaping.Ingress, "src"
+		}
+		if info == "" {
+			continue
+		}
+
+		// Start from an empty htb, unclassified traffic is sent directly without shaping
+		if err := t.run(tcStep{
+			desc:        fmt.Sprintf("delete root qdisc of %s", ifb),
+			args:        []string{"qdisc", "del", "dev", ifb, "root"},
+			ignoreError: true,
+		}); err != nil {
+			return err
+		}
+		if err := t.run(tcStep{
+			desc: fmt.Sprintf("add htb on root of %s", ifb),
+			args: []string{"qdisc", "add", "dev", ifb, "root", "handle", "1:", "htb", "default", "0"},
+			undo: [][]string{{"qdisc", "del", "dev", ifb, "root"}},
+		}); err != nil {
+			return err
+		}
+		if err := t.makeNewClass(defaultRate, ifb, 1); err != nil {
+			return err
+		}
+		if err := t.run(tcStep{
+			desc: fmt.Sprintf("add netem to class 1:1 on %s", ifb),
+			args: []string{"qdisc", "add", "dev", ifb, "parent", "1:1", "handle", netemHandle("1:1"), "netem"},
+		}); err != nil {
+			return err
+		}
+
+		// Protected traffic is classified first, the qdisc's own handle sends it directly
+		for _, cidr := range shaping.ProtectedCIDRs {
+			if err := t.addNodeFilter(ifb, "1", "1:0", "match", "ip", direction, cidr); err != nil {
+				return err
+			}
+		}
+		for _, endpoint := range shaping.ProtectedEndpoints {
+			// A remote endpoint is the source of the traffic received, the node's own its destination
+			address, port := "dst", "dport"
+			if isIngress != endpoint.Local {
+				address, port = "src", "sport"
+			}
+			if err := t.addNodeFilter(ifb, "1", "1:0", "match", "ip", address, endpoint.CIDR,
+				"match", "ip", port, strconv.Itoa(endpoint.Port), "0xffff"); err != nil {
+				return err
+			}
+		}
+		if len(shaping.Peers) == 0 {
+			if err := t.addNodeFilter(ifb, "2", "1:1", "match", "u32", "0", "0"); err != nil {
+				return err
+			}
+		}
+		for _, cidr := range shaping.Peers {
+			if err := t.addNodeFilter(ifb, "2", "1:1", "match", "ip", direction, cidr); err != nil {
+				return err
+			}
+		}
+		if err := t.ExecTcChaos(isIngress, info); err != nil {
+			return err
+		}
+
+		// Redirect the interface's traffic once the ifb is ready
+		if err := t.mirrorNode(isIngress, ifb); err != nil {
+			return err
+		}
+		glog.Infof("Traffic of %s mirrored to %s", t.iface, ifb)
+	}
+	return nil
+}
+
+// Add a filter of the node's ifb classifying the matched traffic into flowid
+func (t *tcShaper) addNodeFilter(ifb, prio, flowid string, match ...string) error {
+	args := append([]string{"filter", "add", "dev", ifb, "parent", "1:0", "protocol", "ip", "prio", prio, "u32"}, match...)
+	return t.run(tcStep{
+		desc: fmt.Sprintf("add filter %s to %s on %s", strings.Join(match, " "), flowid, ifb),
+		args: append(args, "flowid", flowid),
+	})
+}
+
+// Redirect the traffic received, or sent, by the interface to the ifb
+func (t *tcShaper) mirrorNode(isIngress bool, ifb string) error {
+	if isIngress {
+		if err := t.run(tcStep{
+			desc:        fmt.Sprintf("delete ingress qdisc of %s", t.iface),
+			args:        []string{"qdisc", "del", "dev", t.iface, "ingress"},
+			ignoreError: true,
+		}); err != nil {
+			return err
+		}
+		if err := t.run(tcStep{
+			desc: fmt.Sprintf("add ingress qdisc on %s", t.iface),
+			args: []string{"qdisc", "add", "dev", t.iface, "ingress"},
+			undo: [][]string{{"qdisc", "del", "dev", t.iface, "ingress"}},
+		}); err != nil {
+			return err
+		}
+		return t.run(tcStep{
+			desc: fmt.Sprintf("mirror ingress of %s to %s", t.iface, ifb),
+			args: []string{"filter", "add", "dev", t.iface, "parent", "ffff:", "protocol", "ip",
+				"prio", "1", "u32", "match", "u32", "0", "0", "flowid", "1:1",
+				"action", "mirred", "egress", "redirect", "dev", ifb},
+		})
+	}
+
+	// The redirect takes the IP traffic before it is queued, the class only holds the rest
+	if err := t.run(tcStep{
+		desc:        fmt.Sprintf("delete root qdisc of %s", t.iface),
+		args:        []string{"qdisc", "del", "dev", t.iface, "root"},
+		ignoreError: true,
+	}); err != nil {
+		return err
+	}
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add htb on root of %s", t.iface),
+		args: []string{"qdisc", "add", "dev", t.iface, "root", "handle", "1:", "htb", "default", "1"},
+		undo: [][]string{{"qdisc", "del", "dev", t.iface, "root"}},
+	}); err != nil {
+		return err
+	}
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add htb class 1:1 on %s", t.iface),
+		args: []string{"class", "add", "dev", t.iface, "parent", "1:", "classid", "1:1", "htb", "rate", defaultRate},
+	}); err != nil {
+		return err
+	}
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add pfifo on %s", t.iface),
+		args: []string{"qdisc", "add", "dev", t.iface, "parent", "1:1", "handle", "2:1", "pfifo", "limit", "1600"},
+	}); err != nil {
+		return err
+	}
+	return t.run(tcStep{
+		desc: fmt.Sprintf("mirror egress of %s to %s", t.iface, ifb),
+		args: []string{"filter", "add", "dev", t.iface, "parent", "1:", "protocol", "ip",
+			"prio", "1", "u32", "match", "u32", "0", "0", "flowid", "1:1",
+			"action", "mirred", "egress", "redirect", "dev", ifb},
+	})
+}
+
+// Parents of the interface's qdiscs the shaping installs, root to redirect the traffic sent
+// and ingress the traffic received
+func NodeShapingQdiscs(shaping *NodeShaping) []string {
+	qdiscs := []string{}
+	if shaping.Ingress != "" {
+		qdiscs = append(qdiscs, "ingress")
+	}
+	if shaping.Egress != "" {
+		qdiscs = append(qdiscs, "root")
+	}
+	return qdiscs
+}
+
+// Check the interface only has the kernel's default qdiscs on the parents, so shaping it
+// replaces nothing an operator or the CNI set up
+func CheckNodeInterface(iface string, parents []string) error {
+	qdiscs, err := tcstate.Qdiscs(exec.New(), iface)
+	if err != nil {
+		return err
+	}
+	return checkNodeQdiscs(iface, qdiscs, parents)
+}
+
+func checkNodeQdiscs(iface string, qdiscs []tcstate.Qdisc, parents []string) error {
+	for _, parent := range parents {
+		for _, qdisc := range qdiscs {
+			// The kernel's own root qdiscs have no handle
+			if parent == "root" && qdisc.Root && qdisc.Handle != "0:" {
+				return fmt.Errorf("%s has a %s root qdisc kube-chaos would replace", iface, qdisc.Kind)
+			}
+			if parent == "ingress" && (qdisc.Kind == "ingress" || qdisc.Kind == "clsact") {
+				return fmt.Errorf("%s has an %s qdisc kube-chaos would replace", iface, qdisc.Kind)
+			}
+		}
+	}
+	return nil
+}
+
+// Remove the node chaos from the interface and delete the node's ifb devices. Only the qdiscs
+// kube-chaos installed are deleted, the interface had the kernel's default ones before
+func ClearNodeShaping(iface string, installed []string, pool *IfbPool) error {
+	e := exec.New()
+	qdiscs, err := tcstate.Qdiscs(e, iface)
+	if err != nil {
+		return err
+	}
+	for _, parent := range ownNodeQdiscs(qdiscs, installed) {
+		if out, err := e.Command("tc", "qdisc", "del", "dev", iface, parent).CombinedOutput(); err != nil {
+			return fmt.Errorf("fail to delete %s's %s qdisc: %s\n%s", iface, parent, err, out)
+		}
+	}
+	glog.Infof("Node chaos of %s cleared", iface)
+	return pool.DeleteNodeDevices()
+}
+
+// Parents of the qdiscs kube-chaos installed that are still on the interface
+func ownNodeQdiscs(qdiscs []tcstate.Qdisc, installed []string) []string {
+	own := []string{}
+	for _, parent := range installed {
+		for _, qdisc := range qdiscs {
+			if (parent == "root" && qdisc.Root && qdisc.Kind == "htb" && qdisc.Handle == "1:") ||
+				(parent == "ingress" && qdisc.Kind == "ingress" && qdisc.Handle == "ffff:") {
+				own = append(own, parent)
+				break
+			}
+		}
+	}
+	return own
+}
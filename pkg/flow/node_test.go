@@ -0,0 +1,321 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseNodeChaos(t *testing.T) {
+	n, err := ParseNodeChaos("iface=eth0 egress=10mbit,delay,50ms peers=10.1.0.0/16,10.2.0.5 peer-nodes=topology.kubernetes.io/zone=zone-b protect=10.0.0.9 duration=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &NodeChaos{
+		Iface:               "eth0",
+		Egress:              "10mbit,delay,50ms",
+		Peers:               []string{"10.1.0.0/16", "10.2.0.5/32"},
+		PeerNodes:           "topology.kubernetes.io/zone=zone-b",
+		Protect:             []string{"10.0.0.9/32"},
+		ProtectControlPlane: true,
+		Duration:            10 * time.Minute,
+	}
+	if !reflect.DeepEqual(n, expected) {
+		t.Errorf("expected %+v, got %+v", expected, n)
+	}
+
+	invalid := map[string]string{
+		"egress=10mbit":                                        "no iface",
+		"iface=eth0":                                           "no ingress or egress",
+		"iface=cali123 egress=10mbit":                          "invalid iface",
+		"iface=ifb0 egress=10mbit":                             "invalid iface",
+		"iface=eth0 ingress=":                                  "invalid ingress",
+		"iface=eth0 egress=10mbit peers=10.1.0.0/33":           "invalid peers",
+		"iface=eth0 egress=10mbit peers=fd00::/64":             "not an IPv4 CIDR",
+		"iface=eth0 egress=10mbit peer-nodes=zone==a==b":       "invalid peer-nodes",
+		"iface=eth0 egress=10mbit protect-control-plane=maybe": "invalid protect-control-plane",
+		"iface=eth0 egress=10mbit duration=0s":                 "invalid duration",
+		"iface=eth0 egress=10mbit errors=10%":                  "unknown node chaos setting",
+		"iface":                                                "expected key=value",
+	}
+	for spec, message := range invalid {
+		if _, err := ParseNodeChaos(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestCheckNodeChaos(t *testing.T) {
+	n, _ := ParseNodeChaos("iface=eth0 ingress=profile:3g egress=10mbit,delay,50ms")
+	ingress, egress, err := CheckNodeChaos(n, BuiltinProfiles(), DefaultGuards())
+	if err != nil || ingress == "" || strings.HasPrefix(ingress, profilePrefix) || egress != "10mbit,delay,50ms" {
+		t.Errorf("unexpected settings %q %q %v", ingress, egress, err)
+	}
+
+	n, _ = ParseNodeChaos("iface=eth0 egress=10mbit,loss,80%")
+	if _, _, err := CheckNodeChaos(n, BuiltinProfiles(), DefaultGuards()); err == nil || !strings.Contains(err.Error(), "egress: loss") {
+		t.Errorf("expected the loss to be rejected, got %v", err)
+	}
+}
+
+func TestNodePeers(t *testing.T) {
+	node := func(name, ip, podCIDR string) v1.Node {
+		return v1.Node{
+			ObjectMeta: meta_v1.ObjectMeta{Name: name},
+			Spec:       v1.NodeSpec{PodCIDR: podCIDR},
+			Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: name},
+				{Type: v1.NodeInternalIP, Address: ip},
+			}},
+		}
+	}
+	nodes := []v1.Node{node("a", "10.0.0.1", "192.168.1.0/24"), node("b", "10.0.0.2", ""), node("c", "10.0.0.3", "192.168.3.0/24")}
+	expected := []string{"10.0.0.2/32", "10.0.0.3/32", "192.168.3.0/24"}
+	if peers := NodePeers(nodes, "a"); !reflect.DeepEqual(peers, expected) {
+		t.Errorf("expected %v, got %v", expected, peers)
+	}
+}
+
+func TestControlPlaneProtection(t *testing.T) {
+	endpoints := &v1.Endpoints{Subsets: []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "10.0.0.10"}, {IP: "10.0.0.11"}},
+		Ports:     []v1.EndpointPort{{Name: "https", Port: 6443}},
+	}}}
+	node := &v1.Node{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+		{Type: v1.NodeInternalIP, Address: "10.0.0.21"},
+		{Type: v1.NodeHostName, Address: "node-1"},
+	}}}
+	protected := ControlPlaneProtection(endpoints, "https://10.0.0.100:8443", node)
+	expected := []ProtectedEndpoint{
+		{CIDR: "10.0.0.10/32", Port: 6443},
+		{CIDR: "10.0.0.100/32", Port: 8443},
+		{CIDR: "10.0.0.11/32", Port: 6443},
+		{CIDR: "10.0.0.21/32", Port: kubeletPort, Local: true},
+	}
+	if !reflect.DeepEqual(protected, expected) {
+		t.Errorf("expected %v, got %v", expected, protected)
+	}
+
+	// The in-cluster server has the port of its scheme, a server name is left to the endpoints
+	if protected := ControlPlaneProtection(endpoints, "https://10.96.0.1", &v1.Node{}); len(protected) != 3 || protected[2] != (ProtectedEndpoint{CIDR: "10.96.0.1/32", Port: 443}) {
+		t.Errorf("expected 10.96.0.1:443 protected, got %v", protected)
+	}
+	if protected := ControlPlaneProtection(endpoints, "https://api.example.com", &v1.Node{}); len(protected) != 2 {
+		t.Errorf("expected the endpoints only, got %v", protected)
+	}
+}
+
+func TestNodeChaosStatus(t *testing.T) {
+	annotations := map[string]string{NodeChaosAnnotation: "iface=eth0 egress=10mbit"}
+	SetNodeChaosStatus(&NodeChaosStatus{Spec: "iface=eth0 egress=10mbit", Iface: "eth0", Peers: []string{"10.0.0.2/32"}, Applied: true}, annotations)
+	status, err := GetNodeChaosStatus(annotations)
+	if err != nil || status.String() != "shaping eth0 towards 10.0.0.2/32" {
+		t.Errorf("unexpected status %+v %v", status, err)
+	}
+
+	ClearNodeChaos(annotations)
+	if len(annotations) != 0 {
+		t.Errorf("expected no annotation left, got %v", annotations)
+	}
+}
+
+func TestShapeNode(t *testing.T) {
+	shaper := &tcShaper{e: &tcShowExec{}, iface: "eth0", ingressIFB: "ifb4", ingressClassid: "1:1", egressIFB: "ifb5", egressClassid: "1:1", batch: &tcBatch{}}
+	err := shaper.shapeNode(&NodeShaping{
+		Iface:          "eth0",
+		Ingress:        "1mbit,loss,5%",
+		Egress:         "10mbit,delay,50ms",
+		Peers:          []string{"10.0.0.2/32"},
+		ProtectedCIDRs: []string{"10.0.0.9/32"},
+		ProtectedEndpoints: []ProtectedEndpoint{
+			{CIDR: "10.0.0.10/32", Port: 6443},
+			{CIDR: "10.0.0.21/32", Port: kubeletPort, Local: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []string{}
+	for _, step := range shaper.batch.steps {
+		commands = append(commands, strings.Join(step.args, " "))
+	}
+	expected := []string{
+		"filter add dev ifb4 parent 1:0 protocol ip prio 1 u32 match ip src 10.0.0.9/32 flowid 1:0",
+		"filter add dev ifb4 parent 1:0 protocol ip prio 1 u32 match ip src 10.0.0.10/32 match ip sport 6443 0xffff flowid 1:0",
+		"filter add dev ifb4 parent 1:0 protocol ip prio 1 u32 match ip dst 10.0.0.21/32 match ip dport 10250 0xffff flowid 1:0",
+		"filter add dev ifb4 parent 1:0 protocol ip prio 2 u32 match ip src 10.0.0.2/32 flowid 1:1",
+		"qdisc add dev eth0 ingress",
+		"filter add dev ifb5 parent 1:0 protocol ip prio 1 u32 match ip dst 10.0.0.9/32 flowid 1:0",
+		"filter add dev ifb5 parent 1:0 protocol ip prio 1 u32 match ip dst 10.0.0.10/32 match ip dport 6443 0xffff flowid 1:0",
+		"filter add dev ifb5 parent 1:0 protocol ip prio 1 u32 match ip src 10.0.0.21/32 match ip sport 10250 0xffff flowid 1:0",
+		"filter add dev ifb5 parent 1:0 protocol ip prio 2 u32 match ip dst 10.0.0.2/32 flowid 1:1",
+		"qdisc change dev ifb5 parent 1:1 netem delay 50ms",
+		"filter add dev eth0 parent 1: protocol ip prio 1 u32 match u32 0 0 flowid 1:1 action mirred egress redirect dev ifb5",
+	}
+	all := strings.Join(commands, "\n")
+	for _, command := range expected {
+		if !strings.Contains(all, command) {
+			t.Errorf("expected %q in:\n%s", command, all)
+		}
+	}
+	// Traffic is redirected once the ifb is shaped
+	if last := commands[len(commands)-1]; !strings.Contains(last, "mirred") {
+		t.Errorf("expected the redirect last, got %q", last)
+	}
+	// All traffic is shaped without peers
+	shaper.batch = &tcBatch{}
+	if err := shaper.shapeNode(&NodeShaping{Iface: "eth0", Egress: "10mbit"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range shaper.batch.steps {
+		if strings.Contains(strings.Join(step.args, " "), "prio 2 u32 match u32 0 0 flowid 1:1") {
+			return
+		}
+	}
+	t.Errorf("expected a filter shaping all traffic, got %+v", shaper.batch.steps)
+}
+
+func TestNodeQdiscs(t *testing.T) {
+	defaults := []tcstate.Qdisc{
+		{Kind: "mq", Handle: "0:", Root: true},
+		{Kind: "fq_codel", Handle: "0:", Parent: "0:1"},
+	}
+	if err := checkNodeQdiscs("eth0", defaults, []string{"ingress", "root"}); err != nil {
+		t.Errorf("expected the default qdiscs accepted, got %v", err)
+	}
+	operator := []tcstate.Qdisc{
+		{Kind: "fq", Handle: "8001:", Root: true},
+		{Kind: "clsact", Handle: "ffff:fff1", Parent: "ffff:fff1"},
+	}
+	if err := checkNodeQdiscs("eth0", operator, []string{"root"}); err == nil || !strings.Contains(err.Error(), "fq root qdisc") {
+		t.Errorf("expected the fq root rejected, got %v", err)
+	}
+	if err := checkNodeQdiscs("eth0", operator, []string{"ingress"}); err == nil || !strings.Contains(err.Error(), "clsact") {
+		t.Errorf("expected the clsact qdisc rejected, got %v", err)
+	}
+	if err := checkNodeQdiscs("eth0", operator[:1], []string{"ingress"}); err != nil {
+		t.Errorf("expected the root left alone when only ingress is shaped, got %v", err)
+	}
+
+	// Only the qdiscs installed are deleted, and only while they are still kube-chaos'
+	shaped := []tcstate.Qdisc{
+		{Kind: "htb", Handle: "1:", Root: true},
+		{Kind: "ingress", Handle: "ffff:", Parent: "ffff:fff1"},
+	}
+	if own := ownNodeQdiscs(shaped, []string{"root"}); !reflect.DeepEqual(own, []string{"root"}) {
+		t.Errorf("expected the root only, got %v", own)
+	}
+	if own := ownNodeQdiscs(operator, []string{"ingress", "root"}); len(own) != 0 {
+		t.Errorf("expected nothing of the operator's, got %v", own)
+	}
+	if expected := []string{"ingress", "root"}; !reflect.DeepEqual(NodeShapingQdiscs(&NodeShaping{Ingress: "1mbit", Egress: "1mbit"}), expected) {
+		t.Errorf("expected %v", expected)
+	}
+}
+
+// A packet seen by the node's ifb devices
+type testPacket struct {
+	src, dst     string
+	sport, dport int
+}
+
+// The flowid the u32 filters of the ifb classify the packet into, in the order of their prio,
+// empty if none matches
+func classify(steps []tcStep, ifb string, packet testPacket) string {
+	for _, prio := range []string{"1", "2"} {
+		for _, step := range steps {
+			args := step.args
+			if len(args) < 11 || args[0] != "filter" || args[3] != ifb || args[9] != prio {
+				continue
+			}
+			matched := true
+			for i := 11; i+3 < len(args) && args[i] == "match"; i += 4 {
+				switch args[i+1] + " " + args[i+2] {
+				case "ip src", "ip dst":
+					address := packet.src
+					if args[i+2] == "dst" {
+						address = packet.dst
+					}
+					_, cidr, _ := net.ParseCIDR(args[i+3])
+					matched = matched && cidr.Contains(net.ParseIP(address))
+				case "ip sport", "ip dport":
+					port := packet.sport
+					if args[i+2] == "dport" {
+						port = packet.dport
+					}
+					matched = matched && args[i+3] == strconv.Itoa(port)
+					i++
+				}
+			}
+			if matched {
+				return args[len(args)-1]
+			}
+		}
+	}
+	return ""
+}
+
+func TestShapeNodeProtection(t *testing.T) {
+	shaper := &tcShaper{e: &tcShowExec{}, iface: "eth0", ingressIFB: "ifb4", ingressClassid: "1:1", egressIFB: "ifb5", egressClassid: "1:1", batch: &tcBatch{}}
+	err := shaper.shapeNode(&NodeShaping{
+		Iface:   "eth0",
+		Ingress: "1mbit,loss,5%",
+		Egress:  "10mbit",
+		ProtectedEndpoints: []ProtectedEndpoint{
+			{CIDR: "10.0.0.10/32", Port: 6443},
+			{CIDR: "10.96.0.1/32", Port: 443},
+			{CIDR: "10.0.0.21/32", Port: kubeletPort, Local: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ifb    string
+		packet testPacket
+		flowid string
+	}{
+		// The API server's responses and requests
+		{"ifb4", testPacket{"10.0.0.10", "10.0.0.21", 6443, 40000}, "1:0"},
+		{"ifb5", testPacket{"10.0.0.21", "10.0.0.10", 40000, 6443}, "1:0"},
+		{"ifb5", testPacket{"10.0.0.21", "10.96.0.1", 40000, 443}, "1:0"},
+		// The API server calling the kubelet, and its responses
+		{"ifb4", testPacket{"10.0.0.10", "10.0.0.21", 50000, kubeletPort}, "1:0"},
+		{"ifb5", testPacket{"10.0.0.21", "10.0.0.10", kubeletPort, 50000}, "1:0"},
+		// HTTPS of other addresses is shaped, and so are other ports of the API server
+		{"ifb4", testPacket{"203.0.113.5", "10.0.0.21", 443, 40000}, "1:1"},
+		{"ifb5", testPacket{"10.0.0.21", "203.0.113.5", 40000, 443}, "1:1"},
+		{"ifb5", testPacket{"10.0.0.21", "203.0.113.5", 40000, 6443}, "1:1"},
+		{"ifb5", testPacket{"10.0.0.21", "10.0.0.10", 40000, 2379}, "1:1"},
+		// The kubelet port of other addresses
+		{"ifb5", testPacket{"10.0.0.21", "10.0.0.30", 40000, kubeletPort}, "1:1"},
+	}
+	for _, c := range cases {
+		if flowid := classify(shaper.batch.steps, c.ifb, c.packet); flowid != c.flowid {
+			t.Errorf("expected %+v on %s in %s, got %q", c.packet, c.ifb, c.flowid, flowid)
+		}
+	}
+}
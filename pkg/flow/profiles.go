@@ -0,0 +1,194 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Chaos settings of the form profile:<name> are expanded from the profiles
+const profilePrefix = "profile:"
+
+const (
+	effectiveIngressAnnotation = "kubernetes.io/effective-ingress-chaos"
+	effectiveEgressAnnotation  = "kubernetes.io/effective-egress-chaos"
+)
+
+// A named network condition, ingress is the pod's downlink and egress its uplink
+type Profile struct {
+	Ingress ChaosInfo `json:"ingress"`
+	Egress  ChaosInfo `json:"egress"`
+}
+
+// Profiles by name
+type Profiles map[string]Profile
+
+// Profiles compiled into kube-chaos, in the same format as the values of the profile ConfigMap
+const builtinProfiles = `{
+	"3g": {
+		"ingress": {"rate": "780kbit", "delay": {"set": "yes", "time": "100ms", "variation": "20ms"}, "loss": {"set": "yes", "percentage": "0.5%"}},
+		"egress": {"rate": "330kbit", "delay": {"set": "yes", "time": "100ms", "variation": "20ms"}, "loss": {"set": "yes", "percentage": "0.5%"}}
+	},
+	"lte": {
+		"ingress": {"rate": "12mbit", "delay": {"set": "yes", "time": "35ms", "variation": "10ms"}, "loss": {"set": "yes", "percentage": "0.1%"}},
+		"egress": {"rate": "5mbit", "delay": {"set": "yes", "time": "35ms", "variation": "10ms"}, "loss": {"set": "yes", "percentage": "0.1%"}}
+	},
+	"satellite": {
+		"ingress": {"rate": "15mbit", "delay": {"set": "yes", "time": "300ms", "variation": "20ms"}, "loss": {"set": "yes", "percentage": "0.5%"}},
+		"egress": {"rate": "2mbit", "delay": {"set": "yes", "time": "300ms", "variation": "20ms"}, "loss": {"set": "yes", "percentage": "0.5%"}}
+	},
+	"lossy-wifi": {
+		"ingress": {"rate": "20mbit", "delay": {"set": "yes", "time": "5ms", "variation": "5ms"}, "loss": {"set": "yes", "percentage": "5%", "relate": "25%"},
+			"duplicate": {"set": "yes", "percentage": "0.5%"}, "corrupt": {"set": "yes", "percentage": "0.1%"}},
+		"egress": {"rate": "10mbit", "delay": {"set": "yes", "time": "5ms", "variation": "5ms"}, "loss": {"set": "yes", "percentage": "5%", "relate": "25%"},
+			"duplicate": {"set": "yes", "percentage": "0.5%"}, "corrupt": {"set": "yes", "percentage": "0.1%"}}
+	}
+}`
+
+// The built-in profiles
+func BuiltinProfiles() Profiles {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(builtinProfiles), &raw); err != nil {
+		panic(fmt.Sprintf("invalid built-in profiles: %v", err))
+	}
+	profiles := Profiles{}
+	for name, data := range raw {
+		profile, err := parseProfile(name, string(data))
+		if err != nil {
+			panic(fmt.Sprintf("invalid built-in profiles: %v", err))
+		}
+		profiles[name] = profile
+	}
+	return profiles
+}
+
+// The built-in profiles and the ones of a ConfigMap's data, keyed by profile name with
+// the profile's JSON as value. A ConfigMap profile replaces the built-in one of the same
+// name, invalid ones are left out and reported in the error.
+func LoadProfiles(data map[string]string) (Profiles, error) {
+	profiles := BuiltinProfiles()
+	invalid := []string{}
+	for name, value := range data {
+		profile, err := parseProfile(name, value)
+		if err != nil {
+			invalid = append(invalid, err.Error())
+			continue
+		}
+		profiles[name] = profile
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return profiles, fmt.Errorf("invalid profiles: %s", strings.Join(invalid, "; "))
+	}
+	return profiles, nil
+}
+
+func parseProfile(name, value string) (Profile, error) {
+	profile := Profile{}
+	if err := json.Unmarshal([]byte(value), &profile); err != nil {
+		return profile, fmt.Errorf("profile %s: %v", name, err)
+	}
+	if _, _, err := ParseChaosInfo(profile.Ingress.String(), true); err != nil {
+		return profile, fmt.Errorf("profile %s ingress: %v", name, err)
+	}
+	if _, _, err := ParseChaosInfo(profile.Egress.String(), false); err != nil {
+		return profile, fmt.Errorf("profile %s egress: %v", name, err)
+	}
+	return profile, nil
+}
+
+// Names of the profiles, sorted
+func (p Profiles) Names() []string {
+	names := []string{}
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Expand profile:<name> into the profile's chaos settings of the direction,
+// other settings are returned as they are
+func (p Profiles) Resolve(info string, isIngress bool) (string, error) {
+	if !strings.HasPrefix(info, profilePrefix) {
+		return info, nil
+	}
+	name := strings.TrimPrefix(info, profilePrefix)
+	profile, found := p[name]
+	if !found {
+		return "", fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(p.Names(), ", "))
+	}
+	if isIngress {
+		return profile.Ingress.String(), nil
+	}
+	return profile.Egress.String(), nil
+}
+
+// The chaos settings in the annotation format, e.g. 780kbit,delay,100ms,20ms
+func (c *ChaosInfo) String() string {
+	args := []string{c.Rate}
+	if c.Delay.Set == "yes" {
+		args = append(args, "delay", c.Delay.Time)
+		if c.Delay.Variation != "" {
+			args = append(args, c.Delay.Variation)
+		}
+	} else if c.Reorder.Set == "yes" && c.Reorder.Time != "" {
+		// netem only reorders delayed packets
+		args = append(args, "delay", c.Reorder.Time)
+	}
+	if c.Loss.Set == "yes" {
+		args = appendPercentage(args, "loss", c.Loss.Percentage, c.Loss.Relate)
+	}
+	if c.Duplicate.Set == "yes" {
+		args = appendPercentage(args, "duplicate", c.Duplicate.Percentage, "")
+	}
+	if c.Reorder.Set == "yes" {
+		args = appendPercentage(args, "reorder", c.Reorder.Percengtage, c.Reorder.Relate)
+	}
+	if c.Corrupt.Set == "yes" {
+		args = appendPercentage(args, "corrupt", c.Corrupt.Percentage, "")
+	}
+	return strings.Join(args, ",")
+}
+
+func appendPercentage(args []string, name, percentage, relate string) []string {
+	args = append(args, name, percentage)
+	if relate != "" {
+		args = append(args, relate)
+	}
+	return args
+}
+
+// Record the chaos settings applied to the pod, after profiles are expanded
+func SetEffectiveChaos(isIngress bool, info string, podAnnotations map[string]string) {
+	if isIngress {
+		podAnnotations[effectiveIngressAnnotation] = info
+	} else {
+		podAnnotations[effectiveEgressAnnotation] = info
+	}
+}
+
+// Get the chaos settings applied to the pod, empty if none was recorded
+func GetEffectiveChaos(isIngress bool, podAnnotations map[string]string) string {
+	if isIngress {
+		return podAnnotations[effectiveIngressAnnotation]
+	}
+	return podAnnotations[effectiveEgressAnnotation]
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveProfile(t *testing.T) {
+	profiles, err := LoadProfiles(map[string]string{
+		// Replaces the built-in one
+		"3g": `{"ingress": {"rate": "1mbit", "delay": {"set": "yes", "time": "80ms"}}, "egress": {"rate": "500kbit"}}`,
+		"reorder": `{"ingress": {"reorder": {"set": "yes", "time": "10ms", "percentage": "25%", "relate": "50%"}},
+			"egress": {"rate": "1mbit", "duplicate": {"set": "yes", "percentage": "1%"}, "corrupt": {"set": "yes", "percentage": "0.1%"}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		info      string
+		isIngress bool
+		expected  string
+	}{
+		{"100kbps,delay,100ms", true, "100kbps,delay,100ms"},
+		{"profile:3g", true, "1mbit,delay,80ms"},
+		{"profile:3g", false, "500kbit"},
+		{"profile:satellite", true, "15mbit,delay,300ms,20ms,loss,0.5%"},
+		{"profile:lossy-wifi", false, "10mbit,delay,5ms,5ms,loss,5%,25%,duplicate,0.5%,corrupt,0.1%"},
+		{"profile:reorder", true, ",delay,10ms,reorder,25%,50%"},
+		{"profile:reorder", false, "1mbit,duplicate,1%,corrupt,0.1%"},
+	}
+	for _, c := range cases {
+		info, err := profiles.Resolve(c.info, c.isIngress)
+		if err != nil {
+			t.Errorf("%s: %v", c.info, err)
+			continue
+		}
+		if info != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.info, c.expected, info)
+		}
+	}
+
+	if _, err := profiles.Resolve("profile:dialup", true); err == nil || !strings.Contains(err.Error(), "lte") {
+		t.Errorf("expected an unknown profile error listing the profiles, got %v", err)
+	}
+}
+
+func TestBuiltinProfilesAreValid(t *testing.T) {
+	profiles := BuiltinProfiles()
+	for _, name := range []string{"3g", "lte", "satellite", "lossy-wifi"} {
+		if _, found := profiles[name]; !found {
+			t.Errorf("expected built-in profile %s", name)
+		}
+	}
+}
+
+func TestLoadInvalidProfiles(t *testing.T) {
+	profiles, err := LoadProfiles(map[string]string{
+		"broken": `{"ingress": `,
+		"ceil":   `{"ingress": {"rate": "2mbit"}, "egress": {"rate": "2mbit,ceil=1mbit"}}`,
+		"good":   `{"ingress": {"rate": "2mbit"}, "egress": {"rate": "1mbit"}}`,
+	})
+	if err == nil || !strings.Contains(err.Error(), "profile broken") || !strings.Contains(err.Error(), "profile ceil egress") {
+		t.Errorf("expected errors for the broken and ceil profiles, got %v", err)
+	}
+	if _, found := profiles["good"]; !found {
+		t.Errorf("expected the valid profile to be loaded")
+	}
+	if _, found := profiles["broken"]; found {
+		t.Errorf("expected the invalid profile to be left out")
+	}
+}
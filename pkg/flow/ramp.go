@@ -0,0 +1,363 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+)
+
+// Phases of a ramp
+const (
+	RampUp   = "up"
+	RampHold = "hold"
+	RampDown = "down"
+	RampDone = "done"
+)
+
+// Steps of a ramp when it gives none
+const defaultRampSteps = 5
+
+// Netem options whose values are ramped, the others keep the target's values
+var rampedNetemOptions = map[string]bool{"delay": true, "loss": true, "random": true, "duplicate": true, "corrupt": true, "reorder": true}
+
+// Ramp steps chaos settings from a start to the target over a duration, holds them and
+// optionally steps them back down, e.g. over=5m steps=5 hold=10m down=5m from=,delay,10ms
+type Ramp struct {
+	// Chaos settings at step 0, no fault if empty
+	From  string
+	Steps int
+	Over  time.Duration
+	Hold  time.Duration
+	// No ramp down if 0, the target is kept
+	Down time.Duration
+}
+
+// Published in the pod's annotation of each direction
+type RampStatus struct {
+	Phase string `json:"phase"`
+	// Step 0 is the start settings, step Steps the target
+	Step    int    `json:"step"`
+	Steps   int    `json:"steps"`
+	Started string `json:"started"`
+}
+
+func (s *RampStatus) String() string {
+	return fmt.Sprintf("ramp %s %d/%d", s.Phase, s.Step, s.Steps)
+}
+
+// Parse space separated key=value settings of a ramp, over is required
+func ParseRamp(spec string) (*Ramp, error) {
+	r := &Ramp{Steps: defaultRampSteps}
+	err := parseSettings("ramp", spec, func(key, value string) error {
+		var err error
+		switch key {
+		case "from":
+			r.From = value
+		case "steps":
+			if r.Steps, err = strconv.Atoi(value); err != nil || r.Steps < 1 {
+				return fmt.Errorf("invalid ramp steps %q", value)
+			}
+		case "over":
+			if r.Over, err = time.ParseDuration(value); err != nil || r.Over <= 0 {
+				return fmt.Errorf("invalid ramp duration %q", value)
+			}
+		case "hold":
+			if r.Hold, err = time.ParseDuration(value); err != nil || r.Hold < 0 {
+				return fmt.Errorf("invalid ramp hold %q", value)
+			}
+		case "down":
+			if r.Down, err = time.ParseDuration(value); err != nil || r.Down < 0 {
+				return fmt.Errorf("invalid ramp down duration %q", value)
+			}
+		default:
+			err = errUnknownSetting
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.Over == 0 {
+		return nil, fmt.Errorf("ramp %q has no over=<duration>", spec)
+	}
+	return r, nil
+}
+
+// The phase and step of the ramp after it has run for elapsed
+func (r *Ramp) At(elapsed time.Duration) (string, int) {
+	if elapsed < r.Over {
+		return RampUp, int(int64(elapsed) * int64(r.Steps) / int64(r.Over))
+	}
+	if r.Down == 0 {
+		return RampDone, r.Steps
+	}
+	elapsed -= r.Over
+	if elapsed < r.Hold {
+		return RampHold, r.Steps
+	}
+	elapsed -= r.Hold
+	if elapsed < r.Down {
+		return RampDown, r.Steps - int(int64(elapsed)*int64(r.Steps)/int64(r.Down))
+	}
+	return RampDone, 0
+}
+
+// The chaos settings of a step between from and target, both with profiles expanded.
+// Times and percentages of delay, loss, duplicate, corrupt and reorder are stepped linearly
+// from the same option of from, or from 0, rate, ceil and the tbf rate geometrically, the
+// other settings are the target's.
+func RampChaos(from, target string, step, steps int, isIngress bool) (string, error) {
+	if _, _, err := ParseChaosInfo(target, isIngress); err != nil {
+		return "", err
+	}
+	if from != "" {
+		if _, _, err := ParseChaosInfo(from, isIngress); err != nil {
+			return "", fmt.Errorf("invalid ramp start: %v", err)
+		}
+	}
+	if step >= steps {
+		return target, nil
+	}
+	fraction := float64(step) / float64(steps)
+
+	fromFields := strings.Split(from, ",")
+	fromRate, fromCeil, fromTbf := fromFields[0], "", ""
+	if fromRate == "" {
+		fromRate = defaultRate
+	}
+	for _, field := range fromFields[1:] {
+		if strings.HasPrefix(field, "ceil=") {
+			fromCeil = strings.TrimPrefix(field, "ceil=")
+		}
+		if strings.HasPrefix(field, "tbf=") {
+			fromTbf = strings.Split(strings.TrimPrefix(field, "tbf="), "/")[0]
+		}
+	}
+	if fromCeil == "" {
+		fromCeil = fromRate
+	}
+	if fromTbf == "" {
+		fromTbf = fromRate
+	}
+	fromNetem := netemValues(fromFields[1:])
+
+	targetFields := strings.Split(target, ",")
+	targetRate := targetFields[0]
+	if targetRate == "" {
+		targetRate = defaultRate
+	}
+
+	fields := []string{rampRate(fromRate, targetRate, fraction)}
+	// The netem option the values belong to, its occurrence and the value's index
+	option, occurrence, index := "", map[string]int{}, 0
+	for _, field := range targetFields[1:] {
+		if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+			switch parts[0] {
+			case "ceil":
+				field = "ceil=" + rampRate(fromCeil, parts[1], fraction)
+			case "tbf":
+				tbf := strings.Split(parts[1], "/")
+				tbf[0] = rampRate(fromTbf, tbf[0], fraction)
+				field = "tbf=" + strings.Join(tbf, "/")
+			}
+			fields = append(fields, field)
+			continue
+		}
+		if !isNetemValue(field) {
+			option = field
+			occurrence[option]++
+			index = 0
+			fields = append(fields, field)
+			continue
+		}
+		if rampedNetemOptions[option] {
+			start := fromNetem[fmt.Sprintf("%s#%d", option, occurrence[option])]
+			var startValue string
+			if index < len(start) {
+				startValue = start[index]
+			}
+			field = rampValue(startValue, field, fraction)
+		}
+		index++
+		fields = append(fields, field)
+	}
+	return strings.Join(fields, ","), nil
+}
+
+// Values of each netem option, keyed by option#occurrence
+func netemValues(fields []string) map[string][]string {
+	values := map[string][]string{}
+	key := ""
+	occurrence := map[string]int{}
+	for _, field := range fields {
+		if strings.Contains(field, "=") {
+			continue
+		}
+		if !isNetemValue(field) {
+			occurrence[field]++
+			key = fmt.Sprintf("%s#%d", field, occurrence[field])
+			continue
+		}
+		values[key] = append(values[key], field)
+	}
+	return values
+}
+
+// Whether a netem argument is a time or a percentage rather than an option
+func isNetemValue(field string) bool {
+	if strings.HasSuffix(field, "%") {
+		_, err := tcstate.ParsePercent(field)
+		return err == nil
+	}
+	_, err := tcstate.ParseTime(field)
+	return err == nil
+}
+
+// Step a time or percentage linearly from start, 0 if empty, to target
+func rampValue(start, target string, fraction float64) string {
+	if strings.HasSuffix(target, "%") {
+		to, _ := tcstate.ParsePercent(target)
+		from, err := tcstate.ParsePercent(start)
+		if err != nil || !strings.HasSuffix(start, "%") {
+			from = 0
+		}
+		value := from + (to-from)*fraction
+		return strconv.FormatFloat(math.Floor(value*1000+0.5)/1000, 'f', -1, 64) + "%"
+	}
+	to, _ := tcstate.ParseTime(target)
+	from, err := tcstate.ParseTime(start)
+	if err != nil || strings.HasSuffix(start, "%") {
+		from = 0
+	}
+	value := time.Duration(float64(from) + float64(to-from)*fraction)
+	if value%time.Millisecond == 0 {
+		return fmt.Sprintf("%dms", value/time.Millisecond)
+	}
+	return fmt.Sprintf("%dus", value/time.Microsecond)
+}
+
+// Step a rate geometrically from start to target, rates relative to the device are not stepped
+func rampRate(start, target string, fraction float64) string {
+	if strings.HasSuffix(start, "%") || strings.HasSuffix(target, "%") {
+		return target
+	}
+	from, err := tcstate.ParseRate(start)
+	if err != nil || from == 0 {
+		return target
+	}
+	to, err := tcstate.ParseRate(target)
+	if err != nil || to == 0 {
+		return target
+	}
+	rate := float64(from) * math.Pow(float64(to)/float64(from), fraction)
+	return fmt.Sprintf("%dbit", uint64(rate+0.5))
+}
+
+func rampAnnotation(isIngress bool) string {
+	if isIngress {
+		return "kubernetes.io/ingress-chaos-ramp"
+	}
+	return "kubernetes.io/egress-chaos-ramp"
+}
+
+func rampStatusAnnotation(isIngress bool) string {
+	if isIngress {
+		return "kubernetes.io/ingress-chaos-ramp-status"
+	}
+	return "kubernetes.io/egress-chaos-ramp-status"
+}
+
+// Get the ramp of a direction, nil if its chaos settings are applied at once
+func GetPodChaosRamp(isIngress bool, podAnnotations map[string]string) (*Ramp, error) {
+	spec, found := podAnnotations[rampAnnotation(isIngress)]
+	if !found {
+		return nil, nil
+	}
+	return ParseRamp(spec)
+}
+
+// Get the ramp status of a direction, nil if it has none
+func GetPodRampStatus(isIngress bool, podAnnotations map[string]string) (*RampStatus, error) {
+	data, found := podAnnotations[rampStatusAnnotation(isIngress)]
+	if !found {
+		return nil, nil
+	}
+	status := &RampStatus{}
+	if err := json.Unmarshal([]byte(data), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Publish the ramp status of a direction, removing it if status is nil,
+// return false if it hasn't changed
+func SetPodRampStatus(isIngress bool, status *RampStatus, podAnnotations map[string]string) bool {
+	key := rampStatusAnnotation(isIngress)
+	if status == nil {
+		_, found := podAnnotations[key]
+		delete(podAnnotations, key)
+		return found
+	}
+	old, _ := GetPodRampStatus(isIngress, podAnnotations)
+	if reflect.DeepEqual(old, status) {
+		return false
+	}
+	data, _ := json.Marshal(status)
+	podAnnotations[key] = string(data)
+	return true
+}
+
+// Change the class, netem and tbf of the CIDR in place to the chaos settings, the classes
+// and filters are kept so traffic is not interrupted between steps
+func ChangeChaos(cidr string, isIngress bool, info string, pool *IfbPool) error {
+	bandwidth, netemArgs, err := ParseChaosInfo(info, isIngress)
+	if err != nil {
+		return err
+	}
+	ifb, found, err := pool.Find(cidr, isIngress)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s has no class to change", cidr)
+	}
+	classid, _, _, err := findCIDRClass(pool.e, cidr, ifb)
+	if err != nil {
+		return err
+	}
+
+	t := &tcShaper{e: pool.e, iface: ifb, pool: pool}
+	t.Begin()
+	if err := t.changeClass(ifb, classid, bandwidth.htbArgs()); err != nil {
+		return err
+	}
+	if err := t.Netem(classid, ifb, netemArgs...); err != nil {
+		return err
+	}
+	if err := t.changeTbf(classid, ifb, bandwidth.Tbf); err != nil {
+		return err
+	}
+	return t.Commit()
+}
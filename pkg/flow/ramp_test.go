@@ -0,0 +1,203 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+func TestParseRamp(t *testing.T) {
+	ramp, err := ParseRamp("over=5m steps=10 hold=1m down=2m from=,delay,10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Ramp{From: ",delay,10ms", Steps: 10, Over: 5 * time.Minute, Hold: time.Minute, Down: 2 * time.Minute}
+	if *ramp != expected {
+		t.Errorf("expected %+v, got %+v", expected, *ramp)
+	}
+	if ramp, err := ParseRamp("over=1m"); err != nil || ramp.Steps != defaultRampSteps {
+		t.Errorf("expected %d steps by default, got %+v, %v", defaultRampSteps, ramp, err)
+	}
+
+	for _, spec := range []string{"steps=5", "over=1m steps=0", "over=-1m", "over=1m down", "over=1m speed=2"} {
+		if _, err := ParseRamp(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestRampAt(t *testing.T) {
+	ramp := &Ramp{Steps: 4, Over: 4 * time.Minute, Hold: 2 * time.Minute, Down: 2 * time.Minute}
+	cases := []struct {
+		elapsed time.Duration
+		phase   string
+		step    int
+	}{
+		{0, RampUp, 0},
+		{90 * time.Second, RampUp, 1},
+		{4 * time.Minute, RampHold, 4},
+		{6 * time.Minute, RampDown, 4},
+		{7 * time.Minute, RampDown, 2},
+		{8 * time.Minute, RampDone, 0},
+	}
+	for _, c := range cases {
+		if phase, step := ramp.At(c.elapsed); phase != c.phase || step != c.step {
+			t.Errorf("%v: expected %s %d, got %s %d", c.elapsed, c.phase, c.step, phase, step)
+		}
+	}
+
+	ramp.Down = 0
+	if phase, step := ramp.At(time.Hour); phase != RampDone || step != 4 {
+		t.Errorf("expected the target to be kept without ramp down, got %s %d", phase, step)
+	}
+}
+
+func TestRampChaos(t *testing.T) {
+	cases := []struct {
+		from, target string
+		step, steps  int
+		expected     string
+	}{
+		{"10mbit,delay,10ms,loss,1%", "1mbit,delay,110ms,20ms,loss,5%,25%", 1, 2, "3162278bit,delay,60ms,10ms,loss,3%,12.5%"},
+		{"10mbit,delay,10ms,loss,1%", "1mbit,delay,110ms,20ms,loss,5%,25%", 2, 2, "1mbit,delay,110ms,20ms,loss,5%,25%"},
+		// Nothing but the rate and ceil is ramped without a start
+		{"", "1mbit,ceil=2mbit,delay,100ms,distribution,normal", 0, 4, "32000000000bit,ceil=32000000000bit,delay,0ms,distribution,normal"},
+		{"", ",delay,100ms,loss,random,10%", 1, 4, "32000000000bit,delay,25ms,loss,random,2.5%"},
+		// Relative rates are not ramped
+		{"10mbit", "50%,delay,1ms", 1, 2, "50%,delay,500us"},
+		// The tbf rate starts from the start's tbf or rate, its burst and latency are the target's
+		{"10mbit,tbf=4mbit/64kb", "1mbit,tbf=1mbit/32kb/20ms", 1, 2, "3162278bit,tbf=2000000bit/32kb/20ms"},
+		{"4mbit", "1mbit,tbf=1mbit/32kb", 1, 2, "2000000bit,tbf=2000000bit/32kb"},
+	}
+	for _, c := range cases {
+		info, err := RampChaos(c.from, c.target, c.step, c.steps, true)
+		if err != nil {
+			t.Errorf("%q to %q: %v", c.from, c.target, err)
+			continue
+		}
+		if info != c.expected {
+			t.Errorf("%q to %q step %d/%d: expected %q, got %q", c.from, c.target, c.step, c.steps, c.expected, info)
+		}
+	}
+
+	if _, err := RampChaos("fast", "1mbit", 0, 2, true); err == nil {
+		t.Errorf("expected an invalid start to be rejected")
+	}
+}
+
+func TestChangeTbf(t *testing.T) {
+	shaper := &tcShaper{e: &tcShowExec{}, batch: &tcBatch{}}
+	if err := shaper.changeTbf("1:3", "ifb0", &TbfPolicer{Rate: "1mbit", Burst: "32kb", Latency: "50ms"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shaper.changeTbf("1:3", "ifb0", nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"qdisc replace dev ifb0 parent 1003:1 tbf rate 1mbit burst 32kb latency 50ms",
+		"qdisc del dev ifb0 parent 1003:1",
+	}
+	if len(shaper.batch.steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %+v", len(expected), shaper.batch.steps)
+	}
+	for i, step := range shaper.batch.steps {
+		if args := strings.Join(step.args, " "); args != expected[i] {
+			t.Errorf("step %d: expected %q, got %q", i, expected[i], args)
+		}
+	}
+	if !shaper.batch.steps[1].ignoreError {
+		t.Errorf("expected deleting a missing tbf to be ignored")
+	}
+}
+
+// Answers "tc show" with the given JSON, and no objects for the rest
+type tcShowExec struct {
+	qdiscs, classes string
+}
+
+func (f *tcShowExec) Command(cmd string, args ...string) exec.Cmd {
+	out := "[]"
+	if len(args) > 2 && args[2] == "qdisc" && f.qdiscs != "" {
+		out = f.qdiscs
+	} else if len(args) > 2 && args[2] == "class" && f.classes != "" {
+		out = f.classes
+	}
+	fcmd := &exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(out), nil },
+		},
+	}
+	return exec.InitFakeCmd(fcmd, cmd, args...)
+}
+
+func (f *tcShowExec) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+func TestRollbackRestores(t *testing.T) {
+	shaper := &tcShaper{
+		e: &tcShowExec{
+			qdiscs: `[{"kind":"netem","handle":"1003:","parent":"1:3","options":{"limit":1000,"delay":{"delay":0.1,"jitter":0.01,"correlation":0.25},"loss-random":{"loss":0.05,"correlation":0},"gap":0}},` +
+				`{"kind":"tbf","handle":"30:","parent":"1003:1","options":{"rate":125000,"burst":4096,"lat":50000}}]`,
+			classes: `[{"class":"htb","handle":"1:3","root":true,"leaf":"1003:","prio":0,"rate":125000,"ceil":250000,"burst":15360,"cburst":3072}]`,
+		},
+		batch: &tcBatch{},
+	}
+	if err := shaper.changeClass("ifb0", "1:3", []string{"rate", "2mbit"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shaper.Netem("1:3", "ifb0", "delay", "10ms"); err != nil {
+		t.Fatal(err)
+	}
+	if err := shaper.changeTbf("1:3", "ifb0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := shaper.Clear("1:3", "ifb0", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	netem := "qdisc replace dev ifb0 parent 1:3 handle 1003: netem limit 1000 delay 100000us 10000us 25% loss 5% 0%"
+	tbf := "qdisc replace dev ifb0 parent 1003:1 handle 30: tbf rate 1000000bit burst 4096b latency 50000us"
+	expected := [][]string{
+		{"class change dev ifb0 parent 1: classid 1:3 htb rate 1000000bit ceil 2000000bit burst 15360b cburst 3072b prio 0"},
+		{netem, tbf},
+		{tbf},
+		{netem, tbf},
+	}
+	if len(shaper.batch.steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %+v", len(expected), shaper.batch.steps)
+	}
+	for i, step := range shaper.batch.steps {
+		undo := []string{}
+		for _, args := range step.undo {
+			undo = append(undo, strings.Join(args, " "))
+		}
+		if !reflect.DeepEqual(undo, expected[i]) {
+			t.Errorf("step %d: expected undo %q, got %q", i, expected[i], undo)
+		}
+	}
+
+	// A missing tbf is deleted again
+	shaper.e = &tcShowExec{qdiscs: `[{"kind":"netem","handle":"1003:","parent":"1:3","options":{"limit":1000,"gap":0}}]`}
+	if undo := shaper.restoreTbf("ifb0", "1:3"); len(undo) != 1 || strings.Join(undo[0], " ") != "qdisc del dev ifb0 parent 1003:1" {
+		t.Errorf("expected the new tbf deleted, got %q", undo)
+	}
+}
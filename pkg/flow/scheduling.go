@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/schedule"
+)
+
+// Annotations of the pod's schedule and of its status published by the daemon
+const (
+	ChaosScheduleAnnotation  = "kubernetes.io/chaos-schedule"
+	scheduleStatusAnnotation = "kubernetes.io/chaos-schedule-status"
+)
+
+// Published in the pod's annotation, times are RFC3339
+type ScheduleStatus struct {
+	Active bool `json:"active"`
+	// End of the running activation
+	Until string `json:"until,omitempty"`
+	// Start of the next activation, empty if there is none
+	NextActivation string `json:"nextActivation,omitempty"`
+}
+
+// Get the pod's schedule, nil if chaos is not scheduled
+func GetPodSchedule(podAnnotations map[string]string, location *time.Location) (*schedule.Schedule, error) {
+	spec, found := podAnnotations[ChaosScheduleAnnotation]
+	if !found {
+		return nil, nil
+	}
+	return schedule.Parse(spec, location)
+}
+
+// The status of the schedule at now
+func NewScheduleStatus(s *schedule.Schedule, now time.Time) *ScheduleStatus {
+	active, until, next := s.State(now)
+	status := &ScheduleStatus{Active: active}
+	if active {
+		status.Until = until.UTC().Format(time.RFC3339)
+	}
+	if !next.IsZero() {
+		status.NextActivation = next.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// Get the schedule status published in pod's annotation
+func GetPodScheduleStatus(podAnnotations map[string]string) (*ScheduleStatus, error) {
+	data, found := podAnnotations[scheduleStatusAnnotation]
+	if !found {
+		return nil, nil
+	}
+	status := &ScheduleStatus{}
+	if err := json.Unmarshal([]byte(data), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Publish the schedule status in pod's annotation, removing it if status is nil,
+// return false if it hasn't changed
+func SetPodScheduleStatus(status *ScheduleStatus, podAnnotations map[string]string) bool {
+	if status == nil {
+		_, found := podAnnotations[scheduleStatusAnnotation]
+		delete(podAnnotations, scheduleStatusAnnotation)
+		return found
+	}
+	old, _ := GetPodScheduleStatus(podAnnotations)
+	if reflect.DeepEqual(old, status) {
+		return false
+	}
+	data, _ := json.Marshal(status)
+	podAnnotations[scheduleStatusAnnotation] = string(data)
+	return true
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Returned by the set function of parseSettings for a key it doesn't know
+var errUnknownSetting = errors.New("unknown setting")
+
+// Parse space separated key=value settings, calling set with each of them in order, what
+// names the settings in errors, e.g. "pod freeze"
+func parseSettings(what, spec string, set func(key, value string) error) error {
+	for _, field := range strings.Fields(spec) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid %s setting %q, expected key=value", what, field)
+		}
+		if err := set(parts[0], parts[1]); err != nil {
+			if err == errUnknownSetting {
+				return fmt.Errorf("unknown %s setting %q", what, parts[0])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse a duration setting that must be positive, name is the setting's key
+func parsePositiveDuration(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return d, nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSettings(t *testing.T) {
+	set := func(settings map[string]string) func(key, value string) error {
+		return func(key, value string) error {
+			switch key {
+			case "a", "b":
+				settings[key] = value
+				return nil
+			case "bad":
+				return fmt.Errorf("invalid bad %q", value)
+			}
+			return errUnknownSetting
+		}
+	}
+
+	settings := map[string]string{}
+	if err := parseSettings("test", " a=1  b=x=y ", set(settings)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"a": "1", "b": "x=y"}; !reflect.DeepEqual(settings, expected) {
+		t.Errorf("expected %v, got %v", expected, settings)
+	}
+
+	invalid := map[string]string{
+		"a=1 b":   `invalid test setting "b", expected key=value`,
+		"c=1":     `unknown test setting "c"`,
+		"bad=1":   `invalid bad "1"`,
+		"a=1 c=2": `unknown test setting "c"`,
+	}
+	for spec, message := range invalid {
+		if err := parseSettings("test", spec, set(map[string]string{})); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
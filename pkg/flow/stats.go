@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+)
+
+const chaosStatsAnnotation = "kubernetes.io/chaos-stats"
+
+// Least time between two updates of the counters in the annotation, each update is an API
+// write while the counters move with every packet, /metrics has them every round
+const chaosStatsInterval = time.Minute
+
+// Read the statistics of the CIDR's class and its netem, nil if the CIDR has no class
+func GetChaosStats(cidr string, isIngress bool, pool *IfbPool) (*ChaosStats, error) {
+	for _, ifb := range pool.Devices(isIngress) {
+		classid, _, found, err := findCIDRClass(pool.e, cidr, ifb)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+
+		classes, err := tcstate.Classes(pool.e, ifb)
+		if err != nil {
+			return nil, err
+		}
+		qdiscs, err := tcstate.Qdiscs(pool.e, ifb)
+		if err != nil {
+			return nil, err
+		}
+		for _, class := range classes {
+			if class.Handle != classid {
+				continue
+			}
+			stats := &ChaosStats{
+				SentBytes:   class.Stats.Bytes,
+				SentPackets: class.Stats.Packets,
+				Dropped:     class.Stats.Drops,
+				Overlimits:  class.Stats.Overlimits,
+				Requeues:    class.Stats.Requeues,
+				Backlog:     class.Stats.Backlog,
+			}
+			// Loss happens in the netem under the class, and in the tbf under netem
+			for _, qdisc := range qdiscs {
+				if qdisc.Parent == classid || qdisc.Parent == netemHandle(classid)+"1" {
+					stats.Dropped += qdisc.Stats.Drops
+					stats.Requeues += qdisc.Stats.Requeues
+				}
+			}
+			return stats, nil
+		}
+		// The filter is there but the class is not, nothing to report
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// Get the statistics published in pod's annotation
+func GetPodChaosStats(podAnnotations map[string]string) (*PodChaosStats, error) {
+	data, found := podAnnotations[chaosStatsAnnotation]
+	if !found {
+		return nil, nil
+	}
+	stats := &PodChaosStats{}
+	if err := json.Unmarshal([]byte(data), stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Publish the statistics in pod's annotation, return false if they haven't changed or were
+// published less than a minute ago. Directions starting or stopping being shaped are published
+// at once
+func SetPodChaosStats(ingress, egress *ChaosStats, podAnnotations map[string]string) bool {
+	return setPodChaosStats(ingress, egress, podAnnotations, time.Now())
+}
+
+func setPodChaosStats(ingress, egress *ChaosStats, podAnnotations map[string]string, now time.Time) bool {
+	if ingress == nil && egress == nil {
+		_, found := podAnnotations[chaosStatsAnnotation]
+		delete(podAnnotations, chaosStatsAnnotation)
+		return found
+	}
+
+	old, _ := GetPodChaosStats(podAnnotations)
+	if old != nil {
+		if reflect.DeepEqual(old.Ingress, ingress) && reflect.DeepEqual(old.Egress, egress) {
+			return false
+		}
+		updated, err := time.Parse(time.RFC3339, old.UpdateTime)
+		sameDirections := (old.Ingress == nil) == (ingress == nil) && (old.Egress == nil) == (egress == nil)
+		if sameDirections && err == nil && now.Sub(updated) < chaosStatsInterval {
+			return false
+		}
+	}
+	data, _ := json.Marshal(PodChaosStats{
+		Ingress:    ingress,
+		Egress:     egress,
+		UpdateTime: now.UTC().Format(time.RFC3339),
+	})
+	podAnnotations[chaosStatsAnnotation] = string(data)
+	return true
+}
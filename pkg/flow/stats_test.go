@@ -0,0 +1,57 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetPodChaosStats(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	annotations := map[string]string{}
+	if !setPodChaosStats(&ChaosStats{SentPackets: 10}, nil, annotations, now) {
+		t.Fatalf("expected the first stats to be published")
+	}
+
+	// Moving counters wait for the interval
+	if setPodChaosStats(&ChaosStats{SentPackets: 20}, nil, annotations, now.Add(10*time.Second)) {
+		t.Errorf("expected the counters not to be published again within %v", chaosStatsInterval)
+	}
+	if !setPodChaosStats(&ChaosStats{SentPackets: 30}, nil, annotations, now.Add(chaosStatsInterval)) {
+		t.Errorf("expected the counters to be published after %v", chaosStatsInterval)
+	}
+	stats, err := GetPodChaosStats(annotations)
+	if err != nil || stats.Ingress.SentPackets != 30 || stats.UpdateTime != "2018-06-01T12:01:00Z" {
+		t.Errorf("unexpected stats %+v (%v)", stats, err)
+	}
+
+	// A direction starting or stopping is published at once
+	later := now.Add(chaosStatsInterval + time.Second)
+	if !setPodChaosStats(&ChaosStats{SentPackets: 30}, &ChaosStats{SentPackets: 1}, annotations, later) {
+		t.Errorf("expected a new direction to be published at once")
+	}
+	if setPodChaosStats(&ChaosStats{SentPackets: 30}, &ChaosStats{SentPackets: 1}, annotations, later.Add(time.Hour)) {
+		t.Errorf("expected unchanged stats not to be published")
+	}
+	if !setPodChaosStats(nil, nil, annotations, later) {
+		t.Errorf("expected the stats to be removed once cleared")
+	}
+	if _, found := annotations[chaosStatsAnnotation]; found {
+		t.Errorf("expected no stats annotation left, got %v", annotations)
+	}
+}
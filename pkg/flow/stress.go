@@ -0,0 +1,80 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Annotation stressing the pod's CPU and memory, e.g. cpu=2 load=80% memory=256Mi duration=5m
+const PodStressAnnotation = "kubernetes.io/pod-stress"
+
+// Most CPU workers of a pod
+const maxStressCPU = 64
+
+// PodStress runs workers in the pod's cgroup, so they count against its limits
+type PodStress struct {
+	// Workers burning a CPU each
+	CPU int
+	// Percent of its CPU each worker burns
+	Load float64
+	// Bytes a worker allocates and holds
+	Memory int64
+	// Until the stress is removed if zero
+	Duration time.Duration
+}
+
+// Parse space separated key=value settings of a stress, cpu or memory is required
+func ParsePodStress(spec string) (*PodStress, error) {
+	s := &PodStress{Load: 100}
+	err := parseSettings("pod stress", spec, func(key, value string) error {
+		var err error
+		switch key {
+		case "cpu":
+			if s.CPU, err = strconv.Atoi(value); err != nil || s.CPU < 0 || s.CPU > maxStressCPU {
+				return fmt.Errorf("invalid cpu %q, expected 0 to %d workers", value, maxStressCPU)
+			}
+		case "load":
+			if s.Load, err = tcstate.ParsePercent(value); err != nil || s.Load <= 0 || s.Load > 100 {
+				return fmt.Errorf("invalid load %q", value)
+			}
+		case "memory":
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil || quantity.Value() <= 0 {
+				return fmt.Errorf("invalid memory %q, expected a size such as 256Mi", value)
+			}
+			s.Memory = quantity.Value()
+		case "duration":
+			s.Duration, err = parsePositiveDuration(key, value)
+		default:
+			err = errUnknownSetting
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.CPU == 0 && s.Memory == 0 {
+		return nil, fmt.Errorf("no cpu or memory to stress")
+	}
+	return s, nil
+}
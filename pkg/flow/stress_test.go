@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestParsePodStress(t *testing.T) {
+	s, err := ParsePodStress("cpu=2 load=80% memory=256Mi duration=5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PodStress{CPU: 2, Load: 80, Memory: 256 << 20, Duration: 5 * time.Minute}
+	if *s != expected {
+		t.Errorf("expected %+v, got %+v", expected, *s)
+	}
+	if s, err := ParsePodStress("memory=1G"); err != nil || s.Memory != 1000000000 || s.Load != 100 || s.Duration != 0 {
+		t.Errorf("unexpected stress %+v %v", s, err)
+	}
+
+	invalid := map[string]string{
+		"":                  "no cpu or memory",
+		"load=50":           "no cpu or memory",
+		"cpu=-1":            "invalid cpu",
+		"cpu=100":           "invalid cpu",
+		"cpu=1 load=0":      "invalid load",
+		"memory=0":          "invalid memory",
+		"cpu=1 duration=0s": "invalid duration",
+		"cpu=1 io=4":        "unknown pod stress setting",
+	}
+	for spec, message := range invalid {
+		if _, err := ParsePodStress(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestStressedSiblings(t *testing.T) {
+	ready := []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	pods := []v1.Pod{ownedPod("web-1", "web", false), ownedPod("web-2", "web", false), ownedPod("web-3", "web", false)}
+	for i := range pods {
+		pods[i].Status.Conditions = ready
+	}
+	guards := &Guards{MaxPodsPerOwner: 1}
+	if err := StressFault.Check(&pods[0], guards, pods); err != nil {
+		t.Fatalf("expected the first pod to be allowed, got %v", err)
+	}
+
+	// Ready siblings still count while stressed or frozen
+	StressFault.SetStatus(&FaultStatus{Spec: "cpu=1", Active: true}, pods[1].Annotations)
+	if err := StressFault.Check(&pods[0], guards, pods); err == nil {
+		t.Errorf("expected the stressed sibling to count")
+	}
+	StressFault.SetEnded(pods[1].Annotations)
+	FreezeFault.SetStatus(&FaultStatus{Spec: "duration=1m", Active: true}, pods[2].Annotations)
+	if err := StressFault.Check(&pods[0], guards, pods); err == nil {
+		t.Errorf("expected the frozen sibling to count")
+	}
+	FreezeFault.SetEnded(pods[2].Annotations)
+	if err := StressFault.Check(&pods[0], guards, pods); err != nil {
+		t.Errorf("expected the stopped stress and the thawed pod not to count, got %v", err)
+	}
+}
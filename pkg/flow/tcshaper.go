@@ -1,5 +1,3 @@
-//// +build linux
-
 /*
 Copyright 2018 The Kubernetes Authors.
 
@@ -19,67 +17,87 @@ limitations under the License.
 package flow
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/huanwei/kube-chaos/pkg/exec"
 	"github.com/huanwei/kube-chaos/pkg/sets"
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
 
 	"errors"
 	"github.com/golang/glog"
 )
 
-// Create a new shaper
-func NewTCShaper(iface string, firstIFB, secondIFB int) Shaper {
+// Create a new shaper, the pod's classes are allocated from the ifb pool
+func NewTCShaper(iface string, pool *IfbPool) Shaper {
 	shaper := &tcShaper{
-		e:         exec.New(),
-		iface:     iface,
-		firstIFB:  fmt.Sprintf("ifb%d", firstIFB),
-		secondIFB: fmt.Sprintf("ifb%d", secondIFB),
+		e:     exec.New(),
+		iface: iface,
+		pool:  pool,
 	}
 	return shaper
 }
 
-// Execute command and log
-func (t *tcShaper) execAndLog(cmdStr string, args ...string) error {
-	glog.V(4).Infof("Running: %s %s", cmdStr, strings.Join(args, " "))
-	cmd := t.e.Command(cmdStr, args...)
-	out, err := cmd.CombinedOutput()
-	glog.V(4).Infof("Output from tc: %s", string(out))
-	return err
+// Run a tc step, or add it to the batch between Begin and Commit
+func (t *tcShaper) run(step tcStep) error {
+	if t.batch != nil {
+		t.batch.add(step)
+		return nil
+	}
+	glog.V(4).Infof("Running: tc %s", strings.Join(step.args, " "))
+	out, err := t.e.Command("tc", step.args...).CombinedOutput()
+	if err != nil && !step.ignoreError {
+		glog.Errorf("TC exec error: %s\n%s", err, out)
+		return fmt.Errorf("%s: %v", step.desc, err)
+	}
+	return nil
+}
+
+// Lock the ifb against parallel class allocation, until Commit when batching
+func (t *tcShaper) lockDevice(ifb string) func() {
+	unlock := t.pool.lockDevice(ifb)
+	if t.batch != nil {
+		t.batch.unlocks = append(t.batch.unlocks, unlock)
+		return func() {}
+	}
+	return unlock
+}
+
+// Start accumulating tc changes
+func (t *tcShaper) Begin() {
+	if t.batch == nil {
+		t.batch = &tcBatch{}
+	}
+}
+
+// Apply the tc changes accumulated since Begin
+func (t *tcShaper) Commit() error {
+	batch := t.batch
+	if batch == nil {
+		return nil
+	}
+	t.batch = nil
+	return batch.apply(t.e)
 }
 
 // Find available class id in ifb
 func (t *tcShaper) nextClassID(ifb string) (int, error) {
-	// Use tc command to get used class id on device
-	data, err := t.e.Command("tc", "class", "show", "dev", ifb).CombinedOutput()
+	// Get used class ids on device
+	classes, err := tcstate.Classes(t.e, ifb)
 	if err != nil {
 		return -1, err
 	}
-
-	// Scan the output
-	scanner := bufio.NewScanner(bytes.NewBuffer(data))
-	classes := sets.String{}
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// skip empty lines
-		if len(line) == 0 {
-			continue
-		}
-		parts := strings.Split(line, " ")
-
-		if len(parts) != 14 && len(parts) != 16 {
-			return -1, fmt.Errorf("unexpected output from tc: %s (%v)", scanner.Text(), parts)
-		}
-		// Store used class id
-		classes.Insert(parts[2])
+	used := sets.String{}
+	for _, class := range classes {
+		used.Insert(class.Handle)
 	}
 
-	// Make sure it doesn't go forever
-	for nextClass := 1; nextClass < 10000; nextClass++ {
-		if !classes.Has(fmt.Sprintf("1:%d", nextClass)) {
+	// Class ids double as u32 filter handles 800::<id>, and the kernel numbers filters
+	// added without a handle from 800::800, so stay below 0x800
+	for nextClass := 1; nextClass < 0x800; nextClass++ {
+		if !used.Has(fmt.Sprintf("1:%d", nextClass)) {
 			return nextClass, nil
 		}
 	}
@@ -88,41 +106,21 @@ func (t *tcShaper) nextClassID(ifb string) (int, error) {
 }
 
 // Find class using handle
-func findCIDRClass(cidr, ifb string) (class, handle string, found bool, err error) {
-	// Show all tc filters on device
-	e := exec.New()
-	data, err := e.Command("tc", "filter", "show", "dev", ifb).CombinedOutput()
+func findCIDRClass(e exec.Interface, cidr, ifb string) (class, handle string, found bool, err error) {
+	// Get all tc filters on device
+	filters, err := tcstate.Filters(e, ifb, "")
 	if err != nil {
 		return "", "", false, err
 	}
-
-	// Convert cidr from dot-decimal to hexadecimal
-	hex, err := hexCIDR(cidr)
-	if err != nil {
-		return "", "", false, err
-	}
-	spec := fmt.Sprintf("match %s", hex)
-
-	// Scan the output
-	scanner := bufio.NewScanner(bytes.NewBuffer(data))
-	filter := ""
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 {
-			continue
-		}
-		// Find keyword "filter", go to the next line to get class id
-		if strings.HasPrefix(line, "filter") {
-			filter = line
-			continue
-		}
-		// Extract target class id and filter's handle id
-		if strings.Contains(line, spec) {
-			parts := strings.Split(filter, " ")
-			if len(parts) != 19 {
-				return "", "", false, fmt.Errorf("unexpected output from tc: %s %d (%v)", filter, len(parts), parts)
+	for _, filter := range filters {
+		for _, filterCIDR := range filter.CIDRs() {
+			if filterCIDR != cidr {
+				continue
 			}
-			return parts[18], parts[9], true, nil
+			if filter.Handle == "" || filter.FlowID == "" {
+				return "", "", false, fmt.Errorf("unexpected filter of %s on %s: %+v", cidr, ifb, filter)
+			}
+			return filter.FlowID, filter.Handle, true, nil
 		}
 	}
 	return "", "", false, nil
@@ -131,77 +129,209 @@ func findCIDRClass(cidr, ifb string) (class, handle string, found bool, err erro
 // Check whether the corresponding class exists
 func (t *tcShaper) classExists(classid, ifb string) (bool, error) {
 	// Get existed classes on device
-	data, err := t.e.Command("tc", "class", "show", "dev", ifb).CombinedOutput()
+	classes, err := tcstate.Classes(t.e, ifb)
 	if err != nil {
 		return false, err
 	}
-
-	// Scan the output
-	scanner := bufio.NewScanner(bytes.NewBuffer(data))
-	classFound := false
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// skip empty lines
-		if len(line) == 0 {
-			continue
-		}
-		parts := strings.Split(line, " ")
-		// Expected:
-		// class htb 1:1 root leaf 99f9: prio 0 rate 800000bit ceil 800000bit burst 1600b cburst 1600b
-		if parts[2] == classid {
-			classFound = true
+	for _, class := range classes {
+		if class.Handle == classid {
 			glog.Infof("Find class %s at %s was already added", classid, ifb)
-			break
+			return true, nil
 		}
 	}
-	return classFound, nil
+	return false, nil
 }
 
 // Create a new class in ifb with given class id and rate limitation
 func (t *tcShaper) makeNewClass(rate, ifb string, class int) error {
-	if err := t.execAndLog("tc", "class", "add",
-		"dev", ifb,
-		"parent", "1:",
-		"classid", fmt.Sprintf("1:%d", class),
-		"htb", "rate", rate); err != nil {
-		return err
+	classid := fmt.Sprintf("1:%d", class)
+	return t.run(tcStep{
+		desc: fmt.Sprintf("add class %s on %s", classid, ifb),
+		args: []string{"class", "add", "dev", ifb, "parent", "1:", "classid", classid, "htb", "rate", rate},
+		undo: [][]string{{"class", "del", "dev", ifb, "parent", "1:", "classid", classid}},
+	})
+}
+
+// Change class of given id in ifb with new htb settings
+func (t *tcShaper) changeClass(ifb, classid string, htbArgs []string) error {
+	return t.run(tcStep{
+		desc: fmt.Sprintf("set %s of class %s on %s", strings.Join(htbArgs, " "), classid, ifb),
+		args: append([]string{"class", "change", "dev", ifb, "parent", "1:", "classid", classid, "htb"}, htbArgs...),
+		undo: t.restoreClass(ifb, classid),
+	})
+}
+
+// The command restoring the htb settings the class has now, none if it isn't created yet
+func (t *tcShaper) restoreClass(ifb, classid string) [][]string {
+	// Only a batch is rolled back
+	if t.batch == nil {
+		return nil
+	}
+	classes, err := tcstate.Classes(t.e, ifb)
+	if err != nil {
+		glog.Warningf("Failed to read the classes of %s, a rollback can't restore class %s: %v", ifb, classid, err)
+		return nil
+	}
+	for _, class := range classes {
+		if class.Handle != classid || class.Htb == nil {
+			continue
+		}
+		htb := class.Htb
+		args := []string{"class", "change", "dev", ifb, "parent", "1:", "classid", classid, "htb",
+			"rate", fmt.Sprintf("%dbit", htb.Rate), "ceil", fmt.Sprintf("%dbit", htb.Ceil),
+			"burst", fmt.Sprintf("%db", htb.Burst), "cburst", fmt.Sprintf("%db", htb.Cburst), "prio", strconv.FormatUint(htb.Prio, 10)}
+		if htb.Quantum > 0 {
+			args = append(args, "quantum", strconv.FormatUint(htb.Quantum, 10))
+		}
+		return [][]string{args}
 	}
 	return nil
 }
 
-// Change class of given id in ifb with new rate limitation
-func (t *tcShaper) changeClass(rate, ifb string, classid string) error {
-	if err := t.execAndLog("tc", "class", "change",
-		"dev", ifb,
-		"parent", "1:",
-		"classid", classid,
-		"htb", "rate", rate); err != nil {
-		return err
+// The netem under the class and the tbf under the netem, nil if there is none
+func (t *tcShaper) netemQdiscs(ifb, classid string) (netem, tbf *tcstate.Qdisc) {
+	// Only a batch is rolled back
+	if t.batch == nil {
+		return nil, nil
 	}
-	return nil
+	qdiscs, err := tcstate.Qdiscs(t.e, ifb)
+	if err != nil {
+		glog.Warningf("Failed to read the qdiscs of %s, a rollback can't restore the netem of class %s: %v", ifb, classid, err)
+		return nil, nil
+	}
+	for i := range qdiscs {
+		if qdiscs[i].Kind == "netem" && qdiscs[i].Parent == classid && qdiscs[i].Netem != nil {
+			netem = &qdiscs[i]
+		}
+	}
+	if netem == nil {
+		return nil, nil
+	}
+	for i := range qdiscs {
+		if qdiscs[i].Kind == "tbf" && qdiscs[i].Parent == netem.Handle+"1" && qdiscs[i].Tbf != nil {
+			tbf = &qdiscs[i]
+		}
+	}
+	return netem, tbf
+}
+
+// The commands restoring the netem the class has now and the tbf under it, after they were
+// changed or deleted, none if the class has no netem yet
+func (t *tcShaper) restoreNetem(ifb, classid string) [][]string {
+	netem, tbf := t.netemQdiscs(ifb, classid)
+	if netem == nil {
+		return nil
+	}
+	undo := [][]string{append([]string{"qdisc", "replace", "dev", ifb, "parent", classid, "handle", netem.Handle, "netem"}, netemArgs(netem)...)}
+	if tbf != nil {
+		undo = append(undo, tbfArgs(ifb, tbf))
+	}
+	return undo
+}
+
+// The command restoring the tbf under netem of the class, deleting it if there is none now
+func (t *tcShaper) restoreTbf(ifb, classid string) [][]string {
+	netem, tbf := t.netemQdiscs(ifb, classid)
+	if netem == nil {
+		return nil
+	}
+	if tbf == nil {
+		return [][]string{{"qdisc", "del", "dev", ifb, "parent", netem.Handle + "1"}}
+	}
+	return [][]string{tbfArgs(ifb, tbf)}
+}
+
+// Netem options setting the netem qdisc as it is
+func netemArgs(q *tcstate.Qdisc) []string {
+	n := q.Netem
+	args := []string{}
+	if q.Limit > 0 {
+		args = append(args, "limit", strconv.FormatUint(q.Limit, 10))
+	}
+	if n.Delay > 0 || n.Jitter > 0 {
+		args = append(args, "delay", microseconds(n.Delay))
+		if n.Jitter > 0 {
+			args = append(args, microseconds(n.Jitter), percentArg(n.DelayCorrelation))
+		}
+	}
+	for _, option := range []struct {
+		name                 string
+		percent, correlation float64
+	}{
+		{"loss", n.Loss, n.LossCorrelation},
+		{"duplicate", n.Duplicate, n.DuplicateCorrelation},
+		{"reorder", n.Reorder, n.ReorderCorrelation},
+		{"corrupt", n.Corrupt, n.CorruptCorrelation},
+	} {
+		if option.percent > 0 {
+			args = append(args, option.name, percentArg(option.percent), percentArg(option.correlation))
+		}
+	}
+	if n.Gap > 0 {
+		args = append(args, "gap", strconv.FormatUint(n.Gap, 10))
+	}
+	if n.Rate > 0 {
+		args = append(args, "rate", fmt.Sprintf("%dbit", n.Rate))
+	}
+	return args
+}
+
+// Command setting the tbf qdisc as it is
+func tbfArgs(ifb string, q *tcstate.Qdisc) []string {
+	return []string{"qdisc", "replace", "dev", ifb, "parent", q.Parent, "handle", q.Handle, "tbf",
+		"rate", fmt.Sprintf("%dbit", q.Tbf.Rate), "burst", fmt.Sprintf("%db", q.Tbf.Burst), "latency", microseconds(q.Tbf.Latency)}
+}
+
+func microseconds(d time.Duration) string {
+	return fmt.Sprintf("%dus", d/time.Microsecond)
+}
+
+func percentArg(percent float64) string {
+	return strconv.FormatFloat(percent, 'f', -1, 64) + "%"
+}
+
+// Handle of the netem under the class, so qdiscs can be attached to it
+func netemHandle(classid string) string {
+	class, _ := strconv.ParseUint(strings.TrimPrefix(classid, "1:"), 10, 16)
+	// Class ids are below 0x800, and the kernel numbers qdiscs added without a handle from 8000:
+	return fmt.Sprintf("%x:", 0x1000+class)
+}
+
+// Add a filter sending the CIDR's traffic to the class, "src" for egress and "dst" for ingress.
+// The filter handle is derived from the class id, so it can be deleted without looking it up.
+func (t *tcShaper) addCIDRFilter(ifb, direction, cidr string, class int) error {
+	handle := fmt.Sprintf("800::%x", class)
+	return t.run(tcStep{
+		desc: fmt.Sprintf("add filter of %s on %s", cidr, ifb),
+		args: []string{"filter", "add", "dev", ifb, "parent", "1:0", "protocol", "ip", "prio", "1",
+			"handle", handle, "u32", "match", "ip", direction, cidr, "flowid", fmt.Sprintf("1:%d", class)},
+		undo: [][]string{{"filter", "del", "dev", ifb, "parent", "1:", "protocol", "ip", "prio", "1", "handle", handle, "u32"}},
+	})
+}
+
+// Delete the filter whose class is gone
+func (t *tcShaper) deleteFilter(ifb, handle string) error {
+	glog.Infof("Deleting useless filter %s at %s", handle, ifb)
+	return t.run(tcStep{
+		desc: fmt.Sprintf("delete filter %s on %s", handle, ifb),
+		args: []string{"filter", "del", "dev", ifb, "parent", "1:", "protocol", "ip", "prio", "1", "handle", handle, "u32"},
+	})
 }
 
 // tests to see if an interface exists, if it does, return true and the status line for the interface
 // returns false, "", <err> if an error occurs.
 func (t *tcShaper) qdiscExists(vethName string) (bool, bool, error) {
-	data, err := t.e.Command("tc", "qdisc", "show", "dev", vethName).CombinedOutput()
+	qdiscs, err := tcstate.Qdiscs(t.e, vethName)
 	if err != nil {
 		return false, false, err
 	}
-	scanner := bufio.NewScanner(bytes.NewBuffer(data))
-	spec1 := "htb 1: root"
-	spec2 := "ingress ffff:"
 	rootQdisc := false
 	ingressQdisc := false
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 {
-			continue
-		}
-		if strings.Contains(line, spec1) {
+	for _, qdisc := range qdiscs {
+		if qdisc.Kind == "htb" && qdisc.Handle == "1:" && qdisc.Root {
 			rootQdisc = true
 		}
-		if strings.Contains(line, spec2) {
+		if qdisc.Kind == "ingress" && qdisc.Handle == "ffff:" {
 			ingressQdisc = true
 		}
 	}
@@ -220,56 +350,50 @@ func (t *tcShaper) ReconcileEgressCIDR(cidr string, egressChaosInfo string) erro
 
 // Add netem in ingress class
 func (t *tcShaper) ReconcileIngressInterface() error {
-	e := exec.New()
-
-	// For ingress test
-	data, err := e.Command("tc", "qdisc", "add", "dev", t.secondIFB, "parent",
-		t.ingressClassid, "netem").CombinedOutput()
-	if err != nil {
-		glog.Errorf("TC exec error: %s\n%s", err, data)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add netem to class %s on %s", t.ingressClassid, t.ingressIFB),
+		args: []string{"qdisc", "add", "dev", t.ingressIFB, "parent", t.ingressClassid, "handle", netemHandle(t.ingressClassid), "netem"},
+		undo: [][]string{{"qdisc", "del", "dev", t.ingressIFB, "parent", t.ingressClassid}},
+	}); err != nil {
 		return err
-	} else {
-		glog.Infof("Ingress netem added")
 	}
+	glog.Infof("Ingress netem added")
 	return nil
 }
 
 // Add netem in egress class
 func (t *tcShaper) ReconcileEgressInterface() error {
-	e := exec.New()
-
-	// For egress test
-	data, err := e.Command("tc", "qdisc", "add", "dev", t.firstIFB, "parent",
-		t.egressClassid, "netem").CombinedOutput()
-	if err != nil {
-		glog.Errorf("TC exec error: %s\n%s", err, data)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add netem to class %s on %s", t.egressClassid, t.egressIFB),
+		args: []string{"qdisc", "add", "dev", t.egressIFB, "parent", t.egressClassid, "handle", netemHandle(t.egressClassid), "netem"},
+		undo: [][]string{{"qdisc", "del", "dev", t.egressIFB, "parent", t.egressClassid}},
+	}); err != nil {
 		return err
-	} else {
-		glog.Infof("Egress netem added")
 	}
+	glog.Infof("Egress netem added")
 	return nil
 }
 
 // Delete netem in ingress class
 func (t *tcShaper) ClearIngressInterface() error {
-	e := exec.New()
-
-	glog.Infof("Clear ingress interface of class id: " + t.ingressClassid)
-	e.Command("tc", "qdisc", "del", "dev", t.secondIFB, "parent",
-		t.ingressClassid).CombinedOutput()
-
-	return nil
+	glog.Infof("Clear ingress interface of class id: %s", t.ingressClassid)
+	return t.run(tcStep{
+		desc:        fmt.Sprintf("delete netem of class %s on %s", t.ingressClassid, t.ingressIFB),
+		args:        []string{"qdisc", "del", "dev", t.ingressIFB, "parent", t.ingressClassid},
+		undo:        t.restoreNetem(t.ingressIFB, t.ingressClassid),
+		ignoreError: true,
+	})
 }
 
 // Delete netem in egress class
 func (t *tcShaper) ClearEgressInterface() error {
-	e := exec.New()
-
-	glog.Infof("Clear egress interface of class id: " + t.egressClassid)
-	e.Command("tc", "qdisc", "del", "dev", t.firstIFB, "parent",
-		t.egressClassid).CombinedOutput()
-
-	return nil
+	glog.Infof("Clear egress interface of class id: %s", t.egressClassid)
+	return t.run(tcStep{
+		desc:        fmt.Sprintf("delete netem of class %s on %s", t.egressClassid, t.egressIFB),
+		args:        []string{"qdisc", "del", "dev", t.egressIFB, "parent", t.egressClassid},
+		undo:        t.restoreNetem(t.egressIFB, t.egressClassid),
+		ignoreError: true,
+	})
 }
 
 // Delete ingress mirroring
@@ -300,14 +424,21 @@ func ClearEgressMirroring(iface string) error {
 
 // Create ingress mirroring without breaking the existing one
 func (t *tcShaper) ReconcileIngressMirroring(cidr string) error {
-	e := exec.New()
-
-	// Tested highest settable rate on tc
-	rate := "4gbps"
+	// The rate is set by ExecTcChaos, start without a limit
+	rate := defaultRate
 	// Tested queue size
 	size := "1600"
 
-	class, _, isFind, err := findCIDRClass(cidr, t.secondIFB)
+	ifb, err := t.pool.Allocate(cidr, true)
+	if err != nil {
+		glog.Errorf("Error when allocating ifb: %s", err)
+		return err
+	}
+	t.ingressIFB = ifb
+	// Hold the device until the pod's class is created, so parallel pods get different class ids
+	defer t.lockDevice(ifb)()
+
+	class, handle, isFind, err := findCIDRClass(t.e, cidr, t.ingressIFB)
 	if err != nil {
 		glog.Errorf("Error when finding class id: %s", err)
 		return err
@@ -315,117 +446,110 @@ func (t *tcShaper) ReconcileIngressMirroring(cidr string) error {
 
 	isExist := false
 	if isFind {
-		isExist, err = t.classExists(class, t.secondIFB)
+		isExist, err = t.classExists(class, t.ingressIFB)
 		if err != nil {
 			glog.Errorf("Error when checking class id existence: %s", err)
 			return err
 		}
 		if !isExist {
 			// Class not exist but filter was added, delete the useless filter
-			// tc filter del dev SecondIFB parent 1:
-			glog.Infof("Deleting useless filter at %s", t.secondIFB)
-			data, err := e.Command("tc", "filter", "del", "dev", t.secondIFB, "parent",
-				"1:").CombinedOutput()
-			if err != nil {
-				glog.Errorf("TC exec error: %s\n%s", err, data)
+			if err := t.deleteFilter(t.ingressIFB, handle); err != nil {
 				return err
-			} else {
-				glog.Infof("filter deleted")
 			}
 		}
 	}
 
 	if isFind && isExist {
-		glog.Infof("%s has already been initialized", t.secondIFB)
+		glog.Infof("%s has already been initialized", t.ingressIFB)
 		t.ingressClassid = class
-	} else {
-		// Clear the root queue of the interface
-		e.Command("tc", "qdisc", "del", "dev", t.iface, "root").CombinedOutput()
-		glog.Infof("Clear ingress interface: %s", t.iface)
-
-		// Add htb queue at the root of the interface
-		glog.Infof("Adding htb to interface: %s", t.iface)
-		data, err := e.Command("tc", "qdisc", "add", "dev", t.iface, "root",
-			"handle", "1:", "htb", "default", "1").CombinedOutput()
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n%s", err, data)
-			return err
-		} else {
-			glog.Infof("HTB on root added")
-		}
+		return nil
+	}
 
-		// Add htb class
-		data, err = e.Command("tc", "class", "add", "dev", t.iface,
-			"parent", "1:", "classid", "1:1", "htb", "rate", rate).CombinedOutput()
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n%s", err, data)
-			return err
-		} else {
-			glog.Infof("HTB class 1 added")
-		}
+	// Clear the root queue of the interface
+	glog.Infof("Clear ingress interface: %s", t.iface)
+	if err := t.run(tcStep{
+		desc:        fmt.Sprintf("delete root qdisc of %s", t.iface),
+		args:        []string{"qdisc", "del", "dev", t.iface, "root"},
+		ignoreError: true,
+	}); err != nil {
+		return err
+	}
 
-		// Add pfifo queue after the class
-		data, err = e.Command("tc", "qdisc", "add", "dev", t.iface, "parent", "1:1",
-			"handle", "2:1", "pfifo", "limit", size).CombinedOutput()
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n%s", err, data)
-			return err
-		} else {
-			glog.Infof("pfifo queue added at root")
-		}
+	// Add htb queue at the root of the interface
+	glog.Infof("Adding htb to interface: %s", t.iface)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add htb on root of %s", t.iface),
+		args: []string{"qdisc", "add", "dev", t.iface, "root", "handle", "1:", "htb", "default", "1"},
+		undo: [][]string{{"qdisc", "del", "dev", t.iface, "root"}},
+	}); err != nil {
+		return err
+	}
+
+	// Add htb class
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add htb class 1:1 on %s", t.iface),
+		args: []string{"class", "add", "dev", t.iface, "parent", "1:", "classid", "1:1", "htb", "rate", rate},
+	}); err != nil {
+		return err
+	}
 
-		// Mirror the egress of caliXXX to SecondIFB
-		data, err = e.Command("tc", "filter", "add", "dev", t.iface, "parent", "1:", "protocol", "ip",
+	// Add pfifo queue after the class
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add pfifo on %s", t.iface),
+		args: []string{"qdisc", "add", "dev", t.iface, "parent", "1:1", "handle", "2:1", "pfifo", "limit", size},
+	}); err != nil {
+		return err
+	}
+
+	// Mirror the egress of caliXXX to the ingress ifb
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("mirror egress of %s to %s", t.iface, t.ingressIFB),
+		args: []string{"filter", "add", "dev", t.iface, "parent", "1:", "protocol", "ip",
 			"prio", "1", "u32", "match", "u32", "0", "0", "flowid", "1:1",
-			"action", "mirred", "egress", "redirect", "dev", t.secondIFB).CombinedOutput()
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n%s", err, data)
-			return err
-		} else {
-			glog.Infof("Egress of %s mirrored to %s", t.iface, t.secondIFB)
-		}
+			"action", "mirred", "egress", "redirect", "dev", t.ingressIFB},
+	}); err != nil {
+		return err
+	}
+	glog.Infof("Egress of %s mirrored to %s", t.iface, t.ingressIFB)
 
-		// Get an unused classid
-		classid, err := t.nextClassID(t.secondIFB)
-		if err != nil {
-			return err
-		} else {
-			t.ingressClassid = fmt.Sprintf("1:%d", classid)
-			glog.Infof("%s get class %s", t.secondIFB, t.ingressClassid)
-		}
+	// Get an unused classid
+	classid, err := t.nextClassID(t.ingressIFB)
+	if err != nil {
+		return err
+	}
+	t.ingressClassid = fmt.Sprintf("1:%d", classid)
+	glog.Infof("%s get class %s", t.ingressIFB, t.ingressClassid)
 
-		// Add a filter
-		data, err = e.Command("tc", "filter", "add", "dev", t.secondIFB, "parent", "1:0", "protocol", "ip",
-			"prio", "1", "u32", "match", "ip", "dst", cidr, "flowid", t.ingressClassid,
-		).CombinedOutput()
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n%s", err, data)
-			return err
-		} else {
-			glog.Infof("Filter added")
-		}
+	// Create a class at the ingress ifb
+	if err := t.makeNewClass(rate, t.ingressIFB, classid); err != nil {
+		return err
+	}
+	glog.Infof("%s class added", t.ingressIFB)
 
-		// Create a class at SecondIFB
-		err = t.makeNewClass(rate, t.secondIFB, classid)
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n", err)
-			return err
-		} else {
-			glog.Infof("%s class added", t.secondIFB)
-		}
+	// Add a filter
+	if err := t.addCIDRFilter(t.ingressIFB, "dst", cidr, classid); err != nil {
+		return err
 	}
+	glog.Infof("Filter added")
 
 	return nil
 }
 
 // Create egress mirroring without breaking the existing one
 func (t *tcShaper) ReconcileEgressMirroring(cidr string) error {
-	e := exec.New()
+	// The rate is set by ExecTcChaos, start without a limit
+	rate := defaultRate
 
-	// Tested highest settable rate on tc
-	rate := "4gbps"
+	ifb, err := t.pool.Allocate(cidr, false)
+	if err != nil {
+		glog.Errorf("Error when allocating ifb: %s", err)
+		return err
+	}
+	t.egressIFB = ifb
+	// Hold the device until the pod's class is created, so parallel pods get different class ids
+	defer t.lockDevice(ifb)()
 
-	class, _, isFind, err := findCIDRClass(cidr, t.firstIFB)
+	class, handle, isFind, err := findCIDRClass(t.e, cidr, t.egressIFB)
 	if err != nil {
 		glog.Errorf("Error when finding class id: %s", err)
 		return err
@@ -433,83 +557,75 @@ func (t *tcShaper) ReconcileEgressMirroring(cidr string) error {
 
 	isExist := false
 	if isFind {
-		isExist, err = t.classExists(class, t.firstIFB)
+		isExist, err = t.classExists(class, t.egressIFB)
 		if err != nil {
 			glog.Errorf("Error when checking class id existence: %s", err)
 			return err
 		}
 		if !isExist {
 			// Class not exist but filter was added, delete the useless filter
-			// tc filter del dev FirstIFB parent 1:
-			glog.Infof("Deleting useless filter at %s", t.firstIFB)
-			data, err := e.Command("tc", "filter", "del", "dev", t.firstIFB, "parent",
-				"1:").CombinedOutput()
-			if err != nil {
-				glog.Errorf("TC exec error: %s\n%s", err, data)
+			if err := t.deleteFilter(t.egressIFB, handle); err != nil {
 				return err
-			} else {
-				glog.Infof("filter deleted")
 			}
 		}
 	}
 
 	if isFind && isExist {
-		glog.Infof("%s has already been initialized", t.firstIFB)
+		glog.Infof("%s has already been initialized", t.egressIFB)
 		t.egressClassid = class
-	} else {
+		return nil
+	}
 
-		// Delete ingress queue.
-		e.Command("tc", "qdisc", "del", "dev", t.iface, "ingress").CombinedOutput()
+	// Delete ingress queue.
+	if err := t.run(tcStep{
+		desc:        fmt.Sprintf("delete ingress qdisc of %s", t.iface),
+		args:        []string{"qdisc", "del", "dev", t.iface, "ingress"},
+		ignoreError: true,
+	}); err != nil {
+		return err
+	}
 
-		// Add qdisc of ingress
-		data, err := e.Command("tc", "qdisc", "add", "dev", t.iface, "ingress").CombinedOutput()
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n%s", err, data)
-			return err
-		} else {
-			glog.Infof("Ingress added")
-		}
+	// Add qdisc of ingress
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add ingress qdisc on %s", t.iface),
+		args: []string{"qdisc", "add", "dev", t.iface, "ingress"},
+		undo: [][]string{{"qdisc", "del", "dev", t.iface, "ingress"}},
+	}); err != nil {
+		return err
+	}
+	glog.Infof("Ingress added")
 
-		// Mirror the ingress of caliXXX to FirstIFB
-		data, err = e.Command("tc", "filter", "add", "dev", t.iface, "parent", "ffff:", "protocol", "ip",
+	// Mirror the ingress of caliXXX to the egress ifb
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("mirror ingress of %s to %s", t.iface, t.egressIFB),
+		args: []string{"filter", "add", "dev", t.iface, "parent", "ffff:", "protocol", "ip",
 			"prio", "1", "u32", "match", "u32", "0", "0", "flowid", "1:1",
-			"action", "mirred", "egress", "redirect", "dev", t.firstIFB).CombinedOutput()
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n%s", err, data)
-			return err
-		} else {
-			glog.Infof("Ingress of %s mirrored to %s", t.iface, t.firstIFB)
-		}
+			"action", "mirred", "egress", "redirect", "dev", t.egressIFB},
+	}); err != nil {
+		return err
+	}
+	glog.Infof("Ingress of %s mirrored to %s", t.iface, t.egressIFB)
 
-		// Get an unused classid
-		classid, err := t.nextClassID(t.firstIFB)
-		if err != nil {
-			return err
-		} else {
-			t.egressClassid = fmt.Sprintf("1:%d", classid)
-			glog.Infof("%s get class %s", t.firstIFB, t.egressClassid)
-		}
+	// Get an unused classid
+	classid, err := t.nextClassID(t.egressIFB)
+	if err != nil {
+		return err
+	}
+	t.egressClassid = fmt.Sprintf("1:%d", classid)
+	glog.Infof("%s get class %s", t.egressIFB, t.egressClassid)
 
-		// Add a filter
-		data, err = e.Command("tc", "filter", "add", "dev", t.firstIFB, "parent", "1:0", "protocol", "ip",
-			"prio", "1", "u32", "match", "ip", "src", cidr, "flowid", t.egressClassid,
-		).CombinedOutput()
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n%s", err, data)
-			return err
-		} else {
-			glog.Infof("Filter added")
-		}
+	// Create a class
+	if err := t.makeNewClass(rate, t.egressIFB, classid); err != nil {
+		return err
+	}
+	glog.Infof("%s class added", t.egressIFB)
 
-		// Create a class
-		err = t.makeNewClass(rate, t.firstIFB, classid)
-		if err != nil {
-			glog.Errorf("TC exec error: %s\n", err)
-			return err
-		} else {
-			glog.Infof("%s class added", t.firstIFB)
-		}
+	// Add a filter
+	if err := t.addCIDRFilter(t.egressIFB, "src", cidr, classid); err != nil {
+		return err
 	}
+	glog.Infof("Filter added")
+
 	return nil
 }
 
@@ -517,52 +633,36 @@ func (t *tcShaper) ReconcileEgressMirroring(cidr string) error {
 func (t *tcShaper) Rate(classid, ifb string, rate string) error {
 	// For test
 	glog.Infof("Adding rate %s to interface: %s", rate, ifb)
-	t.changeClass(rate, ifb, classid)
-
-	return nil
+	return t.changeClass(ifb, classid, []string{"rate", rate})
 }
 
 // Add empty netem queue discipline
 func (t *tcShaper) Netem(classid, ifb string, args ...string) error {
 	// tc  qdisc  add  dev  eth0  root  netem
-	e := exec.New()
-
-	// For test
 	glog.Infof("Adding netem %v to interface: %s", args, ifb)
-	cmd := []string{"qdisc", "change", "dev", ifb, "parent", classid, "netem"}
-	cmd = append(cmd, args...)
-
-	data, err := e.Command("tc", cmd...).CombinedOutput()
-
-	if err != nil {
-		glog.Errorf("TC exec error: %s\n%s", err, data)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("set netem %v of class %s on %s", args, classid, ifb),
+		args: append([]string{"qdisc", "change", "dev", ifb, "parent", classid, "netem"}, args...),
+		undo: t.restoreNetem(ifb, classid),
+	}); err != nil {
 		return err
-	} else {
-		glog.Infof("Netem added")
 	}
-
+	glog.Infof("Netem added")
 	return nil
 }
 
 // Emulate packets loss
 func (t *tcShaper) Loss(classid, ifb string, args ...string) error {
 	// tc  qdisc  add  dev  eth0  root  netem  loss  1%  30%
-	e := exec.New()
-
-	// For test
 	glog.Infof("Adding loss %v to interface: %s", args, ifb)
-	cmd := []string{"qdisc", "change", "dev", ifb, "parent", classid, "netem", "loss"}
-	cmd = append(cmd, args...)
-
-	data, err := e.Command("tc", cmd...).CombinedOutput()
-
-	if err != nil {
-		glog.Errorf("TC exec error: %s\n%s", err, data)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("set loss %v of class %s on %s", args, classid, ifb),
+		args: append([]string{"qdisc", "change", "dev", ifb, "parent", classid, "netem", "loss"}, args...),
+		undo: t.restoreNetem(ifb, classid),
+	}); err != nil {
 		return err
-	} else {
-		glog.Infof("Loss added")
 	}
-
+	glog.Infof("Loss added")
 	return nil
 }
 
@@ -570,120 +670,131 @@ func (t *tcShaper) Loss(classid, ifb string, args ...string) error {
 func (t *tcShaper) Delay(classid, ifb string, args ...string) error {
 	// tc  qdisc  add  dev  eth0  root  netem  delay  100ms  10ms  30%
 	//												 basis	devi  devirate
-	e := exec.New()
-
-	// For test
 	glog.Infof("Adding delay %v to interface: %s", args, ifb)
-	cmd := []string{"qdisc", "change", "dev", ifb, "parent", classid, "netem", "delay"}
-	cmd = append(cmd, args...)
-
-	data, err := e.Command("tc", cmd...).CombinedOutput()
-
-	if err != nil {
-		glog.Errorf("TC exec error: %s\n%s", err, data)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("set delay %v of class %s on %s", args, classid, ifb),
+		args: append([]string{"qdisc", "change", "dev", ifb, "parent", classid, "netem", "delay"}, args...),
+		undo: t.restoreNetem(ifb, classid),
+	}); err != nil {
 		return err
-	} else {
-		glog.Infof("Delay added")
 	}
-
+	glog.Infof("Delay added")
 	return nil
 }
 
 // Emulate duplicated packets
 func (t *tcShaper) Duplicate(classid, ifb string, args ...string) error {
 	// tc  qdisc  add  dev  eth0  root  netem  duplicate 1%
-	e := exec.New()
-
-	// For test
 	glog.Infof("Adding duplicate %v to interface: %s", args, ifb)
-	cmd := []string{"qdisc", "change", "dev", ifb, "parent", classid, "netem", "duplicate"}
-	cmd = append(cmd, args...)
-
-	data, err := e.Command("tc", cmd...).CombinedOutput()
-
-	if err != nil {
-		glog.Errorf("TC exec error: %s ,\n%s", err, data)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("set duplicate %v of class %s on %s", args, classid, ifb),
+		args: append([]string{"qdisc", "change", "dev", ifb, "parent", classid, "netem", "duplicate"}, args...),
+		undo: t.restoreNetem(ifb, classid),
+	}); err != nil {
 		return err
-	} else {
-		glog.Infof("Duplicate added")
 	}
-
+	glog.Infof("Duplicate added")
 	return nil
 }
 
 // Emulate corrupted packets
 func (t *tcShaper) Corrupt(classid, ifb string, args ...string) error {
 	// tc  qdisc  add  dev  eth0  root  netem  corrupt  0.2%
-	e := exec.New()
-
-	// For test
 	glog.Infof("Adding corrupt %v to interface: %s", args, ifb)
-	cmd := []string{"qdisc", "change", "dev", ifb, "parent", classid, "netem", "corrupt"}
-	cmd = append(cmd, args...)
-
-	data, err := e.Command("tc", cmd...).CombinedOutput()
-
-	if err != nil {
-		glog.Errorf("TC exec error: %s ,\n%s", err, data)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("set corrupt %v of class %s on %s", args, classid, ifb),
+		args: append([]string{"qdisc", "change", "dev", ifb, "parent", classid, "netem", "corrupt"}, args...),
+		undo: t.restoreNetem(ifb, classid),
+	}); err != nil {
 		return err
-	} else {
-		glog.Infof("Corrupt added")
 	}
+	glog.Infof("Corrupt added")
+	return nil
+}
 
+// Limit the traffic leaving netem with a token bucket
+func (t *tcShaper) Tbf(classid, ifb string, tbf *TbfPolicer) error {
+	glog.Infof("Adding tbf %+v to interface: %s", *tbf, ifb)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("add tbf %s/%s/%s under netem of class %s on %s", tbf.Rate, tbf.Burst, tbf.Latency, classid, ifb),
+		args: []string{"qdisc", "add", "dev", ifb, "parent", netemHandle(classid) + "1", "tbf",
+			"rate", tbf.Rate, "burst", tbf.Burst, "latency", tbf.Latency},
+		undo: [][]string{{"qdisc", "del", "dev", ifb, "parent", netemHandle(classid) + "1"}},
+	}); err != nil {
+		return err
+	}
+	glog.Infof("Tbf added")
 	return nil
 }
 
+// Replace the tbf under netem of the class, or delete it if tbf is nil
+func (t *tcShaper) changeTbf(classid, ifb string, tbf *TbfPolicer) error {
+	if tbf == nil {
+		return t.run(tcStep{
+			desc:        fmt.Sprintf("delete tbf under netem of class %s on %s", classid, ifb),
+			args:        []string{"qdisc", "del", "dev", ifb, "parent", netemHandle(classid) + "1"},
+			undo:        t.restoreTbf(ifb, classid),
+			ignoreError: true,
+		})
+	}
+	return t.run(tcStep{
+		desc: fmt.Sprintf("set tbf %s/%s/%s under netem of class %s on %s", tbf.Rate, tbf.Burst, tbf.Latency, classid, ifb),
+		args: []string{"qdisc", "replace", "dev", ifb, "parent", netemHandle(classid) + "1", "tbf",
+			"rate", tbf.Rate, "burst", tbf.Burst, "latency", tbf.Latency},
+		undo: t.restoreTbf(ifb, classid),
+	})
+}
+
 // Delete netem in the class
 func (t *tcShaper) Clear(classid, ifb string, percentage, relate string) error {
-	e := exec.New()
 	glog.Infof("Deleting HTB in interface: %s", t.iface)
-	// For test
-
-	data, err := e.Command("tc", "qdisc", "del", "dev", ifb, "parent",
-		classid, "netem").CombinedOutput()
-	if err != nil {
-		glog.Errorf("TC exec error: %s\n%s", err, data)
+	if err := t.run(tcStep{
+		desc: fmt.Sprintf("delete netem of class %s on %s", classid, ifb),
+		args: []string{"qdisc", "del", "dev", ifb, "parent", classid, "netem"},
+		undo: t.restoreNetem(ifb, classid),
+	}); err != nil {
 		return err
-	} else {
-		glog.Infof("Netem deleted")
 	}
-
+	glog.Infof("Netem deleted")
 	return nil
 }
 
 // Execute chaos settings in ingress or egress from chaosinfo
 func (t *tcShaper) ExecTcChaos(isIngress bool, info string) error {
-	// Split commands
-	cmds := strings.Split(info, ",")
-
 	var classid, ifb string
 	if isIngress {
 		classid = t.ingressClassid
-		ifb = t.secondIFB
+		ifb = t.ingressIFB
 	} else {
 		classid = t.egressClassid
-		ifb = t.firstIFB
+		ifb = t.egressIFB
 	}
 	if info == "" {
 		return errors.New("No chaos info set")
 	}
 
-	if cmds[0] == "" {
-		cmds[0] = "4gbps"
-	}
-	err := t.Rate(classid, ifb, cmds[0])
+	// Split the settings and validate them before touching tc
+	bandwidth, netemArgs, err := ParseChaosInfo(info, isIngress)
 	if err != nil {
 		return err
 	}
+	if err := t.changeClass(ifb, classid, bandwidth.htbArgs()); err != nil {
+		return err
+	}
 
 	// Set netem
-	return t.Netem(classid,ifb,cmds[1:]...)
+	if err := t.Netem(classid, ifb, netemArgs...); err != nil {
+		return err
+	}
+	if bandwidth.Tbf != nil {
+		return t.Tbf(classid, ifb, bandwidth.Tbf)
+	}
+	return nil
 }
 
 // Remove a bandwidth limit for a particular CIDR on a particular network interface
-func Reset(cidr, ifb string) error {
-	e := exec.New()
-	class, handle, found, err := findCIDRClass(cidr, ifb)
+func Reset(e exec.Interface, cidr, ifb string) error {
+	class, handle, found, err := findCIDRClass(e, cidr, ifb)
 	if err != nil {
 		return err
 	}
@@ -707,65 +818,39 @@ func Reset(cidr, ifb string) error {
 }
 
 // Get CIDRs from ifb's filters
-func getCIDRs(ifb string) ([]string, error) {
-	e := exec.New()
-	data, err := e.Command("tc", "filter", "show", "dev", ifb).CombinedOutput()
+func getCIDRs(e exec.Interface, ifb string) ([]string, error) {
+	filters, err := tcstate.Filters(e, ifb, "")
 	if err != nil {
 		return nil, err
 	}
-
 	result := []string{}
-	scanner := bufio.NewScanner(bytes.NewBuffer(data))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 {
-			continue
-		}
-		if strings.Contains(line, "match") {
-			parts := strings.Split(line, " ")
-			// expected tc line:
-			// match <cidr> at <number>
-			if len(parts) != 4 {
-				return nil, fmt.Errorf("unexpected output: %v", parts)
-			}
-			cidr, err := asciiCIDR(parts[1])
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, cidr)
-		}
+	for _, filter := range filters {
+		result = append(result, filter.CIDRs()...)
 	}
 	return result, nil
 }
 
-// Delete classes in the ifb which is not in the CIDR list
-func DeleteExtraChaos(egressPodsCIDRs, ingressPodsCIDRs []string, firstIFB, secondIFB int) error {
+// Delete classes in the ifb pool which are not in the CIDR list
+func DeleteExtraChaos(egressPodsCIDRs, ingressPodsCIDRs []string, pool *IfbPool) error {
 	//delete extra chaos of egress
-	first := fmt.Sprintf("ifb%d", firstIFB)
-	second := fmt.Sprintf("ifb%d", secondIFB)
-
-	egressCIDRsets := sliceToSets(egressPodsCIDRs)
-	ifb0CIDRs, err := getCIDRs(first)
-	if err != nil {
+	if err := deleteExtraCIDRs(pool.e, sliceToSets(egressPodsCIDRs), pool.Devices(false)); err != nil {
 		return err
 	}
-	for _, ifb0CIDR := range ifb0CIDRs {
-		if !egressCIDRsets.Has(ifb0CIDR) {
-			if err := Reset(ifb0CIDR, first); err != nil {
-				return err
-			}
-		}
-	}
 	//delete extra chaos of ingress
-	ingressCIDRsets := sliceToSets(ingressPodsCIDRs)
-	ifb1CIDRs, err := getCIDRs(second)
-	if err != nil {
-		return err
-	}
-	for _, ifb1CIDR := range ifb1CIDRs {
-		if !ingressCIDRsets.Has(ifb1CIDR) {
-			if err := Reset(ifb1CIDR, second); err != nil {
-				return err
+	return deleteExtraCIDRs(pool.e, sliceToSets(ingressPodsCIDRs), pool.Devices(true))
+}
+
+func deleteExtraCIDRs(e exec.Interface, podsCIDRs sets.String, ifbs []string) error {
+	for _, ifb := range ifbs {
+		ifbCIDRs, err := getCIDRs(e, ifb)
+		if err != nil {
+			return err
+		}
+		for _, ifbCIDR := range ifbCIDRs {
+			if !podsCIDRs.Has(ifbCIDR) {
+				if err := Reset(e, ifbCIDR, ifb); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -24,37 +24,60 @@ import "github.com/huanwei/kube-chaos/pkg/exec"
 type tcShaper struct {
 	e              exec.Interface
 	iface          string
-	firstIFB       string
-	secondIFB      string
+	pool           *IfbPool
+	egressIFB      string
+	ingressIFB     string
 	ingressClassid string
 	egressClassid  string
+	// Commands queued between Begin and Commit, nil when not batching
+	batch *tcBatch
 }
 
 // Represent tc chaos information using json encoding
 type ChaosInfo struct {
-	Rate  string
+	Rate  string `json:"rate,omitempty"`
 	Delay struct {
-		Set       string
-		Time      string
-		Variation string
-	}
+		Set       string `json:"set,omitempty"`
+		Time      string `json:"time,omitempty"`
+		Variation string `json:"variation,omitempty"`
+	} `json:"delay"`
 	Loss struct {
-		Set        string
-		Percentage string
-		Relate     string
-	}
+		Set        string `json:"set,omitempty"`
+		Percentage string `json:"percentage,omitempty"`
+		Relate     string `json:"relate,omitempty"`
+	} `json:"loss"`
 	Duplicate struct {
-		Set        string
-		Percentage string
-	}
+		Set        string `json:"set,omitempty"`
+		Percentage string `json:"percentage,omitempty"`
+	} `json:"duplicate"`
 	Reorder struct {
-		Set         string
-		Time        string
-		Percengtage string
-		Relate      string
-	}
+		Set         string `json:"set,omitempty"`
+		Time        string `json:"time,omitempty"`
+		Percengtage string `json:"percentage,omitempty"`
+		Relate      string `json:"relate,omitempty"`
+	} `json:"reorder"`
 	Corrupt struct {
-		Set        string
-		Percentage string
-	}
+		Set        string `json:"set,omitempty"`
+		Percentage string `json:"percentage,omitempty"`
+	} `json:"corrupt"`
+}
+
+// Statistics of the pod's class in one direction
+type ChaosStats struct {
+	SentBytes   uint64 `json:"sentBytes"`
+	SentPackets uint64 `json:"sentPackets"`
+	// Packets dropped by netem, or by the class when the pod has no netem
+	Dropped uint64 `json:"dropped"`
+	// Packets delayed by the rate limit
+	Overlimits uint64 `json:"overlimits"`
+	Requeues   uint64 `json:"requeues"`
+	// Bytes queued
+	Backlog uint64 `json:"backlog"`
+}
+
+// Represent the statistics in kubernetes.io/chaos-stats using json encoding
+type PodChaosStats struct {
+	Ingress    *ChaosStats `json:"ingress,omitempty"`
+	Egress     *ChaosStats `json:"egress,omitempty"`
+	UpdateTime string      `json:"updateTime,omitempty"`
 }
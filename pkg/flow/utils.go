@@ -17,12 +17,13 @@ limitations under the License.
 package flow
 
 import (
-	"encoding/hex"
 	"fmt"
 	"github.com/huanwei/kube-chaos/pkg/sets"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"net"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -30,24 +31,66 @@ import (
 func SetPodChaosUpdated(ingressNeedUpdate, egressNeedUpdate, ingressNeedClear, egressNeedClear bool, podAnnotations map[string]string) (newAnnotations map[string]string) {
 	if ingressNeedUpdate {
 		podAnnotations["kubernetes.io/done-ingress-chaos"] = "yes"
+		delete(podAnnotations, "kubernetes.io/rejected-ingress-chaos")
 	}
 	if egressNeedUpdate {
 		podAnnotations["kubernetes.io/done-egress-chaos"] = "yes"
+		delete(podAnnotations, "kubernetes.io/rejected-egress-chaos")
 	}
 
 	if ingressNeedClear {
 		delete(podAnnotations, "kubernetes.io/clear-ingress-chaos")
 		delete(podAnnotations, "kubernetes.io/done-ingress-chaos")
 		delete(podAnnotations, "kubernetes.io/ingress-chaos")
+		delete(podAnnotations, effectiveIngressAnnotation)
+		delete(podAnnotations, "kubernetes.io/rejected-ingress-chaos")
+		delete(podAnnotations, rampAnnotation(true))
+		delete(podAnnotations, rampStatusAnnotation(true))
 	}
 	if egressNeedClear {
 		delete(podAnnotations, "kubernetes.io/clear-egress-chaos")
 		delete(podAnnotations, "kubernetes.io/done-egress-chaos")
 		delete(podAnnotations, "kubernetes.io/egress-chaos")
+		delete(podAnnotations, effectiveEgressAnnotation)
+		delete(podAnnotations, "kubernetes.io/rejected-egress-chaos")
+		delete(podAnnotations, rampAnnotation(false))
+		delete(podAnnotations, rampStatusAnnotation(false))
+	}
+	if ingressNeedClear && egressNeedClear {
+		delete(podAnnotations, chaosStatsAnnotation)
+		delete(podAnnotations, ChaosScheduleAnnotation)
+		delete(podAnnotations, scheduleStatusAnnotation)
 	}
 	return podAnnotations
 }
 
+// Set the chaos settings of a direction to be applied, ramped if ramp is not empty
+func SetPodChaos(isIngress bool, info, ramp string, podAnnotations map[string]string) {
+	direction := "egress"
+	if isIngress {
+		direction = "ingress"
+	}
+	podAnnotations["kubernetes.io/"+direction+"-chaos"] = info
+	podAnnotations["kubernetes.io/done-"+direction+"-chaos"] = "no"
+	delete(podAnnotations, "kubernetes.io/clear-"+direction+"-chaos")
+	delete(podAnnotations, "kubernetes.io/rejected-"+direction+"-chaos")
+	if ramp != "" {
+		podAnnotations[rampAnnotation(isIngress)] = ramp
+	} else {
+		delete(podAnnotations, rampAnnotation(isIngress))
+	}
+}
+
+// Set the clear flag of a direction, the chaos settings are removed once cleared
+func SetPodChaosClear(isIngress bool, podAnnotations map[string]string) {
+	direction := "egress"
+	if isIngress {
+		direction = "ingress"
+	}
+	podAnnotations["kubernetes.io/clear-"+direction+"-chaos"] = "yes"
+	podAnnotations["kubernetes.io/done-"+direction+"-chaos"] = "no"
+}
+
 func GetClearFlag(podAnnotations map[string]string) (ingressNeedClear, egressNeedClear bool) {
 	_, ingressNeedClear = podAnnotations["kubernetes.io/clear-ingress-chaos"]
 	_, egressNeedClear = podAnnotations["kubernetes.io/clear-egress-chaos"]
@@ -58,14 +101,14 @@ func GetClearFlag(podAnnotations map[string]string) (ingressNeedClear, egressNee
 // Extract Chaos settings from pod's annotation
 func ExtractPodChaosInfo(podAnnotations map[string]string) (ingressChaosInfo, egressChaosInfo string, ingressNeedUpdate, egressNeedUpdate bool, err error) {
 	ingressDone, found := podAnnotations["kubernetes.io/done-ingress-chaos"]
-	if (found && ingressDone == "yes") || !found {
+	if (found && (ingressDone == "yes" || ingressDone == rejected)) || !found {
 		ingressNeedUpdate = false
 	} else {
 		ingressNeedUpdate = true
 	}
 
 	egressDone, found := podAnnotations["kubernetes.io/done-egress-chaos"]
-	if (found && egressDone == "yes") || !found {
+	if (found && (egressDone == "yes" || egressDone == rejected)) || !found {
 		egressNeedUpdate = false
 	} else {
 		egressNeedUpdate = true
@@ -77,6 +120,25 @@ func ExtractPodChaosInfo(podAnnotations map[string]string) (ingressChaosInfo, eg
 	return ingressChaosInfo, egressChaosInfo, ingressNeedUpdate, egressNeedUpdate, nil
 }
 
+// Get the data of a ConfigMap given as namespace/name, nil if it does not exist
+func GetConfigMapData(clientset *kubernetes.Clientset, name string) (map[string]string, error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid ConfigMap %q, expected namespace/name", name)
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps(parts[0]).Get(parts[1], meta_v1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if configMap.Data == nil {
+		return map[string]string{}, nil
+	}
+	return configMap.Data, nil
+}
+
 func GetMasterIP(clientset *kubernetes.Clientset) (masterIP string) {
 	nodes, _ := clientset.CoreV1().Nodes().List(meta_v1.ListOptions{LabelSelector: "node-role.kubernetes.io/master="})
 	masterAddrs := nodes.Items[0].Status.Addresses
@@ -97,34 +159,38 @@ func sliceToSets(slice []string) sets.String {
 	return ss
 }
 
-// Convert a CIDR from hex representation to text, opposite of the above.
-func asciiCIDR(cidr string) (string, error) {
-	parts := strings.Split(cidr, "/")
-	if len(parts) != 2 {
-		return "", fmt.Errorf("unexpected CIDR format: %s", cidr)
-	}
-	ipData, err := hex.DecodeString(parts[0])
-	if err != nil {
-		return "", err
-	}
-	ip := net.IP(ipData)
+// Put the ifb at the head of the list, removing it from the rest
+func prepend(ifb string, ifbs []string) []string {
+	return append([]string{ifb}, without(ifbs, ifb)...)
+}
 
-	maskData, err := hex.DecodeString(parts[1])
-	mask := net.IPMask(maskData)
-	size, _ := mask.Size()
+func without(ifbs []string, ifb string) []string {
+	result := []string{}
+	for _, name := range ifbs {
+		if name != ifb {
+			result = append(result, name)
+		}
+	}
+	return result
+}
 
-	return fmt.Sprintf("%s/%d", ip.String(), size), nil
+// Sort ifb devices by their id, so ifb10 comes after ifb2
+func sortIfbs(ifbs []string) {
+	sort.Slice(ifbs, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(ifbs[i], "ifb"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(ifbs[j], "ifb"))
+		return a < b
+	})
 }
 
-// Convert a CIDR from text to a hex representation
-// Strips any masked parts of the IP, so 1.2.3.4/16 becomes hex(1.2.0.0)/ffffffff
-func hexCIDR(cidr string) (string, error) {
-	ip, ipnet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return "", err
+// Return the field following the first of the given keys, or "" if none is found
+func fieldAfter(parts []string, keys ...string) string {
+	for i := 0; i < len(parts)-1; i++ {
+		for _, key := range keys {
+			if parts[i] == key {
+				return parts[i+1]
+			}
+		}
 	}
-	ip = ip.Mask(ipnet.Mask)
-	hexIP := hex.EncodeToString([]byte(ip.To4()))
-	hexMask := ipnet.Mask.String()
-	return hexIP + "/" + hexMask, nil
+	return ""
 }
@@ -0,0 +1,181 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpchaos
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("port=8080 path=/api/orders* method=get,POST header=x-canary:true abort=503,10%; port=9090 delay=2s,50% set-header=X-Chaos:yes body=oops%20there")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %+v", rules)
+	}
+	first := rules[0]
+	if first.Port != 8080 || first.Path != "/api/orders*" || !reflect.DeepEqual(first.Methods, []string{"GET", "POST"}) ||
+		first.Headers.Get("X-Canary") != "true" || first.Abort != 503 || first.AbortPercent != 10 || first.Delay != 0 {
+		t.Errorf("unexpected first rule %+v", first)
+	}
+	second := rules[1]
+	if second.Port != 9090 || second.Delay != 2*time.Second || second.DelayPercent != 50 || second.Abort != 0 ||
+		second.SetHeaders.Get("X-Chaos") != "yes" || second.Body == nil || *second.Body != "oops there" {
+		t.Errorf("unexpected second rule %+v", second)
+	}
+	if ports := Ports(append(rules, rules[0])); !reflect.DeepEqual(ports, []int{8080, 9090}) {
+		t.Errorf("expected ports 8080 and 9090, got %v", ports)
+	}
+
+	invalid := map[string]string{
+		"":                              "no http rules",
+		"abort=503":                     "has no port",
+		"port=8080":                     "has no abort, delay, set-header or body",
+		"port=0 abort=503":              "invalid port",
+		"port=8080 abort=42":            "invalid abort status",
+		"port=8080 abort=503,0%":        "invalid percent",
+		"port=8080 delay=soon":          "invalid delay",
+		"port=8080 path=api abort=503":  "invalid path",
+		"port=8080 header=:x abort=503": "invalid header",
+		"port=8080 retry=3":             "unknown http rule setting",
+		"port=8080 abort":               "expected key=value",
+	}
+	for spec, message := range invalid {
+		if _, err := ParseRules(spec); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected an error containing %q, got %v", spec, message, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rules, _ := ParseRules("port=8080 path=/api/orders* method=POST header=X-Canary: abort=503; port=8080 path=/health abort=500")
+	request := func(method, path string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+	if rule := Match(rules, 8080, request("POST", "/api/orders/42", map[string]string{"X-Canary": "a"})); rule == nil || rule.Abort != 503 {
+		t.Errorf("expected the orders rule, got %+v", rule)
+	}
+	if rule := Match(rules, 8080, request("POST", "/api/orders/42", nil)); rule != nil {
+		t.Errorf("expected no rule without the header, got %+v", rule)
+	}
+	if rule := Match(rules, 8080, request("GET", "/api/orders", map[string]string{"X-Canary": "a"})); rule != nil {
+		t.Errorf("expected no rule for another method, got %+v", rule)
+	}
+	if rule := Match(rules, 8080, request("GET", "/health", nil)); rule == nil || rule.Abort != 500 {
+		t.Errorf("expected the health rule, got %+v", rule)
+	}
+	if rule := Match(rules, 9090, request("GET", "/health", nil)); rule != nil {
+		t.Errorf("expected no rule for another port, got %+v", rule)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Backend", "yes")
+		w.Write([]byte("hello from " + req.URL.Path))
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(listener, 8080, target.Host, net.Dial)
+	go proxy.Serve()
+	defer proxy.Close()
+	rules, _ := ParseRules("port=8080 path=/broken abort=503; port=8080 path=/changed set-header=X-Chaos:yes body=changed; port=8080 path=/slow delay=50ms")
+	proxy.SetRules(rules)
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	if resp, body := get("/ok"); resp.StatusCode != 200 || body != "hello from /ok" {
+		t.Errorf("expected the backend's response, got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := get("/broken"); resp.StatusCode != 503 || resp.Header.Get("X-Backend") != "" {
+		t.Errorf("expected an aborted request, got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := get("/changed"); body != "changed" || resp.Header.Get("X-Chaos") != "yes" || resp.Header.Get("X-Backend") != "yes" {
+		t.Errorf("expected a changed response, got %v %q", resp.Header, body)
+	}
+	start := time.Now()
+	if resp, _ := get("/slow"); resp.StatusCode != 200 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected a delayed response, got %d after %v", resp.StatusCode, time.Since(start))
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			func() ([]byte, error) {
+				return []byte("iptables: Chain already exists."), &exec.FakeExitError{Status: 1}
+			},
+			func() ([]byte, error) { return nil, nil },
+			func() ([]byte, error) { return nil, nil },
+			func() ([]byte, error) { return nil, nil },
+			// No jump to the chain yet
+			func() ([]byte, error) { return nil, &exec.FakeExitError{Status: 1} },
+			func() ([]byte, error) { return nil, nil },
+		},
+	}
+	fexec := exec.FakeExec{}
+	for range fcmd.CombinedOutputScript {
+		fexec.CommandScript = append(fexec.CommandScript,
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) })
+	}
+	r := &Redirector{e: &fexec}
+	if err := r.Redirect("192.168.0.10", map[int]int{9090: 40001, 8080: 40000}); err != nil {
+		t.Fatal(err)
+	}
+	redirect := func(port, to string) []string {
+		return []string{"iptables", "-w", "-t", "nat", "-A", Chain, "-p", "tcp", "--dport", port, "!", "-s", "192.168.0.10",
+			"-m", "comment", "--comment", "kube-chaos http", "-j", "REDIRECT", "--to-ports", to}
+	}
+	expectedCalls := [][]string{
+		{"iptables", "-w", "-t", "nat", "-N", Chain},
+		{"iptables", "-w", "-t", "nat", "-F", Chain},
+		redirect("8080", "40000"),
+		redirect("9090", "40001"),
+		{"iptables", "-w", "-t", "nat", "-C", "PREROUTING", "-j", Chain},
+		{"iptables", "-w", "-t", "nat", "-I", "PREROUTING", "1", "-j", Chain},
+	}
+	if !reflect.DeepEqual(fcmd.CombinedOutputLog, expectedCalls) {
+		t.Errorf("expected calls %v, got %v", expectedCalls, fcmd.CombinedOutputLog)
+	}
+}
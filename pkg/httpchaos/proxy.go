@@ -0,0 +1,158 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpchaos
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Key of the matched rule in the context of a forwarded request
+type ruleKey struct{}
+
+// Proxy serves the requests redirected from a pod's port, and forwards them to the port
+// with the faults of the rules matching them
+type Proxy struct {
+	port     int
+	listener net.Listener
+	server   *http.Server
+	proxy    *httputil.ReverseProxy
+	// Dials the pod's port, from the pod's network namespace
+	transport *http.Transport
+
+	mu    sync.RWMutex
+	rules []Rule
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// A proxy of the port, serving the listener and forwarding to target, host:port of the pod
+func NewProxy(listener net.Listener, port int, target string, dial func(network, address string) (net.Conn, error)) *Proxy {
+	p := &Proxy{
+		port:      port,
+		listener:  listener,
+		transport: &http.Transport{Dial: dial, IdleConnTimeout: 90 * time.Second},
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = target
+		},
+		Transport:      p.transport,
+		ModifyResponse: modifyResponse,
+	}
+	p.server = &http.Server{Handler: p}
+	return p
+}
+
+// Set the rules of the requests, rules of other ports are ignored
+func (p *Proxy) SetRules(rules []Rule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+}
+
+// The port the proxy listens on, the pod's port is redirected to
+func (p *Proxy) ListenPort() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Serve the requests until the proxy is closed
+func (p *Proxy) Serve() error {
+	err := p.server.Serve(p.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close the listener and the connections, the requests being served are dropped
+func (p *Proxy) Close() error {
+	err := p.server.Close()
+	p.transport.CloseIdleConnections()
+	return err
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.mu.RLock()
+	rule := Match(p.rules, p.port, req)
+	p.mu.RUnlock()
+	if rule == nil {
+		p.proxy.ServeHTTP(w, req)
+		return
+	}
+
+	if rule.Delay > 0 && p.hit(rule.DelayPercent) {
+		glog.V(4).Infof("Delaying %s %s to port %d by %v", req.Method, req.URL.Path, p.port, rule.Delay)
+		select {
+		case <-time.After(rule.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if rule.Abort != 0 && p.hit(rule.AbortPercent) {
+		glog.V(4).Infof("Aborting %s %s to port %d with %d", req.Method, req.URL.Path, p.port, rule.Abort)
+		http.Error(w, fmt.Sprintf("kube-chaos: aborted with %d", rule.Abort), rule.Abort)
+		return
+	}
+	if rule.SetHeaders != nil || rule.Body != nil {
+		req = req.WithContext(context.WithValue(req.Context(), ruleKey{}, rule))
+	}
+	p.proxy.ServeHTTP(w, req)
+}
+
+func (p *Proxy) hit(percent float64) bool {
+	if percent >= 100 {
+		return true
+	}
+	p.randMu.Lock()
+	defer p.randMu.Unlock()
+	return p.rand.Float64()*100 < percent
+}
+
+// Set the headers and replace the body of the response to a request matching a rule
+func modifyResponse(resp *http.Response) error {
+	rule, _ := resp.Request.Context().Value(ruleKey{}).(*Rule)
+	if rule == nil {
+		return nil
+	}
+	for name, values := range rule.SetHeaders {
+		resp.Header[name] = values
+	}
+	if rule.Body != nil {
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(strings.NewReader(*rule.Body))
+		resp.ContentLength = int64(len(*rule.Body))
+		resp.TransferEncoding = nil
+		resp.Header.Set("Content-Length", strconv.Itoa(len(*rule.Body)))
+		resp.Header.Del("Content-Encoding")
+	}
+	return nil
+}
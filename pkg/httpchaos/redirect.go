@@ -0,0 +1,88 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpchaos
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// Chain of the nat table in the pod's network namespace redirecting the ports to the proxies
+const Chain = "KUBE-CHAOS-HTTP"
+
+// Redirector redirects the connections to a pod's ports to the proxies, it runs iptables in
+// the network namespace it is called from
+type Redirector struct {
+	e exec.Interface
+}
+
+func NewRedirector() *Redirector {
+	return &Redirector{e: exec.New()}
+}
+
+// Redirect the connections to the ports, the keys, to the proxies' ports, replacing the
+// previous rules, connections from the node's IP such as the kubelet's probes are left alone
+func (r *Redirector) Redirect(hostIP string, ports map[int]int) error {
+	if out, err := r.iptables("-N", Chain); err != nil && !strings.Contains(out, "exists") {
+		return fmt.Errorf("failed to create chain %s: %v: %s", Chain, err, out)
+	}
+	if out, err := r.iptables("-F", Chain); err != nil {
+		return fmt.Errorf("failed to flush chain %s: %v: %s", Chain, err, out)
+	}
+	podPorts := []int{}
+	for port := range ports {
+		podPorts = append(podPorts, port)
+	}
+	sort.Ints(podPorts)
+	for _, port := range podPorts {
+		rule := []string{"-A", Chain, "-p", "tcp", "--dport", strconv.Itoa(port)}
+		if hostIP != "" {
+			rule = append(rule, "!", "-s", hostIP)
+		}
+		rule = append(rule, "-m", "comment", "--comment", "kube-chaos http",
+			"-j", "REDIRECT", "--to-ports", strconv.Itoa(ports[port]))
+		if out, err := r.iptables(rule...); err != nil {
+			return fmt.Errorf("failed to redirect port %d: %v: %s", port, err, out)
+		}
+	}
+	if _, err := r.iptables("-C", "PREROUTING", "-j", Chain); err == nil {
+		return nil
+	}
+	if out, err := r.iptables("-I", "PREROUTING", "1", "-j", Chain); err != nil {
+		return fmt.Errorf("failed to jump to chain %s: %v: %s", Chain, err, out)
+	}
+	return nil
+}
+
+// Remove the chain and the jump to it
+func (r *Redirector) Clear() error {
+	r.iptables("-D", "PREROUTING", "-j", Chain)
+	r.iptables("-F", Chain)
+	if out, err := r.iptables("-X", Chain); err != nil && !strings.Contains(out, "No chain") {
+		return fmt.Errorf("failed to delete chain %s: %v: %s", Chain, err, out)
+	}
+	return nil
+}
+
+func (r *Redirector) iptables(args ...string) (string, error) {
+	out, err := r.e.Command("iptables", append([]string{"-w", "-t", "nat"}, args...)...).CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package httpchaos injects faults into the HTTP requests to pods' ports: a proxy in the
+// pod's network namespace aborts, delays or changes the responses of the requests matching
+// a rule and forwards the others to the pod.
+package httpchaos
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/tcstate"
+)
+
+// Rule applies faults to the requests to a port matching the path, methods and headers
+type Rule struct {
+	Port int
+	// Path pattern, * matches any characters including /, any path if empty
+	Path    string
+	Methods []string
+	// Request headers that must be present, with the value unless it is empty
+	Headers http.Header
+
+	// Status code of the aborted requests, 0 to forward them
+	Abort        int
+	AbortPercent float64
+	Delay        time.Duration
+	DelayPercent float64
+	// Headers set on and body replacing the forwarded responses
+	SetHeaders http.Header
+	Body       *string
+
+	path *regexp.Regexp
+}
+
+// Parse rules separated by ;, each of space separated settings, e.g.
+// port=8080 path=/api/orders* method=POST abort=503,10%; port=8080 delay=2s
+func ParseRules(spec string) ([]Rule, error) {
+	rules := []Rule{}
+	for _, text := range strings.Split(spec, ";") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		rule, err := parseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *rule)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no http rules")
+	}
+	return rules, nil
+}
+
+func parseRule(text string) (*Rule, error) {
+	rule := &Rule{AbortPercent: 100, DelayPercent: 100}
+	for _, field := range strings.Fields(text) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid http rule setting %q, expected key=value", field)
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			rule.Port = port
+		case "path":
+			if !strings.HasPrefix(value, "/") {
+				return nil, fmt.Errorf("invalid path %q, expected to start with /", value)
+			}
+			rule.Path = value
+		case "method":
+			for _, method := range strings.Split(value, ",") {
+				if method == "" {
+					return nil, fmt.Errorf("invalid method %q", value)
+				}
+				rule.Methods = append(rule.Methods, strings.ToUpper(method))
+			}
+		case "header", "set-header":
+			name, headerValue, err := parseHeader(value)
+			if err != nil {
+				return nil, err
+			}
+			if key == "header" {
+				if rule.Headers == nil {
+					rule.Headers = http.Header{}
+				}
+				rule.Headers.Add(name, headerValue)
+			} else {
+				if rule.SetHeaders == nil {
+					rule.SetHeaders = http.Header{}
+				}
+				rule.SetHeaders.Add(name, headerValue)
+			}
+		case "abort":
+			values := strings.SplitN(value, ",", 2)
+			code, err := strconv.Atoi(values[0])
+			if err != nil || code < 200 || code > 599 {
+				return nil, fmt.Errorf("invalid abort status %q, expected 200 to 599", values[0])
+			}
+			rule.Abort = code
+			if len(values) == 2 {
+				if rule.AbortPercent, err = parsePercent(values[1]); err != nil {
+					return nil, err
+				}
+			}
+		case "delay":
+			values := strings.SplitN(value, ",", 2)
+			delay, err := time.ParseDuration(values[0])
+			if err != nil || delay <= 0 {
+				return nil, fmt.Errorf("invalid delay %q", values[0])
+			}
+			rule.Delay = delay
+			if len(values) == 2 {
+				if rule.DelayPercent, err = parsePercent(values[1]); err != nil {
+					return nil, err
+				}
+			}
+		case "body":
+			body, err := url.QueryUnescape(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid body %q: %v", value, err)
+			}
+			rule.Body = &body
+		default:
+			return nil, fmt.Errorf("unknown http rule setting %q", key)
+		}
+	}
+	if rule.Port == 0 {
+		return nil, fmt.Errorf("http rule %q has no port", strings.TrimSpace(text))
+	}
+	if rule.Abort == 0 && rule.Delay == 0 && rule.SetHeaders == nil && rule.Body == nil {
+		return nil, fmt.Errorf("http rule %q has no abort, delay, set-header or body", strings.TrimSpace(text))
+	}
+	if rule.Path != "" {
+		pattern := strings.Replace(regexp.QuoteMeta(rule.Path), `\*`, ".*", -1)
+		rule.path = regexp.MustCompile("^" + pattern + "$")
+	}
+	return rule, nil
+}
+
+// Parse Name:Value, the value may be empty
+func parseHeader(value string) (string, string, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid header %q, expected Name:Value", value)
+	}
+	return http.CanonicalHeaderKey(parts[0]), parts[1], nil
+}
+
+func parsePercent(value string) (float64, error) {
+	percent, err := tcstate.ParsePercent(value)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid percent %q", value)
+	}
+	return percent, nil
+}
+
+// The ports the rules apply to
+func Ports(rules []Rule) []int {
+	ports := []int{}
+	seen := map[int]bool{}
+	for _, rule := range rules {
+		if !seen[rule.Port] {
+			seen[rule.Port] = true
+			ports = append(ports, rule.Port)
+		}
+	}
+	return ports
+}
+
+// The first rule of the port matching the request, nil if none does
+func Match(rules []Rule, port int, req *http.Request) *Rule {
+	for i := range rules {
+		if rules[i].Port == port && rules[i].matches(req) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func (rule *Rule) matches(req *http.Request) bool {
+	if rule.path != nil && !rule.path.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(rule.Methods) > 0 && !contains(rule.Methods, req.Method) {
+		return false
+	}
+	for name, values := range rule.Headers {
+		actual, present := req.Header[name]
+		if !present {
+			return false
+		}
+		for _, value := range values {
+			if value != "" && !contains(actual, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
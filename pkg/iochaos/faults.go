@@ -0,0 +1,107 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package iochaos injects latency and errors into the file operations under a path in a
+// container, by mounting a FUSE filesystem over the path that passes the operations through
+// to the files below it.
+package iochaos
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Operations faults can be injected into
+var Ops = []string{"lookup", "getattr", "setattr", "readlink", "symlink", "mknod", "mkdir", "unlink", "rmdir",
+	"rename", "link", "open", "create", "read", "write", "flush", "fsync", "statfs", "opendir", "readdir"}
+
+// Operations faults are injected into when none are given
+var DefaultOps = map[string]bool{"read": true, "write": true}
+
+// Errors an operation can fail with
+var errnos = map[string]syscall.Errno{
+	"EIO":       syscall.EIO,
+	"ENOSPC":    syscall.ENOSPC,
+	"EDQUOT":    syscall.EDQUOT,
+	"EROFS":     syscall.EROFS,
+	"EACCES":    syscall.EACCES,
+	"EPERM":     syscall.EPERM,
+	"ENOENT":    syscall.ENOENT,
+	"EBUSY":     syscall.EBUSY,
+	"EAGAIN":    syscall.EAGAIN,
+	"EINTR":     syscall.EINTR,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+	"EFBIG":     syscall.EFBIG,
+	"ENOMEM":    syscall.ENOMEM,
+}
+
+// Faults injected into the operations on the files under a path
+type Faults struct {
+	// Added to each operation in Ops
+	Delay time.Duration
+	// Error each operation in Ops fails with by a chance of Percent, after the delay
+	Errno   syscall.Errno
+	Percent float64
+	Ops     map[string]bool
+}
+
+// Parse an error name, e.g. EIO
+func ParseErrno(name string) (syscall.Errno, error) {
+	if errno, found := errnos[strings.ToUpper(name)]; found {
+		return errno, nil
+	}
+	names := []string{}
+	for name := range errnos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("unknown error %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// Parse a comma separated list of operations
+func ParseOps(list string) (map[string]bool, error) {
+	known := map[string]bool{}
+	for _, op := range Ops {
+		known[op] = true
+	}
+	ops := map[string]bool{}
+	for _, op := range strings.Split(list, ",") {
+		if !known[op] {
+			return nil, fmt.Errorf("unknown operation %q, expected one of %s", op, strings.Join(Ops, ", "))
+		}
+		ops[op] = true
+	}
+	return ops, nil
+}
+
+// The error an operation fails with, 0 if it is done, roll is a random number in [0, 100)
+func (f *Faults) errno(op string, roll float64) syscall.Errno {
+	if !f.Ops[op] || f.Errno == 0 || roll >= f.Percent {
+		return 0
+	}
+	return f.Errno
+}
+
+// The delay added to an operation
+func (f *Faults) delay(op string) time.Duration {
+	if !f.Ops[op] {
+		return 0
+	}
+	return f.Delay
+}
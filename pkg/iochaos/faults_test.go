@@ -0,0 +1,67 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iochaos
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseErrno(t *testing.T) {
+	if errno, err := ParseErrno("eio"); err != nil || errno != syscall.EIO {
+		t.Errorf("expected EIO, got %v %v", errno, err)
+	}
+	if _, err := ParseErrno("EWHATEVER"); err == nil {
+		t.Errorf("expected an unknown error to be rejected")
+	}
+}
+
+func TestParseOps(t *testing.T) {
+	ops, err := ParseOps("read,fsync")
+	if err != nil || len(ops) != 2 || !ops["read"] || !ops["fsync"] {
+		t.Errorf("expected read and fsync, got %v %v", ops, err)
+	}
+	if _, err := ParseOps("read,chmod"); err == nil {
+		t.Errorf("expected an unknown operation to be rejected")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	f := &Faults{Delay: time.Second, Errno: syscall.ENOSPC, Percent: 30, Ops: map[string]bool{"write": true}}
+	cases := []struct {
+		op    string
+		roll  float64
+		errno syscall.Errno
+		delay time.Duration
+	}{
+		{"write", 10, syscall.ENOSPC, time.Second},
+		{"write", 30, 0, time.Second},
+		{"read", 10, 0, 0},
+	}
+	for _, c := range cases {
+		if errno := f.errno(c.op, c.roll); errno != c.errno {
+			t.Errorf("%s rolling %v: expected %v, got %v", c.op, c.roll, c.errno, errno)
+		}
+		if delay := f.delay(c.op); delay != c.delay {
+			t.Errorf("%s: expected a delay of %v, got %v", c.op, c.delay, delay)
+		}
+	}
+	if errno := (&Faults{Delay: time.Second, Ops: DefaultOps}).errno("read", 0); errno != 0 {
+		t.Errorf("expected only a delay without an error, got %v", errno)
+	}
+}
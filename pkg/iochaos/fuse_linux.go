@@ -0,0 +1,324 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iochaos
+
+import "unsafe"
+
+// The FUSE kernel protocol, from include/uapi/linux/fuse.h. The server speaks 7.19, the kernel
+// adapts the messages it sends to the version the server replies to FUSE_INIT with
+const (
+	kernelVersion      = 7
+	kernelMinorVersion = 19
+)
+
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opSetattr     = 4
+	opReadlink    = 5
+	opSymlink     = 6
+	opMknod       = 8
+	opMkdir       = 9
+	opUnlink      = 10
+	opRmdir       = 11
+	opRename      = 12
+	opLink        = 13
+	opOpen        = 14
+	opRead        = 15
+	opWrite       = 16
+	opStatfs      = 17
+	opRelease     = 18
+	opFsync       = 20
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opFsyncdir    = 30
+	opCreate      = 35
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+)
+
+// Names of the operations faults can be injected into
+var opNames = map[uint32]string{
+	opLookup:   "lookup",
+	opGetattr:  "getattr",
+	opSetattr:  "setattr",
+	opReadlink: "readlink",
+	opSymlink:  "symlink",
+	opMknod:    "mknod",
+	opMkdir:    "mkdir",
+	opUnlink:   "unlink",
+	opRmdir:    "rmdir",
+	opRename:   "rename",
+	opLink:     "link",
+	opOpen:     "open",
+	opRead:     "read",
+	opWrite:    "write",
+	opStatfs:   "statfs",
+	opFsync:    "fsync",
+	opFlush:    "flush",
+	opOpendir:  "opendir",
+	opReaddir:  "readdir",
+	opFsyncdir: "fsync",
+	opCreate:   "create",
+}
+
+// FUSE_INIT flags
+const (
+	initAsyncRead = 1 << 0
+	initBigWrites = 1 << 5
+)
+
+// fuse_setattr_in valid bits
+const (
+	setattrMode     = 1 << 0
+	setattrUID      = 1 << 1
+	setattrGID      = 1 << 2
+	setattrSize     = 1 << 3
+	setattrAtime    = 1 << 4
+	setattrMtime    = 1 << 5
+	setattrFH       = 1 << 6
+	setattrAtimeNow = 1 << 7
+	setattrMtimeNow = 1 << 8
+)
+
+const (
+	getattrFH     = 1 << 0
+	fsyncDataOnly = 1 << 0
+)
+
+type inHeader struct {
+	Len     uint32
+	Opcode  uint32
+	Unique  uint64
+	NodeID  uint64
+	UID     uint32
+	GID     uint32
+	PID     uint32
+	Padding uint32
+}
+
+type outHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type attr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	UID       uint32
+	GID       uint32
+	Rdev      uint32
+	Blksize   uint32
+	Padding   uint32
+}
+
+type entryOut struct {
+	NodeID         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr           attr
+}
+
+type attrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Dummy         uint32
+	Attr          attr
+}
+
+type initIn struct {
+	Major        uint32
+	Minor        uint32
+	MaxReadahead uint32
+	Flags        uint32
+}
+
+type initOut struct {
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+}
+
+type forgetIn struct {
+	Nlookup uint64
+}
+
+type batchForgetIn struct {
+	Count uint32
+	Dummy uint32
+}
+
+type forgetOne struct {
+	NodeID  uint64
+	Nlookup uint64
+}
+
+type getattrIn struct {
+	Flags uint32
+	Dummy uint32
+	FH    uint64
+}
+
+type setattrIn struct {
+	Valid     uint32
+	Padding   uint32
+	FH        uint64
+	Size      uint64
+	LockOwner uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Unused4   uint32
+	UID       uint32
+	GID       uint32
+	Unused5   uint32
+}
+
+type mknodIn struct {
+	Mode    uint32
+	Rdev    uint32
+	Umask   uint32
+	Padding uint32
+}
+
+type mkdirIn struct {
+	Mode  uint32
+	Umask uint32
+}
+
+type renameIn struct {
+	Newdir uint64
+}
+
+type linkIn struct {
+	Oldnodeid uint64
+}
+
+type openIn struct {
+	Flags  uint32
+	Unused uint32
+}
+
+type createIn struct {
+	Flags   uint32
+	Mode    uint32
+	Umask   uint32
+	Padding uint32
+}
+
+type openOut struct {
+	FH        uint64
+	OpenFlags uint32
+	Padding   uint32
+}
+
+type readIn struct {
+	FH        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
+}
+
+type writeIn struct {
+	FH         uint64
+	Offset     uint64
+	Size       uint32
+	WriteFlags uint32
+	LockOwner  uint64
+	Flags      uint32
+	Padding    uint32
+}
+
+type writeOut struct {
+	Size    uint32
+	Padding uint32
+}
+
+type releaseIn struct {
+	FH           uint64
+	Flags        uint32
+	ReleaseFlags uint32
+	LockOwner    uint64
+}
+
+type flushIn struct {
+	FH        uint64
+	Unused    uint32
+	Padding   uint32
+	LockOwner uint64
+}
+
+type fsyncIn struct {
+	FH         uint64
+	FsyncFlags uint32
+	Padding    uint32
+}
+
+type kstatfs struct {
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Bsize   uint32
+	Namelen uint32
+	Frsize  uint32
+	Padding uint32
+	Spare   [6]uint32
+}
+
+type dirent struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
+
+const (
+	inHeaderSize  = int(unsafe.Sizeof(inHeader{}))
+	outHeaderSize = int(unsafe.Sizeof(outHeader{}))
+	direntSize    = int(unsafe.Sizeof(dirent{}))
+)
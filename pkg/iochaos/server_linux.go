@@ -0,0 +1,980 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iochaos
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"golang.org/x/sys/unix"
+)
+
+// Mounts are shown as fuse.kube-chaos, from a source naming the daemon's process and the mount
+const (
+	fsSubtype = "kube-chaos"
+	fsType    = "fuse." + fsSubtype
+)
+
+// Largest write the kernel sends at once
+const maxWrite = 128 * 1024
+
+// Requests handled at once, also the background requests the kernel queues before it makes
+// the processes wait, so delayed operations can't pile up goroutines
+const maxBackground = 64
+
+// How long the kernel caches lookups and attributes, short as the files below the mount also
+// change through other mounts
+const cacheSeconds = 1
+
+// AT_EMPTY_PATH, missing from the vendored unix package
+const atEmptyPath = 0x1000
+
+// Mounts made by the process, to name their sources
+var mounted uint64
+
+// Server passes the operations on its mount through to the directory below the mount,
+// injecting the faults into them
+type Server struct {
+	// The /dev/fuse the kernel's requests are read from
+	fuse     int
+	procRoot string
+	pid      int
+	source   string
+	faults   Faults
+	mu       sync.Mutex
+	rand     *rand.Rand
+	nodes    map[uint64]*node
+	inodes   map[inodeKey]uint64
+	lastNode uint64
+	dirs     map[uint64]*openDir
+	lastDir  uint64
+	// No faults are injected into the files still open once unmounted
+	unmounted bool
+	done      chan struct{}
+}
+
+// A file below the mount the kernel looked up, by its node id
+type node struct {
+	// O_PATH descriptor of the file
+	fd      int
+	key     inodeKey
+	lookups uint64
+}
+
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// An open directory, its entries are read when it is opened
+type openDir struct {
+	fd      int
+	entries []dirEntry
+}
+
+type dirEntry struct {
+	ino  uint64
+	typ  uint32
+	name string
+}
+
+// Mount a server over the directory at path in the mount namespace of the process under
+// procRoot, and serve it in the background until it is unmounted. The files below stay
+// reachable through the server
+func Mount(procRoot string, pid int, path string, faults Faults) (*Server, error) {
+	fuse, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		fuse:     fuse,
+		procRoot: procRoot,
+		pid:      pid,
+		source:   fmt.Sprintf("%s-%d-%d", fsSubtype, os.Getpid(), atomic.AddUint64(&mounted, 1)),
+		faults:   faults,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		nodes:    map[uint64]*node{},
+		inodes:   map[inodeKey]uint64{},
+		dirs:     map[uint64]*openDir{},
+		done:     make(chan struct{}),
+	}
+	root := -1
+	err = container.InMountNS(procRoot, pid, func() error {
+		var err error
+		if root, err = unix.Open(path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0); err != nil {
+			return err
+		}
+		options := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0,allow_other,default_permissions", fuse)
+		return unix.Mount(s.source, path, fsType, unix.MS_NOSUID|unix.MS_NODEV, options)
+	})
+	if err != nil {
+		if root >= 0 {
+			unix.Close(root)
+		}
+		unix.Close(fuse)
+		return nil, fmt.Errorf("failed to mount over %s: %v", path, err)
+	}
+	var st unix.Stat_t
+	unix.Fstat(root, &st)
+	key := inodeKey{uint64(st.Dev), uint64(st.Ino)}
+	// The kernel's root node is 1 and never forgotten
+	s.lastNode = 1
+	s.nodes[1] = &node{fd: root, key: key, lookups: 1}
+	s.inodes[key] = 1
+
+	go func() {
+		if err := s.serve(); err != nil {
+			glog.Errorf("IO chaos server of %s in process %d stopped: %v", path, pid, err)
+		}
+	}()
+	return s, nil
+}
+
+// Unmount the server, the files still open through it are served without faults until
+// they are closed
+func (s *Server) Unmount() error {
+	s.mu.Lock()
+	s.unmounted = true
+	s.mu.Unlock()
+	if s.Exited() {
+		return nil
+	}
+	_, err := unmount(s.procRoot, s.pid, func(mount container.Mount) bool {
+		return mount.Source == s.source
+	})
+	return err
+}
+
+// Whether the server stopped serving, its mount is gone, e.g. with its container
+func (s *Server) Exited() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Unmount the servers in the mount namespace of the process under procRoot, also those of a
+// daemon that exited, return how many there were
+func Unmount(procRoot string, pid int) (int, error) {
+	return unmount(procRoot, pid, func(mount container.Mount) bool {
+		return mount.FSType == fsType
+	})
+}
+
+func unmount(procRoot string, pid int, match func(mount container.Mount) bool) (int, error) {
+	mounts, err := container.NewProcesses(procRoot).Mounts(pid)
+	// The mounts are gone with the process's namespace
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	found := []container.Mount{}
+	for _, mount := range mounts {
+		if match(mount) {
+			found = append(found, mount)
+		}
+	}
+	if len(found) == 0 {
+		return 0, nil
+	}
+	err = container.InMountNS(procRoot, pid, func() error {
+		// The last mounted first, they may be mounted over each other
+		for i := len(found) - 1; i >= 0; i-- {
+			if over := mountedOver(mounts, found[i], match); over != "" {
+				return fmt.Errorf("%s is mounted over by %s", found[i].Point, over)
+			}
+			if err := unix.Unmount(found[i].Point, unix.MNT_DETACH); err != nil {
+				return fmt.Errorf("failed to unmount %s: %v", found[i].Point, err)
+			}
+		}
+		return nil
+	})
+	return len(found), err
+}
+
+// The source of a mount over the mount at the same point other than the server's, the point
+// would unmount it instead
+func mountedOver(mounts []container.Mount, mount container.Mount, match func(mount container.Mount) bool) string {
+	for _, other := range mounts {
+		if other.Parent == mount.ID && other.Point == mount.Point && !match(other) {
+			return other.Source
+		}
+	}
+	return ""
+}
+
+// Answer the kernel's requests until the mount is gone
+func (s *Server) serve() error {
+	defer s.close()
+	// Large enough for the largest write and its headers
+	buf := make([]byte, maxWrite+4096)
+	handlers := make(chan struct{}, maxBackground)
+	for {
+		n, err := unix.Read(s.fuse, buf)
+		switch err {
+		case nil:
+		// Interrupted before it was read
+		case unix.EINTR, unix.ENOENT, unix.EAGAIN:
+			continue
+		// Unmounted
+		case unix.ENODEV:
+			return nil
+		default:
+			return err
+		}
+		if n < inHeaderSize {
+			return fmt.Errorf("short request of %d bytes", n)
+		}
+		header := *(*inHeader)(unsafe.Pointer(&buf[0]))
+		body := make([]byte, n-inHeaderSize)
+		copy(body, buf[inHeaderSize:n])
+
+		switch header.Opcode {
+		case opInit:
+			s.init(&header, body)
+		case opForget:
+			if in := (*forgetIn)(structAt(body, unsafe.Sizeof(forgetIn{}))); in != nil {
+				s.forget(header.NodeID, in.Nlookup)
+			}
+		case opBatchForget:
+			s.batchForget(body)
+		// Requests are answered when done, and there are none to tear down
+		case opInterrupt, opDestroy:
+		default:
+			// Wait for a handler to be free, the kernel keeps the next requests queued until then
+			handlers <- struct{}{}
+			go func() {
+				defer func() { <-handlers }()
+				s.handle(&header, body)
+			}()
+		}
+	}
+}
+
+func (s *Server) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.nodes {
+		unix.Close(n.fd)
+	}
+	for _, dir := range s.dirs {
+		unix.Close(dir.fd)
+	}
+	s.nodes, s.dirs = map[uint64]*node{}, map[uint64]*openDir{}
+	unix.Close(s.fuse)
+	close(s.done)
+}
+
+func (s *Server) init(header *inHeader, body []byte) {
+	in := (*initIn)(structAt(body, unsafe.Sizeof(initIn{})))
+	if in == nil || in.Major != kernelVersion {
+		s.reply(header, unix.EPROTO, nil)
+		return
+	}
+	out := initOut{
+		Major:        kernelVersion,
+		Minor:        kernelMinorVersion,
+		MaxReadahead: in.MaxReadahead,
+		Flags:        in.Flags & (initAsyncRead | initBigWrites),
+		// Sized to the handlers, the threshold in proportion as the kernel's default 12 and 9
+		MaxBackground:       maxBackground,
+		CongestionThreshold: maxBackground * 3 / 4,
+		MaxWrite:            maxWrite,
+	}
+	s.reply(header, 0, bytesOf(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+}
+
+func (s *Server) handle(header *inHeader, body []byte) {
+	if op, found := opNames[header.Opcode]; found {
+		if errno := s.inject(op); errno != 0 {
+			s.reply(header, errno, nil)
+			return
+		}
+	}
+	var (
+		out []byte
+		err error
+	)
+	switch header.Opcode {
+	case opLookup:
+		out, err = s.lookup(header, body)
+	case opGetattr:
+		out, err = s.getattr(header)
+	case opSetattr:
+		out, err = s.setattr(header, body)
+	case opReadlink:
+		out, err = s.readlink(header)
+	case opSymlink, opMknod, opMkdir:
+		out, err = s.makeNode(header, body)
+	case opUnlink, opRmdir:
+		err = s.remove(header, body)
+	case opRename:
+		err = s.rename(header, body)
+	case opLink:
+		out, err = s.link(header, body)
+	case opOpen:
+		out, err = s.open(header, body)
+	case opCreate:
+		out, err = s.create(header, body)
+	case opRead:
+		out, err = s.read(body)
+	case opWrite:
+		out, err = s.write(body)
+	case opStatfs:
+		out, err = s.statfs()
+	case opRelease:
+		err = s.release(body)
+	case opFlush:
+		err = s.flush(body)
+	case opFsync:
+		err = s.fsync(body, false)
+	case opOpendir:
+		out, err = s.opendir(header)
+	case opReaddir:
+		out, err = s.readdir(body)
+	case opReleasedir:
+		err = s.releasedir(body)
+	case opFsyncdir:
+		err = s.fsync(body, true)
+	default:
+		err = unix.ENOSYS
+	}
+	s.reply(header, errnoOf(err), out)
+}
+
+// Delay the operation and decide whether it fails
+func (s *Server) inject(op string) syscall.Errno {
+	s.mu.Lock()
+	if s.unmounted {
+		s.mu.Unlock()
+		return 0
+	}
+	roll := s.rand.Float64() * 100
+	s.mu.Unlock()
+	if delay := s.faults.delay(op); delay > 0 {
+		time.Sleep(delay)
+	}
+	return s.faults.errno(op, roll)
+}
+
+func (s *Server) reply(header *inHeader, errno syscall.Errno, out []byte) {
+	if errno != 0 {
+		out = nil
+	}
+	buf := make([]byte, outHeaderSize+len(out))
+	*(*outHeader)(unsafe.Pointer(&buf[0])) = outHeader{Len: uint32(len(buf)), Error: -int32(errno), Unique: header.Unique}
+	copy(buf[outHeaderSize:], out)
+	// The request was interrupted, or the mount is gone
+	if _, err := unix.Write(s.fuse, buf); err != nil && err != unix.ENOENT && err != unix.ENODEV {
+		glog.Warningf("Failed to answer request %d of IO chaos server %s: %v", header.Unique, s.source, err)
+	}
+}
+
+func (s *Server) node(id uint64) (*node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, found := s.nodes[id]
+	if !found {
+		return nil, unix.ESTALE
+	}
+	return n, nil
+}
+
+func (s *Server) lookup(header *inHeader, body []byte) ([]byte, error) {
+	parent, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	return s.lookupName(parent, cstring(body))
+}
+
+// Look a file up below the parent and count the kernel's reference to its node
+func (s *Server) lookupName(parent *node, name string) ([]byte, error) {
+	fd, err := unix.Openat(parent.fd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	key := inodeKey{uint64(st.Dev), uint64(st.Ino)}
+	s.mu.Lock()
+	id, found := s.inodes[key]
+	if found {
+		s.nodes[id].lookups++
+		unix.Close(fd)
+	} else {
+		s.lastNode++
+		id = s.lastNode
+		s.nodes[id] = &node{fd: fd, key: key, lookups: 1}
+		s.inodes[key] = id
+	}
+	s.mu.Unlock()
+	out := entryOut{NodeID: id, EntryValid: cacheSeconds, AttrValid: cacheSeconds, Attr: toAttr(&st)}
+	return bytesOf(unsafe.Pointer(&out), unsafe.Sizeof(out)), nil
+}
+
+func (s *Server) forget(id, lookups uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, found := s.nodes[id]
+	if !found || id == 1 {
+		return
+	}
+	if n.lookups > lookups {
+		n.lookups -= lookups
+		return
+	}
+	unix.Close(n.fd)
+	delete(s.nodes, id)
+	delete(s.inodes, n.key)
+}
+
+func (s *Server) batchForget(body []byte) {
+	in := (*batchForgetIn)(structAt(body, unsafe.Sizeof(batchForgetIn{})))
+	if in == nil {
+		return
+	}
+	size := unsafe.Sizeof(forgetOne{})
+	body = body[unsafe.Sizeof(*in):]
+	for i := uint32(0); i < in.Count; i++ {
+		one := (*forgetOne)(structAt(body, size))
+		if one == nil {
+			return
+		}
+		s.forget(one.NodeID, one.Nlookup)
+		body = body[size:]
+	}
+}
+
+func (s *Server) getattr(header *inHeader) ([]byte, error) {
+	n, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	return attrOf(n.fd)
+}
+
+func attrOf(fd int) ([]byte, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil, err
+	}
+	out := attrOut{AttrValid: cacheSeconds, Attr: toAttr(&st)}
+	return bytesOf(unsafe.Pointer(&out), unsafe.Sizeof(out)), nil
+}
+
+func (s *Server) setattr(header *inHeader, body []byte) ([]byte, error) {
+	in := (*setattrIn)(structAt(body, unsafe.Sizeof(setattrIn{})))
+	if in == nil {
+		return nil, unix.EINVAL
+	}
+	n, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(n.fd, &st); err != nil {
+		return nil, err
+	}
+	// Symbolic links can only be chowned through their O_PATH descriptor
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK && in.Valid&(setattrMode|setattrSize|setattrAtime|setattrMtime) != 0 {
+		return nil, unix.EPERM
+	}
+	path := procPath(n.fd)
+	withFH := in.Valid&setattrFH != 0
+
+	if in.Valid&setattrMode != 0 {
+		if withFH {
+			err = unix.Fchmod(int(in.FH), in.Mode&07777)
+		} else {
+			err = unix.Fchmodat(unix.AT_FDCWD, path, in.Mode&07777, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if in.Valid&(setattrUID|setattrGID) != 0 {
+		uid, gid := -1, -1
+		if in.Valid&setattrUID != 0 {
+			uid = int(in.UID)
+		}
+		if in.Valid&setattrGID != 0 {
+			gid = int(in.GID)
+		}
+		if err := unix.Fchownat(n.fd, "", uid, gid, atEmptyPath|unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return nil, err
+		}
+	}
+	if in.Valid&setattrSize != 0 {
+		if withFH {
+			err = unix.Ftruncate(int(in.FH), int64(in.Size))
+		} else {
+			err = unix.Truncate(path, int64(in.Size))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if in.Valid&(setattrAtime|setattrMtime) != 0 {
+		times := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, {Nsec: unix.UTIME_OMIT}}
+		if in.Valid&setattrAtimeNow != 0 {
+			times[0] = unix.Timespec{Nsec: unix.UTIME_NOW}
+		} else if in.Valid&setattrAtime != 0 {
+			times[0] = unix.NsecToTimespec(int64(in.Atime)*1e9 + int64(in.Atimensec))
+		}
+		if in.Valid&setattrMtimeNow != 0 {
+			times[1] = unix.Timespec{Nsec: unix.UTIME_NOW}
+		} else if in.Valid&setattrMtime != 0 {
+			times[1] = unix.NsecToTimespec(int64(in.Mtime)*1e9 + int64(in.Mtimensec))
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, 0); err != nil {
+			return nil, err
+		}
+	}
+	return attrOf(n.fd)
+}
+
+func (s *Server) readlink(header *inHeader) ([]byte, error) {
+	n, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, unix.PathMax)
+	size, err := unix.Readlinkat(n.fd, "", buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// Make a symbolic link, device, fifo or directory owned by the caller
+func (s *Server) makeNode(header *inHeader, body []byte) ([]byte, error) {
+	parent, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	var name string
+	switch header.Opcode {
+	case opSymlink:
+		names := bytes.SplitN(body, []byte{0}, 3)
+		if len(names) < 2 {
+			return nil, unix.EINVAL
+		}
+		name = string(names[0])
+		err = unix.Symlinkat(string(names[1]), parent.fd, name)
+	case opMknod:
+		in := (*mknodIn)(structAt(body, unsafe.Sizeof(mknodIn{})))
+		if in == nil {
+			return nil, unix.EINVAL
+		}
+		name = cstring(body[unsafe.Sizeof(*in):])
+		if err = unix.Mknodat(parent.fd, name, in.Mode, int(in.Rdev)); err == nil {
+			err = unix.Fchmodat(parent.fd, name, in.Mode&07777, 0)
+		}
+	case opMkdir:
+		in := (*mkdirIn)(structAt(body, unsafe.Sizeof(mkdirIn{})))
+		if in == nil {
+			return nil, unix.EINVAL
+		}
+		name = cstring(body[unsafe.Sizeof(*in):])
+		if err = unix.Mkdirat(parent.fd, name, in.Mode); err == nil {
+			err = unix.Fchmodat(parent.fd, name, in.Mode&07777, 0)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	uid, gid := s.owner(header, parent)
+	if err := unix.Fchownat(parent.fd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, err
+	}
+	return s.lookupName(parent, name)
+}
+
+// The owner of a file the caller creates in the parent, the parent's group if it is set-group-ID
+func (s *Server) owner(header *inHeader, parent *node) (int, int) {
+	var st unix.Stat_t
+	if err := unix.Fstat(parent.fd, &st); err == nil && st.Mode&unix.S_ISGID != 0 {
+		return int(header.UID), -1
+	}
+	return int(header.UID), int(header.GID)
+}
+
+func (s *Server) remove(header *inHeader, body []byte) error {
+	parent, err := s.node(header.NodeID)
+	if err != nil {
+		return err
+	}
+	flags := 0
+	if header.Opcode == opRmdir {
+		flags = unix.AT_REMOVEDIR
+	}
+	return unix.Unlinkat(parent.fd, cstring(body), flags)
+}
+
+func (s *Server) rename(header *inHeader, body []byte) error {
+	in := (*renameIn)(structAt(body, unsafe.Sizeof(renameIn{})))
+	if in == nil {
+		return unix.EINVAL
+	}
+	names := bytes.SplitN(body[unsafe.Sizeof(*in):], []byte{0}, 3)
+	if len(names) < 2 {
+		return unix.EINVAL
+	}
+	parent, err := s.node(header.NodeID)
+	if err != nil {
+		return err
+	}
+	newParent, err := s.node(in.Newdir)
+	if err != nil {
+		return err
+	}
+	return unix.Renameat(parent.fd, string(names[0]), newParent.fd, string(names[1]))
+}
+
+func (s *Server) link(header *inHeader, body []byte) ([]byte, error) {
+	in := (*linkIn)(structAt(body, unsafe.Sizeof(linkIn{})))
+	if in == nil {
+		return nil, unix.EINVAL
+	}
+	name := cstring(body[unsafe.Sizeof(*in):])
+	parent, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	old, err := s.node(in.Oldnodeid)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Linkat(unix.AT_FDCWD, procPath(old.fd), parent.fd, name, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return nil, err
+	}
+	return s.lookupName(parent, name)
+}
+
+// Flags of the files opened below the mount, the reads and writes through the server are not
+// aligned for O_DIRECT
+func openFlags(flags uint32) int {
+	return int(flags)&^(unix.O_NOFOLLOW|unix.O_DIRECT|unix.O_NOCTTY) | unix.O_CLOEXEC
+}
+
+func (s *Server) open(header *inHeader, body []byte) ([]byte, error) {
+	in := (*openIn)(structAt(body, unsafe.Sizeof(openIn{})))
+	if in == nil {
+		return nil, unix.EINVAL
+	}
+	n, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Open(procPath(n.fd), openFlags(in.Flags)&^(unix.O_CREAT|unix.O_EXCL), 0)
+	if err != nil {
+		return nil, err
+	}
+	out := openOut{FH: uint64(fd)}
+	return bytesOf(unsafe.Pointer(&out), unsafe.Sizeof(out)), nil
+}
+
+func (s *Server) create(header *inHeader, body []byte) ([]byte, error) {
+	in := (*createIn)(structAt(body, unsafe.Sizeof(createIn{})))
+	if in == nil {
+		return nil, unix.EINVAL
+	}
+	name := cstring(body[unsafe.Sizeof(*in):])
+	parent, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Openat(parent.fd, name, openFlags(in.Flags)|unix.O_CREAT, in.Mode&07777)
+	if err != nil {
+		return nil, err
+	}
+	uid, gid := s.owner(header, parent)
+	if err = unix.Fchmod(fd, in.Mode&07777); err == nil {
+		err = unix.Fchown(fd, uid, gid)
+	}
+	var entry []byte
+	if err == nil {
+		entry, err = s.lookupName(parent, name)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	out := openOut{FH: uint64(fd)}
+	return append(entry, bytesOf(unsafe.Pointer(&out), unsafe.Sizeof(out))...), nil
+}
+
+func (s *Server) read(body []byte) ([]byte, error) {
+	in := (*readIn)(structAt(body, unsafe.Sizeof(readIn{})))
+	if in == nil {
+		return nil, unix.EINVAL
+	}
+	buf := make([]byte, in.Size)
+	n, err := unix.Pread(int(in.FH), buf, int64(in.Offset))
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (s *Server) write(body []byte) ([]byte, error) {
+	in := (*writeIn)(structAt(body, unsafe.Sizeof(writeIn{})))
+	if in == nil {
+		return nil, unix.EINVAL
+	}
+	data := body[unsafe.Sizeof(*in):]
+	if uint32(len(data)) < in.Size {
+		return nil, unix.EINVAL
+	}
+	n, err := unix.Pwrite(int(in.FH), data[:in.Size], int64(in.Offset))
+	if err != nil {
+		return nil, err
+	}
+	out := writeOut{Size: uint32(n)}
+	return bytesOf(unsafe.Pointer(&out), unsafe.Sizeof(out)), nil
+}
+
+func (s *Server) statfs() ([]byte, error) {
+	root, err := s.node(1)
+	if err != nil {
+		return nil, err
+	}
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(root.fd, &st); err != nil {
+		return nil, err
+	}
+	out := kstatfs{
+		Blocks:  uint64(st.Blocks),
+		Bfree:   uint64(st.Bfree),
+		Bavail:  uint64(st.Bavail),
+		Files:   uint64(st.Files),
+		Ffree:   uint64(st.Ffree),
+		Bsize:   uint32(st.Bsize),
+		Namelen: uint32(st.Namelen),
+		Frsize:  uint32(st.Frsize),
+	}
+	return bytesOf(unsafe.Pointer(&out), unsafe.Sizeof(out)), nil
+}
+
+func (s *Server) release(body []byte) error {
+	in := (*releaseIn)(structAt(body, unsafe.Sizeof(releaseIn{})))
+	if in == nil {
+		return unix.EINVAL
+	}
+	return unix.Close(int(in.FH))
+}
+
+// Closing a duplicate flushes the file as closing it would, e.g. on NFS
+func (s *Server) flush(body []byte) error {
+	in := (*flushIn)(structAt(body, unsafe.Sizeof(flushIn{})))
+	if in == nil {
+		return unix.EINVAL
+	}
+	fd, err := unix.Dup(int(in.FH))
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
+
+func (s *Server) fsync(body []byte, isDir bool) error {
+	in := (*fsyncIn)(structAt(body, unsafe.Sizeof(fsyncIn{})))
+	if in == nil {
+		return unix.EINVAL
+	}
+	fd := int(in.FH)
+	if isDir {
+		s.mu.Lock()
+		dir, found := s.dirs[in.FH]
+		s.mu.Unlock()
+		if !found {
+			return unix.EBADF
+		}
+		fd = dir.fd
+	}
+	if in.FsyncFlags&fsyncDataOnly != 0 {
+		return unix.Fdatasync(fd)
+	}
+	return unix.Fsync(fd)
+}
+
+func (s *Server) opendir(header *inHeader) ([]byte, error) {
+	n, err := s.node(header.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Openat(n.fd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readEntries(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	s.mu.Lock()
+	s.lastDir++
+	id := s.lastDir
+	s.dirs[id] = &openDir{fd: fd, entries: entries}
+	s.mu.Unlock()
+	out := openOut{FH: id}
+	return bytesOf(unsafe.Pointer(&out), unsafe.Sizeof(out)), nil
+}
+
+// The entries of a directory, from linux_dirent64 records
+func readEntries(fd int) ([]dirEntry, error) {
+	entries := []dirEntry{}
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := unix.Getdents(fd, buf)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return entries, nil
+		}
+		for pos := 0; pos+19 < n; {
+			// ino u64, off s64, reclen u16, type u8, name
+			reclen := int(*(*uint16)(unsafe.Pointer(&buf[pos+16])))
+			if reclen == 0 || pos+reclen > n {
+				break
+			}
+			entries = append(entries, dirEntry{
+				ino:  *(*uint64)(unsafe.Pointer(&buf[pos])),
+				typ:  uint32(buf[pos+18]),
+				name: cstring(buf[pos+19 : pos+reclen]),
+			})
+			pos += reclen
+		}
+	}
+}
+
+// Entries from the offset, the index of the entry, that fit in the size
+func (s *Server) readdir(body []byte) ([]byte, error) {
+	in := (*readIn)(structAt(body, unsafe.Sizeof(readIn{})))
+	if in == nil {
+		return nil, unix.EINVAL
+	}
+	s.mu.Lock()
+	dir, found := s.dirs[in.FH]
+	s.mu.Unlock()
+	if !found {
+		return nil, unix.EBADF
+	}
+	out := []byte{}
+	for i := int(in.Offset); i < len(dir.entries); i++ {
+		entry := dir.entries[i]
+		size := (direntSize + len(entry.name) + 7) &^ 7
+		if len(out)+size > int(in.Size) {
+			break
+		}
+		record := dirent{Ino: entry.ino, Off: uint64(i + 1), Namelen: uint32(len(entry.name)), Type: entry.typ}
+		buf := make([]byte, size)
+		copy(buf, bytesOf(unsafe.Pointer(&record), unsafe.Sizeof(record)))
+		copy(buf[direntSize:], entry.name)
+		out = append(out, buf...)
+	}
+	return out, nil
+}
+
+func (s *Server) releasedir(body []byte) error {
+	in := (*releaseIn)(structAt(body, unsafe.Sizeof(releaseIn{})))
+	if in == nil {
+		return unix.EINVAL
+	}
+	s.mu.Lock()
+	dir, found := s.dirs[in.FH]
+	delete(s.dirs, in.FH)
+	s.mu.Unlock()
+	if !found {
+		return unix.EBADF
+	}
+	return unix.Close(dir.fd)
+}
+
+func toAttr(st *unix.Stat_t) attr {
+	return attr{
+		Ino:       uint64(st.Ino),
+		Size:      uint64(st.Size),
+		Blocks:    uint64(st.Blocks),
+		Atime:     uint64(st.Atim.Sec),
+		Mtime:     uint64(st.Mtim.Sec),
+		Ctime:     uint64(st.Ctim.Sec),
+		Atimensec: uint32(st.Atim.Nsec),
+		Mtimensec: uint32(st.Mtim.Nsec),
+		Ctimensec: uint32(st.Ctim.Nsec),
+		Mode:      st.Mode,
+		Nlink:     uint32(st.Nlink),
+		UID:       st.Uid,
+		GID:       st.Gid,
+		Rdev:      uint32(st.Rdev),
+		Blksize:   uint32(st.Blksize),
+	}
+}
+
+// The file of an O_PATH descriptor, to reopen or change it
+func procPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
+
+// The struct at the start of a request's body, nil if the body is too short
+func structAt(body []byte, size uintptr) unsafe.Pointer {
+	if uintptr(len(body)) < size {
+		return nil
+	}
+	return unsafe.Pointer(&body[0])
+}
+
+func bytesOf(p unsafe.Pointer, size uintptr) []byte {
+	out := make([]byte, size)
+	copy(out, (*[1 << 16]byte)(p)[:size:size])
+	return out
+}
+
+// A name up to its terminating NUL
+func cstring(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+func errnoOf(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+	return syscall.EIO
+}
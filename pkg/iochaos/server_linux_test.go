@@ -0,0 +1,229 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iochaos
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Mount a server over a new directory in the test's own mount namespace, skipped if FUSE can't
+// be mounted
+func mountTemp(t *testing.T, faults Faults) (string, *Server) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting FUSE needs root")
+	}
+	dir, err := ioutil.TempDir("", "iochaos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "before"), []byte("below"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, err := Mount("/proc", os.Getpid(), dir, faults)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("FUSE can't be mounted: %v", err)
+	}
+	return dir, server
+}
+
+// Files on the mount are opened without the runtime's poller, registering one polls the mount,
+// which the server of the same process may not get to answer
+func readFile(path string) ([]byte, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	data := []byte{}
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		data = append(data, buf[:n]...)
+	}
+}
+
+func writeFile(path string, data []byte, mode uint32) error {
+	fd, err := syscall.Open(path, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	_, err = syscall.Write(fd, data)
+	return err
+}
+
+func readDir(path string) ([]string, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	names := []string{}
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.Getdents(fd, buf)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			sort.Strings(names)
+			return names, nil
+		}
+		_, _, names = syscall.ParseDirent(buf[:n], -1, names)
+	}
+}
+
+func unmountTemp(t *testing.T, dir string, server *Server) {
+	if err := server.Unmount(); err != nil {
+		t.Errorf("failed to unmount: %v", err)
+	}
+	for i := 0; i < 100 && !server.Exited(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !server.Exited() {
+		t.Errorf("expected the server to exit once unmounted")
+	}
+	os.RemoveAll(dir)
+}
+
+func TestServerPassesThrough(t *testing.T) {
+	dir, server := mountTemp(t, Faults{Ops: DefaultOps})
+
+	if data, err := readFile(filepath.Join(dir, "before")); err != nil || string(data) != "below" {
+		t.Errorf("expected the file below the mount, got %q %v", data, err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sub", "deeper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "sub", "file")
+	if err := writeFile(file, []byte("through the mount"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file, filepath.Join(dir, "sub", "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("renamed", filepath.Join(dir, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readFile(filepath.Join(dir, "sub", "link")); err != nil || string(data) != "through the mount" {
+		t.Errorf("expected to read through the link, got %q %v", data, err)
+	}
+	if err := os.Truncate(filepath.Join(dir, "sub", "renamed"), 7); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "sub", "renamed"))
+	if err != nil || info.Size() != 7 || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a file of 7 bytes with mode 0600, got %v %v", info, err)
+	}
+	names, err := readDir(filepath.Join(dir, "sub"))
+	if err != nil || len(names) != 3 || names[0] != "deeper" || names[1] != "link" || names[2] != "renamed" {
+		t.Errorf("expected deeper, link and renamed, got %v %v", names, err)
+	}
+	if err := os.Remove(filepath.Join(dir, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "sub", "deeper")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	// The changes were made to the directory below
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "sub", "renamed")); err != nil || string(data) != "through" {
+		t.Errorf("expected the changes below the mount, got %q %v", data, err)
+	}
+	unmountTemp(t, dir, server)
+}
+
+func TestServerInjectsFaults(t *testing.T) {
+	dir, server := mountTemp(t, Faults{Delay: 50 * time.Millisecond, Errno: syscall.EIO, Percent: 100, Ops: map[string]bool{"read": true}})
+	defer unmountTemp(t, dir, server)
+
+	fd, err := syscall.Open(filepath.Join(dir, "before"), syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("expected open not to fail, got %v", err)
+	}
+	defer syscall.Close(fd)
+	start := time.Now()
+	if _, err := syscall.Read(fd, make([]byte, 10)); err != syscall.EIO {
+		t.Errorf("expected the read to fail with EIO, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the read to be delayed by 50ms, took %v", elapsed)
+	}
+	if err := writeFile(filepath.Join(dir, "written"), []byte("ok"), 0644); err != nil {
+		t.Errorf("expected writes not to fail, got %v", err)
+	}
+}
+
+func TestServerBoundsHandlers(t *testing.T) {
+	dir, server := mountTemp(t, Faults{Delay: 100 * time.Millisecond, Ops: map[string]bool{"open": true}})
+	defer unmountTemp(t, dir, server)
+
+	// Twice as many opens as handlers take two delays
+	start := time.Now()
+	errs := make(chan error)
+	for i := 0; i < 2*maxBackground; i++ {
+		go func() {
+			fd, err := syscall.Open(filepath.Join(dir, "before"), syscall.O_RDONLY, 0)
+			if err == nil {
+				syscall.Close(fd)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2*maxBackground; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("expected the opens not to fail, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected at most %d opens handled at once, all took %v", maxBackground, elapsed)
+	}
+}
+
+func TestUnmountFindsServers(t *testing.T) {
+	dir, server := mountTemp(t, Faults{})
+	defer os.RemoveAll(dir)
+
+	if count, err := Unmount("/proc", os.Getpid()); err != nil || count != 1 {
+		t.Errorf("expected to unmount the server, got %d %v", count, err)
+	}
+	for i := 0; i < 100 && !server.Exited(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !server.Exited() {
+		t.Errorf("expected the server to exit once unmounted")
+	}
+	if count, err := Unmount("/proc", os.Getpid()); err != nil || count != 0 {
+		t.Errorf("expected no server left, got %d %v", count, err)
+	}
+}
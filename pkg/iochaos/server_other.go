@@ -0,0 +1,44 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iochaos
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Server injects faults through FUSE, only supported on Linux
+type Server struct{}
+
+func Mount(procRoot string, pid int, path string, faults Faults) (*Server, error) {
+	return nil, fmt.Errorf("io chaos is not supported on %s", runtime.GOOS)
+}
+
+func (s *Server) Unmount() error {
+	return nil
+}
+
+func (s *Server) Exited() bool {
+	return true
+}
+
+func Unmount(procRoot string, pid int) (int, error) {
+	return 0, nil
+}
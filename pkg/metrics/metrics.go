@@ -0,0 +1,130 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics serves the pods' chaos statistics in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+)
+
+// Identify the statistics of a pod in one direction
+type PodKey struct {
+	Namespace string
+	Pod       string
+	// "ingress" or "egress"
+	Direction string
+}
+
+// Round collects the statistics of one sync, it is safe for parallel workers
+type Round struct {
+	mu    sync.Mutex
+	stats map[PodKey]flow.ChaosStats
+}
+
+func NewRound() *Round {
+	return &Round{stats: map[PodKey]flow.ChaosStats{}}
+}
+
+// Record the statistics of the pod, nothing if stats is nil
+func (r *Round) Set(namespace, pod, direction string, stats *flow.ChaosStats) {
+	if stats == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats[PodKey{Namespace: namespace, Pod: pod, Direction: direction}] = *stats
+}
+
+// Registry holds the statistics of the latest round, pods gone since are dropped
+type Registry struct {
+	mu    sync.Mutex
+	stats map[PodKey]flow.ChaosStats
+}
+
+func NewRegistry() *Registry {
+	return &Registry{stats: map[PodKey]flow.ChaosStats{}}
+}
+
+// Replace the statistics with the round's
+func (r *Registry) Publish(round *Round) {
+	round.mu.Lock()
+	stats := round.stats
+	round.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = stats
+}
+
+var metrics = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(flow.ChaosStats) uint64
+}{
+	{"kube_chaos_sent_bytes_total", "counter", "Bytes sent through the pod's chaos class.", func(s flow.ChaosStats) uint64 { return s.SentBytes }},
+	{"kube_chaos_sent_packets_total", "counter", "Packets sent through the pod's chaos class.", func(s flow.ChaosStats) uint64 { return s.SentPackets }},
+	{"kube_chaos_dropped_packets_total", "counter", "Packets dropped by the pod's chaos settings.", func(s flow.ChaosStats) uint64 { return s.Dropped }},
+	{"kube_chaos_overlimits_total", "counter", "Packets delayed by the pod's rate limit.", func(s flow.ChaosStats) uint64 { return s.Overlimits }},
+	{"kube_chaos_requeues_total", "counter", "Packets requeued in the pod's chaos class.", func(s flow.ChaosStats) uint64 { return s.Requeues }},
+	{"kube_chaos_backlog_bytes", "gauge", "Bytes queued in the pod's chaos class.", func(s flow.ChaosStats) uint64 { return s.Backlog }},
+}
+
+// Write the statistics in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	keys := []PodKey{}
+	for key := range r.stats {
+		keys = append(keys, key)
+	}
+	stats := r.stats
+	r.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Direction < b.Direction
+	})
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, err := fmt.Fprintf(w, "%s{namespace=%q,pod=%q,direction=%q} %d\n",
+				m.name, key.Namespace, key.Pod, key.Direction, m.value(stats[key])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
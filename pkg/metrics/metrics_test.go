@@ -0,0 +1,80 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	round := NewRound()
+	round.Set("default", "web-1", "ingress", &flow.ChaosStats{SentBytes: 1500, SentPackets: 10, Dropped: 2, Backlog: 300})
+	round.Set("default", "web-0", "egress", &flow.ChaosStats{SentPackets: 5})
+	round.Set("default", "web-2", "egress", nil)
+	registry := NewRegistry()
+	registry.Publish(round)
+
+	buf := &bytes.Buffer{}
+	if err := registry.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	expected := []string{
+		"# HELP kube_chaos_sent_bytes_total Bytes sent through the pod's chaos class.\n# TYPE kube_chaos_sent_bytes_total counter\n" +
+			"kube_chaos_sent_bytes_total{namespace=\"default\",pod=\"web-0\",direction=\"egress\"} 0\n" +
+			"kube_chaos_sent_bytes_total{namespace=\"default\",pod=\"web-1\",direction=\"ingress\"} 1500\n",
+		"kube_chaos_dropped_packets_total{namespace=\"default\",pod=\"web-1\",direction=\"ingress\"} 2\n",
+		"# TYPE kube_chaos_backlog_bytes gauge\n",
+		"kube_chaos_backlog_bytes{namespace=\"default\",pod=\"web-1\",direction=\"ingress\"} 300\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("expected %q in:\n%s", e, out)
+		}
+	}
+	// Pods without statistics are left out
+	if strings.Contains(out, "web-2") {
+		t.Errorf("expected no series of web-2 in:\n%s", out)
+	}
+}
+
+func TestRegistryPublish(t *testing.T) {
+	registry := NewRegistry()
+	first := NewRound()
+	first.Set("default", "web-0", "ingress", &flow.ChaosStats{SentPackets: 1})
+	registry.Publish(first)
+
+	// Pods gone since the last round are dropped
+	second := NewRound()
+	second.Set("default", "web-1", "ingress", &flow.ChaosStats{SentPackets: 2})
+	registry.Publish(second)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4" {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+	out := recorder.Body.String()
+	if strings.Contains(out, "web-0") || !strings.Contains(out, `kube_chaos_sent_packets_total{namespace="default",pod="web-1",direction="ingress"} 2`) {
+		t.Errorf("expected the statistics of the last round only, got:\n%s", out)
+	}
+}
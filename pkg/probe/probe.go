@@ -0,0 +1,316 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package probe checks the steady state of a system during chaos experiments, with
+// HTTP requests, TCP connections or Prometheus queries.
+package probe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Defaults of the probes' settings
+const (
+	defaultTimeout          = 5 * time.Second
+	defaultInterval         = 10 * time.Second
+	defaultFailureThreshold = 3
+)
+
+// Probe is one of an HTTP, TCP or Prometheus check, failing the experiment after
+// FailureThreshold consecutive failures
+type Probe struct {
+	Name       string           `json:"name"`
+	HTTP       *HTTPProbe       `json:"http,omitempty"`
+	TCP        *TCPProbe        `json:"tcp,omitempty"`
+	Prometheus *PrometheusProbe `json:"prometheus,omitempty"`
+	// Durations, e.g. 5s
+	Timeout          string `json:"timeout,omitempty"`
+	Interval         string `json:"interval,omitempty"`
+	FailureThreshold int    `json:"failureThreshold,omitempty"`
+
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// GET a URL, expecting a status and a response within a latency
+type HTTPProbe struct {
+	URL string `json:"url"`
+	// 200 if not set
+	ExpectStatus int `json:"expectStatus,omitempty"`
+	// No limit but the timeout if not set
+	MaxLatency string `json:"maxLatency,omitempty"`
+
+	maxLatency time.Duration
+}
+
+// Connect to host:port
+type TCPProbe struct {
+	Address string `json:"address"`
+}
+
+// Query a Prometheus server, expecting every sample of the result within bounds
+type PrometheusProbe struct {
+	// Base URL of the server, e.g. http://prometheus.monitoring:9090
+	URL   string   `json:"url"`
+	Query string   `json:"query"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// Result of a check
+type Result struct {
+	Time    time.Time `json:"time"`
+	Probe   string    `json:"probe"`
+	OK      bool      `json:"ok"`
+	Latency string    `json:"latency"`
+	Message string    `json:"message,omitempty"`
+}
+
+// Check the settings and fill in the defaults
+func (p *Probe) Validate() error {
+	kinds := 0
+	for _, set := range []bool{p.HTTP != nil, p.TCP != nil, p.Prometheus != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("probe %s: expected one of http, tcp or prometheus", p.Name)
+	}
+	var err error
+	if p.timeout, err = parseDuration(p.Timeout, defaultTimeout); err != nil {
+		return fmt.Errorf("probe %s: invalid timeout %q", p.Name, p.Timeout)
+	}
+	if p.interval, err = parseDuration(p.Interval, defaultInterval); err != nil {
+		return fmt.Errorf("probe %s: invalid interval %q", p.Name, p.Interval)
+	}
+	if p.FailureThreshold == 0 {
+		p.FailureThreshold = defaultFailureThreshold
+	}
+	if p.FailureThreshold < 0 {
+		return fmt.Errorf("probe %s: invalid failure threshold %d", p.Name, p.FailureThreshold)
+	}
+
+	switch {
+	case p.HTTP != nil:
+		if _, err := url.Parse(p.HTTP.URL); err != nil || p.HTTP.URL == "" {
+			return fmt.Errorf("probe %s: invalid url %q", p.Name, p.HTTP.URL)
+		}
+		if p.HTTP.ExpectStatus == 0 {
+			p.HTTP.ExpectStatus = http.StatusOK
+		}
+		if p.HTTP.maxLatency, err = parseDuration(p.HTTP.MaxLatency, 0); err != nil {
+			return fmt.Errorf("probe %s: invalid max latency %q", p.Name, p.HTTP.MaxLatency)
+		}
+	case p.TCP != nil:
+		if _, _, err := net.SplitHostPort(p.TCP.Address); err != nil {
+			return fmt.Errorf("probe %s: invalid address %q, expected host:port", p.Name, p.TCP.Address)
+		}
+	case p.Prometheus != nil:
+		if _, err := url.Parse(p.Prometheus.URL); err != nil || p.Prometheus.URL == "" {
+			return fmt.Errorf("probe %s: invalid url %q", p.Name, p.Prometheus.URL)
+		}
+		if p.Prometheus.Query == "" {
+			return fmt.Errorf("probe %s: no query", p.Name)
+		}
+		if p.Prometheus.Min == nil && p.Prometheus.Max == nil {
+			return fmt.Errorf("probe %s: expected min or max", p.Name)
+		}
+	}
+	return nil
+}
+
+func parseDuration(value string, byDefault time.Duration) (time.Duration, error) {
+	if value == "" {
+		return byDefault, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// Run the check once
+func (p *Probe) Check() Result {
+	start := time.Now()
+	var err error
+	switch {
+	case p.HTTP != nil:
+		err = p.checkHTTP()
+	case p.TCP != nil:
+		err = p.checkTCP()
+	case p.Prometheus != nil:
+		err = p.checkPrometheus()
+	}
+	result := Result{Time: start, Probe: p.Name, OK: err == nil, Latency: time.Since(start).String()}
+	if err != nil {
+		result.Message = err.Error()
+	}
+	return result
+}
+
+func (p *Probe) checkHTTP() error {
+	client := &http.Client{Timeout: p.timeout}
+	start := time.Now()
+	resp, err := client.Get(p.HTTP.URL)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+	if resp.StatusCode != p.HTTP.ExpectStatus {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, p.HTTP.ExpectStatus)
+	}
+	if p.HTTP.maxLatency > 0 && latency > p.HTTP.maxLatency {
+		return fmt.Errorf("latency %v, more than %v", latency, p.HTTP.maxLatency)
+	}
+	return nil
+}
+
+func (p *Probe) checkTCP() error {
+	conn, err := net.DialTimeout("tcp", p.TCP.Address, p.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Response of the Prometheus query API
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+func (p *Probe) checkPrometheus() error {
+	client := &http.Client{Timeout: p.timeout}
+	resp, err := client.Get(p.Prometheus.URL + "/api/v1/query?query=" + url.QueryEscape(p.Prometheus.Query))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	response := queryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("invalid response, status %d: %v", resp.StatusCode, err)
+	}
+	if response.Status != "success" {
+		return fmt.Errorf("query failed: %s", response.Error)
+	}
+
+	// Values are [time, "value"] pairs
+	values := [][]interface{}{}
+	switch response.Data.ResultType {
+	case "scalar":
+		value := []interface{}{}
+		if err := json.Unmarshal(response.Data.Result, &value); err != nil {
+			return err
+		}
+		values = append(values, value)
+	case "vector":
+		samples := []struct {
+			Value []interface{} `json:"value"`
+		}{}
+		if err := json.Unmarshal(response.Data.Result, &samples); err != nil {
+			return err
+		}
+		for _, sample := range samples {
+			values = append(values, sample.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported result type %q, expected scalar or vector", response.Data.ResultType)
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("query returned no samples")
+	}
+
+	for _, value := range values {
+		if len(value) != 2 {
+			return fmt.Errorf("invalid sample %v", value)
+		}
+		s, _ := value[1].(string)
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sample value %v", value[1])
+		}
+		if p.Prometheus.Min != nil && v < *p.Prometheus.Min {
+			return fmt.Errorf("value %v, less than %v", v, *p.Prometheus.Min)
+		}
+		if p.Prometheus.Max != nil && v > *p.Prometheus.Max {
+			return fmt.Errorf("value %v, more than %v", v, *p.Prometheus.Max)
+		}
+	}
+	return nil
+}
+
+// Failure of a probe over its threshold
+type Failure struct {
+	Probe    string
+	Failures int
+	Message  string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("probe %s failed %d times: %s", f.Probe, f.Failures, f.Message)
+}
+
+// Prober runs the probes at their intervals and counts their consecutive failures
+type Prober struct {
+	probes   []Probe
+	last     map[string]time.Time
+	failures map[string]int
+}
+
+// The probes must be validated
+func NewProber(probes []Probe) *Prober {
+	return &Prober{probes: probes, last: map[string]time.Time{}, failures: map[string]int{}}
+}
+
+// Run the probes due at now, return their results and the first failure over the threshold
+func (p *Prober) Run(now time.Time) ([]Result, *Failure) {
+	results := []Result{}
+	var failed *Failure
+	for i := range p.probes {
+		probe := &p.probes[i]
+		if last, found := p.last[probe.Name]; found && now.Sub(last) < probe.interval {
+			continue
+		}
+		p.last[probe.Name] = now
+		result := probe.Check()
+		results = append(results, result)
+		if result.OK {
+			p.failures[probe.Name] = 0
+			continue
+		}
+		p.failures[probe.Name]++
+		if p.failures[probe.Name] >= probe.FailureThreshold && failed == nil {
+			failed = &Failure{Probe: probe.Name, Failures: p.failures[probe.Name], Message: result.Message}
+		}
+	}
+	return results, failed
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func validated(t *testing.T, p Probe) *Probe {
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &p
+}
+
+func TestHTTPProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		probe HTTPProbe
+		err   string
+	}{
+		{HTTPProbe{URL: server.URL + "/"}, ""},
+		{HTTPProbe{URL: server.URL + "/missing"}, "status 404, expected 200"},
+		{HTTPProbe{URL: server.URL + "/missing", ExpectStatus: 404}, ""},
+		{HTTPProbe{URL: server.URL + "/slow", MaxLatency: "10ms"}, "latency"},
+	}
+	for _, c := range cases {
+		probe := c.probe
+		result := validated(t, Probe{Name: "web", HTTP: &probe}).Check()
+		if c.err == "" && !result.OK || c.err != "" && !strings.Contains(result.Message, c.err) {
+			t.Errorf("%+v: expected %q, got %+v", c.probe, c.err, result)
+		}
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	if result := validated(t, Probe{Name: "db", TCP: &TCPProbe{Address: address}}).Check(); !result.OK {
+		t.Errorf("expected the connection to succeed, got %+v", result)
+	}
+	listener.Close()
+	if result := validated(t, Probe{Name: "db", TCP: &TCPProbe{Address: address}}).Check(); result.OK {
+		t.Errorf("expected the connection to fail once closed")
+	}
+}
+
+func TestPrometheusProbe(t *testing.T) {
+	responses := map[string]string{
+		"errors":  `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"pod":"web-1"},"value":[1528000000,"0.01"]},{"metric":{"pod":"web-2"},"value":[1528000000,"0.2"]}]}}`,
+		"latency": `{"status":"success","data":{"resultType":"scalar","result":[1528000000,"0.15"]}}`,
+		"none":    `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+		"invalid": `{"status":"error","error":"parse error"}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/query" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprint(w, responses[req.URL.Query().Get("query")])
+	}))
+	defer server.Close()
+
+	limit := func(v float64) *float64 { return &v }
+	cases := []struct {
+		query    string
+		min, max *float64
+		err      string
+	}{
+		{"errors", nil, limit(0.5), ""},
+		{"errors", nil, limit(0.1), "value 0.2, more than 0.1"},
+		{"latency", limit(0.2), nil, "value 0.15, less than 0.2"},
+		{"latency", limit(0.1), limit(0.2), ""},
+		{"none", nil, limit(1), "no samples"},
+		{"invalid", nil, limit(1), "parse error"},
+	}
+	for _, c := range cases {
+		result := validated(t, Probe{Name: c.query, Prometheus: &PrometheusProbe{URL: server.URL, Query: c.query, Min: c.min, Max: c.max}}).Check()
+		if c.err == "" && !result.OK || c.err != "" && !strings.Contains(result.Message, c.err) {
+			t.Errorf("%s: expected %q, got %+v", c.query, c.err, result)
+		}
+	}
+}
+
+func TestProberThreshold(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	prober := NewProber([]Probe{*validated(t, Probe{Name: "web", HTTP: &HTTPProbe{URL: server.URL}, Interval: "1s", FailureThreshold: 2})})
+	now := time.Now()
+	if results, failure := prober.Run(now); failure != nil || len(results) != 1 || !results[0].OK {
+		t.Fatalf("expected one passing result, got %+v, %v", results, failure)
+	}
+	if results, _ := prober.Run(now.Add(500 * time.Millisecond)); len(results) != 0 {
+		t.Errorf("expected the probe to wait for its interval, got %+v", results)
+	}
+
+	status = http.StatusServiceUnavailable
+	if _, failure := prober.Run(now.Add(time.Second)); failure != nil {
+		t.Errorf("expected one failure to be tolerated, got %v", failure)
+	}
+	if _, failure := prober.Run(now.Add(2 * time.Second)); failure == nil || failure.Probe != "web" || !strings.Contains(failure.Error(), "probe web failed 2 times") {
+		t.Errorf("expected the probe to fail, got %v", failure)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, p := range []Probe{
+		{Name: "none"},
+		{Name: "both", TCP: &TCPProbe{Address: "db:5432"}, HTTP: &HTTPProbe{URL: "http://web"}},
+		{Name: "port", TCP: &TCPProbe{Address: "db"}},
+		{Name: "bounds", Prometheus: &PrometheusProbe{URL: "http://prometheus:9090", Query: "up"}},
+		{Name: "interval", TCP: &TCPProbe{Address: "db:5432"}, Interval: "often"},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%s: expected an error", p.Name)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scenario
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Reports are saved as ConfigMaps with this label, the timeline in reportKey
+const (
+	reportLabel = "kube-chaos/report"
+	reportKey   = "report.json"
+	// Largest timeline saved, leaving room for the ConfigMap's metadata within the 1 MiB of an object
+	maxReportSize = 1000 * 1024
+)
+
+// Write the timeline as indented JSON
+func (t *Timeline) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// The outcome in a few words
+func (t *Timeline) Result() string {
+	if t.Aborted {
+		return "aborted: " + t.Reason
+	}
+	for i := range t.Steps {
+		if t.Steps[i].Failed() {
+			return "finished with failures"
+		}
+	}
+	return "passed"
+}
+
+// Write the timeline as a Markdown report
+func (t *Timeline) WriteMarkdown(w io.Writer) error {
+	p := &printer{w: w}
+	p.printf("# Chaos report: %s\n\n", t.Scenario)
+	p.printf("| | |\n| --- | --- |\n")
+	p.printf("| Started | %s |\n", formatTime(t.Started))
+	p.printf("| Finished | %s |\n", formatTime(t.Finished))
+	p.printf("| Duration | %v |\n", t.Finished.Sub(t.Started).Truncate(time.Second))
+	p.printf("| Result | %s |\n", escape(t.Result()))
+
+	p.printf("\n## Steps\n\n")
+	p.printf("| Step | Direction | Chaos | Targets | Started | Finished | Pods | Result |\n")
+	p.printf("| --- | --- | --- | --- | --- | --- | --- | --- |\n")
+	for _, step := range t.Steps {
+		applied := 0
+		for _, pod := range step.Pods {
+			if pod.Result == PodApplied {
+				applied++
+			}
+		}
+		result := "ok"
+		switch {
+		case step.Started.IsZero() && step.Message == "":
+			result = "not started"
+		case step.Failed():
+			result = "failed"
+		}
+		p.printf("| %s | %s | `%s` | %s/%s | %s | %s | %d/%d applied | %s |\n", step.Name, step.Direction, step.Chaos,
+			step.Namespace, escape(step.Selector), formatTime(step.Started), formatTime(step.Finished), applied, len(step.Pods), result)
+	}
+
+	for _, step := range t.Steps {
+		if len(step.Pods) == 0 && step.Message == "" {
+			continue
+		}
+		p.printf("\n### %s\n\n", step.Name)
+		if step.Message != "" {
+			p.printf("%s\n\n", step.Message)
+		}
+		if len(step.Pods) == 0 {
+			continue
+		}
+		p.printf("| Pod | Result | Direction | Applied | Sent | Dropped | Overlimits | Message |\n")
+		p.printf("| --- | --- | --- | --- | --- | --- | --- | --- |\n")
+		for _, pod := range step.Pods {
+			for _, direction := range []string{"ingress", "egress"} {
+				if step.Direction != direction && step.Direction != "both" {
+					continue
+				}
+				sent, dropped, overlimits := "-", "-", "-"
+				if stats := directionStats(pod.Stats, direction); stats != nil {
+					sent = fmt.Sprintf("%d pkt (%d B)", stats.SentPackets, stats.SentBytes)
+					dropped, overlimits = fmt.Sprint(stats.Dropped), fmt.Sprint(stats.Overlimits)
+				}
+				applied := pod.Effective[direction]
+				if applied != "" {
+					applied = "`" + applied + "`"
+				}
+				p.printf("| %s | %s | %s | %s | %s | %s | %s | %s |\n", pod.Pod, pod.Result, direction, applied, sent, dropped, overlimits, escape(pod.Message))
+			}
+		}
+	}
+
+	if len(t.Probes) > 0 {
+		p.printf("\n## Probes\n\n")
+		p.printf("| Probe | Checks | Failures | Last failure |\n| --- | --- | --- | --- |\n")
+		for _, summary := range t.Probes {
+			lastFailure := ""
+			if summary.LastFailure != nil {
+				lastFailure = fmt.Sprintf("%s: %s", formatTime(summary.LastFailure.Time), summary.LastFailure.Message)
+			}
+			p.printf("| %s | %d | %d | %s |\n", summary.Probe, summary.Checks, summary.Failures, escape(lastFailure))
+		}
+	}
+
+	p.printf("\n## Timeline\n\n")
+	p.printf("| Time | Step | Event | Pod | Message |\n| --- | --- | --- | --- | --- |\n")
+	for _, event := range t.Events {
+		p.printf("| +%v | %s | %s | %s | %s |\n", event.Time.Sub(t.Started).Truncate(time.Second),
+			event.Step, event.Type, event.Pod, escape(event.Message))
+	}
+	return p.err
+}
+
+// JUnit XML, so CI pipelines fail on aborted scenarios and failed steps
+type junitSuite struct {
+	XMLName   xml.Name    `xml:"testsuite"`
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// Write the timeline as a JUnit test suite: a test case for each step and probe,
+// and one for the scenario failing when it was aborted
+func (t *Timeline) WriteJUnit(w io.Writer) error {
+	suite := junitSuite{
+		Name:      t.Scenario,
+		Time:      seconds(t.Finished.Sub(t.Started)),
+		Timestamp: t.Started.UTC().Format("2006-01-02T15:04:05"),
+	}
+
+	scenario := junitCase{Name: "scenario", Classname: t.Scenario, Time: suite.Time}
+	if t.Aborted {
+		scenario.Failure = &junitFailure{Message: "aborted", Text: t.Reason}
+	}
+	suite.Cases = append(suite.Cases, scenario)
+
+	for _, step := range t.Steps {
+		c := junitCase{Name: "step " + step.Name, Classname: t.Scenario}
+		if step.Started.IsZero() && step.Message == "" {
+			c.Skipped = &struct{}{}
+			suite.Cases = append(suite.Cases, c)
+			continue
+		}
+		if !step.Finished.IsZero() {
+			c.Time = seconds(step.Finished.Sub(step.Started))
+		}
+		out := []string{}
+		for _, pod := range step.Pods {
+			line := fmt.Sprintf("%s: %s", pod.Pod, pod.Result)
+			if pod.Message != "" {
+				line += " (" + pod.Message + ")"
+			}
+			out = append(out, line)
+		}
+		c.SystemOut = strings.Join(out, "\n")
+		if step.Failed() {
+			message := step.Message
+			if message == "" {
+				message = "settings not applied to every pod"
+			}
+			c.Failure = &junitFailure{Message: message, Text: c.SystemOut}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	for _, summary := range t.Probes {
+		c := junitCase{Name: "probe " + summary.Probe, Classname: t.Scenario,
+			SystemOut: fmt.Sprintf("%d checks, %d failures", summary.Checks, summary.Failures)}
+		if summary.Probe == t.FailedProbe {
+			c.Failure = &junitFailure{Message: "probe failed", Text: t.Reason}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	for _, c := range suite.Cases {
+		suite.Tests++
+		if c.Failure != nil {
+			suite.Failures++
+		}
+		if c.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", xml.Header, data)
+	return err
+}
+
+// Save the timeline in a ConfigMap of the namespace, return its name
+func SaveTimeline(clientset *kubernetes.Clientset, namespace string, t *Timeline) (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxReportSize {
+		return "", fmt.Errorf("the report is %d bytes, more than a ConfigMap holds", len(data))
+	}
+	name := ReportName(t)
+	configMap := &v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{reportLabel: "true"},
+		},
+		Data: map[string]string{reportKey: string(data)},
+	}
+	if _, err := clientset.CoreV1().ConfigMaps(namespace).Create(configMap); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+var invalidNameChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// Name of the timeline's report, chaos-report-<scenario>-<start time>
+func ReportName(t *Timeline) string {
+	scenario := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(t.Scenario), "-"), "-")
+	if len(scenario) > 200 {
+		scenario = scenario[:200]
+	}
+	if scenario == "" {
+		scenario = "scenario"
+	}
+	return fmt.Sprintf("chaos-report-%s-%s", scenario, t.Started.UTC().Format("20060102-150405"))
+}
+
+// Load a saved timeline
+func LoadTimeline(clientset *kubernetes.Clientset, namespace, name string) (*Timeline, error) {
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data, found := configMap.Data[reportKey]
+	if !found {
+		return nil, fmt.Errorf("ConfigMap %s/%s holds no report", namespace, name)
+	}
+	return ParseTimeline([]byte(data))
+}
+
+// Parse a timeline written as JSON
+func ParseTimeline(data []byte) (*Timeline, error) {
+	t := &Timeline{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("invalid report: %v", err)
+	}
+	return t, nil
+}
+
+// Saved timelines of the namespace, the latest first
+func ListTimelines(clientset *kubernetes.Clientset, namespace string) ([]string, []*Timeline, error) {
+	list, err := clientset.CoreV1().ConfigMaps(namespace).List(meta_v1.ListOptions{LabelSelector: reportLabel + "=true"})
+	if err != nil {
+		return nil, nil, err
+	}
+	names, timelines := []string{}, []*Timeline{}
+	for _, configMap := range list.Items {
+		t, err := ParseTimeline([]byte(configMap.Data[reportKey]))
+		if err != nil {
+			continue
+		}
+		names = append(names, configMap.Name)
+		timelines = append(timelines, t)
+	}
+	sort.Sort(byStart{names, timelines})
+	return names, timelines, nil
+}
+
+type byStart struct {
+	names     []string
+	timelines []*Timeline
+}
+
+func (b byStart) Len() int { return len(b.names) }
+func (b byStart) Less(i, j int) bool {
+	return b.timelines[i].Started.After(b.timelines[j].Started)
+}
+func (b byStart) Swap(i, j int) {
+	b.names[i], b.names[j] = b.names[j], b.names[i]
+	b.timelines[i], b.timelines[j] = b.timelines[j], b.timelines[i]
+}
+
+// Writes until the first error
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func directionStats(stats *flow.PodChaosStats, direction string) *flow.ChaosStats {
+	if stats == nil {
+		return nil
+	}
+	if direction == "ingress" {
+		return stats.Ingress
+	}
+	return stats.Egress
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// Keep table cells on one line and in one column
+func escape(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(s)
+}
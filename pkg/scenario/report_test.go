@@ -0,0 +1,147 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scenario
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/probe"
+)
+
+func abortedTimeline() *Timeline {
+	start := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	return &Timeline{
+		Scenario:    "Checkout incident",
+		Started:     start,
+		Finished:    start.Add(3 * time.Minute),
+		Aborted:     true,
+		Reason:      "probe web failed 3 times: status 503, expected 200",
+		FailedProbe: "web",
+		Events: []Event{
+			{Time: start, Type: EventStarted, Step: "latency", Message: "egress ,delay,300ms on 2 pods"},
+			{Time: start.Add(2 * time.Second), Type: EventApplied, Step: "latency", Pod: "default/web-1"},
+			{Time: start.Add(3 * time.Minute), Type: EventAborted, Message: "probe web failed 3 times"},
+		},
+		Probes: []ProbeSummary{
+			{Probe: "web", Checks: 2, Failures: 1,
+				LastFailure: &probe.Result{Time: start.Add(3 * time.Minute), Probe: "web", Message: "status 503, expected 200"}},
+		},
+		Steps: []StepResult{
+			{
+				Name: "latency", Namespace: "default", Selector: "app=web", Direction: "egress", Chaos: ",delay,300ms",
+				Started: start, Finished: start.Add(3 * time.Minute),
+				Pods: []PodResult{
+					{Pod: "default/web-1", Result: PodApplied, Effective: map[string]string{"egress": ",delay,300ms"},
+						Stats: &flow.PodChaosStats{Egress: &flow.ChaosStats{SentPackets: 120, SentBytes: 9000, Dropped: 2}}},
+					{Pod: "default/web-2", Result: PodRejected, Message: "egress: namespace default is protected from chaos"},
+				},
+			},
+			{Name: "partition", Namespace: "default", Selector: "app=db", Direction: "both", Chaos: ",loss,100%", Pods: []PodResult{}},
+		},
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := abortedTimeline().WriteMarkdown(out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# Chaos report: Checkout incident",
+		"| Result | aborted: probe web failed 3 times: status 503, expected 200 |",
+		"| latency | egress | `,delay,300ms` | default/app=web | 2018-06-01T10:00:00Z | 2018-06-01T10:03:00Z | 1/2 applied | failed |",
+		"| partition | both | `,loss,100%` | default/app=db | - | - | 0/0 applied | not started |",
+		"| default/web-1 | applied | egress | `,delay,300ms` | 120 pkt (9000 B) | 2 | 0 |  |",
+		"| web | 2 | 1 | 2018-06-01T10:03:00Z: status 503, expected 200 |",
+		"| +2s | latency | applied | default/web-1 |  |",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in:\n%s", expected, out)
+		}
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := abortedTimeline().WriteJUnit(out); err != nil {
+		t.Fatal(err)
+	}
+	suite := junitSuite{}
+	if err := xml.Unmarshal(out.Bytes(), &suite); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, out)
+	}
+	// The scenario, two steps and a probe
+	if suite.Tests != 4 || suite.Failures != 3 || suite.Skipped != 1 || suite.Time != "180.000" {
+		t.Errorf("unexpected suite %+v", suite)
+	}
+	failed := []string{}
+	for _, c := range suite.Cases {
+		if c.Failure != nil {
+			failed = append(failed, c.Name)
+		}
+	}
+	if strings.Join(failed, ",") != "scenario,step latency,probe web" {
+		t.Errorf("unexpected failed cases %v", failed)
+	}
+}
+
+func TestTimelineRoundTrip(t *testing.T) {
+	timeline := abortedTimeline()
+	if name := ReportName(timeline); name != "chaos-report-checkout-incident-20180601-100000" {
+		t.Errorf("unexpected report name %s", name)
+	}
+	out := &bytes.Buffer{}
+	if err := timeline.WriteJSON(out); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseTimeline(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Result() != timeline.Result() || len(parsed.Steps) != 2 || parsed.Steps[0].Pods[0].Stats.Egress.Dropped != 2 {
+		t.Errorf("unexpected timeline after a round trip %+v", parsed)
+	}
+}
+
+func TestAddProbeResult(t *testing.T) {
+	start := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	timeline := &Timeline{}
+	for i := 0; i < 3*maxProbeFailures; i++ {
+		at := start.Add(time.Duration(i) * time.Second)
+		timeline.AddProbeResult(probe.Result{Time: at, Probe: "web", OK: i%2 == 0, Message: fmt.Sprint(i)})
+		timeline.AddProbeResult(probe.Result{Time: at, Probe: "api", OK: true})
+	}
+
+	// Every check is counted, the failures kept are capped to the latest ones
+	if len(timeline.Probes) != 2 || timeline.Probes[0].Probe != "api" || timeline.Probes[0].Checks != 3*maxProbeFailures ||
+		timeline.Probes[0].Failures != 0 || timeline.Probes[0].LastFailure != nil {
+		t.Errorf("unexpected api summary %+v", timeline.Probes)
+	}
+	web := timeline.Probes[1]
+	if web.Checks != 3*maxProbeFailures || web.Failures != 3*maxProbeFailures/2 || web.LastFailure.Message != fmt.Sprint(3*maxProbeFailures-1) {
+		t.Errorf("unexpected web summary %+v", web)
+	}
+	if len(timeline.ProbeFailures) != maxProbeFailures || timeline.ProbeFailures[maxProbeFailures-1].Message != web.LastFailure.Message {
+		t.Errorf("expected the latest %d failures, got %d", maxProbeFailures, len(timeline.ProbeFailures))
+	}
+}
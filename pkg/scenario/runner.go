@@ -0,0 +1,548 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scenario
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/probe"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// How long cleared pods are waited for before a step is considered finished anyway
+const clearTimeout = time.Minute
+
+// Phases of a step in a run
+const (
+	phasePending  = "pending"
+	phaseRunning  = "running"
+	phaseClearing = "clearing"
+	phaseFinished = "finished"
+)
+
+// Runner drives the daemons through the pods' chaos annotations
+type Runner struct {
+	clientset *kubernetes.Clientset
+	scenario  *Scenario
+	// Namespace of the steps without one
+	namespace string
+	// Label the daemons select pods by, added to the targets, e.g. chaos=on
+	label string
+	// Control ConfigMap whose abort state aborts the run, empty to ignore it
+	controlMap string
+	interval   time.Duration
+
+	timeline *Timeline
+	states   map[string]*stepState
+	prober   *probe.Prober
+	// Pods the label was added to, by namespace/name, with the value the key had before, it
+	// is restored once they are cleared
+	labelled map[string]*string
+}
+
+type stepState struct {
+	step    *Step
+	phase   string
+	started time.Time
+	// Clearing started
+	clearing time.Time
+	// Pods of the step and whether the daemon is done with them, by namespace/name
+	pods   map[string]bool
+	result *StepResult
+}
+
+// The result of the pod, added if it is not there yet
+func (st *stepState) pod(key string) *PodResult {
+	for i := range st.result.Pods {
+		if st.result.Pods[i].Pod == key {
+			return &st.result.Pods[i]
+		}
+	}
+	st.result.Pods = append(st.result.Pods, PodResult{Pod: key, Result: PodPending})
+	return &st.result.Pods[len(st.result.Pods)-1]
+}
+
+func NewRunner(clientset *kubernetes.Clientset, scenario *Scenario, namespace, label, controlMap string, interval time.Duration) *Runner {
+	return &Runner{
+		clientset:  clientset,
+		scenario:   scenario,
+		namespace:  namespace,
+		label:      label,
+		controlMap: controlMap,
+		interval:   interval,
+	}
+}
+
+// Run the scenario until every step is cleared, or until it is aborted by closing stop,
+// by the control ConfigMap or by a step matching no pods. The faults in place are
+// cleared on abort.
+func (r *Runner) Run(stop <-chan struct{}) (*Timeline, error) {
+	r.timeline = &Timeline{Scenario: r.scenario.Name, Started: time.Now(), Events: []Event{}}
+	r.timeline.Steps = make([]StepResult, len(r.scenario.Steps))
+	r.states = map[string]*stepState{}
+	r.labelled = map[string]*string{}
+	for i := range r.scenario.Steps {
+		step := &r.scenario.Steps[i]
+		namespace := step.Namespace
+		if namespace == "" {
+			namespace = r.namespace
+		}
+		direction, chaos := step.Fault()
+		r.timeline.Steps[i] = StepResult{Name: step.Name, Namespace: namespace, Selector: step.Selector,
+			Direction: direction, Chaos: chaos, Pods: []PodResult{}}
+		r.states[step.Name] = &stepState{step: step, phase: phasePending, pods: map[string]bool{}, result: &r.timeline.Steps[i]}
+	}
+
+	// The steady state is checked before any fault is applied
+	r.prober = probe.NewProber(r.scenario.Probes)
+	results, _ := r.prober.Run(time.Now())
+	r.recordProbes(results)
+	for _, result := range results {
+		if !result.OK {
+			r.timeline.FailedProbe = result.Probe
+			return r.abort(fmt.Sprintf("steady state not met before the first step, probe %s: %s", result.Probe, result.Message))
+		}
+	}
+
+	for {
+		select {
+		case <-stop:
+			return r.abort("interrupted")
+		default:
+		}
+		if r.controlMap != "" {
+			data, err := flow.GetConfigMapData(r.clientset, r.controlMap)
+			if err != nil {
+				glog.Errorf("Failed get control ConfigMap %s: %v", r.controlMap, err)
+			} else if state, _ := flow.ParseControlState(data); state == flow.ControlAbort {
+				return r.abort("chaos aborted on all nodes")
+			}
+		}
+
+		results, failure := r.prober.Run(time.Now())
+		r.recordProbes(results)
+		if failure != nil {
+			r.timeline.FailedProbe = failure.Probe
+			return r.abort(failure.Error())
+		}
+
+		finished := true
+		for i := range r.scenario.Steps {
+			st := r.states[r.scenario.Steps[i].Name]
+			switch st.phase {
+			case phasePending:
+				if r.ready(st) {
+					if err := r.start(st); err != nil {
+						return r.abort(fmt.Sprintf("step %s: %v", st.step.Name, err))
+					}
+				}
+			case phaseRunning:
+				r.confirm(st)
+				if time.Since(st.started) >= st.step.duration {
+					r.clear(st)
+				}
+			case phaseClearing:
+				r.confirmClear(st)
+			}
+			if st.phase != phaseFinished {
+				finished = false
+			}
+		}
+		if finished {
+			r.timeline.Finished = time.Now()
+			return r.timeline, nil
+		}
+
+		select {
+		case <-stop:
+			return r.abort("interrupted")
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+func (r *Runner) record(eventType, step, pod, message string) {
+	glog.V(2).Infof("Scenario %s: %s %s %s %s", r.scenario.Name, step, eventType, pod, message)
+	r.timeline.Events = append(r.timeline.Events, Event{Time: time.Now(), Type: eventType, Step: step, Pod: pod, Message: message})
+}
+
+func (r *Runner) recordProbes(results []probe.Result) {
+	for _, result := range results {
+		r.timeline.AddProbeResult(result)
+		if !result.OK {
+			r.record(EventProbeFailed, "", "", fmt.Sprintf("%s: %s", result.Probe, result.Message))
+		}
+	}
+}
+
+// Whether the steps the step comes after are finished
+func (r *Runner) ready(st *stepState) bool {
+	for _, after := range st.step.After {
+		if r.states[after].phase != phaseFinished {
+			return false
+		}
+	}
+	return true
+}
+
+// Set the step's chaos settings on the pods it selects
+func (r *Runner) start(st *stepState) error {
+	namespace := st.result.Namespace
+	pods, err := r.clientset.CoreV1().Pods(namespace).List(meta_v1.ListOptions{LabelSelector: st.step.Selector})
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, pod := range pods.Items {
+		// Pods not scheduled yet have no daemon to apply the settings
+		if pod.Spec.NodeName != "" && pod.DeletionTimestamp == nil {
+			names = append(names, pod.Name)
+		}
+	}
+	if len(names) == 0 {
+		st.result.Message = fmt.Sprintf("no pods in %s match %s", namespace, st.step.Selector)
+		r.record(EventFailed, st.step.Name, "", st.result.Message)
+		return fmt.Errorf("%s", st.result.Message)
+	}
+	sort.Strings(names)
+
+	st.phase, st.started = phaseRunning, time.Now()
+	st.result.Started = st.started
+	r.record(EventStarted, st.step.Name, "", fmt.Sprintf("%s %s on %d pods", st.result.Direction, st.result.Chaos, len(names)))
+	labelKey, labelValue := r.labelKeyValue()
+	for _, name := range names {
+		key := namespace + "/" + name
+		labelled, before := false, (*string)(nil)
+		err := r.updatePod(namespace, name, func(pod *v1.Pod) bool {
+			labelled, before = false, nil
+			if value, found := pod.Labels[labelKey]; labelKey != "" && (!found || value != labelValue) {
+				if found {
+					before = &value
+				}
+				pod.Labels[labelKey] = labelValue
+				labelled = true
+			}
+			if st.step.PodFailure != "" {
+				flow.SetPodFailure(st.step.PodFailure, pod.Annotations)
+				return true
+			}
+			for _, isIngress := range st.step.directions() {
+				flow.SetPodChaos(isIngress, st.step.Chaos, st.step.Ramp, pod.Annotations)
+			}
+			return true
+		})
+		if err != nil {
+			r.record(EventFailed, st.step.Name, key, err.Error())
+			result := st.pod(key)
+			result.Result, result.Message = PodFailed, err.Error()
+			continue
+		}
+		if _, found := r.labelled[key]; labelled && !found {
+			r.labelled[key] = before
+		}
+		st.pod(key)
+		st.pods[key] = false
+	}
+	return nil
+}
+
+func (r *Runner) labelKeyValue() (string, string) {
+	if r.label == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(r.label, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Record the pods the daemons applied or rejected the settings of
+func (r *Runner) confirm(st *stepState) {
+	for _, key := range sortedKeys(st.pods) {
+		if st.pods[key] {
+			continue
+		}
+		pod, err := r.getPod(key)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				r.record(EventFailed, st.step.Name, key, "pod deleted")
+				st.pod(key).Result = PodDeleted
+				delete(st.pods, key)
+			}
+			continue
+		}
+		// A pod failure is in place once set, the daemon records its kills as events
+		applied, reasons := true, []string{}
+		for _, isIngress := range st.step.chaosDirections() {
+			direction := directionName(isIngress)
+			switch pod.Annotations["kubernetes.io/done-"+direction+"-chaos"] {
+			case "yes":
+			case "rejected":
+				reasons = append(reasons, fmt.Sprintf("%s: %s", direction, flow.GetPodChaosRejected(isIngress, pod.Annotations)))
+			default:
+				applied = false
+			}
+		}
+		switch {
+		case len(reasons) > 0:
+			r.record(EventRejected, st.step.Name, key, strings.Join(reasons, "; "))
+			result := st.pod(key)
+			result.Result, result.Message = PodRejected, strings.Join(reasons, "; ")
+			st.pods[key] = true
+		case applied:
+			r.record(EventApplied, st.step.Name, key, "")
+			st.pod(key).Result = PodApplied
+			st.pods[key] = true
+		}
+	}
+}
+
+// Set the clear flags of the step's pods, unless another step has set its own settings since
+func (r *Runner) clear(st *stepState) {
+	st.phase, st.clearing = phaseClearing, time.Now()
+	r.record(EventClearing, st.step.Name, "", "")
+	for _, key := range sortedKeys(st.pods) {
+		namespace, name := splitKey(key)
+		err := r.updatePod(namespace, name, func(pod *v1.Pod) bool {
+			// What was in place, the statistics are removed once cleared
+			result := st.pod(key)
+			result.Stats, _ = flow.GetPodChaosStats(pod.Annotations)
+			result.Effective = map[string]string{}
+			for _, isIngress := range st.step.chaosDirections() {
+				if effective := flow.GetEffectiveChaos(isIngress, pod.Annotations); effective != "" {
+					result.Effective[directionName(isIngress)] = effective
+				}
+			}
+
+			updated := false
+			if st.step.PodFailure != "" && pod.Annotations[flow.PodFailureAnnotation] == st.step.PodFailure {
+				flow.ClearPodFailure(pod.Annotations)
+				updated = true
+			}
+			for _, isIngress := range st.step.chaosDirections() {
+				if pod.Annotations["kubernetes.io/"+directionName(isIngress)+"-chaos"] == st.step.Chaos {
+					flow.SetPodChaosClear(isIngress, pod.Annotations)
+					updated = true
+				}
+			}
+			return updated
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			r.record(EventFailed, st.step.Name, key, fmt.Sprintf("failed to clear: %v", err))
+		}
+		st.pods[key] = false
+	}
+}
+
+// Record the pods cleared by the daemons, the step is finished when all of them are
+func (r *Runner) confirmClear(st *stepState) {
+	for _, key := range sortedKeys(st.pods) {
+		if st.pods[key] {
+			continue
+		}
+		pod, err := r.getPod(key)
+		if err != nil && !apierrors.IsNotFound(err) {
+			continue
+		}
+		cleared := true
+		for _, isIngress := range st.step.chaosDirections() {
+			if err == nil {
+				if _, found := pod.Annotations["kubernetes.io/clear-"+directionName(isIngress)+"-chaos"]; found {
+					cleared = false
+				}
+			}
+		}
+		if cleared {
+			r.record(EventCleared, st.step.Name, key, "")
+			st.pods[key] = true
+		}
+	}
+
+	done := true
+	for _, cleared := range st.pods {
+		done = done && cleared
+	}
+	if !done && time.Since(st.clearing) < clearTimeout {
+		return
+	}
+	message := ""
+	if !done {
+		message = fmt.Sprintf("not all pods cleared after %v", clearTimeout)
+	}
+	st.phase, st.result.Finished = phaseFinished, time.Now()
+	r.record(EventFinished, st.step.Name, "", message)
+	r.unlabel(st)
+}
+
+// Remove the label from the step's pods the runner labelled, or give it back its value, once no
+// other step in progress targets them, so the daemons no longer select them
+func (r *Runner) unlabel(st *stepState) {
+	labelKey, labelValue := r.labelKeyValue()
+	for _, key := range sortedKeys(st.pods) {
+		before, found := r.labelled[key]
+		if !found || r.targeted(key) {
+			continue
+		}
+		namespace, name := splitKey(key)
+		err := r.updatePod(namespace, name, func(pod *v1.Pod) bool {
+			if value, found := pod.Labels[labelKey]; !found || value != labelValue {
+				return false
+			}
+			if before != nil {
+				pod.Labels[labelKey] = *before
+			} else {
+				delete(pod.Labels, labelKey)
+			}
+			return true
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			r.record(EventFailed, st.step.Name, key, fmt.Sprintf("failed to remove label %s: %v", r.label, err))
+			continue
+		}
+		delete(r.labelled, key)
+	}
+}
+
+// Whether a step in progress targets the pod
+func (r *Runner) targeted(key string) bool {
+	for _, st := range r.states {
+		if _, found := st.pods[key]; found && (st.phase == phaseRunning || st.phase == phaseClearing) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clear the steps in progress, record the reason on their pods and end the run once the daemons
+// cleared them, so the pods' label can be removed
+func (r *Runner) abort(reason string) (*Timeline, error) {
+	aborted := []*stepState{}
+	for i := range r.scenario.Steps {
+		if st := r.states[r.scenario.Steps[i].Name]; st.phase == phaseRunning || st.phase == phaseClearing {
+			if st.phase == phaseRunning {
+				r.clear(st)
+			}
+			for _, key := range sortedKeys(st.pods) {
+				r.recordPodEvent(key, "ChaosAborted", fmt.Sprintf("Scenario %s step %s aborted: %s", r.scenario.Name, st.step.Name, reason))
+			}
+			aborted = append(aborted, st)
+		}
+	}
+	for clearing := len(aborted) > 0; clearing; {
+		time.Sleep(r.interval)
+		clearing = false
+		for _, st := range aborted {
+			if st.phase == phaseClearing {
+				r.confirmClear(st)
+				clearing = clearing || st.phase == phaseClearing
+			}
+		}
+	}
+	r.record(EventAborted, "", "", reason)
+	r.timeline.Finished = time.Now()
+	r.timeline.Aborted, r.timeline.Reason = true, reason
+	return r.timeline, fmt.Errorf("scenario %s aborted: %s", r.scenario.Name, reason)
+}
+
+// Record a warning event on the pod
+func (r *Runner) recordPodEvent(key, reason, message string) {
+	pod, err := r.getPod(key)
+	if err != nil {
+		return
+	}
+	now := meta_v1.Now()
+	event := &v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{GenerateName: pod.Name + ".", Namespace: pod.Namespace},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Pod",
+			APIVersion:      "v1",
+			Namespace:       pod.Namespace,
+			Name:            pod.Name,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           v1.EventTypeWarning,
+		Source:         v1.EventSource{Component: "chaosctl"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := r.clientset.CoreV1().Events(pod.Namespace).Create(event); err != nil {
+		glog.Errorf("Failed to record event on %s: %v", key, err)
+	}
+}
+
+func (r *Runner) getPod(key string) (*v1.Pod, error) {
+	namespace, name := splitKey(key)
+	return r.clientset.CoreV1().Pods(namespace).Get(name, meta_v1.GetOptions{})
+}
+
+// Get, change and update the pod, again if it changed in between, update returns
+// false if there is nothing to change
+func (r *Runner) updatePod(namespace, name string, update func(pod *v1.Pod) bool) error {
+	for retries := 0; ; retries++ {
+		pod, err := r.clientset.CoreV1().Pods(namespace).Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		if !update(pod) {
+			return nil
+		}
+		_, err = r.clientset.CoreV1().Pods(namespace).Update(pod)
+		if err == nil || !apierrors.IsConflict(err) || retries >= 4 {
+			return err
+		}
+	}
+}
+
+func directionName(isIngress bool) string {
+	if isIngress {
+		return "ingress"
+	}
+	return "egress"
+}
+
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	return parts[0], parts[1]
+}
+
+func sortedKeys(pods map[string]bool) []string {
+	keys := make([]string, 0, len(pods))
+	for key := range pods {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scenario runs sequences of faults over time, setting and clearing the
+// chaos annotations of the selected pods the way a user would.
+package scenario
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/probe"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Scenario is a set of steps, each step starts when the ones it comes after are cleared.
+// The probes must pass before the first step, and the scenario is aborted when one
+// of them fails during the steps.
+type Scenario struct {
+	Name   string        `json:"name"`
+	Steps  []Step        `json:"steps"`
+	Probes []probe.Probe `json:"probes,omitempty"`
+}
+
+// Step applies chaos settings to the selected pods for a duration
+type Step struct {
+	Name string `json:"name"`
+	// Namespace of the pods, the one given to the runner if empty
+	Namespace string `json:"namespace,omitempty"`
+	// Label selector of the pods, e.g. app=web
+	Selector string `json:"selector"`
+	// ingress, egress or both
+	Direction string `json:"direction"`
+	// Chaos settings as in the annotations, e.g. ,delay,100ms or profile:3g
+	Chaos string `json:"chaos"`
+	// Optional ramp, e.g. over=1m steps=4
+	Ramp string `json:"ramp,omitempty"`
+	// Pod failure instead of chaos settings, e.g. action=kill-container interval=30s
+	PodFailure string `json:"podFailure,omitempty"`
+	Duration   string `json:"duration"`
+	// Names of the steps to wait for, the previous step if nil, none if empty
+	After []string `json:"after"`
+
+	duration time.Duration
+}
+
+// Load a scenario from YAML or JSON and check it
+func Load(data []byte) (*Scenario, error) {
+	s := &Scenario{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid scenario: %v", err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Scenario) validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("scenario %s has no steps", s.Name)
+	}
+	index := map[string]int{}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step-%d", i+1)
+		}
+		if _, found := index[step.Name]; found {
+			return fmt.Errorf("duplicate step %s", step.Name)
+		}
+		index[step.Name] = i
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("step %s: %v", step.Name, err)
+		}
+		if step.After == nil && i > 0 {
+			step.After = []string{s.Steps[i-1].Name}
+		}
+	}
+
+	// Steps may come after later ones, as long as there is no cycle
+	visiting, visited := map[string]bool{}, map[string]bool{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("step %s comes after itself", name)
+		}
+		visiting[name] = true
+		for _, after := range s.Steps[index[name]].After {
+			if _, found := index[after]; !found {
+				return fmt.Errorf("step %s comes after unknown step %s", name, after)
+			}
+			if err := visit(after); err != nil {
+				return err
+			}
+		}
+		visited[name] = true
+		return nil
+	}
+	for _, step := range s.Steps {
+		if err := visit(step.Name); err != nil {
+			return err
+		}
+	}
+
+	probes := map[string]bool{}
+	for i := range s.Probes {
+		p := &s.Probes[i]
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("probe-%d", i+1)
+		}
+		if probes[p.Name] {
+			return fmt.Errorf("duplicate probe %s", p.Name)
+		}
+		probes[p.Name] = true
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (step *Step) validate() error {
+	if _, err := labels.Parse(step.Selector); err != nil || step.Selector == "" {
+		return fmt.Errorf("invalid selector %q", step.Selector)
+	}
+	if step.PodFailure != "" {
+		if err := step.validatePodFailure(); err != nil {
+			return err
+		}
+	} else if err := step.validateChaos(); err != nil {
+		return err
+	}
+	var err error
+	if step.duration, err = time.ParseDuration(step.Duration); err != nil || step.duration <= 0 {
+		return fmt.Errorf("invalid duration %q", step.Duration)
+	}
+	return nil
+}
+
+func (step *Step) validatePodFailure() error {
+	if step.Chaos != "" || step.Ramp != "" || step.Direction != "" {
+		return fmt.Errorf("podFailure can't be set with chaos, ramp or direction")
+	}
+	_, err := flow.ParsePodFailure(step.PodFailure)
+	return err
+}
+
+func (step *Step) validateChaos() error {
+	switch step.Direction {
+	case "ingress", "egress", "both":
+	default:
+		return fmt.Errorf("invalid direction %q, expected ingress, egress or both", step.Direction)
+	}
+	if step.Chaos == "" {
+		return fmt.Errorf("no chaos settings or podFailure")
+	}
+	// Profiles are expanded by the daemons, which know the ones of the cluster
+	if !strings.HasPrefix(step.Chaos, "profile:") {
+		for _, isIngress := range step.directions() {
+			if _, _, err := flow.ParseChaosInfo(step.Chaos, isIngress); err != nil {
+				return err
+			}
+		}
+	}
+	if step.Ramp != "" {
+		if _, err := flow.ParseRamp(step.Ramp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The direction and settings of the step's fault, pod and the failure settings for a pod failure
+func (step *Step) Fault() (string, string) {
+	if step.PodFailure != "" {
+		return "pod", step.PodFailure
+	}
+	return step.Direction, step.Chaos
+}
+
+// The directions of the step, true for ingress
+func (step *Step) directions() []bool {
+	switch step.Direction {
+	case "ingress":
+		return []bool{true}
+	case "egress":
+		return []bool{false}
+	}
+	return []bool{true, false}
+}
+
+// The directions of the step's chaos settings, none for a pod failure
+func (step *Step) chaosDirections() []bool {
+	if step.PodFailure != "" {
+		return nil
+	}
+	return step.directions()
+}
+
+// Planned offsets of a step from the start of the scenario
+type PlannedStep struct {
+	Name  string
+	Start time.Duration
+	End   time.Duration
+}
+
+// The offsets the steps start and end at, if every step is applied and cleared at once,
+// in the order they start
+func (s *Scenario) Plan() []PlannedStep {
+	ends := map[string]time.Duration{}
+	var end func(step *Step) time.Duration
+	end = func(step *Step) time.Duration {
+		if e, found := ends[step.Name]; found {
+			return e
+		}
+		start := s.start(step, end)
+		ends[step.Name] = start + step.duration
+		return ends[step.Name]
+	}
+
+	plan := []PlannedStep{}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		plan = append(plan, PlannedStep{Name: step.Name, Start: s.start(step, end), End: end(step)})
+	}
+	// Stable, so steps starting together keep their order
+	for i := 1; i < len(plan); i++ {
+		for j := i; j > 0 && plan[j].Start < plan[j-1].Start; j-- {
+			plan[j], plan[j-1] = plan[j-1], plan[j]
+		}
+	}
+	return plan
+}
+
+func (s *Scenario) start(step *Step, end func(step *Step) time.Duration) time.Duration {
+	var start time.Duration
+	for _, after := range step.After {
+		if e := end(s.step(after)); e > start {
+			start = e
+		}
+	}
+	return start
+}
+
+func (s *Scenario) step(name string) *Step {
+	for i := range s.Steps {
+		if s.Steps[i].Name == name {
+			return &s.Steps[i]
+		}
+	}
+	return nil
+}
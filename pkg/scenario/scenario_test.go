@@ -0,0 +1,117 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scenario
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const incident = `
+name: checkout-incident
+steps:
+- name: latency
+  selector: app=web
+  direction: egress
+  chaos: ",delay,300ms"
+  duration: 2m
+- name: partition
+  selector: app=db
+  direction: both
+  chaos: ",loss,100%"
+  duration: 1m
+- name: lossy-clients
+  namespace: clients
+  selector: tier=frontend
+  direction: ingress
+  chaos: profile:lossy-wifi
+  ramp: over=1m steps=3
+  duration: 5m
+  after: []
+- selector: app=web
+  podFailure: action=kill-container interval=10s
+  duration: 30s
+  after: [partition, lossy-clients]
+probes:
+- http: {url: "http://web.default/healthz", maxLatency: 500ms}
+  failureThreshold: 2
+- name: errors
+  prometheus: {url: "http://prometheus.monitoring:9090", query: "sum(rate(http_errors_total[1m]))", max: 5}
+`
+
+func TestLoad(t *testing.T) {
+	s, err := Load([]byte(incident))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "checkout-incident" || len(s.Steps) != 4 {
+		t.Fatalf("unexpected scenario %+v", s)
+	}
+	if after := s.Steps[1].After; !reflect.DeepEqual(after, []string{"latency"}) {
+		t.Errorf("expected partition to come after the previous step, got %v", after)
+	}
+	if after := s.Steps[2].After; len(after) != 0 {
+		t.Errorf("expected lossy-clients to start at once, got %v", after)
+	}
+	if name := s.Steps[3].Name; name != "step-4" {
+		t.Errorf("expected a default name, got %s", name)
+	}
+	if direction, chaos := s.Steps[3].Fault(); direction != "pod" || chaos != "action=kill-container interval=10s" {
+		t.Errorf("expected a pod failure step, got %s %s", direction, chaos)
+	}
+	if len(s.Probes) != 2 || s.Probes[0].Name != "probe-1" || s.Probes[1].FailureThreshold != 3 {
+		t.Errorf("expected probes with default names and thresholds, got %+v", s.Probes)
+	}
+
+	expected := []PlannedStep{
+		{"latency", 0, 2 * time.Minute},
+		{"lossy-clients", 0, 5 * time.Minute},
+		{"partition", 2 * time.Minute, 3 * time.Minute},
+		{"step-4", 5 * time.Minute, 5*time.Minute + 30*time.Second},
+	}
+	if plan := s.Plan(); !reflect.DeepEqual(plan, expected) {
+		t.Errorf("expected plan %+v, got %+v", expected, plan)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	cases := []struct {
+		scenario string
+		err      string
+	}{
+		{"name: empty", "has no steps"},
+		{"steps: [{selector: app=web, direction: up, chaos: ',delay,1ms', duration: 1m}]", "invalid direction"},
+		{"steps: [{selector: app=web, direction: ingress, chaos: ',delay,1ms', duration: soon}]", "invalid duration"},
+		{"steps: [{direction: ingress, chaos: ',delay,1ms', duration: 1m}]", "invalid selector"},
+		{"steps: [{selector: app=web, direction: egress, chaos: ',delay,1ms,tbf=1mbit/10k', duration: 1m}]", "tbf"},
+		{"steps: [{selector: app=web, direction: egress, chaos: ',delay,1ms', ramp: steps=2, duration: 1m}]", "over"},
+		{"{steps: [{selector: app=web, direction: egress, chaos: ',delay,1ms', duration: 1m}], probes: [{name: db}]}", "expected one of http, tcp or prometheus"},
+		{"steps: [{name: a, selector: app=web, direction: egress, chaos: ',delay,1ms', duration: 1m, after: [c]}]", "unknown step c"},
+		{"steps: [{selector: app=web, podFailure: action=reboot, duration: 1m}]", "invalid action"},
+		{"steps: [{selector: app=web, direction: egress, chaos: ',delay,1ms', podFailure: action=delete, duration: 1m}]", "can't be set with chaos"},
+		{`steps:
+- {name: a, selector: app=web, direction: egress, chaos: ',delay,1ms', duration: 1m, after: [b]}
+- {name: b, selector: app=web, direction: egress, chaos: ',delay,1ms', duration: 1m}`, "comes after itself"},
+	}
+	for _, c := range cases {
+		if _, err := Load([]byte(c.scenario)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.scenario, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scenario
+
+import (
+	"sort"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/probe"
+)
+
+// Types of the timeline's events
+const (
+	EventStarted  = "started"
+	EventApplied  = "applied"
+	EventRejected = "rejected"
+	EventClearing = "clearing"
+	EventCleared  = "cleared"
+	EventFinished = "finished"
+	EventFailed   = "failed"
+	EventAborted  = "aborted"
+	// A probe failed, without reaching its failure threshold yet
+	EventProbeFailed = "probe-failed"
+)
+
+// Something that happened to a step or one of its pods
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Step string    `json:"step,omitempty"`
+	// namespace/name of the pod
+	Pod     string `json:"pod,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Timeline of a scenario run
+type Timeline struct {
+	Scenario string    `json:"scenario"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Aborted  bool      `json:"aborted"`
+	// Why the scenario was aborted
+	Reason string `json:"reason,omitempty"`
+	// The probe that aborted it
+	FailedProbe string  `json:"failedProbe,omitempty"`
+	Events      []Event `json:"events"`
+	// Checks of each probe, by name
+	Probes []ProbeSummary `json:"probes,omitempty"`
+	// Failed checks of the probes, the latest maxProbeFailures of them
+	ProbeFailures []probe.Result `json:"probeFailures,omitempty"`
+	// What each step did, in the scenario's order
+	Steps []StepResult `json:"steps"`
+}
+
+// Failed probe checks kept in a timeline, so long runs still fit in the report's ConfigMap
+const maxProbeFailures = 100
+
+// How a probe did over the run
+type ProbeSummary struct {
+	Probe    string `json:"probe"`
+	Checks   int    `json:"checks"`
+	Failures int    `json:"failures"`
+	// The last failed check
+	LastFailure *probe.Result `json:"lastFailure,omitempty"`
+}
+
+// Count the probe's check in its summary, and keep it if it failed
+func (t *Timeline) AddProbeResult(result probe.Result) {
+	i := sort.Search(len(t.Probes), func(i int) bool { return t.Probes[i].Probe >= result.Probe })
+	if i == len(t.Probes) || t.Probes[i].Probe != result.Probe {
+		t.Probes = append(t.Probes, ProbeSummary{})
+		copy(t.Probes[i+1:], t.Probes[i:])
+		t.Probes[i] = ProbeSummary{Probe: result.Probe}
+	}
+	summary := &t.Probes[i]
+	summary.Checks++
+	if result.OK {
+		return
+	}
+	summary.Failures++
+	summary.LastFailure = &result
+	t.ProbeFailures = append(t.ProbeFailures, result)
+	if len(t.ProbeFailures) > maxProbeFailures {
+		t.ProbeFailures = t.ProbeFailures[len(t.ProbeFailures)-maxProbeFailures:]
+	}
+}
+
+// Results of a step's pods
+const (
+	PodPending  = "pending"
+	PodApplied  = "applied"
+	PodRejected = "rejected"
+	PodFailed   = "failed"
+	PodDeleted  = "deleted"
+)
+
+// What a step did, a step that never started has no start time
+type StepResult struct {
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace"`
+	Selector  string      `json:"selector"`
+	Direction string      `json:"direction"`
+	Chaos     string      `json:"chaos"`
+	Started   time.Time   `json:"started"`
+	Finished  time.Time   `json:"finished"`
+	Pods      []PodResult `json:"pods"`
+	// Why the step failed as a whole
+	Message string `json:"message,omitempty"`
+}
+
+// What happened to a pod of a step
+type PodResult struct {
+	// namespace/name
+	Pod     string `json:"pod"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+	// Settings the daemon applied by direction, after profiles and ramps
+	Effective map[string]string `json:"effective,omitempty"`
+	// Statistics just before the pod was cleared
+	Stats *flow.PodChaosStats `json:"stats,omitempty"`
+}
+
+// Whether the step failed or its settings were not applied to every pod
+func (s *StepResult) Failed() bool {
+	if s.Message != "" {
+		return true
+	}
+	for _, pod := range s.Pods {
+		if pod.Result != PodApplied {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A standard 5 field cron expression: minute hour day-of-month month day-of-week
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	// Whether day-of-month and day-of-week were restricted, cron matches either of them if both are
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = cronField{0, 59, nil}
+	hourField   = cronField{0, 23, nil}
+	domField    = cronField{1, 31, nil}
+	monthField  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is Sunday as well as 0
+	dowField = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// Give up looking for the next activation after this long, e.g. for 0 0 30 2 *
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// Parse a cron expression, fields accept *, numbers, names, ranges a-b, steps */n or a-b/n and lists
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, expected 5 fields", expr)
+	}
+	c := &Cron{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	var err error
+	for i, f := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&c.minute, minuteField}, {&c.hour, hourField}, {&c.dom, domField}, {&c.month, monthField}, {&c.dow, dowField},
+	} {
+		if *f.bits, err = f.field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+	}
+	// Sunday is bit 0
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func (f cronField) parse(value string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart = part[:i]
+		}
+
+		low, high := f.min, f.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// a/n runs from a to the end
+				high = f.max
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, found := f.names[strings.ToLower(s)]; found {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q, expected %d to %d", s, f.min, f.max)
+	}
+	return v, nil
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// The first activation after t, in t's location, zero if there is none within 5 years
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.Add(maxSearch)
+	for t.Before(end) {
+		switch {
+		case !has(c.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !has(c.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !has(c.minute, t.Minute()):
+			t = t.Truncate(time.Minute).Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schedule decides when chaos is active, from a cron expression with a duration
+// or from a list of time windows.
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Layouts of the window bounds, the ones without a zone are in the schedule's location
+var windowLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"}
+
+// Schedule is either a cron expression with a duration, or a list of windows
+type Schedule struct {
+	cron     *Cron
+	duration time.Duration
+	windows  []Window
+	location *time.Location
+}
+
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Parse a schedule, either "[TZ=<zone>] <cron expression> for <duration>", e.g.
+// "TZ=Asia/Shanghai 0 10 * * mon-fri for 30m", or comma separated windows of the
+// form <start>/<end>, e.g. "2018-06-01T10:00/2018-06-01T11:00". Times without a
+// zone are in location, unless TZ= gives another one.
+func Parse(spec string, location *time.Location) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	s := &Schedule{location: location}
+	if strings.HasPrefix(spec, "TZ=") {
+		fields := strings.SplitN(spec, " ", 2)
+		loc, err := time.LoadLocation(strings.TrimPrefix(fields[0], "TZ="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %v", err)
+		}
+		s.location = loc
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid schedule %q, nothing after the timezone", spec)
+		}
+		spec = strings.TrimSpace(fields[1])
+	}
+
+	if i := strings.LastIndex(spec, " for "); i >= 0 {
+		cron, err := ParseCron(spec[:i])
+		if err != nil {
+			return nil, err
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(spec[i+len(" for "):]))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid duration in %q", spec)
+		}
+		s.cron, s.duration = cron, duration
+		return s, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.Split(strings.TrimSpace(part), "/")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid schedule %q, expected \"<cron> for <duration>\" or <start>/<end> windows", spec)
+		}
+		start, err := s.parseTime(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := s.parseTime(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("window %s ends before it starts", part)
+		}
+		s.windows = append(s.windows, Window{Start: start, End: end})
+	}
+	sort.Slice(s.windows, func(i, j int) bool { return s.windows[i].Start.Before(s.windows[j].Start) })
+	return s, nil
+}
+
+func (s *Schedule) parseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range windowLayouts {
+		if t, err := time.ParseInLocation(layout, value, s.location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 2006-01-02T15:04 or RFC3339", value)
+}
+
+// Whether chaos is active at now, until when if it is, and the next activation after that,
+// zero when there is none
+func (s *Schedule) State(now time.Time) (active bool, until, next time.Time) {
+	now = now.In(s.location)
+	if s.cron != nil {
+		// Activations within the last duration are still running
+		start := s.cron.Next(now.Add(-s.duration))
+		for !start.IsZero() && !start.After(now) {
+			active, until = true, start.Add(s.duration)
+			start = s.cron.Next(start)
+		}
+		// Later activations overlapping the running one extend it, e.g. */5 * * * * for 10m,
+		// a schedule that never stops is followed for a day
+		for active && !start.IsZero() && !start.After(until) && until.Before(now.Add(24*time.Hour)) {
+			until = start.Add(s.duration)
+			start = s.cron.Next(start)
+		}
+		return active, until, start
+	}
+
+	// Windows are sorted by start
+	for _, w := range s.windows {
+		switch {
+		case !w.End.After(now):
+			continue
+		case !w.Start.After(now):
+			active, until = true, maxTime(until, w.End)
+		case active && !w.Start.After(until):
+			// Overlapping or touching windows extend the active one
+			until = maxTime(until, w.End)
+		case next.IsZero():
+			next = w.Start
+		}
+	}
+	return active, until, next
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
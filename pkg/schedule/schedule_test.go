@@ -0,0 +1,127 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestCronNext(t *testing.T) {
+	cases := []struct {
+		expr     string
+		after    string
+		expected string
+	}{
+		{"0 10 * * *", "2018-06-01T09:59:30Z", "2018-06-01T10:00:00Z"},
+		{"0 10 * * *", "2018-06-01T10:00:00Z", "2018-06-02T10:00:00Z"},
+		{"*/15 * * * *", "2018-06-01T10:07:00Z", "2018-06-01T10:15:00Z"},
+		{"30 9-17/4 * * *", "2018-06-01T14:00:00Z", "2018-06-01T17:30:00Z"},
+		// 2018-06-01 is a Friday
+		{"0 10 * * mon-fri", "2018-06-01T11:00:00Z", "2018-06-04T10:00:00Z"},
+		{"0 0 * * 7", "2018-06-01T00:00:00Z", "2018-06-03T00:00:00Z"},
+		{"0 0 1 jan,jul *", "2018-06-01T00:00:00Z", "2018-07-01T00:00:00Z"},
+		// Either day of month or day of week when both are restricted
+		{"0 0 13 * fri", "2018-06-02T00:00:00Z", "2018-06-08T00:00:00Z"},
+		{"0 0 29 2 *", "2018-03-01T00:00:00Z", "2020-02-29T00:00:00Z"},
+		{"0 0 30 2 *", "2018-03-01T00:00:00Z", "0001-01-01T00:00:00Z"},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		next := cron.Next(mustTime(t, c.after))
+		if !next.Equal(mustTime(t, c.expected)) {
+			t.Errorf("%s after %s: expected %s, got %s", c.expr, c.after, c.expected, next)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestScheduleState(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skipf("no timezone data: %v", err)
+	}
+	cases := []struct {
+		spec   string
+		now    string
+		active bool
+		until  string
+		next   string
+	}{
+		{"0 10 * * * for 30m", "2018-06-01T10:10:00Z", true, "2018-06-01T10:30:00Z", "2018-06-02T10:00:00Z"},
+		{"0 10 * * * for 30m", "2018-06-01T10:30:00Z", false, "", "2018-06-02T10:00:00Z"},
+		{"*/5 * * * * for 10m", "2018-06-01T10:07:00Z", true, "", ""},
+		// The node's location is UTC, TZ= moves the schedule to Shanghai
+		{"TZ=Asia/Shanghai 0 18 * * * for 1h", "2018-06-01T10:30:00Z", true, "2018-06-01T11:00:00Z", "2018-06-02T10:00:00Z"},
+		{"2018-06-01T10:00/2018-06-01T11:00, 2018-06-01T11:00/2018-06-01T11:30, 2018-06-02T10:00/2018-06-02T11:00",
+			"2018-06-01T10:30:00Z", true, "2018-06-01T11:30:00Z", "2018-06-02T10:00:00Z"},
+		{"2018-06-01T10:00:00+08:00/2018-06-01T11:00:00+08:00", "2018-06-01T01:00:00Z", false, "", "2018-06-01T02:00:00Z"},
+		{"2018-06-01T10:00/2018-06-01T11:00", "2018-06-01T12:00:00Z", false, "", ""},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.spec, time.UTC)
+		if err != nil {
+			t.Errorf("%s: %v", c.spec, err)
+			continue
+		}
+		active, until, next := s.State(mustTime(t, c.now))
+		if active != c.active {
+			t.Errorf("%s at %s: expected active %v", c.spec, c.now, c.active)
+		}
+		if c.until != "" && !until.Equal(mustTime(t, c.until)) {
+			t.Errorf("%s at %s: expected until %s, got %s", c.spec, c.now, c.until, until)
+		}
+		if c.next != "" && !next.Equal(mustTime(t, c.next)) {
+			t.Errorf("%s at %s: expected next %s, got %s", c.spec, c.now, c.next, next)
+		}
+		if c.next == "" && c.until == "" && !c.active && !next.IsZero() {
+			t.Errorf("%s at %s: expected no next activation, got %s", c.spec, c.now, next)
+		}
+	}
+
+	// Times without a zone are in the given location
+	s, err := Parse("2018-06-01 18:00/2018-06-01 19:00", shanghai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, _, _ := s.State(mustTime(t, "2018-06-01T10:30:00Z")); !active {
+		t.Errorf("expected the window to be in Shanghai time")
+	}
+
+	for _, spec := range []string{"0 10 * * * for", "0 10 * * * for -5m", "2018-06-01T11:00/2018-06-01T10:00", "tomorrow", "TZ=Mars/Olympus 0 10 * * * for 1h"} {
+		if _, err := Parse(spec, time.UTC); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stress
+
+import (
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+var (
+	forkOnce sync.Once
+	forks    = make(chan func())
+)
+
+// Start the worker, killed when the daemon dies. The parent death signal is sent when the
+// thread forking the worker exits, and locked threads exit with their goroutines, e.g. the
+// ones entering a container's mount namespace, so workers are forked from a thread locked
+// for good
+func startWorker(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	forkOnce.Do(func() {
+		go func() {
+			runtime.LockOSThread()
+			for fork := range forks {
+				fork()
+			}
+		}()
+	})
+	started := make(chan error)
+	forks <- func() { started <- cmd.Start() }
+	return <-started
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stress
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The main thread is not left when a goroutine exits locked to it, keep the tests off it
+func init() {
+	runtime.LockOSThread()
+}
+
+func TestWorkerOutlivesStartingThread(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	started := make(chan error)
+	// The thread of a goroutine exiting while locked exits too
+	go func() {
+		runtime.LockOSThread()
+		started <- startWorker(cmd)
+	}()
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	var status syscall.WaitStatus
+	if pid, _ := syscall.Wait4(cmd.Process.Pid, &status, syscall.WNOHANG, nil); pid != 0 {
+		t.Errorf("expected the worker running after the thread starting it exited, got %v", status)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package stress runs workers burning CPU and holding memory as processes of their own,
+// moved into a pod's cgroups so the pod's limits apply to them.
+package stress
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/container"
+)
+
+// Subcommand of the daemon running a worker
+const WorkerCommand = "stress-worker"
+
+// Group of workers stressing a pod
+type Group struct {
+	cmds    []*exec.Cmd
+	cgroups []string
+}
+
+// Start cpu workers burning load percent of a CPU each, and a worker holding memory bytes
+// if memory is set, from exe, the daemon's binary, in the cgroups
+func Start(exe string, cgroups []string, cpu int, load float64, memory int64) (*Group, error) {
+	g := &Group{cgroups: cgroups}
+	for _, args := range WorkerArgs(cpu, load, memory) {
+		if err := g.start(exe, args); err != nil {
+			g.Stop()
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Arguments of the workers' subcommand
+func WorkerArgs(cpu int, load float64, memory int64) [][]string {
+	args := [][]string{}
+	for i := 0; i < cpu; i++ {
+		args = append(args, []string{WorkerCommand, "--cpuLoad", strconv.FormatFloat(load, 'f', -1, 64)})
+	}
+	if memory > 0 {
+		args = append(args, []string{WorkerCommand, "--memory", strconv.FormatInt(memory, 10)})
+	}
+	return args
+}
+
+func (g *Group) start(exe string, args []string) error {
+	cmd := exec.Command(exe, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := startWorker(cmd); err != nil {
+		return err
+	}
+	g.cmds = append(g.cmds, cmd)
+	defer stdin.Close()
+	// The worker waits to be in the cgroups before it starts
+	if err := container.AddProcess(g.cgroups, cmd.Process.Pid); err != nil {
+		return fmt.Errorf("failed to move worker %d into the pod's cgroup: %v", cmd.Process.Pid, err)
+	}
+	_, err = stdin.Write([]byte("\n"))
+	return err
+}
+
+// Stop the workers and remove their cgroups
+func (g *Group) Stop() error {
+	for _, cmd := range g.cmds {
+		// Workers killed by the OOM killer have exited already
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	g.cmds = nil
+	return container.RemoveCgroups(g.cgroups)
+}
+
+// Burn load percent of a CPU, forever
+func BurnCPU(load float64) {
+	const period = 100 * time.Millisecond
+	busy := time.Duration(float64(period) * load / 100)
+	for {
+		start := time.Now()
+		for time.Since(start) < busy {
+		}
+		if busy < period {
+			time.Sleep(period - busy)
+		}
+	}
+}
+
+// Allocate size bytes and touch every page so they are resident
+func AllocateMemory(size int64) []byte {
+	data := make([]byte, size)
+	for i := 0; i < len(data); i += os.Getpagesize() {
+		data[i] = 1
+	}
+	return data
+}
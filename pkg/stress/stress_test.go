@@ -0,0 +1,43 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stress
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWorkerArgs(t *testing.T) {
+	expected := [][]string{
+		{WorkerCommand, "--cpuLoad", "80"},
+		{WorkerCommand, "--cpuLoad", "80"},
+		{WorkerCommand, "--memory", "1048576"},
+	}
+	if args := WorkerArgs(2, 80, 1<<20); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+	if args := WorkerArgs(0, 100, 0); len(args) != 0 {
+		t.Errorf("expected no workers, got %v", args)
+	}
+}
+
+func TestAllocateMemory(t *testing.T) {
+	data := AllocateMemory(1 << 20)
+	if len(data) != 1<<20 || data[0] != 1 {
+		t.Errorf("expected 1MiB touched, got %d bytes", len(data))
+	}
+}
@@ -0,0 +1,352 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tcstate reads the qdiscs, classes and filters of a device from "tc -j -s",
+// falling back to the text output of iproute2 versions without JSON support.
+package tcstate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// Qdiscs of the device
+func Qdiscs(e exec.Interface, dev string) ([]Qdisc, error) {
+	data, err := show(e, "qdisc", "dev", dev)
+	if err != nil {
+		return nil, err
+	}
+	return ParseQdiscs(data)
+}
+
+// Classes of the device
+func Classes(e exec.Interface, dev string) ([]Class, error) {
+	data, err := show(e, "class", "dev", dev)
+	if err != nil {
+		return nil, err
+	}
+	return ParseClasses(data)
+}
+
+// Filters of the device attached to parent, the root qdisc if parent is empty
+func Filters(e exec.Interface, dev, parent string) ([]Filter, error) {
+	args := []string{"dev", dev}
+	if parent != "" {
+		args = append(args, "parent", parent)
+	}
+	data, err := show(e, "filter", args...)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := ParseFilters(data)
+	if err != nil {
+		return nil, err
+	}
+	// tc leaves out the parent when it is given on the command line
+	for i := range filters {
+		if filters[i].Parent == "" {
+			filters[i].Parent = parent
+		}
+	}
+	return filters, nil
+}
+
+// Run "tc -j -s <object> show", or "tc -s <object> show" if -j is not supported
+func show(e exec.Interface, object string, args ...string) ([]byte, error) {
+	args = append([]string{"-s", object, "show"}, args...)
+	data, err := e.Command("tc", append([]string{"-j"}, args...)...).CombinedOutput()
+	if err == nil {
+		return data, nil
+	}
+	glog.V(4).Infof("tc -j %s show failed, retrying without -j: %v\n%s", object, err, data)
+	data, err = e.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("fail to show %s: %v\n%s", object, err, data)
+	}
+	return data, nil
+}
+
+// Whether the output is JSON, some objects are printed as text even with -j
+func isJSON(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("["))
+}
+
+// Parse the output of "tc -j -s qdisc show" or "tc -s qdisc show"
+func ParseQdiscs(data []byte) ([]Qdisc, error) {
+	if !isJSON(data) {
+		return parseQdiscsText(data)
+	}
+	var raw []struct {
+		Kind    string          `json:"kind"`
+		Handle  string          `json:"handle"`
+		Parent  string          `json:"parent"`
+		Root    bool            `json:"root"`
+		Options json.RawMessage `json:"options"`
+		Stats
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unexpected output from tc: %v", err)
+	}
+	qdiscs := []Qdisc{}
+	for _, r := range raw {
+		q := Qdisc{Kind: r.Kind, Handle: r.Handle, Parent: r.Parent, Root: r.Root, Stats: r.Stats}
+		if len(r.Options) > 0 {
+			if err := decodeQdiscOptions(&q, r.Options); err != nil {
+				return nil, fmt.Errorf("unexpected %s options from tc: %v", q.Kind, err)
+			}
+		}
+		qdiscs = append(qdiscs, q)
+	}
+	return qdiscs, nil
+}
+
+func decodeQdiscOptions(q *Qdisc, options json.RawMessage) error {
+	switch q.Kind {
+	case "htb":
+		var o struct {
+			R2q               uint64 `json:"r2q"`
+			Default           string `json:"default"`
+			DirectPacketsStat uint64 `json:"direct_packets_stat"`
+		}
+		if err := json.Unmarshal(options, &o); err != nil {
+			return err
+		}
+		q.Htb = &HtbQdisc{R2q: o.R2q, Default: o.Default, DirectPacketsStat: o.DirectPacketsStat}
+	case "netem":
+		// Percentages are printed as fractions and times in seconds
+		var o struct {
+			Limit uint64 `json:"limit"`
+			Delay *struct {
+				Delay       float64 `json:"delay"`
+				Jitter      float64 `json:"jitter"`
+				Correlation float64 `json:"correlation"`
+			} `json:"delay"`
+			Loss *struct {
+				Loss        float64 `json:"loss"`
+				Correlation float64 `json:"correlation"`
+			} `json:"loss-random"`
+			Duplicate *struct {
+				Duplicate   float64 `json:"duplicate"`
+				Correlation float64 `json:"correlation"`
+			} `json:"duplicate"`
+			Reorder *struct {
+				Reorder     float64 `json:"reorder"`
+				Correlation float64 `json:"correlation"`
+			} `json:"reorder"`
+			Corrupt *struct {
+				Corrupt     float64 `json:"corrupt"`
+				Correlation float64 `json:"correlation"`
+			} `json:"corrupt"`
+			Rate *struct {
+				Rate uint64 `json:"rate"`
+			} `json:"rate"`
+			Gap uint64 `json:"gap"`
+		}
+		if err := json.Unmarshal(options, &o); err != nil {
+			return err
+		}
+		n := &Netem{Gap: o.Gap}
+		if o.Delay != nil {
+			n.Delay = seconds(o.Delay.Delay)
+			n.Jitter = seconds(o.Delay.Jitter)
+			n.DelayCorrelation = percent(o.Delay.Correlation)
+		}
+		if o.Loss != nil {
+			n.Loss, n.LossCorrelation = percent(o.Loss.Loss), percent(o.Loss.Correlation)
+		}
+		if o.Duplicate != nil {
+			n.Duplicate, n.DuplicateCorrelation = percent(o.Duplicate.Duplicate), percent(o.Duplicate.Correlation)
+		}
+		if o.Reorder != nil {
+			n.Reorder, n.ReorderCorrelation = percent(o.Reorder.Reorder), percent(o.Reorder.Correlation)
+		}
+		if o.Corrupt != nil {
+			n.Corrupt, n.CorruptCorrelation = percent(o.Corrupt.Corrupt), percent(o.Corrupt.Correlation)
+		}
+		if o.Rate != nil {
+			n.Rate = o.Rate.Rate * 8
+		}
+		q.Netem = n
+		q.Limit = o.Limit
+	case "tbf":
+		// Rate is printed in bytes/s and latency in microseconds
+		var o struct {
+			Rate  uint64 `json:"rate"`
+			Burst uint64 `json:"burst"`
+			Lat   uint64 `json:"lat"`
+		}
+		if err := json.Unmarshal(options, &o); err != nil {
+			return err
+		}
+		q.Tbf = &Tbf{Rate: o.Rate * 8, Burst: o.Burst, Latency: time.Duration(o.Lat) * time.Microsecond}
+	case "pfifo", "bfifo", "pfifo_head_drop":
+		var o struct {
+			Limit uint64 `json:"limit"`
+		}
+		if err := json.Unmarshal(options, &o); err != nil {
+			return err
+		}
+		q.Limit = o.Limit
+	}
+	return nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Round(s * float64(time.Second)))
+}
+
+// Convert a fraction to a percentage, rounding off the float error
+func percent(f float64) float64 {
+	return math.Round(f*1e8) / 1e6
+}
+
+// Parse the output of "tc -j -s class show" or "tc -s class show"
+func ParseClasses(data []byte) ([]Class, error) {
+	if !isJSON(data) {
+		return parseClassesText(data)
+	}
+	// Rates are printed in bytes/s
+	var raw []struct {
+		Kind    string `json:"class"`
+		Handle  string `json:"handle"`
+		Parent  string `json:"parent"`
+		Root    bool   `json:"root"`
+		Leaf    string `json:"leaf"`
+		Prio    uint64 `json:"prio"`
+		Rate    uint64 `json:"rate"`
+		Ceil    uint64 `json:"ceil"`
+		Burst   uint64 `json:"burst"`
+		Cburst  uint64 `json:"cburst"`
+		Quantum uint64 `json:"quantum"`
+		Stats
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unexpected output from tc: %v", err)
+	}
+	classes := []Class{}
+	for _, r := range raw {
+		c := Class{Kind: r.Kind, Handle: r.Handle, Parent: r.Parent, Root: r.Root, Leaf: r.Leaf, Stats: r.Stats}
+		if c.Kind == "htb" {
+			c.Htb = &HtbClass{Prio: r.Prio, Rate: r.Rate * 8, Ceil: r.Ceil * 8, Burst: r.Burst, Cburst: r.Cburst, Quantum: r.Quantum}
+		}
+		classes = append(classes, c)
+	}
+	return classes, nil
+}
+
+// Parse the output of "tc -j -s filter show" or "tc -s filter show"
+func ParseFilters(data []byte) ([]Filter, error) {
+	if !isJSON(data) {
+		return parseFiltersText(data)
+	}
+	var raw []struct {
+		Parent   string          `json:"parent"`
+		Protocol string          `json:"protocol"`
+		Pref     uint64          `json:"pref"`
+		Kind     string          `json:"kind"`
+		Chain    uint64          `json:"chain"`
+		Options  json.RawMessage `json:"options"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unexpected output from tc: %v", err)
+	}
+	filters := []Filter{}
+	for _, r := range raw {
+		f := Filter{Parent: r.Parent, Protocol: r.Protocol, Pref: r.Pref, Kind: r.Kind, Chain: r.Chain}
+		if len(r.Options) > 0 {
+			if err := decodeFilterOptions(&f, r.Options); err != nil {
+				return nil, fmt.Errorf("unexpected %s options from tc: %v", f.Kind, err)
+			}
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// Decode the filter options key by key, as u32 filters repeat "match" for every key
+func decodeFilterOptions(f *Filter, options json.RawMessage) error {
+	dec := json.NewDecoder(bytes.NewReader(options))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var decodeErr error
+		switch token {
+		case "fh":
+			decodeErr = dec.Decode(&f.Handle)
+		case "flowid":
+			decodeErr = dec.Decode(&f.FlowID)
+		case "match":
+			var m struct {
+				Value string `json:"value"`
+				Mask  string `json:"mask"`
+				Off   int    `json:"off"`
+			}
+			if decodeErr = dec.Decode(&m); decodeErr != nil {
+				break
+			}
+			key, err := u32Key(m.Value, m.Mask, m.Off)
+			if err != nil {
+				return err
+			}
+			f.Keys = append(f.Keys, key)
+		case "actions":
+			var actions []struct {
+				Kind      string `json:"kind"`
+				Mirred    string `json:"mirred_action"`
+				Direction string `json:"direction"`
+				Dev       string `json:"to_dev"`
+			}
+			if decodeErr = dec.Decode(&actions); decodeErr != nil {
+				break
+			}
+			for _, a := range actions {
+				f.Actions = append(f.Actions, Action{Kind: a.Kind, Direction: a.Direction, Mirred: a.Mirred, Dev: a.Dev})
+			}
+		default:
+			var skip json.RawMessage
+			decodeErr = dec.Decode(&skip)
+		}
+		if decodeErr != nil {
+			return decodeErr
+		}
+	}
+	return nil
+}
+
+// Build a u32 key from hexadecimal value and mask, JSON leaves out leading zeros
+func u32Key(value, mask string, off int) (U32Key, error) {
+	v, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return U32Key{}, fmt.Errorf("invalid u32 value %q", value)
+	}
+	m, err := strconv.ParseUint(mask, 16, 32)
+	if err != nil {
+		return U32Key{}, fmt.Errorf("invalid u32 mask %q", mask)
+	}
+	return U32Key{Value: uint32(v), Mask: uint32(m), Off: off}, nil
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcstate
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// Fixtures were captured with iproute2-6.1 unless named legacy_* (iproute2 without chains)
+// or hand written in the same layout (netem_*, htb_class.json)
+func fixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func withoutStats(qdiscs []Qdisc) []Qdisc {
+	result := []Qdisc{}
+	for _, q := range qdiscs {
+		q.Stats = Stats{}
+		result = append(result, q)
+	}
+	return result
+}
+
+func TestParseQdiscs(t *testing.T) {
+	cases := []struct {
+		name     string
+		fixtures []string
+		expected []Qdisc
+	}{
+		{
+			name:     "veth",
+			fixtures: []string{"veth_qdisc.json", "veth_qdisc.txt"},
+			expected: []Qdisc{
+				{Kind: "htb", Handle: "1:", Root: true, Htb: &HtbQdisc{R2q: 10, Default: "0x1"}},
+				{Kind: "pfifo", Handle: "2:", Parent: "1:1", Limit: 1600},
+				{Kind: "ingress", Handle: "ffff:", Parent: "ffff:fff1"},
+			},
+		},
+		{
+			name:     "ifb",
+			fixtures: []string{"ifb_qdisc.json", "ifb_qdisc.txt"},
+			expected: []Qdisc{
+				{Kind: "htb", Handle: "1:", Root: true, Htb: &HtbQdisc{R2q: 10, Default: "0"}},
+				{Kind: "tbf", Handle: "30:", Parent: "1:12", Tbf: &Tbf{Rate: 1000000, Burst: 4096, Latency: 400 * time.Millisecond}},
+			},
+		},
+		{
+			name:     "netem",
+			fixtures: []string{"netem_qdisc.json", "netem_qdisc.txt"},
+			expected: []Qdisc{
+				{Kind: "htb", Handle: "1:", Root: true, Htb: &HtbQdisc{R2q: 10, Default: "0"}},
+				{Kind: "netem", Handle: "8001:", Parent: "1:2", Limit: 1000, Netem: &Netem{
+					Delay: 100 * time.Millisecond, Jitter: 10 * time.Millisecond, DelayCorrelation: 25,
+					Loss: 1, LossCorrelation: 30, Duplicate: 2, Corrupt: 0.5,
+				}},
+			},
+		},
+	}
+	for _, c := range cases {
+		for _, name := range c.fixtures {
+			qdiscs, err := ParseQdiscs(fixture(t, name))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			// Stats of the captures differ, they are checked separately
+			qdiscs = withoutStats(qdiscs)
+			for i := range qdiscs {
+				if qdiscs[i].Htb != nil {
+					qdiscs[i].Htb.DirectPacketsStat = 0
+				}
+			}
+			if !reflect.DeepEqual(qdiscs, c.expected) {
+				t.Errorf("%s: expected %+v, got %+v", name, c.expected, qdiscs)
+			}
+		}
+	}
+}
+
+func TestParseQdiscStats(t *testing.T) {
+	expected := Stats{Bytes: 1200, Packets: 12, Drops: 3, Requeues: 1, Backlog: 180, Qlen: 2}
+	for _, name := range []string{"netem_qdisc.json", "netem_qdisc.txt"} {
+		qdiscs, err := ParseQdiscs(fixture(t, name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if qdiscs[1].Stats != expected {
+			t.Errorf("%s: expected %+v, got %+v", name, expected, qdiscs[1].Stats)
+		}
+		if qdiscs[0].Htb.DirectPacketsStat != 3 {
+			t.Errorf("%s: expected 3 direct packets, got %d", name, qdiscs[0].Htb.DirectPacketsStat)
+		}
+	}
+}
+
+func TestParseClasses(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected []Class
+	}{
+		{
+			// iproute2-6.1 prints htb classes as text even with -j
+			name: "ifb_class.txt",
+			expected: []Class{
+				{Kind: "htb", Handle: "1:1", Root: true, Htb: &HtbClass{Rate: 32000000000, Ceil: 32000000000}},
+				{Kind: "htb", Handle: "1:12", Root: true, Leaf: "30:", Htb: &HtbClass{Rate: 1000000, Ceil: 2000000, Burst: 15360, Cburst: 3072}},
+				{Kind: "tbf", Handle: "30:1", Parent: "30:"},
+			},
+		},
+		{
+			name: "legacy_class.txt",
+			expected: []Class{
+				{Kind: "htb", Handle: "1:3", Root: true, Leaf: "8001:", Htb: &HtbClass{Rate: 800000, Ceil: 800000, Burst: 1600, Cburst: 1600}},
+				{Kind: "htb", Handle: "1:4", Root: true, Leaf: "8002:", Htb: &HtbClass{Rate: 4000000000, Ceil: 4000000000}},
+				{Kind: "netem", Handle: "8001:1", Parent: "8001:", Leaf: "10:"},
+			},
+		},
+		{
+			name: "htb_class.json",
+			expected: []Class{
+				{Kind: "htb", Handle: "1:1", Root: true, Htb: &HtbClass{Rate: 32000000000, Ceil: 32000000000, Burst: 1600, Cburst: 1600}},
+				{Kind: "htb", Handle: "1:12", Root: true, Leaf: "30:", Htb: &HtbClass{Rate: 1000000, Ceil: 2000000, Burst: 15360, Cburst: 3072},
+					Stats: Stats{Bytes: 980, Packets: 7, Drops: 1, Overlimits: 2}},
+			},
+		},
+	}
+	for _, c := range cases {
+		classes, err := ParseClasses(fixture(t, c.name))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(classes, c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.expected, classes)
+		}
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	mirred := []Action{{Kind: "mirred", Direction: "egress", Mirred: "redirect", Dev: "ifb77"}}
+	cases := []struct {
+		name     string
+		fixtures []string
+		expected []Filter
+	}{
+		{
+			name:     "veth",
+			fixtures: []string{"veth_filter.json", "veth_filter.txt"},
+			expected: []Filter{
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32"},
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32", Handle: "800:"},
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32", Handle: "800::800", FlowID: "1:1",
+					Keys: []U32Key{{}}, Actions: mirred},
+			},
+		},
+		{
+			name:     "ifb",
+			fixtures: []string{"ifb_filter.json", "ifb_filter.txt"},
+			expected: []Filter{
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32"},
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32", Handle: "800:"},
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32", Handle: "800::1", FlowID: "1:1",
+					Keys: []U32Key{{Value: 0x0a090002, Mask: 0xffffffff, Off: DstOffset}}},
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32", Handle: "800::c", FlowID: "1:12",
+					Keys: []U32Key{{Value: 0x0a09000c, Mask: 0xffffffff, Off: DstOffset}}},
+			},
+		},
+		{
+			name:     "legacy",
+			fixtures: []string{"legacy_filter.txt"},
+			expected: []Filter{
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32"},
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32", Handle: "800:"},
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32", Handle: "800::800", FlowID: "1:3",
+					Keys: []U32Key{{Value: 0x0a090002, Mask: 0xffffffff, Off: SrcOffset}}},
+				{Parent: "1:", Protocol: "ip", Pref: 1, Kind: "u32", Handle: "800::801", FlowID: "1:4",
+					Keys: []U32Key{{Value: 0x0a090003, Mask: 0xffffffff, Off: SrcOffset}}},
+			},
+		},
+	}
+	for _, c := range cases {
+		for _, name := range c.fixtures {
+			filters, err := ParseFilters(fixture(t, name))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if !reflect.DeepEqual(filters, c.expected) {
+				t.Errorf("%s: expected %+v, got %+v", name, c.expected, filters)
+			}
+		}
+	}
+}
+
+func TestFilterCIDRs(t *testing.T) {
+	filters, err := ParseFilters(fixture(t, "ifb_filter.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidrs := []string{}
+	for _, f := range filters {
+		cidrs = append(cidrs, f.CIDRs()...)
+	}
+	expected := []string{"10.9.0.2/32", "10.9.0.12/32"}
+	if !reflect.DeepEqual(cidrs, expected) {
+		t.Errorf("expected %v, got %v", expected, cidrs)
+	}
+
+	// The match-all key of the mirroring filter is not a CIDR
+	if cidr, ok := (U32Key{}).CIDR(); ok {
+		t.Errorf("expected no CIDR for the match-all key, got %s", cidr)
+	}
+}
+
+func TestFiltersFallbackToText(t *testing.T) {
+	text := fixture(t, "veth_filter.txt")
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			// Old iproute2 does not know -j
+			func() ([]byte, error) {
+				return []byte("Option \"-j\" is unknown, try \"tc -help\".\n"), &exec.FakeExitError{Status: 255}
+			},
+			func() ([]byte, error) { return text, nil },
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+
+	filters, err := Filters(&fexec, "veth0", "ffff:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCalls := [][]string{
+		{"tc", "-j", "-s", "filter", "show", "dev", "veth0", "parent", "ffff:"},
+		{"tc", "-s", "filter", "show", "dev", "veth0", "parent", "ffff:"},
+	}
+	if !reflect.DeepEqual(fcmd.CombinedOutputLog, expectedCalls) {
+		t.Errorf("expected calls %v, got %v", expectedCalls, fcmd.CombinedOutputLog)
+	}
+	if len(filters) != 3 || filters[2].FlowID != "1:1" || len(filters[2].Actions) != 1 {
+		t.Errorf("unexpected filters %+v", filters)
+	}
+}
@@ -0,0 +1,421 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcstate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fallback for iproute2 without -j, and for objects tc prints as text anyway
+
+func parseQdiscsText(data []byte) ([]Qdisc, error) {
+	qdiscs := []Qdisc{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+		if parts[0] != "qdisc" {
+			if len(qdiscs) > 0 {
+				parseStats(parts, &qdiscs[len(qdiscs)-1].Stats)
+			}
+			continue
+		}
+		// Expected:
+		// qdisc htb 1: root refcnt 2 r2q 10 default 0 direct_packets_stat 0
+		// qdisc netem 8001: parent 1:2 limit 1000 delay 100ms  10ms loss 1%
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("unexpected output from tc: %s", scanner.Text())
+		}
+		q := Qdisc{Kind: parts[1], Handle: parts[2]}
+		options := parts[3:]
+		if options[0] == "root" {
+			q.Root = true
+			options = options[1:]
+		} else if options[0] == "parent" && len(options) > 1 {
+			q.Parent = options[1]
+			options = options[2:]
+		}
+		if err := parseQdiscOptions(&q, options); err != nil {
+			return nil, fmt.Errorf("unexpected output from tc: %s (%v)", scanner.Text(), err)
+		}
+		qdiscs = append(qdiscs, q)
+	}
+	return qdiscs, nil
+}
+
+func parseQdiscOptions(q *Qdisc, options []string) error {
+	var err error
+	switch q.Kind {
+	case "htb":
+		q.Htb = &HtbQdisc{Default: fieldAfter(options, "default")}
+		if q.Htb.R2q, err = parseUint(fieldAfter(options, "r2q")); err != nil {
+			return err
+		}
+		q.Htb.DirectPacketsStat, err = parseUint(fieldAfter(options, "direct_packets_stat"))
+	case "netem":
+		q.Netem, err = parseNetem(options)
+		if err == nil {
+			q.Limit, err = parseUint(fieldAfter(options, "limit"))
+		}
+	case "tbf":
+		q.Tbf = &Tbf{}
+		if q.Tbf.Rate, err = ParseRate(fieldAfter(options, "rate")); err != nil {
+			return err
+		}
+		if q.Tbf.Burst, err = ParseSize(fieldAfter(options, "burst")); err != nil {
+			return err
+		}
+		q.Tbf.Latency, err = ParseTime(fieldAfter(options, "lat"))
+	case "pfifo", "bfifo", "pfifo_head_drop":
+		q.Limit, err = ParseSize(strings.TrimSuffix(fieldAfter(options, "limit"), "p"))
+	}
+	return err
+}
+
+// Parse netem options, e.g.
+// limit 1000 delay 100ms  10ms 25% loss 1% 30% duplicate 2% corrupt 0.5%
+func parseNetem(options []string) (*Netem, error) {
+	n := &Netem{}
+	// Values following the option, up to the next option
+	values := func(i int) []string {
+		end := i + 1
+		for end < len(options) && isNumeric(options[end]) {
+			end++
+		}
+		return options[i+1 : end]
+	}
+	for i := 0; i < len(options); i++ {
+		var err error
+		v := values(i)
+		switch options[i] {
+		case "delay":
+			if len(v) > 0 {
+				n.Delay, err = ParseTime(v[0])
+			}
+			if err == nil && len(v) > 1 {
+				n.Jitter, err = ParseTime(v[1])
+			}
+			if err == nil && len(v) > 2 {
+				n.DelayCorrelation, err = ParsePercent(v[2])
+			}
+		case "loss":
+			err = parsePercents(v, &n.Loss, &n.LossCorrelation)
+		case "duplicate":
+			err = parsePercents(v, &n.Duplicate, &n.DuplicateCorrelation)
+		case "reorder":
+			err = parsePercents(v, &n.Reorder, &n.ReorderCorrelation)
+		case "corrupt":
+			err = parsePercents(v, &n.Corrupt, &n.CorruptCorrelation)
+		case "gap":
+			if len(v) > 0 {
+				n.Gap, err = parseUint(v[0])
+			}
+		case "rate":
+			if len(v) > 0 {
+				n.Rate, err = ParseRate(v[0])
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		i += len(v)
+	}
+	return n, nil
+}
+
+func parseClassesText(data []byte) ([]Class, error) {
+	classes := []Class{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+		if parts[0] != "class" {
+			if len(classes) > 0 {
+				parseStats(parts, &classes[len(classes)-1].Stats)
+			}
+			continue
+		}
+		// Expected:
+		// class htb 1:1 root leaf 8001: prio 0 rate 800000bit ceil 800000bit burst 1600b cburst 1600b
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("unexpected output from tc: %s", scanner.Text())
+		}
+		c := Class{Kind: parts[1], Handle: parts[2]}
+		options := parts[3:]
+		if options[0] == "root" {
+			c.Root = true
+		} else {
+			c.Parent = fieldAfter(options, "parent")
+		}
+		c.Leaf = fieldAfter(options, "leaf")
+		if c.Kind == "htb" {
+			htb, err := parseHtbClass(options)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected output from tc: %s (%v)", scanner.Text(), err)
+			}
+			c.Htb = htb
+		}
+		classes = append(classes, c)
+	}
+	return classes, nil
+}
+
+func parseHtbClass(options []string) (*HtbClass, error) {
+	var err error
+	htb := &HtbClass{}
+	if htb.Prio, err = parseUint(fieldAfter(options, "prio")); err != nil {
+		return nil, err
+	}
+	if htb.Quantum, err = parseUint(fieldAfter(options, "quantum")); err != nil {
+		return nil, err
+	}
+	if htb.Rate, err = ParseRate(fieldAfter(options, "rate")); err != nil {
+		return nil, err
+	}
+	if htb.Ceil, err = ParseRate(fieldAfter(options, "ceil")); err != nil {
+		return nil, err
+	}
+	if htb.Burst, err = ParseSize(fieldAfter(options, "burst")); err != nil {
+		return nil, err
+	}
+	if htb.Cburst, err = ParseSize(fieldAfter(options, "cburst")); err != nil {
+		return nil, err
+	}
+	return htb, nil
+}
+
+func parseFiltersText(data []byte) ([]Filter, error) {
+	filters := []Filter{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+		switch parts[0] {
+		case "filter":
+			// Expected, older iproute2 has no "chain" and no "*" before flowid:
+			// filter parent 1: protocol ip pref 1 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 *flowid 1:1 not_in_hw
+			f := Filter{
+				Parent:   fieldAfter(parts, "parent"),
+				Protocol: fieldAfter(parts, "protocol"),
+				Handle:   fieldAfter(parts, "fh"),
+				FlowID:   fieldAfter(parts, "flowid", "*flowid", "classid"),
+			}
+			// The kind follows the preference
+			for i := 0; i < len(parts)-2; i++ {
+				if parts[i] == "pref" {
+					f.Kind = parts[i+2]
+					break
+				}
+			}
+			var err error
+			if f.Pref, err = parseUint(fieldAfter(parts, "pref")); err != nil {
+				return nil, fmt.Errorf("unexpected output from tc: %s", scanner.Text())
+			}
+			if f.Chain, err = parseUint(fieldAfter(parts, "chain")); err != nil {
+				return nil, fmt.Errorf("unexpected output from tc: %s", scanner.Text())
+			}
+			filters = append(filters, f)
+		case "match":
+			// Expected:
+			// match 0a090002/ffffffff at 16
+			if len(filters) == 0 || len(parts) != 4 {
+				continue
+			}
+			valueMask := strings.Split(parts[1], "/")
+			if len(valueMask) != 2 {
+				return nil, fmt.Errorf("unexpected output from tc: %s", scanner.Text())
+			}
+			off, err := strconv.Atoi(parts[3])
+			if err != nil {
+				return nil, fmt.Errorf("unexpected output from tc: %s", scanner.Text())
+			}
+			key, err := u32Key(valueMask[0], valueMask[1], off)
+			if err != nil {
+				return nil, err
+			}
+			f := &filters[len(filters)-1]
+			f.Keys = append(f.Keys, key)
+		case "action":
+			// Expected:
+			// action order 1: mirred (Egress Redirect to device ifb0) stolen
+			if len(filters) == 0 || len(parts) < 4 {
+				continue
+			}
+			a := Action{Kind: parts[3]}
+			if a.Kind == "mirred" && len(parts) >= 9 {
+				a.Direction = strings.ToLower(strings.TrimPrefix(parts[4], "("))
+				a.Mirred = strings.ToLower(parts[5])
+				a.Dev = strings.TrimSuffix(parts[8], ")")
+			}
+			f := &filters[len(filters)-1]
+			f.Actions = append(f.Actions, a)
+		}
+	}
+	return filters, nil
+}
+
+// Parse statistics lines, e.g.
+// Sent 656 bytes 8 pkt (dropped 0, overlimits 8 requeues 0)
+// backlog 0b 0p requeues 0
+func parseStats(parts []string, stats *Stats) {
+	for i := range parts {
+		parts[i] = strings.Trim(parts[i], "(),")
+	}
+	switch parts[0] {
+	case "Sent":
+		if len(parts) >= 5 {
+			stats.Bytes, _ = parseUint(parts[1])
+			stats.Packets, _ = parseUint(parts[3])
+		}
+		stats.Drops, _ = parseUint(fieldAfter(parts, "dropped"))
+		stats.Overlimits, _ = parseUint(fieldAfter(parts, "overlimits"))
+		stats.Requeues, _ = parseUint(fieldAfter(parts, "requeues"))
+	case "backlog":
+		if len(parts) >= 3 {
+			stats.Backlog, _ = ParseSize(parts[1])
+			stats.Qlen, _ = parseUint(strings.TrimSuffix(parts[2], "p"))
+		}
+	}
+}
+
+// The field after the first of the keys found
+func fieldAfter(parts []string, keys ...string) string {
+	for i := 0; i < len(parts)-1; i++ {
+		for _, key := range keys {
+			if parts[i] == key {
+				return parts[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+func isNumeric(s string) bool {
+	return len(s) > 0 && (s[0] >= '0' && s[0] <= '9' || s[0] == '.')
+}
+
+// Parse a number, empty for 0
+func parseUint(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasPrefix(s, "0x") {
+		return strconv.ParseUint(s[2:], 16, 64)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// Units in order of matching, longest suffix first
+var (
+	rateUnits = []struct {
+		suffix string
+		factor float64
+	}{
+		{"tibit", 1 << 40}, {"gibit", 1 << 30}, {"mibit", 1 << 20}, {"kibit", 1 << 10},
+		{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3},
+		{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3},
+		{"bit", 1}, {"bps", 8},
+	}
+	sizeUnits = []struct {
+		suffix string
+		factor float64
+	}{
+		{"gbit", 1 << 27}, {"mbit", 1 << 17}, {"kbit", 1 << 7},
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}, {"b", 1},
+	}
+)
+
+// Parse a rate printed or accepted by tc, e.g. 800000bit, 32Gbit or 100kbps, into bit/s
+func ParseRate(s string) (uint64, error) {
+	lower := strings.ToLower(s)
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(lower, unit.suffix) {
+			return scale(strings.TrimSuffix(lower, unit.suffix), unit.factor)
+		}
+	}
+	return scale(lower, 1)
+}
+
+// Parse a size printed or accepted by tc, e.g. 1600b, 15Kb or 15k, into bytes
+func ParseSize(s string) (uint64, error) {
+	lower := strings.ToLower(s)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(lower, unit.suffix) {
+			return scale(strings.TrimSuffix(lower, unit.suffix), unit.factor)
+		}
+	}
+	return scale(lower, 1)
+}
+
+func scale(number string, factor float64) (uint64, error) {
+	if number == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(f * factor), nil
+}
+
+// Parse a time printed or accepted by tc, e.g. 100ms, 100.0ms or 100msec
+func ParseTime(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for _, unit := range []struct{ tc, golang string }{{"usecs", "us"}, {"usec", "us"}, {"msecs", "ms"}, {"msec", "ms"}, {"secs", "s"}, {"sec", "s"}} {
+		if strings.HasSuffix(s, unit.tc) {
+			s = strings.TrimSuffix(s, unit.tc) + unit.golang
+			break
+		}
+	}
+	// A bare number is in microseconds
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		s += "us"
+	}
+	return time.ParseDuration(s)
+}
+
+// Parse a percentage, e.g. 0.5%
+func ParsePercent(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+}
+
+func parsePercents(values []string, percent, correlation *float64) error {
+	var err error
+	if len(values) > 0 {
+		*percent, err = ParsePercent(values[0])
+	}
+	if err == nil && len(values) > 1 {
+		*correlation, err = ParsePercent(values[1])
+	}
+	return err
+}
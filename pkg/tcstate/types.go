@@ -0,0 +1,175 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcstate
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Statistics of a qdisc or class, as printed by "tc -s"
+type Stats struct {
+	Bytes      uint64 `json:"bytes"`
+	Packets    uint64 `json:"packets"`
+	Drops      uint64 `json:"drops"`
+	Overlimits uint64 `json:"overlimits"`
+	Requeues   uint64 `json:"requeues"`
+	// Bytes queued
+	Backlog uint64 `json:"backlog"`
+	// Packets queued
+	Qlen uint64 `json:"qlen"`
+}
+
+// A queue discipline, e.g.
+// qdisc htb 1: root refcnt 2 r2q 10 default 0 direct_packets_stat 0
+type Qdisc struct {
+	Kind   string
+	Handle string
+	// Empty for the root qdisc
+	Parent string
+	Root   bool
+	// Options of the kinds kube-chaos uses, nil for the other kinds
+	Htb   *HtbQdisc
+	Netem *Netem
+	Tbf   *Tbf
+	// Queue size of fifo and netem qdiscs
+	Limit uint64
+	Stats Stats
+}
+
+type HtbQdisc struct {
+	R2q uint64
+	// Class of unclassified traffic, e.g. "0x1"
+	Default           string
+	DirectPacketsStat uint64
+}
+
+// Netem settings, percentages are from 0 to 100
+type Netem struct {
+	Delay                time.Duration
+	Jitter               time.Duration
+	DelayCorrelation     float64
+	Loss                 float64
+	LossCorrelation      float64
+	Duplicate            float64
+	DuplicateCorrelation float64
+	Reorder              float64
+	ReorderCorrelation   float64
+	Corrupt              float64
+	CorruptCorrelation   float64
+	Gap                  uint64
+	// bit/s
+	Rate uint64
+}
+
+type Tbf struct {
+	// bit/s
+	Rate uint64
+	// bytes
+	Burst   uint64
+	Latency time.Duration
+}
+
+// A class, e.g.
+// class htb 1:1 root leaf 8001: prio 0 rate 800000bit ceil 800000bit burst 1600b cburst 1600b
+type Class struct {
+	Kind   string
+	Handle string
+	// Empty for the classes at the root
+	Parent string
+	Root   bool
+	// Handle of the qdisc attached to the class
+	Leaf  string
+	Htb   *HtbClass
+	Stats Stats
+}
+
+type HtbClass struct {
+	Prio uint64
+	// bit/s
+	Rate uint64
+	Ceil uint64
+	// bytes
+	Burst   uint64
+	Cburst  uint64
+	Quantum uint64
+}
+
+// A filter and its u32 keys, e.g.
+// filter parent 1: protocol ip pref 1 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 *flowid 1:1 not_in_hw
+// match 0a090002/ffffffff at 16
+type Filter struct {
+	Parent   string
+	Protocol string
+	Pref     uint64
+	Kind     string
+	Chain    uint64
+	// "fh" of u32 filters, e.g. 800::800
+	Handle string
+	// Target class
+	FlowID  string
+	Keys    []U32Key
+	Actions []Action
+}
+
+// A u32 match, comparing the 32 bits at Off of the packet with Value under Mask
+type U32Key struct {
+	Value uint32
+	Mask  uint32
+	Off   int
+}
+
+// A filter action, e.g. mirred (Egress Redirect to device ifb0) stolen
+type Action struct {
+	Kind string
+	// "egress" or "ingress" for mirred
+	Direction string
+	// "redirect" or "mirror" for mirred
+	Mirred string
+	Dev    string
+}
+
+// Offsets of the IPv4 source and destination addresses, as matched by "match ip src/dst"
+const (
+	SrcOffset = 12
+	DstOffset = 16
+)
+
+// CIDR matched by the key, false if the key does not match an IPv4 address
+func (k U32Key) CIDR() (string, bool) {
+	if k.Off != SrcOffset && k.Off != DstOffset {
+		return "", false
+	}
+	ones, bits := net.IPMask([]byte{byte(k.Mask >> 24), byte(k.Mask >> 16), byte(k.Mask >> 8), byte(k.Mask)}).Size()
+	if bits == 0 {
+		return "", false
+	}
+	ip := net.IPv4(byte(k.Value>>24), byte(k.Value>>16), byte(k.Value>>8), byte(k.Value))
+	return fmt.Sprintf("%s/%d", ip, ones), true
+}
+
+// CIDRs matched by the filter
+func (f Filter) CIDRs() []string {
+	cidrs := []string{}
+	for _, key := range f.Keys {
+		if cidr, ok := key.CIDR(); ok {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook validates the chaos annotations of pods when they are created or updated,
+// with the same parser and guards as the daemon.
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AdmissionReview of admission.k8s.io/v1beta1, the vendored API has no admission package
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID       string                   `json:"uid"`
+	Kind      meta_v1.GroupVersionKind `json:"kind"`
+	Namespace string                   `json:"namespace,omitempty"`
+	Operation string                   `json:"operation"`
+	Object    json.RawMessage          `json:"object,omitempty"`
+	OldObject json.RawMessage          `json:"oldObject,omitempty"`
+}
+
+type AdmissionResponse struct {
+	UID     string          `json:"uid"`
+	Allowed bool            `json:"allowed"`
+	Result  *meta_v1.Status `json:"status,omitempty"`
+}
+
+// Validator checks the chaos annotations of pods against the profiles and guards,
+// which are updated as the ConfigMaps change
+type Validator struct {
+	mu       sync.RWMutex
+	profiles flow.Profiles
+	guards   *flow.Guards
+	// Pods of a namespace, to check the owner limits
+	listPods func(namespace string) ([]v1.Pod, error)
+}
+
+func NewValidator(listPods func(namespace string) ([]v1.Pod, error)) *Validator {
+	return &Validator{
+		profiles: flow.BuiltinProfiles(),
+		guards:   flow.DefaultGuards(),
+		listPods: listPods,
+	}
+}
+
+// Replace the profiles and guards
+func (v *Validator) Update(profiles flow.Profiles, guards *flow.Guards) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.profiles = profiles
+	v.guards = guards
+}
+
+func (v *Validator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response := &AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	if err := v.Review(review.Request); err != nil {
+		glog.V(2).Infof("Denied %s of %s in %s: %v", review.Request.Operation, review.Request.Kind.Kind, review.Request.Namespace, err)
+		response.Allowed = false
+		response.Result = &meta_v1.Status{
+			Status:  meta_v1.StatusFailure,
+			Message: err.Error(),
+			Reason:  meta_v1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+
+	data, _ := json.Marshal(AdmissionReview{APIVersion: review.APIVersion, Kind: review.Kind, Response: response})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Check the request, objects other than pods are allowed
+func (v *Validator) Review(request *AdmissionRequest) error {
+	if request.Kind.Kind != "Pod" || (request.Operation != "CREATE" && request.Operation != "UPDATE") {
+		return nil
+	}
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(request.Object, pod); err != nil {
+		return fmt.Errorf("invalid pod: %v", err)
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = request.Namespace
+	}
+	var old *v1.Pod
+	if len(request.OldObject) > 0 && string(request.OldObject) != "null" {
+		old = &v1.Pod{}
+		if err := json.Unmarshal(request.OldObject, old); err != nil {
+			return fmt.Errorf("invalid old pod: %v", err)
+		}
+	}
+	return v.validatePod(pod, old)
+}
+
+// Check the chaos settings that are new or changed
+func (v *Validator) validatePod(pod, old *v1.Pod) error {
+	v.mu.RLock()
+	profiles, guards := v.profiles, v.guards
+	v.mu.RUnlock()
+
+	// Replicas are created before any of them is under chaos, the daemon checks
+	// the owner limits when it applies the settings
+	if old == nil {
+		withoutOwnerLimits := *guards
+		withoutOwnerLimits.MaxPodsPerOwner, withoutOwnerLimits.MaxPercentPerOwner = 0, 0
+		guards = &withoutOwnerLimits
+	}
+
+	if spec, found := pod.Annotations[flow.ChaosScheduleAnnotation]; found && (old == nil || old.Annotations[flow.ChaosScheduleAnnotation] != spec) {
+		if _, err := flow.GetPodSchedule(pod.Annotations, time.Local); err != nil {
+			return fmt.Errorf("%s %q rejected: %v", flow.ChaosScheduleAnnotation, spec, err)
+		}
+	}
+
+	if err := validateFailure(pod, old, guards); err != nil {
+		return err
+	}
+	for _, fault := range flow.PodFaults {
+		spec, found := pod.Annotations[fault.Annotation]
+		if !found || (old != nil && old.Annotations[fault.Annotation] == spec) {
+			continue
+		}
+		if err := fault.Parse(spec); err != nil {
+			return fmt.Errorf("%s %q rejected: %v", fault.Annotation, spec, err)
+		}
+		if err := guards.CheckNamespace(pod.Namespace); err != nil {
+			return fmt.Errorf("%s %q rejected: %v", fault.Annotation, spec, err)
+		}
+	}
+
+	if err := v.validateRules(pod, old, guards, flow.DNSChaosAnnotation, func(pod *v1.Pod, spec string, guards *flow.Guards, pods []v1.Pod) error {
+		_, err := flow.CheckPodDNSChaos(pod, spec, guards, pods)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := v.validateRules(pod, old, guards, flow.HTTPChaosAnnotation, func(pod *v1.Pod, spec string, guards *flow.Guards, pods []v1.Pod) error {
+		_, err := flow.CheckPodHTTPChaos(pod, spec, guards, pods)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	ingressNeedClear, egressNeedClear := flow.GetClearFlag(pod.Annotations)
+	for _, direction := range []string{"ingress", "egress"} {
+		key := fmt.Sprintf("kubernetes.io/%s-chaos", direction)
+		doneKey := fmt.Sprintf("kubernetes.io/done-%s-chaos", direction)
+		info, found := pod.Annotations[key]
+		if !found {
+			continue
+		}
+		isIngress := direction == "ingress"
+		if (isIngress && ingressNeedClear) || (!isIngress && egressNeedClear) {
+			continue
+		}
+		if old != nil && old.Annotations[key] == info && old.Annotations[doneKey] == pod.Annotations[doneKey] {
+			continue
+		}
+
+		var pods []v1.Pod
+		if guards.MaxPodsPerOwner > 0 || guards.MaxPercentPerOwner > 0 {
+			var err error
+			if pods, err = v.listPods(pod.Namespace); err != nil {
+				return fmt.Errorf("failed to check %s: %v", key, err)
+			}
+		}
+		if _, err := flow.CheckPodChaos(pod, info, isIngress, profiles, guards, pods); err != nil {
+			return fmt.Errorf("%s %q rejected: %v", key, info, err)
+		}
+	}
+	return nil
+}
+
+// Check the pod failure if it is new or changed, the owner limits are checked by the daemon
+// at each kill
+func validateFailure(pod, old *v1.Pod, guards *flow.Guards) error {
+	spec, found := pod.Annotations[flow.PodFailureAnnotation]
+	if !found || (old != nil && old.Annotations[flow.PodFailureAnnotation] == spec) {
+		return nil
+	}
+	failure, err := flow.ParsePodFailure(spec)
+	if err == nil {
+		withoutOwnerLimits := *guards
+		withoutOwnerLimits.MaxPodsPerOwner, withoutOwnerLimits.MaxPercentPerOwner = 0, 0
+		err = flow.CheckPodFailure(pod, failure, &withoutOwnerLimits, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("%s %q rejected: %v", flow.PodFailureAnnotation, spec, err)
+	}
+	return nil
+}
+
+// Check the pod's DNS or HTTP chaos rules under the key if they are new or changed and not being
+// cleared, with the same flags as network chaos
+func (v *Validator) validateRules(pod, old *v1.Pod, guards *flow.Guards, key string,
+	check func(pod *v1.Pod, spec string, guards *flow.Guards, pods []v1.Pod) error) error {
+	spec, found := pod.Annotations[key]
+	if !found {
+		return nil
+	}
+	if _, needClear := pod.Annotations[strings.Replace(key, "kubernetes.io/", "kubernetes.io/clear-", 1)]; needClear {
+		return nil
+	}
+	doneKey := strings.Replace(key, "kubernetes.io/", "kubernetes.io/done-", 1)
+	if old != nil && old.Annotations[key] == spec && old.Annotations[doneKey] == pod.Annotations[doneKey] {
+		return nil
+	}
+
+	var pods []v1.Pod
+	if guards.MaxPodsPerOwner > 0 || guards.MaxPercentPerOwner > 0 {
+		var err error
+		if pods, err = v.listPods(pod.Namespace); err != nil {
+			return fmt.Errorf("failed to check %s: %v", key, err)
+		}
+	}
+	if err := check(pod, spec, guards, pods); err != nil {
+		return fmt.Errorf("%s %q rejected: %v", key, spec, err)
+	}
+	return nil
+}
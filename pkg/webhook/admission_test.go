@@ -0,0 +1,260 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func podJSON(t *testing.T, namespace string, annotations map[string]string) json.RawMessage {
+	controller := true
+	pod := v1.Pod{ObjectMeta: meta_v1.ObjectMeta{
+		Name:            "web-1",
+		Namespace:       namespace,
+		UID:             "web-1",
+		Annotations:     annotations,
+		OwnerReferences: []meta_v1.OwnerReference{{Kind: "ReplicaSet", Name: "web", UID: "web", Controller: &controller}},
+	}}
+	data, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func review(t *testing.T, handler http.Handler, request *AdmissionRequest) *AdmissionResponse {
+	body, _ := json.Marshal(AdmissionReview{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview", Request: request})
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/validate", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	result := AdmissionReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || result.Response == nil {
+		t.Fatalf("invalid response %s: %v", recorder.Body.String(), err)
+	}
+	if result.Response.UID != request.UID {
+		t.Errorf("expected uid %s, got %s", request.UID, result.Response.UID)
+	}
+	return result.Response
+}
+
+func TestValidatePods(t *testing.T) {
+	sibling := v1.Pod{ObjectMeta: meta_v1.ObjectMeta{
+		Name:            "web-2",
+		Namespace:       "default",
+		UID:             "web-2",
+		Annotations:     map[string]string{"kubernetes.io/done-egress-chaos": "yes"},
+		OwnerReferences: []meta_v1.OwnerReference{{Kind: "ReplicaSet", Name: "web", UID: "web"}},
+	}}
+	controller := true
+	sibling.OwnerReferences[0].Controller = &controller
+	validator := NewValidator(func(namespace string) ([]v1.Pod, error) {
+		return []v1.Pod{sibling}, nil
+	})
+	guards := flow.DefaultGuards()
+	guards.MaxPodsPerOwner = 1
+	validator.Update(flow.BuiltinProfiles(), guards)
+
+	gvk := meta_v1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	cases := []struct {
+		name    string
+		request AdmissionRequest
+		allowed bool
+		message string
+	}{
+		{
+			name:    "no chaos",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", nil)},
+			allowed: true,
+		},
+		{
+			name: "valid",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/egress-chaos": "100kbps,delay,100ms,10ms", "kubernetes.io/ingress-chaos": "profile:3g"})},
+			allowed: true,
+		},
+		{
+			name: "malformed",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/egress-chaos": "1mbit,ceil=100kbit"})},
+			message: "ceil 100kbit is lower than rate 1mbit",
+		},
+		{
+			name: "unknown profile",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/ingress-chaos": "profile:dialup"})},
+			message: "unknown profile",
+		},
+		{
+			name: "too severe",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/egress-chaos": ",loss,80%"})},
+			message: "loss 80% is more than the 50% allowed",
+		},
+		{
+			name: "protected namespace",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Namespace: "kube-system", Object: podJSON(t, "", map[string]string{
+				"kubernetes.io/egress-chaos": ",delay,10ms"})},
+			message: "namespace kube-system is protected",
+		},
+		{
+			// A replica created with the template's annotations is not held to the owner limits
+			name: "owner limit on update",
+			request: AdmissionRequest{Kind: gvk, Operation: "UPDATE",
+				Object:    podJSON(t, "default", map[string]string{"kubernetes.io/egress-chaos": ",delay,10ms", "kubernetes.io/done-egress-chaos": "no"}),
+				OldObject: podJSON(t, "default", nil)},
+			message: "at most 1 allowed",
+		},
+		{
+			name: "unchanged on update",
+			request: AdmissionRequest{Kind: gvk, Operation: "UPDATE",
+				Object:    podJSON(t, "default", map[string]string{"kubernetes.io/egress-chaos": ",loss,80%", "app": "web"}),
+				OldObject: podJSON(t, "default", map[string]string{"kubernetes.io/egress-chaos": ",loss,80%"})},
+			allowed: true,
+		},
+		{
+			name: "clearing",
+			request: AdmissionRequest{Kind: gvk, Operation: "UPDATE",
+				Object:    podJSON(t, "default", map[string]string{"kubernetes.io/egress-chaos": ",loss,80%", "kubernetes.io/clear-egress-chaos": "", "kubernetes.io/done-egress-chaos": "no"}),
+				OldObject: podJSON(t, "default", map[string]string{"kubernetes.io/egress-chaos": ",loss,80%"})},
+			allowed: true,
+		},
+		{
+			name: "pod failure",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/pod-failure": "action=kill-container signal=TERM interval=2m"})},
+			allowed: true,
+		},
+		{
+			name: "malformed pod failure",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/pod-failure": "action=restart"})},
+			message: "invalid action",
+		},
+		{
+			name: "pod failure in protected namespace",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Namespace: "kube-system", Object: podJSON(t, "", map[string]string{
+				"kubernetes.io/pod-failure": "action=delete"})},
+			message: "namespace kube-system is protected",
+		},
+		{
+			name: "malformed freeze",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/pod-freeze": "duration=forever"})},
+			message: "invalid duration",
+		},
+		{
+			name: "malformed stress",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/pod-stress": "cpu=2 memory=lots"})},
+			message: "invalid memory",
+		},
+		{
+			name: "malformed io throttling",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/pod-io": "path=/data"})},
+			message: "no read-bps",
+		},
+		{
+			name: "malformed io chaos",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/pod-io-chaos": "path=/data errno=EIO"})},
+			message: "no percent",
+		},
+		{
+			name: "malformed clock skew",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/pod-clock": "offset=90500ms"})},
+			message: "expected whole seconds",
+		},
+		{
+			name: "malformed dns chaos",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/dns-chaos": "*.example.com=drop"})},
+			message: "invalid action",
+		},
+		{
+			name: "malformed http chaos",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/http-chaos": "path=/api/* abort=503,10%"})},
+			message: "has no port",
+		},
+		{
+			name: "dns chaos being cleared",
+			request: AdmissionRequest{Kind: gvk, Operation: "CREATE", Object: podJSON(t, "default", map[string]string{
+				"kubernetes.io/dns-chaos": "*.example.com=drop", "kubernetes.io/clear-dns-chaos": "yes"})},
+			allowed: true,
+		},
+		{
+			name:    "other kinds",
+			request: AdmissionRequest{Kind: meta_v1.GroupVersionKind{Version: "v1", Kind: "Service"}, Operation: "CREATE", Object: json.RawMessage(`{}`)},
+			allowed: true,
+		},
+	}
+	for i, c := range cases {
+		c.request.UID = c.name
+		response := review(t, validator, &c.request)
+		if response.Allowed != c.allowed {
+			t.Errorf("case %d %s: expected allowed %v, got %+v", i, c.name, c.allowed, response.Result)
+			continue
+		}
+		if !c.allowed && (response.Result == nil || !strings.Contains(response.Result.Message, c.message)) {
+			t.Errorf("case %d %s: expected message containing %q, got %+v", i, c.name, c.message, response.Result)
+		}
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	certPEM, keyPEM, err := SelfSignedCert([]string{"kube-chaos-webhook.kube-system.svc", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate is its own CA bundle
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("invalid certificate PEM")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the certificate to verify against itself: %v", err)
+	}
+	resp.Body.Close()
+}
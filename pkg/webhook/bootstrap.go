@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	admission "k8s.io/api/admissionregistration/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Name of the ValidatingWebhookConfiguration registered by kube-chaos
+const ConfigurationName = "kube-chaos"
+
+// Create a self-signed certificate for the hosts, which is also the CA bundle of the webhook
+func SelfSignedCert(hosts []string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"kube-chaos"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// Register the webhook for pod creates and updates, replacing an earlier registration
+func Register(clientset *kubernetes.Clientset, clientConfig admission.WebhookClientConfig, failurePolicy admission.FailurePolicyType) error {
+	configuration := &admission.ValidatingWebhookConfiguration{
+		ObjectMeta: meta_v1.ObjectMeta{Name: ConfigurationName},
+		Webhooks: []admission.Webhook{{
+			Name:         "pods.kube-chaos.io",
+			ClientConfig: clientConfig,
+			Rules: []admission.RuleWithOperations{{
+				Operations: []admission.OperationType{admission.Create, admission.Update},
+				Rule: admission.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+				},
+			}},
+			FailurePolicy: &failurePolicy,
+		}},
+	}
+
+	configurations := clientset.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations()
+	existing, err := configurations.Get(ConfigurationName, meta_v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configurations.Create(configuration)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	configuration.ResourceVersion = existing.ResourceVersion
+	_, err = configurations.Update(configuration)
+	return err
+}
+
+// Parse the failure policy flag
+func ParseFailurePolicy(policy string) (admission.FailurePolicyType, error) {
+	switch admission.FailurePolicyType(policy) {
+	case admission.Ignore, admission.Fail:
+		return admission.FailurePolicyType(policy), nil
+	}
+	return "", fmt.Errorf("invalid failure policy %q, expected %s or %s", policy, admission.Ignore, admission.Fail)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/container"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/stress"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Name of the cgroup of the workers, beside the ones of the pod's containers
+const stressCgroup = "kube-chaos-stress"
+
+// Burn a CPU or hold memory until killed, started by the daemon for a pod's stress
+func runStressWorker(args []string) {
+	var (
+		cpuLoad float64
+		memory  int64
+	)
+	flag.Float64Var(&cpuLoad, "cpuLoad", 0, "percent of a CPU to burn")
+	flag.Int64Var(&memory, "memory", 0, "bytes of memory to hold")
+	flag.CommandLine.Parse(args)
+
+	// Wait to be moved into the pod's cgroups, the daemon is gone if stdin is closed first
+	if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err != nil {
+		os.Exit(1)
+	}
+	if cpuLoad > 0 {
+		runtime.GOMAXPROCS(1)
+		stress.BurnCPU(cpuLoad)
+	}
+	data := stress.AllocateMemory(memory)
+	for {
+		time.Sleep(time.Minute)
+		runtime.KeepAlive(data)
+	}
+}
+
+// Workers of the pods stressed by the daemon, kept across rounds so they are stopped when
+// their pod leaves the node's selection, chaos is aborted or the daemon stops
+type stressedPods struct {
+	cgroups *container.Cgroups
+	mu      sync.Mutex
+	groups  map[types.UID]*stress.Group
+	// No pod is stressed once the daemon stops
+	stopped bool
+}
+
+func newStressedPods(cgroups *container.Cgroups) *stressedPods {
+	return &stressedPods{cgroups: cgroups, groups: map[types.UID]*stress.Group{}}
+}
+
+func (s *stressedPods) kind() *flow.PodFault {
+	return flow.StressFault
+}
+
+func (s *stressedPods) prepare(pod *v1.Pod, spec string) (string, time.Duration, error) {
+	settings, err := flow.ParsePodStress(spec)
+	if err != nil {
+		return "", 0, err
+	}
+	return "", settings.Duration, nil
+}
+
+// Start the workers of the stress in the pod's cgroups, the workers running are kept
+func (s *stressedPods) start(pod *v1.Pod, spec, target string) error {
+	settings, err := flow.ParsePodStress(spec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	if _, found := s.groups[pod.UID]; found {
+		return nil
+	}
+	cgroups, err := s.cgroups.CreatePodChild(string(pod.UID), stressCgroup, "cpu", "memory")
+	if err != nil {
+		return err
+	}
+	group, err := stress.Start("/proc/self/exe", cgroups, settings.CPU, settings.Load, settings.Memory)
+	if err != nil {
+		return err
+	}
+	s.groups[pod.UID] = group
+	return nil
+}
+
+func (s *stressedPods) active(uid types.UID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.groups[uid]
+	return found
+}
+
+// Stop the pod's workers, those started before the daemon started died with it
+func (s *stressedPods) stop(pod *v1.Pod, target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, found := s.groups[pod.UID]
+	if !found {
+		return nil
+	}
+	delete(s.groups, pod.UID)
+	return group.Stop()
+}
+
+func (s *stressedPods) stopExcept(keep map[types.UID]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for uid, group := range s.groups {
+		if keep[uid] {
+			continue
+		}
+		// The cgroup of a deleted pod is gone with it
+		if err := group.Stop(); err != nil {
+			glog.Warningf("Failed to stop the stress of pod %s: %v", uid, err)
+		}
+		glog.Infof("Stopped the stress of pod %s no longer selected", uid)
+		delete(s.groups, uid)
+	}
+}
+
+func (s *stressedPods) stopAll(stop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = s.stopped || stop
+	for uid, group := range s.groups {
+		if err := group.Stop(); err != nil {
+			glog.Errorf("Failed to stop the stress of pod %s: %v", uid, err)
+		}
+		glog.Infof("Stopped the stress of pod %s", uid)
+		delete(s.groups, uid)
+	}
+}
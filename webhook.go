@@ -0,0 +1,171 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/webhook"
+	admission "k8s.io/api/admissionregistration/v1beta1"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Path the webhook is served at
+const webhookPath = "/validate"
+
+// Serve the validating admission webhook for the pods' chaos annotations
+func runWebhook(args []string) {
+	var (
+		kubeconfig    string
+		address       string
+		certFile      string
+		keyFile       string
+		caFile        string
+		selfSigned    bool
+		register      bool
+		service       string
+		webhookURL    string
+		failurePolicy string
+		controlMap    string
+		profileMap    string
+		syncDuration  int
+	)
+
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file, empty to use the in-cluster config")
+	flag.StringVar(&address, "address", ":8443", "address serving the webhook")
+	flag.StringVar(&certFile, "tlsCertFile", "", "serving certificate, not needed with --selfSigned")
+	flag.StringVar(&keyFile, "tlsKeyFile", "", "serving key, not needed with --selfSigned")
+	flag.StringVar(&caFile, "caFile", "", "CA bundle registered with --register, not needed with --selfSigned")
+	flag.BoolVar(&selfSigned, "selfSigned", false, "serve a generated self-signed certificate and register the webhook with it, for local clusters")
+	flag.BoolVar(&register, "register", false, "register the ValidatingWebhookConfiguration, implied by --selfSigned")
+	flag.StringVar(&service, "service", "kube-system/kube-chaos-webhook", "namespace/name of the service in front of the webhook")
+	flag.StringVar(&webhookURL, "url", "", "URL the API server calls instead of the service, e.g. https://192.168.99.1:8443"+webhookPath)
+	flag.StringVar(&failurePolicy, "failurePolicy", string(admission.Ignore), "what the API server does when the webhook is down, Ignore or Fail")
+	flag.StringVar(&controlMap, "controlConfigMap", flow.DefaultControlConfigMap, "namespace/name of the ConfigMap holding the guards")
+	flag.StringVar(&profileMap, "profileConfigMap", "kube-system/kube-chaos-profiles", "namespace/name of the ConfigMap adding network profiles")
+	flag.IntVar(&syncDuration, "syncDuration", 5, "seconds between reading the ConfigMaps")
+	// Parse into the global flag set, so glog's flags also work in webhook mode
+	flag.CommandLine.Parse(args)
+	defer glog.Flush()
+
+	policy, err := webhook.ParseFailurePolicy(failurePolicy)
+	if err != nil {
+		exitLocal(err)
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		exitLocal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		exitLocal(err)
+	}
+
+	// The API server calls either the service or the URL
+	clientConfig := admission.WebhookClientConfig{}
+	var hosts []string
+	if webhookURL != "" {
+		u, err := url.Parse(webhookURL)
+		if err != nil || u.Scheme != "https" {
+			exitLocal(fmt.Errorf("invalid --url %q, expected an https URL", webhookURL))
+		}
+		clientConfig.URL = &webhookURL
+		hosts = []string{u.Hostname()}
+	} else {
+		parts := strings.SplitN(service, "/", 2)
+		if len(parts) != 2 {
+			exitLocal(fmt.Errorf("invalid --service %q, expected namespace/name", service))
+		}
+		path := webhookPath
+		clientConfig.Service = &admission.ServiceReference{Namespace: parts[0], Name: parts[1], Path: &path}
+		hosts = []string{parts[1] + "." + parts[0] + ".svc", parts[1] + "." + parts[0], parts[1]}
+	}
+
+	var cert tls.Certificate
+	if selfSigned {
+		certPEM, keyPEM, err := webhook.SelfSignedCert(hosts, 10*365*24*time.Hour)
+		if err != nil {
+			exitLocal(fmt.Errorf("failed to create a self-signed certificate: %v", err))
+		}
+		if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			exitLocal(err)
+		}
+		clientConfig.CABundle = certPEM
+		register = true
+	} else {
+		if certFile == "" || keyFile == "" {
+			exitLocal(fmt.Errorf("--tlsCertFile and --tlsKeyFile are required without --selfSigned"))
+		}
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			exitLocal(err)
+		}
+		if caFile != "" {
+			if clientConfig.CABundle, err = ioutil.ReadFile(caFile); err != nil {
+				exitLocal(err)
+			}
+		}
+	}
+	if register {
+		if err := webhook.Register(clientset, clientConfig, policy); err != nil {
+			exitLocal(fmt.Errorf("failed to register the webhook: %v", err))
+		}
+		glog.Infof("Registered ValidatingWebhookConfiguration %s", webhook.ConfigurationName)
+	}
+
+	validator := webhook.NewValidator(func(namespace string) ([]v1.Pod, error) {
+		pods, err := clientset.CoreV1().Pods(namespace).List(meta_v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return pods.Items, nil
+	})
+	// Follow the ConfigMaps the daemons read
+	go func() {
+		state, guards := flow.ControlRunning, flow.DefaultGuards()
+		var profiles flow.Profiles
+		for {
+			state, guards = loadControl(clientset, controlMap, state, guards)
+			profiles = loadProfiles(clientset, profileMap, profiles)
+			validator.Update(profiles, guards)
+			glog.Flush()
+			time.Sleep(time.Duration(syncDuration) * time.Second)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, validator)
+	server := &http.Server{
+		Addr:      address,
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	glog.Infof("Serving the webhook at %s%s", address, webhookPath)
+	glog.Flush()
+	exitLocal(server.ListenAndServeTLS("", ""))
+}